@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Archive kinds recognized by detectArchive
+const (
+	archiveZip   = "zip"
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+)
+
+// Ways of splitting an uploaded archive into jobs
+const (
+	SplitSample = "sample" // one job per directory, e.g. a barcode directory of a MinION run
+	SplitFile   = "file"   // one job per FASTQ file
+)
+
+// maxArchiveExpansion caps what an archive may extract to, as a multiple of -body-limit
+const maxArchiveExpansion = 8
+
+// sequenceExtensions are the file extensions picked out of archives, before any .gz
+var sequenceExtensions = []string{".fastq", ".fq", ".fasta", ".fa", ".fna"}
+
+// errArchiveTooLarge rejects archives that expand past their budget
+var errArchiveTooLarge = errors.New("archive expands to too much data")
+
+// archiveMember reports whether an archive entry is a sequence file to
+// classify. Hidden files, macOS resource forks and MinION fastq_fail reads are skipped.
+func archiveMember(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" || part == "fastq_fail" {
+			return false
+		}
+	}
+	base := strings.TrimSuffix(strings.ToLower(path.Base(name)), ".gz")
+	for _, ext := range sequenceExtensions {
+		if strings.HasSuffix(base, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandArchive spools the sequence files of an archive, in archive order
+func expandArchive(archive spooledFile, kind string) ([]spooledFile, error) {
+	var files []spooledFile
+	budget := int64(bodyLimit) * maxArchiveExpansion
+	add := func(name string, r io.Reader) error {
+		file, err := expandEntry(name, r, &budget)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	}
+
+	var err error
+	if kind == archiveZip {
+		err = walkZip(archive.Path, add)
+	} else {
+		err = walkTar(archive.Path, kind == archiveTarGz, add)
+	}
+	if err == nil && len(files) == 0 {
+		err = &contentError{Filename: archive.Filename, Problem: "contains no FASTQ or FASTA files"}
+	}
+	if err != nil {
+		for _, file := range files {
+			os.Remove(file.Path)
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+func walkZip(archivePath string, add func(name string, r io.Reader) error) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %w", err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !archiveMember(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("invalid zip archive: %w", err)
+		}
+		err = add(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkTar(archivePath string, gzipped bool, add func(name string, r io.Reader) error) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to re-open the archive: %w", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if gzipped {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("invalid tar.gz archive: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !archiveMember(hdr.Name) {
+			continue
+		}
+		if err := add(strings.TrimPrefix(hdr.Name, "./"), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// expandEntry spools one archive entry like an uploaded file, drawing on budget
+func expandEntry(name string, r io.Reader, budget *int64) (spooledFile, error) {
+	limited := &limitedBody{r: r, left: *budget}
+	content, kind, err := sniffContent(limited, name)
+	if err == nil && kind != "" {
+		err = &contentError{Filename: name, Problem: "is an archive inside the archive"}
+	}
+	if err != nil {
+		return spooledFile{}, err
+	}
+	tempFile, err := os.CreateTemp(spoolDir, "fastq-*.tmp")
+	if err != nil {
+		return spooledFile{}, fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	file := spooledFile{Filename: name, Path: tempFile.Name()}
+	sums := newChecksums()
+	file.Stat, err = spoolCounting(sums.Writer(tempFile), content)
+	file.MD5, file.SHA256 = sums.MD5(), sums.SHA256()
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	*budget = limited.left
+	if errors.Is(err, errBodyTooLarge) {
+		err = errArchiveTooLarge
+	}
+	if err != nil {
+		os.Remove(file.Path)
+		return spooledFile{}, fmt.Errorf("failed to extract %q: %w", name, err)
+	}
+	return file, nil
+}
+
+// archiveSample is the files of an archive classified as one job
+type archiveSample struct {
+	Name  string
+	Files []spooledFile
+}
+
+// groupArchive splits expanded archive files into samples. With SplitSample
+// the files of a directory are one sample named after it; files at the top
+// of the archive, or every file with SplitFile, are samples of their own.
+func groupArchive(files []spooledFile, split string) []archiveSample {
+	var samples []archiveSample
+	index := make(map[string]int)
+	seen := make(map[string]int)
+	for _, file := range files {
+		dir := path.Dir(file.Filename)
+		if split == SplitSample && dir != "." {
+			if i, ok := index[dir]; ok {
+				samples[i].Files = append(samples[i].Files, file)
+				continue
+			}
+			index[dir] = len(samples)
+		}
+		name := path.Base(dir)
+		if split != SplitSample || dir == "." {
+			name = sampleName(file.Filename)
+		}
+		if seen[name]++; seen[name] > 1 {
+			name += "-" + strconv.Itoa(seen[name])
+		}
+		samples = append(samples, archiveSample{Name: name, Files: []spooledFile{file}})
+	}
+	return samples
+}
+
+// handleArchiveUpload expands an uploaded archive and starts one async job per
+// sample, answering with all of their statuses. It owns the upload's spool files.
+func handleArchiveUpload(c *fiber.Ctx, upload *streamedUpload, key string) error {
+	defer upload.Remove()
+	files, err := expandArchive(*upload.Archive, upload.ArchiveKind)
+	var contentErr *contentError
+	switch {
+	case errors.As(err, &contentErr):
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(fmt.Sprintf("Upload rejected: %v", err))
+	case errors.Is(err, errArchiveTooLarge):
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("Upload rejected: %v", err))
+	case err != nil:
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Upload failed: %v", err))
+	}
+	upload.Files = files
+
+	split := upload.FormValue("split", SplitSample)
+	if split != SplitSample && split != SplitFile {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("unknown split %q (expected %s or %s)", split, SplitSample, SplitFile))
+	}
+	samples := groupArchive(files, split)
+
+	// Check every job's options before starting any
+	type archiveJob struct {
+		sample archiveSample
+		opts   OutputOptions
+		params JobParams
+	}
+	pending := make([]archiveJob, 0, len(samples))
+	for _, sample := range samples {
+		name := sample.Name
+		field := func(key string, defaultValue ...string) string {
+			switch key {
+			case "mode":
+				return UploadSample
+			case "sample":
+				return name
+			}
+			return upload.FormValue(key, defaultValue...)
+		}
+		filenames := make([]string, 0, len(sample.Files))
+		for _, file := range sample.Files {
+			filenames = append(filenames, file.Filename)
+		}
+		opts, params, err := jobOptions(c, field, filenames)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		params.Archive = upload.Archive.Filename
+		params.IdempotencyKey = key
+		pending = append(pending, archiveJob{sample: sample, opts: opts, params: params})
+	}
+
+	// From here each job owns its sample's spool files
+	upload.Files = nil
+	statuses := make([]JobStatus, 0, len(pending))
+	for _, p := range pending {
+		spools := make([]string, 0, len(p.sample.Files))
+		stats := make([]SpoolStat, 0, len(p.sample.Files))
+		for _, file := range p.sample.Files {
+			spools = append(spools, file.Path)
+			stats = append(stats, file.Stat)
+		}
+		job := jobs.Create(p.params)
+		auditSubmission(c, job, map[string]any{"archive_sha256": upload.Archive.SHA256})
+		sankets, err := prepareJob(job, &p.opts)
+		if err == nil {
+			err = launchJob(job, spools, stats, sankets, p.opts)
+		} else {
+			removeSpools(spools)
+		}
+		if err != nil {
+			job.Finish(err)
+		}
+		statuses = append(statuses, job.Status())
+	}
+	return c.Status(fiber.StatusAccepted).JSON(statuses)
+}
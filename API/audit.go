@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Audited actions
+const (
+	AuditJobSubmitted     = "job.submitted"
+	AuditJobCanceled      = "job.canceled"
+	AuditJobExpired       = "job.expired"
+	AuditResultDownloaded = "result.downloaded"
+	AuditPanelReloaded    = "panel.reloaded"
+	AuditKeyCreated       = "key.created"
+	AuditKeyRevoked       = "key.revoked"
+)
+
+// AuditEvent records who did what and when. Events are only ever appended:
+// the audit_log table refuses updates and deletes, and retention leaves it alone.
+type AuditEvent struct {
+	ID        int64          `json:"id"`
+	Time      time.Time      `json:"time"`
+	Actor     string         `json:"actor"` // admin, key:<id>, oidc:<user>, ip:<addr>, or the server itself: signal, retention
+	Workspace string         `json:"workspace,omitempty"`
+	IP        string         `json:"ip,omitempty"`
+	Action    string         `json:"action"`
+	JobID     string         `json:"job_id,omitempty"`
+	Detail    map[string]any `json:"detail,omitempty"`
+}
+
+// auditFilter selects events for GET /admin/audit
+type auditFilter struct {
+	Action, Actor, Workspace, JobID string
+	Since, Until                    time.Time
+	Limit                           int
+}
+
+func (f auditFilter) match(e AuditEvent) bool {
+	return (f.Action == "" || e.Action == f.Action) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Workspace == "" || e.Workspace == f.Workspace) &&
+		(f.JobID == "" || e.JobID == f.JobID) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// auditLog keeps the audit trail in the job database, or in memory without -db
+type auditLog struct {
+	mu     sync.Mutex
+	store  *jobStore
+	events []AuditEvent
+}
+
+var audit = &auditLog{}
+
+// UseStore appends events to store from now on
+func (a *auditLog) UseStore(store *jobStore) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.store = store
+}
+
+// Record appends an event. A failure is logged rather than failing the request
+// being audited.
+func (a *auditLog) Record(e AuditEvent) {
+	e.Time = time.Now().UTC()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store != nil {
+		if err := a.store.AppendAudit(e); err != nil {
+			slog.Error("can't write audit event", "action", e.Action, "actor", e.Actor, "job_id", e.JobID, "error", err)
+		}
+		return
+	}
+	e.ID = int64(len(a.events) + 1)
+	a.events = append(a.events, e)
+}
+
+// Query returns the events matching filter, newest first
+func (a *auditLog) Query(filter auditFilter) ([]AuditEvent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store != nil {
+		return a.store.LoadAudit(filter)
+	}
+	matched := make([]AuditEvent, 0)
+	for i := len(a.events) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(matched) == filter.Limit {
+			break
+		}
+		if filter.match(a.events[i]) {
+			matched = append(matched, a.events[i])
+		}
+	}
+	return matched, nil
+}
+
+// requestActor names who made a request for the audit log
+func requestActor(c *fiber.Ctx) string {
+	if isAdmin(requestSecret(c)) {
+		return "admin"
+	}
+	return clientID(c)
+}
+
+// auditRequest records an action taken through the API
+func auditRequest(c *fiber.Ctx, action string, detail map[string]any) {
+	audit.Record(AuditEvent{Actor: requestActor(c), Workspace: requestWorkspace(c), IP: c.IP(), Action: action, Detail: detail})
+}
+
+// auditJob records an action on a job taken through the API
+func auditJob(c *fiber.Ctx, action string, job *Job, detail map[string]any) {
+	audit.Record(AuditEvent{Actor: requestActor(c), Workspace: job.Params.Workspace, IP: c.IP(), Action: action, JobID: job.ID, Detail: detail})
+}
+
+// auditSubmission records a new job with what it was given to classify, adding
+// detail such as checksums or source URLs
+func auditSubmission(c *fiber.Ctx, job *Job, detail map[string]any) {
+	filenames := job.Params.Files
+	if len(filenames) == 0 {
+		filenames = []string{job.Params.Filename}
+	}
+	detail["files"] = filenames
+	if job.Params.Archive != "" {
+		detail["archive"] = job.Params.Archive
+	}
+	if job.Params.Sample != nil && job.Params.Sample.Name != "" {
+		detail["sample"] = job.Params.Sample.Name
+	}
+	auditJob(c, AuditJobSubmitted, job, detail)
+}
+
+// fileChecksums lists the SHA-256 of each uploaded file
+func fileChecksums(files []spooledFile) []string {
+	sums := make([]string, len(files))
+	for i, file := range files {
+		sums[i] = file.SHA256
+	}
+	return sums
+}
+
+// redactURL drops the query and credentials of a URL, which for presigned
+// links hold the signature, before it goes in the audit log
+func redactURL(u *url.URL) string {
+	redacted := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	return redacted.String()
+}
+
+// parseAuditTime reads a since/until value, YYYY-MM-DD or RFC 3339
+func parseAuditTime(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q (expected YYYY-MM-DD or RFC 3339)", name, value)
+	}
+	return t, nil
+}
+
+// handleAuditList serves GET /admin/audit: audit events, newest first,
+// filtered by ?action=, ?actor=, ?workspace=, ?job_id=, ?since= and ?until=
+// and capped by ?limit=
+func handleAuditList(c *fiber.Ctx) error {
+	filter := auditFilter{
+		Action:    c.Query("action"),
+		Actor:     c.Query("actor"),
+		Workspace: c.Query("workspace"),
+		JobID:     c.Query("job_id"),
+		Limit:     c.QueryInt("limit", 100),
+	}
+	var err error
+	if filter.Since, err = parseAuditTime("since", c.Query("since")); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if filter.Until, err = parseAuditTime("until", c.Query("until")); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	events, err := audit.Query(filter)
+	if err != nil {
+		requestLogger(c).Error("can't read the audit log", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to read the audit log")
+	}
+	return c.JSON(events)
+}
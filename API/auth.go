@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// adminKey manages API keys; set with -admin-key or BHEDI_ADMIN_KEY. While
+// it is empty the server accepts requests without a key.
+var adminKey string
+
+// defaultKeyRateLimit is the rate limit of keys created without one, in requests per minute
+var defaultKeyRateLimit = 120
+
+// APIKey is a client credential. Only a hash of the secret is kept; the key
+// itself is shown once, when it is created.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	RateLimit int       `json:"rate_limit"`          // requests per minute, 0 for unlimited
+	Workspace string    `json:"workspace,omitempty"` // the only jobs and panel the key can use
+	CreatedAt time.Time `json:"created_at"`
+	hash      string
+	limiter   *rateLimiter
+}
+
+// keyRing holds the API keys known to this server
+type keyRing struct {
+	mu     sync.RWMutex
+	byHash map[string]*APIKey
+	store  *jobStore
+}
+
+var apiKeys = &keyRing{byHash: make(map[string]*APIKey)}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// UseStore persists keys to store from now on and loads the stored ones
+func (r *keyRing) UseStore(store *jobStore) error {
+	keys, err := store.LoadKeys()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store = store
+	for _, key := range keys {
+		key.limiter = newRateLimiter(key.RateLimit)
+		r.byHash[key.hash] = key
+	}
+	return nil
+}
+
+// Create makes a new key and returns it with its secret
+func (r *keyRing) Create(name, workspace string, rateLimit int) (*APIKey, string, error) {
+	id := "k_" + randomHex(4)
+	secret := "bhedi_" + id + "_" + randomHex(16)
+	key := &APIKey{ID: id, Name: name, RateLimit: rateLimit, Workspace: workspace, CreatedAt: time.Now().UTC(), hash: hashKey(secret), limiter: newRateLimiter(rateLimit)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.store != nil {
+		if err := r.store.SaveKey(key); err != nil {
+			return nil, "", err
+		}
+	}
+	r.byHash[key.hash] = key
+	return key, secret, nil
+}
+
+// Revoke deletes the key with the given ID
+func (r *keyRing) Revoke(id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for hash, key := range r.byHash {
+		if key.ID != id {
+			continue
+		}
+		if r.store != nil {
+			if err := r.store.DeleteKey(id); err != nil {
+				return false, err
+			}
+		}
+		delete(r.byHash, hash)
+		return true, nil
+	}
+	return false, nil
+}
+
+// List returns the keys, oldest first
+func (r *keyRing) List() []*APIKey {
+	r.mu.RLock()
+	list := make([]*APIKey, 0, len(r.byHash))
+	for _, key := range r.byHash {
+		list = append(list, key)
+	}
+	r.mu.RUnlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].CreatedAt.Before(list[k].CreatedAt) })
+	return list
+}
+
+// Lookup finds the key with the given secret
+func (r *keyRing) Lookup(secret string) (*APIKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.byHash[hashKey(secret)]
+	return key, ok
+}
+
+// rateLimiter is a token bucket holding up to a minute's worth of requests
+type rateLimiter struct {
+	mu       sync.Mutex
+	perMin   float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMin: float64(perMinute), tokens: float64(perMinute), lastFill: time.Now()}
+}
+
+// Allow takes a token, or says how long until one is available
+func (l *rateLimiter) Allow() (bool, time.Duration) {
+	if l.perMin <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = math.Min(l.perMin, l.tokens+now.Sub(l.lastFill).Minutes()*l.perMin)
+	l.lastFill = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.perMin * float64(time.Minute))
+}
+
+// requestSecret reads the API key from the Authorization (Bearer) or
+// X-API-Key header, or the api_key query value for clients that can't set
+// headers, such as browser WebSockets and EventSource
+func requestSecret(c *fiber.Ctx) string {
+	if auth := c.Get(fiber.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key := c.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return c.Query("api_key")
+}
+
+// isAdmin reports whether secret is the admin key
+func isAdmin(secret string) bool {
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(adminKey)) == 1
+}
+
+// requestKey returns the API key a request was made with, if any
+func requestKey(c *fiber.Ctx) *APIKey {
+	key, _ := c.Locals("apiKey").(*APIKey)
+	return key
+}
+
+// publicPaths are served without credentials or rate limits: the OpenAPI
+// spec, so clients can be generated before a key is issued, the health
+// probes, which load balancers and Kubernetes call without one, and the
+// dashboard page, which asks for a key itself
+var publicPaths = map[string]bool{
+	"/openapi.yaml": true,
+	"/openapi.json": true,
+	"/docs":         true,
+	"/healthz":      true,
+	"/readyz":       true,
+	"/ui":           true,
+	"/":             true,
+}
+
+func isPublicPath(c *fiber.Ctx) bool {
+	return publicPaths[strings.TrimPrefix(c.Path(), apiPrefix)]
+}
+
+// authenticate lets through requests carrying a valid API key, within its
+// rate limit, or a valid OIDC bearer token. It is a no-op unless -admin-key
+// or -oidc-issuer is set. Signed result links carry their own authorization.
+func authenticate(c *fiber.Ctx) error {
+	if (adminKey == "" && oidcAuth == nil) || isPublicPath(c) {
+		return c.Next()
+	}
+	if strings.HasSuffix(c.Path(), "/result") && c.Query("signature") != "" {
+		return c.Next()
+	}
+	secret := requestSecret(c)
+	if isAdmin(secret) {
+		return c.Next()
+	}
+	if key, ok := apiKeys.Lookup(secret); ok {
+		if ok, wait := key.limiter.Allow(); !ok {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return c.Status(fiber.StatusTooManyRequests).SendString(fmt.Sprintf("Rate limit of %d requests per minute exceeded", key.RateLimit))
+		}
+		c.Locals("apiKey", key)
+		c.Locals("workspace", key.Workspace)
+		return c.Next()
+	}
+	if oidcAuth != nil && secret != "" {
+		user, workspace, err := oidcAuth.Verify(c.UserContext(), secret)
+		var forbidden errOIDCForbidden
+		if errors.As(err, &forbidden) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		if err != nil {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return c.Status(fiber.StatusUnauthorized).SendString(fmt.Sprintf("Invalid bearer token: %v", err))
+		}
+		c.Locals("oidcUser", user)
+		c.Locals("workspace", workspace)
+		return c.Next()
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+	if secret == "" {
+		return c.Status(fiber.StatusUnauthorized).SendString("Missing API key or bearer token")
+	}
+	return c.Status(fiber.StatusUnauthorized).SendString("Invalid API key")
+}
+
+// requireAdmin guards the key management routes
+func requireAdmin(c *fiber.Ctx) error {
+	if adminKey == "" {
+		return c.Status(fiber.StatusNotFound).SendString("API keys are disabled; start the server with -admin-key")
+	}
+	if !isAdmin(requestSecret(c)) {
+		return c.Status(fiber.StatusForbidden).SendString("Admin key required")
+	}
+	return c.Next()
+}
+
+// handleKeyCreate serves POST /admin/keys
+func handleKeyCreate(c *fiber.Ctx) error {
+	var req struct {
+		Name      string `json:"name"`
+		RateLimit *int   `json:"rate_limit"`
+		Workspace string `json:"workspace"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %v", err))
+	}
+	if req.Name == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Expected a name for the key")
+	}
+	rateLimit := defaultKeyRateLimit
+	if req.RateLimit != nil {
+		if rateLimit = *req.RateLimit; rateLimit < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("rate_limit must be 0 (unlimited) or more requests per minute")
+		}
+	}
+	if req.Workspace != "" {
+		if err := validateWorkspace(req.Workspace); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+	}
+	key, secret, err := apiKeys.Create(req.Name, req.Workspace, rateLimit)
+	if err != nil {
+		requestLogger(c).Error("can't create API key", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create the key")
+	}
+	auditRequest(c, AuditKeyCreated, map[string]any{"key_id": key.ID, "name": key.Name, "workspace": key.Workspace})
+	return c.Status(fiber.StatusCreated).JSON(struct {
+		*APIKey
+		Key string `json:"key"` // shown only this once
+	}{key, secret})
+}
+
+// handleKeyList serves GET /admin/keys
+func handleKeyList(c *fiber.Ctx) error {
+	return c.JSON(apiKeys.List())
+}
+
+// handleKeyRevoke serves DELETE /admin/keys/:id
+func handleKeyRevoke(c *fiber.Ctx) error {
+	ok, err := apiKeys.Revoke(c.Params("id"))
+	if err != nil {
+		requestLogger(c).Error("can't revoke API key", "key_id", c.Params("id"), "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to revoke the key")
+	}
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Key not found")
+	}
+	auditRequest(c, AuditKeyRevoked, map[string]any{"key_id": c.Params("id")})
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Upload modes for requests carrying several files
+const (
+	UploadSample = "sample" // the files are one sample, e.g. R1 + R2
+	UploadBatch  = "batch"  // each file is its own sample, e.g. a barcode directory
+)
+
+// removeSpools deletes spooled upload files
+func removeSpools(spools []string) {
+	for _, path := range spools {
+		os.Remove(path)
+	}
+}
+
+// processSpools classifies the spooled files, in order, into one output
+func processSpools(ctx context.Context, spools []string, sankets map[string]SanketInfo, outputFilePath string, stat SpoolStat, opts OutputOptions, job *Job) error {
+	readers := make([]io.Reader, 0, len(spools))
+	for _, path := range spools {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to re-open the temp file: %w", err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	return processFastqStream(ctx, readers, sankets, outputFilePath, stat.Records, stat.ReadLength, opts, job)
+}
+
+// sampleName strips FASTQ and compression extensions from an uploaded file name
+func sampleName(filename string) string {
+	name := filepath.Base(filename)
+	name = strings.TrimSuffix(name, ".gz")
+	for _, ext := range []string{".fastq", ".fq"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// runBatch classifies each spooled file as its own sample and zips the outputs
+// into zipPath, one entry per sample named after its upload
+func runBatch(ctx context.Context, job *Job, spools []string, stats []SpoolStat, sankets map[string]SanketInfo, opts OutputOptions, zipPath string) error {
+	dir := strings.TrimSuffix(zipPath, filepath.Ext(zipPath))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("can't create batch directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	seen := make(map[string]int)
+	var names []string
+	for i, spool := range spools {
+		name := sampleName(job.Params.Files[i])
+		if seen[name]++; seen[name] > 1 {
+			name += "-" + strconv.Itoa(seen[name])
+		}
+		name += opts.Extension()
+		if err := processSpools(ctx, []string{spool}, sankets, filepath.Join(dir, name), stats[i], opts, job); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	return zipFiles(zipPath, dir, names)
+}
+
+// zipFiles writes the named files from dir into a new zip archive at path
+func zipFiles(path, dir string, names []string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("can't create zip file: %w", err)
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error finalizing zip file: %w", err)
+	}
+	return out.Close()
+}
@@ -2,29 +2,33 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"bhedi/output"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/shenwei356/bio/seqio/fastx"
-	"github.com/xitongsys/parquet-go-source/local"
-	"github.com/xitongsys/parquet-go/writer"
 )
 
-// Define your structs here (SanketInfo, MatchInfo, ProcessRecordResult, ParquetRecord)
+// Define your structs here (SanketInfo; the result types are in bhedi/output)
 var coverageMapMutex sync.Mutex
-var parquetWriterMutex sync.Mutex // Mutex for the Parquet writer
 
 type SanketInfo struct {
 	SID      string // Add this line
@@ -36,49 +40,36 @@ type SanketInfo struct {
 	MRCAvg   string
 	PCount   string
 	PLenAvg  string
+	seq      []byte // Sanket as bytes, so reads are matched as the FASTQ reader holds them
 }
 
-type MatchInfo struct {
-	SID      string // Add this line
-	Sanket   string
-	Serotype string
-	SLen     int
-	SSRCount string
-	MLenAvg  string
-	MRCAvg   string
-	PCount   string
-	PLenAvg  string
-	BScore   float64 // Add this line
+// calculateGCPercentage returns the share of G and C bases in seq. bytes.Count is vectorized on amd64 and arm64
+// (AVX2 or POPCNT, NEON) and plain Go elsewhere, so two passes of it are many times faster than one of a loop.
+func calculateGCPercentage(seq []byte) float64 {
+	gcCount := bytes.Count(seq, []byte{'G'}) + bytes.Count(seq, []byte{'C'})
+	return (float64(gcCount) / float64(len(seq))) * 100
 }
 
-type ProcessRecordResult struct {
-	ReadID        string `parquet:"name=read_id, type=UTF8"`
-	Matches       []MatchInfo
-	GCPercentage  float64 `parquet:"name=gc_percentage, type=DOUBLE"`
-	TotalCoverage int     `parquet:"name=total_coverage, type=INT32"`
-	MatchesFound  bool
-	BScore        float64 `parquet:"name=b_score, type=DOUBLE"`
-}
-type ParquetRecord struct {
-	SID           string  `parquet:"name=sid, type=BYTE_ARRAY, convertedtype=UTF8"`
-	ReadID        string  `parquet:"name=read_id, type=BYTE_ARRAY, convertedtype=UTF8"`
-	MatchedSanket string  `parquet:"name=matched_sanket, type=BYTE_ARRAY, convertedtype=UTF8"`
-	Serotype      string  `parquet:"name=serotype, type=BYTE_ARRAY, convertedtype=UTF8"`
-	GCPercentage  float64 `parquet:"name=gc_percentage, type=DOUBLE"`
-	TotalCoverage int32   `parquet:"name=total_coverage, type=INT32"` // Changed to int32
-	SLen          int32   `parquet:"name=s_len, type=INT32"`          // Changed to int32
-	SSRCount      string  `parquet:"name=ssr_count, type=BYTE_ARRAY, convertedtype=UTF8"`
-	MLenAvg       string  `parquet:"name=mlen_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
-	MRCAvg        string  `parquet:"name=mrc_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
-	PCount        string  `parquet:"name=p_count, type=BYTE_ARRAY, convertedtype=UTF8"`
-	PLenAvg       string  `parquet:"name=plen_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
-	BScore        float64 `parquet:"name=b_score, type=DOUBLE"`
+// ScoringParams holds the constants of the BScore heuristic
+type ScoringParams struct {
+	GenomeSize          float64 `json:"genome_size"`           // Dengue virus genome size in base pairs
+	MaxSLen             float64 `json:"max_s_len"`             // sanket length that earns the full sLen weight
+	TotalCoverageWeight float64 `json:"total_coverage_weight"` // weight of normalized totalCoverage
+	SLenWeight          float64 `json:"s_len_weight"`          // weight of normalized sLen
+	BothCountsBase      float64 `json:"both_counts_base"`      // base score when both ssrCount and pCount are present
+	OneCountBase        float64 `json:"one_count_base"`        // base score when only one of them is present
 }
 
-func calculateGCPercentage(seq string) float64 {
-	gcCount := strings.Count(seq, "G") + strings.Count(seq, "C")
-	return (float64(gcCount) / float64(len(seq))) * 100
+// scoring is the parameter set used by calculateBScore
+var scoring = ScoringParams{
+	GenomeSize:          11000.0,
+	MaxSLen:             25.0,
+	TotalCoverageWeight: 0.37,
+	SLenWeight:          0.4,
+	BothCountsBase:      0.35,
+	OneCountBase:        0.2,
 }
+
 func calculateBScore(totalCoverage, sLen int, ssrCount, pCount string, avgReadLength float64, totalRecords int) float64 {
 	// Convert string parameters to integers
 	ssrCountInt, err1 := strconv.Atoi(ssrCount)
@@ -95,13 +86,13 @@ func calculateBScore(totalCoverage, sLen int, ssrCount, pCount string, avgReadLe
 
 	// Check for presence of both ssrCount and pCount and adjust base score
 	if ssrCountInt > 0 && pCountInt > 0 {
-		baseScore += 0.35 // Assign a higher base score if both are present
+		baseScore += scoring.BothCountsBase // Assign a higher base score if both are present
 	} else if ssrCountInt > 0 || pCountInt > 0 {
-		baseScore += 0.2 // Assign a lower base score if only one is present
+		baseScore += scoring.OneCountBase // Assign a lower base score if only one is present
 	}
 
 	// Calculate maxTotalCoverage using the Lander/Waterman equation
-	genomeSize := 11000.0 // Dengue virus genome size in base pairs
+	genomeSize := scoring.GenomeSize // Dengue virus genome size in base pairs
 	maxTotalCoverage := (avgReadLength * float64(totalRecords)) / genomeSize
 
 	// Normalize and weight totalCoverage and sLen
@@ -109,12 +100,12 @@ func calculateBScore(totalCoverage, sLen int, ssrCount, pCount string, avgReadLe
 	maxExpectedCoverage := maxTotalCoverage // You might want to adjust this based on your dataset
 	normalizedTotalCoverage := math.Min(float64(totalCoverage)/maxExpectedCoverage, 1)
 
-	maxSLen := 25.0 // Adjust based on expected range
+	maxSLen := scoring.MaxSLen // Adjust based on expected range
 	normalizedSLen := math.Min(float64(sLen)/maxSLen, 1)
 
 	// Weighted contributions (adjust weights as needed)
-	totalCoverageWeight := 0.37 // Higher weight for totalCoverage
-	sLenWeight := 0.4           // Weight for sLen
+	totalCoverageWeight := scoring.TotalCoverageWeight // Higher weight for totalCoverage
+	sLenWeight := scoring.SLenWeight                   // Weight for sLen
 
 	// Calculate weighted contributions
 	weightedTotalCoverage := normalizedTotalCoverage * totalCoverageWeight
@@ -129,39 +120,15 @@ func calculateBScore(totalCoverage, sLen int, ssrCount, pCount string, avgReadLe
 	return bScore
 }
 
-func getTotalRecordsAndAvgReadLength(fastqPath string) (totalRecords int, avgReadLength float64, err error) {
-	cmd := exec.Command("seqkit", "stats", fastqPath, "--tabular")
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, 0, err
-	}
-	lines := strings.Split(string(output), "\n")
-	if len(lines) > 2 {
-		fields := strings.Fields(lines[1])
-		if len(fields) > 5 {
-			totalRecords, err = strconv.Atoi(fields[3])
-			if err != nil {
-				return 0, 0, fmt.Errorf("failed to parse total records: %w", err)
-			}
-			avgReadLength, err = strconv.ParseFloat(fields[5], 64)
-			if err != nil {
-				return 0, 0, fmt.Errorf("failed to parse average read length: %w", err)
-			}
-			return totalRecords, avgReadLength, nil
-		}
-	}
-	return 0, 0, fmt.Errorf("failed to parse seqkit stats output")
-}
-
-func processRecord(seq string, id string, sankets map[string]SanketInfo, avgReadLength float64, totalRecords int) ProcessRecordResult {
+func processRecord(seq []byte, id string, sankets map[string]SanketInfo, avgReadLength float64, totalRecords int) output.Result {
 	gcPercentage := calculateGCPercentage(seq)
-	var matches []MatchInfo
+	var matches []output.Match
 	coverageMap := make(map[string]int)
 	matchesFound := false
 	for _, info := range sankets {
-		if strings.Contains(seq, info.Sanket) {
+		if bytes.Contains(seq, info.seq) {
 			matchesFound = true
-			match := MatchInfo{
+			match := output.Match{
 				SID:      info.SID, // Add this line
 				Sanket:   info.Sanket,
 				Serotype: info.Serotype,
@@ -184,7 +151,7 @@ func processRecord(seq string, id string, sankets map[string]SanketInfo, avgRead
 		// Pass the missing avgReadLength and totalRecords arguments
 		matches[i].BScore = calculateBScore(totalCoverage, match.SLen, match.SSRCount, match.PCount, avgReadLength, totalRecords)
 	}
-	return ProcessRecordResult{
+	return output.Result{
 		ReadID:        id,
 		Matches:       matches,
 		GCPercentage:  gcPercentage,
@@ -231,182 +198,681 @@ func LoadSankets(csvFilePath string) (map[string]SanketInfo, error) {
 			MRCAvg:   mrcAvg,
 			PCount:   pCount,
 			PLenAvg:  plenAvg,
+			seq:      []byte(sanket),
 		}
 	}
 	return sankets, nil
 }
 
-func processFastqStream(fastqReader io.Reader, sankets map[string]SanketInfo, parquetFilePath string, totalRecords int, avgReadLength float64) error {
-	// Initialize the FASTX reader
-	reader, err := fastx.NewReaderFromIO(nil, fastqReader, "")
-	if err != nil {
-		return fmt.Errorf("error initializing FASTX reader: %w", err)
-	}
+// Reads are handed to the workers in batches of readBatch reads, or fewer holding batchBases bases, so
+// the cost of a handover is paid once per batch while long reads don't hold much memory waiting
+const (
+	readBatch  = 1000
+	batchBases = 1 << 20
+)
 
-	// Setup Parquet writer
-	fw, err := local.NewLocalFileWriter(parquetFilePath)
-	if err != nil {
-		return fmt.Errorf("can't create local file: %w", err)
-	}
-	defer fw.Close()
+// batchSize returns the reads per batch for a job of total reads and the given workers: readBatch, or
+// less so a small job still gives every worker a few batches
+func batchSize(total, workers int) int {
+	return min(readBatch, max(1, total/(4*workers)))
+}
+
+// resultBuffer is about how many classified reads may wait for the writer before the workers block on it.
+// They are handed over a batch at a time, so the writer doesn't pay for a channel operation per read.
+const resultBuffer = 1024
+
+// fastqBatch is a batch of reads copied out of the reader's buffers, their sequences back to back in one
+// buffer. Batches are reused through batchPool, so reading an upload allocates little besides the read IDs
+// the results keep.
+type fastqBatch struct {
+	reads []fastqRead
+	seqs  []byte
+}
+
+// fastqRead is a read of a fastqBatch
+type fastqRead struct {
+	id         string
+	start, end int // the sequence in the batch's seqs
+}
+
+var batchPool = sync.Pool{New: func() any { return &fastqBatch{} }}
 
-	pw, err := writer.NewParquetWriter(fw, new(ParquetRecord), 4)
+// add copies a record into the batch
+func (b *fastqBatch) add(record *fastx.Record) {
+	read := fastqRead{id: string(record.ID), start: len(b.seqs)}
+	b.seqs = append(b.seqs, record.Seq.Seq...)
+	read.end = len(b.seqs)
+	b.reads = append(b.reads, read)
+}
+
+// seq returns the sequence of the batch's i-th read
+func (b *fastqBatch) seq(i int) []byte {
+	return b.seqs[b.reads[i].start:b.reads[i].end]
+}
+
+// release empties the batch and returns it to batchPool; nothing may hold on to its sequences
+func (b *fastqBatch) release() {
+	b.reads, b.seqs = b.reads[:0], b.seqs[:0]
+	batchPool.Put(b)
+}
+
+// processFastqStream classifies every read of the readers, in order, and writes the results. When ctx is
+// canceled it stops feeding workers, waits for in-flight reads and returns ctx.Err().
+func processFastqStream(ctx context.Context, fastqReaders []io.Reader, sankets map[string]SanketInfo, outputFilePath string, totalRecords int, avgReadLength float64, opts OutputOptions, job *Job) error {
+	// Setup the output writer
+	out, err := newOutputWriter(outputFilePath, opts)
 	if err != nil {
-		return fmt.Errorf("can't create parquet writer: %w", err)
+		return err
 	}
-	defer pw.WriteStop()
 
 	// Initialize progress bar
 	bar := pb.StartNew(totalRecords)
 	defer bar.Finish()
 
-	// Setup concurrency control
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 30) // Limit the number of concurrent goroutines
-
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
+	// Reads shorter than every sanket can't match; they are counted for the job log
+	minLength := math.MaxInt
+	for _, info := range sankets {
+		minLength = min(minLength, len(info.Sanket))
+	}
+	reads, shortReads := 0, 0
+	start := time.Now()
+
+	// One goroutine owns the output writer: the workers hand it their results and block while resultBuffer
+	// of them wait, and it closes the writer once they are all written
+	size := batchSize(totalRecords, opts.workers())
+	results := make(chan []output.Result, max(1, resultBuffer/size))
+	written := make(chan error, 1)
+	go func() {
+		writeErrors := 0
+		for batch := range results {
+			for _, result := range batch {
+				if err := out.Write(result); err != nil {
+					if writeErrors == 0 {
+						job.logger().Error("can't write to the output file", "read", result.ReadID, "error", err)
+					}
+					writeErrors++
+				}
+				bar.Increment()    // Update progress bar
+				job.Record(result) // Update job progress and summary for GET /jobs/:id
+			}
 		}
-		if err != nil {
-			return fmt.Errorf("error reading FASTQ record: %w", err)
+		if writeErrors > 0 {
+			job.logger().Error("reads missing from the output", "reads", writeErrors)
 		}
+		written <- out.Close()
+	}()
 
-		// Make deep copies of the data needed by the goroutine
-		seqCopy := string(record.Seq.Seq) // This is already a copy, but included for clarity
-		idCopy := string(record.ID)
-
+	// A fixed set of workers classifies the reads, taking a batch at a time
+	var wg sync.WaitGroup
+	batches := make(chan *fastqBatch, opts.workers())
+	for i := 0; i < opts.workers(); i++ {
 		wg.Add(1)
-		semaphore <- struct{}{} // Acquire a token
-
-		go func(seqCopy string, idCopy string) {
+		go func() {
 			defer wg.Done()
-			result := processRecord(seqCopy, idCopy, sankets, avgReadLength, totalRecords)
-
-			if result.MatchesFound {
-				// Write each match as a separate record in the Parquet file
-				for _, match := range result.Matches {
-					parquetRecord := ParquetRecord{
-						SID:           match.SID,
-						ReadID:        result.ReadID,
-						MatchedSanket: match.Sanket,
-						Serotype:      match.Serotype,
-						GCPercentage:  result.GCPercentage,
-						TotalCoverage: int32(result.TotalCoverage),
-						SLen:          int32(match.SLen),
-						SSRCount:      match.SSRCount,
-						MLenAvg:       match.MLenAvg,
-						MRCAvg:        match.MRCAvg,
-						PCount:        match.PCount,
-						PLenAvg:       match.PLenAvg,
-						BScore:        match.BScore,
-					}
-					parquetWriterMutex.Lock()
-					if err := pw.Write(parquetRecord); err != nil {
-						log.Printf("error writing to Parquet file: %v", err)
-					}
-					parquetWriterMutex.Unlock()
+			for batch := range batches {
+				classified := make([]output.Result, 0, len(batch.reads))
+				for i, read := range batch.reads {
+					classified = append(classified, processRecord(batch.seq(i), read.id, sankets, avgReadLength, totalRecords))
 				}
-			} else {
-				// Write a record indicating no match was found
-				parquetWriterMutex.Lock()
-				if err := pw.Write(ParquetRecord{
-					ReadID:        result.ReadID,
-					MatchedSanket: "No Match Found",
-					Serotype:      "Unassigned",
-					GCPercentage:  result.GCPercentage,
-					TotalCoverage: 0,
-					SLen:          0,
-					SSRCount:      "",
-					MLenAvg:       "",
-					MRCAvg:        "",
-					PCount:        "",
-					PLenAvg:       "",
-					BScore:        0, // Use 0 as BScore for no match found
-				}); err != nil {
-					log.Printf("error writing to Parquet file: %v", err)
-				}
-				parquetWriterMutex.Unlock()
+				batch.release()
+				results <- classified
+			}
+		}()
+	}
+	batch := batchPool.Get().(*fastqBatch)
+	submit := func() {
+		if len(batch.reads) > 0 && ctx.Err() == nil {
+			// Give up on the batch if the job is canceled while waiting
+			select {
+			case batches <- batch:
+				batch = batchPool.Get().(*fastqBatch)
+			case <-ctx.Done():
 			}
+		}
+	}
+	// stop lets the workers finish the batches handed over and the writer write their results, and returns
+	// the error of closing the output
+	stop := func() error {
+		close(batches)
+		wg.Wait()
+		close(results)
+		return <-written
+	}
+
+	for _, fastqReader := range fastqReaders {
+		// Initialize the FASTX reader
+		reader, err := fastx.NewReaderFromIO(nil, fastqReader, "")
+		if err != nil {
+			stop()
+			return fmt.Errorf("error initializing FASTX reader: %w", err)
+		}
 
-			bar.Increment() // Update progress bar
-			<-semaphore     // Release the token
-		}(seqCopy, idCopy) // Pass the copies to the goroutine
+		for ctx.Err() == nil {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				stop()
+				return fmt.Errorf("error reading FASTQ record: %w", err)
+			}
+
+			// Copy what the worker needs, as the reader reuses its buffers
+			batch.add(record)
+			reads++
+			if len(record.Seq.Seq) < minLength {
+				shortReads++
+			}
+			if len(batch.reads) == size || len(batch.seqs) >= batchBases {
+				submit()
+			}
+		}
 	}
+	submit()
+	batch.release() // the empty one submit took, or the last one if the job was canceled
 
-	wg.Wait() // Wait for all goroutines to finish
+	err = stop()
 	bar.Finish()
+	classified := time.Now()
+	if shortReads > 0 {
+		job.logger().Warn("reads too short to match any sanket", "reads", shortReads, "min_length", minLength)
+	}
+	if err != nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		job.logger().Info("output written", "file", filepath.Base(outputFilePath), "reads", reads,
+			"classify_duration", classified.Sub(start).Round(time.Millisecond), "flush_duration", time.Since(classified).Round(time.Millisecond))
+	}
+
+	return ctx.Err()
+}
+
+// runJob classifies the spooled uploads into the job's output file. A job
+// stopped by its time limit fails with the errJobTimeout cause, not as canceled.
+func runJob(job *Job, spools []string, stats []SpoolStat, sankets map[string]SanketInfo, opts OutputOptions) (err error) {
+	// Wait for a slot; the job stays queued meanwhile
+	release, err := scheduler.Wait(job.Context(), job.ID, job.Params.User, job.Params.Priority)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Total records and read length, counted while spooling, drive the progress bar and BScore
+	total := combineStats(stats)
+	job.Start(total.Records)
+
+	// The time limit counts from the start, not from the submission
+	if limit := job.TimeLimit(); limit > 0 {
+		timer := time.AfterFunc(limit, func() { job.cancel(fmt.Errorf("%w after %v", errJobTimeout, limit)) })
+		defer timer.Stop()
+		defer func() {
+			if cause := context.Cause(job.Context()); errors.Is(err, context.Canceled) && errors.Is(cause, errJobTimeout) {
+				err = cause
+			}
+		}()
+	}
 
-	// Lock the mutex before stopping the Parquet writer
-	parquetWriterMutex.Lock()
-	if err := pw.WriteStop(); err != nil {
-		return fmt.Errorf("error finalizing Parquet file write: %w", err)
+	// Process the FASTQ files into a scratch directory next to the output, so
+	// the result only appears under its final path once it is complete
+	output := job.Output()
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		return fmt.Errorf("can't create the job directory: %w", err)
+	}
+	scratch, err := os.MkdirTemp(filepath.Dir(output), ".partial-*")
+	if err != nil {
+		return fmt.Errorf("can't create the job directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+	partial := filepath.Join(scratch, filepath.Base(output))
+	if job.Params.Mode == UploadBatch {
+		err = runBatch(job.Context(), job, spools, stats, sankets, opts, partial)
+	} else {
+		err = processSpools(job.Context(), spools, sankets, partial, total, opts, job)
+	}
+	if err == nil {
+		err = os.Rename(partial, output)
+	}
+	if err != nil {
+		removeOutput(job.ID, output)
+		if job.Context().Err() != nil {
+			return job.Context().Err()
+		}
+		return fmt.Errorf("failed to process FASTQ file: %w", err)
 	}
-	parquetWriterMutex.Unlock() // Unlock the mutex after stopping the writer
+	if resultBucket != nil {
+		return moveToBucket(job, output)
+	}
+	return nil
+}
 
+// moveToBucket uploads a finished output to resultBucket and removes the local
+// copy. If the upload fails the output stays on local disk, so the result isn't lost.
+func moveToBucket(job *Job, output string) error {
+	start := time.Now()
+	location, err := uploadResult(job.Context(), job, output)
+	if err != nil {
+		if job.Context().Err() != nil {
+			removeOutput(job.ID, output)
+			return job.Context().Err()
+		}
+		job.logger().Error("can't upload the result to the output bucket; keeping it on local disk", "error", err)
+		return nil
+	}
+	job.SetOutput(location, job.DownloadName())
+	removeOutput(job.ID, output)
+	job.logger().Info("result uploaded", "key", strings.TrimPrefix(location, bucketLocation), "duration", time.Since(start).Round(time.Millisecond))
 	return nil
 }
+
+// removeOutput deletes a job's output and scratch files, and its job directory
+// unless the job has a log to keep
+func removeOutput(id, output string) {
+	if output == "" {
+		return
+	}
+	dir := filepath.Dir(output)
+	if filepath.Base(dir) != id {
+		os.Remove(output) // written before jobs had their own directory
+		return
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.Name() != jobLogName {
+			os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+	}
+	os.Remove(dir) // fails, leaving it, when there is a log
+}
+
+// Directories and URLs shared by the upload handler and queue workers
+var (
+	spoolDir  string
+	outputDir string
+	publicURL string
+)
+
+// envString reads a flag default from the environment
+func envString(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// envDuration reads a duration flag default from the environment
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fatal("invalid environment variable", "name", name, "value", value)
+	}
+	return d
+}
+
+// envInt reads an integer flag default from the environment
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		fatal("invalid environment variable", "name", name, "value", value)
+	}
+	return n
+}
+
 func main() {
+	fitToContainer()
+	jobMemory = byteSize(memoryShare(int64(jobMemory), 8, 1<<20)) // in a container, an eighth of its memory at most
+	flag.StringVar(&defaultOpts.Format, "format", output.FormatParquet, "Default output format: parquet, csv, json (newline-delimited) or sqlite")
+	flag.StringVar(&defaultOpts.Compression, "parquet-compression", "snappy", "Parquet compression codec: zstd, snappy, gzip or none")
+	dbPath := flag.String("db", "bhedi-jobs.db", "SQLite database keeping job history across restarts; empty keeps jobs in memory only")
+	panelPath := flag.String("panel", os.Getenv("BHEDI_PANEL"), "Sanket panel CSV (default $BHEDI_PANEL, else the first "+panelFile+" in the working directory, next to the executable or in <user config dir>/bhedi); reload it, or switch to another, with SIGHUP or POST /admin/panel/reload")
+	flag.StringVar(&workspacePanelDir, "workspace-panels", "", "Directory of <workspace>.csv panels for workspaces that don't use -panel; reloaded with SIGHUP")
+	flag.StringVar(&spoolDir, "spool-dir", "", "Directory for spooled uploads (default: the system temp directory); must be shared between instances when using -redis")
+	flag.StringVar(&outputDir, "output-dir", ".", "Directory for job outputs; must be shared between instances when using -redis")
+	outputBucket := flag.String("output-bucket", "", "Object storage bucket finished results are moved to, e.g. s3://results?region=eu-west-1&prefix=bhedi/, gs://results or azblob://results; -output-dir then only holds jobs in progress and their logs")
+	signingKeyFlag := flag.String("signing-key", os.Getenv("BHEDI_SIGNING_KEY"), "Secret for signed download links and webhook signatures (default $BHEDI_SIGNING_KEY); must match between instances")
+	flag.DurationVar(&retention, "retention", 0, "How long finished jobs and their results are kept, e.g. 168h; older ones and stale temp files are deleted hourly (0 keeps them forever)")
+	flag.DurationVar(&linkTTL, "link-ttl", linkTTL, "How long signed download links sent to callbacks stay valid")
+	flag.StringVar(&publicURL, "public-url", "", "Base URL clients reach this server at, used in signed download links (default: taken from the upload request)")
+	maxRunning := flag.Int("max-running", 4, "Jobs this instance classifies at once; others wait, highest priority first (0 for no limit)")
+	userMaxRunning := flag.Int("user-max-running", 2, "Jobs one user may have running at once (0 for no limit)")
+	flag.DurationVar(&jobTimeout, "job-timeout", 0, "Longest a job may run once started, e.g. 6h; jobs may ask for less and fail when it runs out (0 for no limit)")
+	flag.Var(&jobMemory, "job-memory", "Output rows each job buffers in memory: the Parquet row group size, or the SQLite page cache; jobs may ask for less")
+	flag.IntVar(&maxQueued, "max-queued", 0, "Jobs that may wait for a slot; more submissions are refused with 429 and Retry-After (0 for no limit)")
+	redisURL := flag.String("redis", "", "Redis URL (e.g. redis://localhost:6379/0) of a job queue shared by several instances; empty runs async jobs in-process")
+	redisWorkers := flag.Int("redis-workers", 1, "Number of queued jobs this instance runs at once")
+	flag.Var(&bodyLimit, "body-limit", "Largest accepted upload request, e.g. 500MB or 20GB")
+	flag.StringVar(&adminKey, "admin-key", os.Getenv("BHEDI_ADMIN_KEY"), "Admin secret for managing API keys (default $BHEDI_ADMIN_KEY); when set, every request needs an API key")
+	flag.IntVar(&defaultKeyRateLimit, "key-rate-limit", defaultKeyRateLimit, "Requests per minute allowed to API keys created without a rate_limit (0 for no limit)")
+	var oidcFlags oidcConfig
+	flag.StringVar(&oidcFlags.Issuer, "oidc-issuer", "", "OIDC issuer URL (e.g. https://keycloak.example.org/realms/lab) whose bearer tokens are accepted")
+	flag.StringVar(&oidcFlags.Audience, "oidc-audience", "", "Audience (client ID) OIDC tokens must be issued for")
+	flag.StringVar(&oidcFlags.UserClaim, "oidc-user-claim", "preferred_username", "Token claim naming the user (falls back to sub)")
+	flag.StringVar(&oidcFlags.GroupClaim, "oidc-group-claim", "groups", "Token claim listing the user's groups or roles, dotted for nested claims (e.g. realm_access.roles)")
+	flag.StringVar(&oidcFlags.WorkspaceClaim, "oidc-workspace-claim", "", "Token claim naming the user's workspace, dotted for nested claims; empty puts every OIDC user in the default workspace")
+	oidcGroups := flag.String("oidc-allowed-groups", "", "Comma-separated groups allowed in; empty allows every authenticated user")
+	flag.IntVar(&clientRateLimit, "rate-limit", 0, "Requests per minute allowed to each client without an API key, by OIDC user or address (0 for no limit)")
+	fetchAllow := flag.String("fetch-allow", os.Getenv("BHEDI_FETCH_ALLOW"), "Comma-separated IPs or CIDRs of private networks POST /jobs may fetch from, e.g. an in-house object store; other loopback, private and link-local addresses are refused (default $BHEDI_FETCH_ALLOW)")
+	flag.Var(&dailyUploadQuota, "daily-upload-quota", "Bytes each client may upload or have fetched per UTC day, e.g. 50GB (0 for no quota)")
+	flag.IntVar(&maxActiveJobs, "max-active-jobs", 0, "Queued plus running jobs each client may have at once; more are refused with 429 (0 for no limit)")
+	flag.IntVar(&maxWorkspaceJobs, "max-workspace-jobs", 0, "Queued plus running jobs each workspace may have at once; more are refused with 429 (0 for no limit)")
+	redisRetries := flag.Int("redis-retries", 2, "How many times a failed queued job is retried")
+	swaggerUI := flag.Bool("swagger-ui", false, "Serve Swagger UI for the OpenAPI spec at /docs")
+	dashboard := flag.Bool("dashboard", true, "Serve the web dashboard at /ui")
+	logFormat := flag.String("log-format", LogFormatText, "Log format: text or json")
+	var listen listenConfig
+	flag.StringVar(&listen.Addr, "addr", envString("BHEDI_ADDR", ":3000"), "Address to listen on (default $BHEDI_ADDR or :3000)")
+	flag.StringVar(&listen.TLSCert, "tls-cert", os.Getenv("BHEDI_TLS_CERT"), "PEM certificate chain to serve HTTPS with, alongside -tls-key (default $BHEDI_TLS_CERT)")
+	flag.StringVar(&listen.TLSKey, "tls-key", os.Getenv("BHEDI_TLS_KEY"), "PEM private key of -tls-cert (default $BHEDI_TLS_KEY)")
+	acmeDomains := flag.String("acme-domains", os.Getenv("BHEDI_ACME_DOMAINS"), "Comma-separated hostnames to get Let's Encrypt certificates for instead of -tls-cert; -addr must be reachable on port 443 (default $BHEDI_ACME_DOMAINS)")
+	flag.StringVar(&listen.ACMECache, "acme-cache", envString("BHEDI_ACME_CACHE", "acme-cache"), "Directory keeping Let's Encrypt certificates across restarts (default $BHEDI_ACME_CACHE or acme-cache)")
+	flag.StringVar(&listen.ACMEEmail, "acme-email", os.Getenv("BHEDI_ACME_EMAIL"), "Contact address for Let's Encrypt expiry notices (default $BHEDI_ACME_EMAIL)")
+	flag.StringVar(&listen.RedirectAddr, "redirect-addr", os.Getenv("BHEDI_REDIRECT_ADDR"), "Plain HTTP address, e.g. :80, redirecting to HTTPS and answering ACME HTTP-01 challenges (default $BHEDI_REDIRECT_ADDR)")
+	readTimeout := flag.Duration("read-timeout", envDuration("BHEDI_READ_TIMEOUT", 0), "Longest time to read a request, body included; 0 for none, as large uploads can take a while (default $BHEDI_READ_TIMEOUT)")
+	writeTimeout := flag.Duration("write-timeout", envDuration("BHEDI_WRITE_TIMEOUT", 0), "Longest time to write a response; 0 for none, as results, sync uploads and progress streams can take a while (default $BHEDI_WRITE_TIMEOUT)")
+	idleTimeout := flag.Duration("idle-timeout", envDuration("BHEDI_IDLE_TIMEOUT", 2*time.Minute), "How long idle keep-alive connections stay open (default $BHEDI_IDLE_TIMEOUT or 2m)")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("BHEDI_TRUSTED_PROXIES"), "Comma-separated IPs or CIDRs of reverse proxies or load balancers whose -proxy-header and X-Forwarded-Proto are believed (default $BHEDI_TRUSTED_PROXIES)")
+	proxyHeader := flag.String("proxy-header", envString("BHEDI_PROXY_HEADER", fiber.HeaderXForwardedFor), "Header trusted proxies give the client address in (default $BHEDI_PROXY_HEADER or X-Forwarded-For)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Minute, "On SIGTERM or SIGINT, how long jobs in flight get to finish before they are aborted")
+	flag.IntVar(&defaultOpts.Workers, "workers", envInt("BHEDI_WORKERS", availableCPUs()), "Reads each job classifies at once (default $BHEDI_WORKERS or the number of CPUs, or the container's CPU quota if lower); jobs may ask for fewer")
+	flag.IntVar(&defaultOpts.WriterParallelism, "writer-parallelism", envInt("BHEDI_WRITER_PARALLELISM", availableCPUs()), "Goroutines encoding each Parquet row group (default $BHEDI_WRITER_PARALLELISM or the number of CPUs, or the container's CPU quota if lower); jobs may ask for fewer")
+	flag.Var(&parquetPageSize, "parquet-page-size", "Bytes per page of the Parquet files jobs write; rows go to the encoders a few pages' worth at a time, so larger pages, e.g. 1MB, mean fewer, larger batches for samples with many matches")
+	slackWebhook := flag.String("slack-webhook", os.Getenv("BHEDI_SLACK_WEBHOOK"), "Slack incoming webhook URL to post finished jobs to (default $BHEDI_SLACK_WEBHOOK)")
+	smtpAddr := flag.String("smtp", "", "SMTP server (host:port) to email finished jobs through; the password is read from $BHEDI_SMTP_PASSWORD")
+	smtpFrom := flag.String("smtp-from", "", "Sender address of notification emails")
+	smtpUser := flag.String("smtp-user", "", "SMTP user name, if the server needs authentication")
+	notifyEmail := flag.String("notify-email", "", "Comma-separated addresses notification emails are sent to")
+	notifyOn := flag.String("notify-on", "done,failed", "Comma-separated job states to send notifications for: done, failed and/or canceled")
+	enablePprof := flag.Bool("enable-pprof", false, "Serve runtime profiles under /debug/pprof/ for performance bug reports (admin key only when -admin-key is set)")
+	flag.Parse()
+
+	if err := setupLogging(*logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if container.CPUs > 0 || container.Memory > 0 {
+		slog.Info("fitted to the container", "cpu_quota", container.CPUs, "memory_limit", container.Memory, "gomaxprocs", availableCPUs(), "job_memory", jobMemory.String())
+	}
+	defaultOpts.Schema = output.SchemaFlat
+	defaultOpts.Memory = int64(jobMemory)
+	defaultOpts.PageSize = int64(parquetPageSize)
+	if err := defaultOpts.Validate(); err != nil {
+		fatal("invalid output options", "error", err)
+	}
+	if defaultOpts.Workers < 1 || defaultOpts.WriterParallelism < 1 {
+		fatal("-workers and -writer-parallelism must be at least 1")
+	}
+	if jobMemory < 1<<20 {
+		fatal("-job-memory must be at least 1MB")
+	}
+	if parquetPageSize < 1<<10 || parquetPageSize > jobMemory {
+		fatal("-parquet-page-size must be at least 1KB and at most -job-memory")
+	}
+	listen.ACMEDomains = splitTags(*acmeDomains)
+	if err := listen.validate(); err != nil {
+		fatal("invalid listener settings", "error", err)
+	}
+	proxies := splitTags(*trustedProxies)
+	allowed, err := parseFetchAllowed(*fetchAllow)
+	if err != nil {
+		fatal("invalid -fetch-allow", "error", err)
+	}
+	fetchAllowed = allowed
+	panelCSV, err := findPanel(*panelPath)
+	if err != nil {
+		fatal("can't find the sanket panel", "error", err)
+	}
+	panel, err := loadPanel(panelCSV)
+	if err != nil {
+		fatal("can't load the sanket panel", "error", err)
+	}
+	currentPanel.Store(panel)
+	if workspacePanelDir != "" {
+		panels, err := loadWorkspacePanels(workspacePanelDir)
+		if err != nil {
+			fatal("can't load the workspace panels", "error", err)
+		}
+		workspacePanels.Store(&panels)
+	}
+	if *outputBucket != "" {
+		if resultBucket, err = openBucket(context.Background(), *outputBucket); err != nil {
+			fatal("can't open the output bucket", "error", err)
+		}
+	}
+	initSigningKey(*signingKeyFlag)
+	if notifyStates, err = parseNotifyStates(*notifyOn); err != nil {
+		fatal("invalid -notify-on", "error", err)
+	}
+	if *slackWebhook != "" {
+		slack, err := newSlackNotifier(*slackWebhook)
+		if err != nil {
+			fatal("can't set up Slack notifications", "error", err)
+		}
+		notifiers = append(notifiers, slack)
+	}
+	if *smtpAddr != "" {
+		email, err := newEmailNotifier(*smtpAddr, *smtpFrom, *notifyEmail, *smtpUser, os.Getenv("BHEDI_SMTP_PASSWORD"))
+		if err != nil {
+			fatal("can't set up email notifications", "error", err)
+		}
+		notifiers = append(notifiers, email)
+	}
+	if oidcFlags.Issuer != "" {
+		oidcFlags.AllowedGroups = splitTags(*oidcGroups)
+		if err := initOIDC(context.Background(), &oidcFlags); err != nil {
+			fatal("can't set up OIDC", "error", err)
+		}
+		oidcAuth = &oidcFlags
+	}
+	scheduler = NewScheduler(*maxRunning, *userMaxRunning)
+	if *dbPath != "" {
+		store, err := openJobStore(*dbPath)
+		if err != nil {
+			fatal("can't open the job database", "path", *dbPath, "error", err)
+		}
+		if err := jobs.UseStore(store); err != nil {
+			fatal("can't load jobs", "error", err)
+		}
+		if err := apiKeys.UseStore(store); err != nil {
+			fatal("can't load API keys", "error", err)
+		}
+		audit.UseStore(store)
+	} else if adminKey != "" {
+		slog.Warn("no -db set, API keys are kept in memory and lost on restart")
+	}
+
+	if *redisURL != "" {
+		var err error
+		if queue, err = newRedisQueue(*redisURL, *redisRetries); err != nil {
+			fatal("can't set up the job queue", "error", err)
+		}
+		jobs.UseQueue(queue)
+		queue.Start(*redisWorkers)
+	}
+
 	app := fiber.New(fiber.Config{
-		BodyLimit: 11 * 1024 * 1024 * 1024, // Set limit to slightly above 10 GB
+		BodyLimit: int(bodyLimit),
+		// Hand request bodies to handlers as streams so uploads are spooled
+		// to disk as they arrive instead of being buffered in memory
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		DisableStartupMessage:        *logFormat == LogFormatJSON, // keep stderr parseable
+		ReadTimeout:                  *readTimeout,
+		WriteTimeout:                 *writeTimeout,
+		IdleTimeout:                  *idleTimeout,
+		// Behind a trusted proxy, take the client address and scheme from
+		// its headers; anyone else could forge them
+		EnableTrustedProxyCheck: len(proxies) > 0,
+		TrustedProxies:          proxies,
+		ProxyHeader:             proxyHeaderFor(proxies, *proxyHeader),
+		EnableIPValidation:      true,
 	})
+	app.Use(assignRequestID)
 	app.Use(cors.New()) // Enable CORS for all routes
-	app.Use(logger.New())
+	app.Use(logRequests)
+	app.Use(negotiateVersion)
+	app.Use(limitBody)
+	app.Use(authenticate)
+	app.Use(rateLimit)
+	app.Use(refuseNewJobs)
+	if *enablePprof {
+		mountPprof(app)
+	}
 
-	app.Post("/upload", func(c *fiber.Ctx) error {
-		file, err := c.FormFile("file")
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString("Upload failed")
+	// Routes live under /v1; negotiateVersion maps unprefixed paths onto them
+	api := app.Group(apiPrefix)
+
+	api.Get("/healthz", handleLiveness)
+	api.Get("/readyz", handleReadiness)
+	if err := serveOpenAPI(api, *swaggerUI); err != nil {
+		fatal("can't serve the OpenAPI spec", "error", err)
+	}
+	if *dashboard {
+		serveDashboard(api)
+	}
+
+	api.Post("/upload", func(c *fiber.Ctx) error {
+		if err := checkQuota(c); err != nil {
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+		// A retried submission gets the job it already started
+		key, done, err := claimIdempotencyKey(c)
+		if done {
+			return err
 		}
+		defer jobs.Release(requestWorkspace(c), key)
 
-		fastqFile, err := file.Open()
+		// One or more FASTQ files, all in "file" parts, streamed straight to spool files
+		upload, err := streamUpload(c)
+		if errors.Is(err, errQuotaExceeded) {
+			return c.Status(fiber.StatusTooManyRequests).SendString(fmt.Sprintf("Upload rejected: it would exceed the daily upload quota of %v", &dailyUploadQuota))
+		}
+		if errors.Is(err, errBodyTooLarge) {
+			return c.Status(fiber.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("Upload rejected: larger than the %v limit", &bodyLimit))
+		}
+		var contentErr *contentError
+		if errors.As(err, &contentErr) {
+			return c.Status(fiber.StatusUnprocessableEntity).SendString(fmt.Sprintf("Upload rejected: %v", err))
+		}
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Failed to open uploaded file")
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Upload failed: %v", err))
 		}
-		defer fastqFile.Close()
+		if len(upload.Uploaded()) == 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("Upload failed")
+		}
+		handedOff := false // set once a background job owns the spool files
+		defer func() {
+			if !handedOff {
+				upload.Remove() // Clean up the temp files afterwards
+			}
+		}()
 
-		// Load sankets from CSV
-		sankets, err := LoadSankets("sanket.csv") // Specify the path to your CSV file
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to load sankets: %v", err))
+		// Check the upload arrived intact before committing to a long job
+		md5s, sha256s := expectedChecksums(c.Get, upload.FormValue)
+		if err := verifyChecksums(upload.Uploaded(), md5s, sha256s); err != nil {
+			return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
 		}
 
-		// Save the uploaded file to a temporary location to use it with getTotalRecordsAndAvgReadLength
-		tempFile, err := os.CreateTemp("", "fastq-*.tmp")
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to create a temporary file: %v", err))
+		// An archive becomes one background job per sample inside it
+		if upload.Archive != nil {
+			handedOff = true
+			return handleArchiveUpload(c, upload, key)
 		}
-		defer tempFile.Close()
-		defer os.Remove(tempFile.Name()) // Clean up the temp file afterwards
+		spools := upload.Spools()
 
-		_, err = io.Copy(tempFile, fastqFile)
+		filenames := make([]string, 0, len(upload.Files))
+		for _, file := range upload.Files {
+			filenames = append(filenames, file.Filename)
+		}
+		opts, params, err := jobOptions(c, upload.FormValue, filenames)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to save the uploaded file: %v", err))
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 		}
+		params.IdempotencyKey = key
+		job := jobs.Create(params)
+		c.Set("X-Job-ID", job.ID)
+		auditSubmission(c, job, map[string]any{"sha256": fileChecksums(upload.Files)})
 
-		// Get total records and average read length for progress bar and BScore calculation
-		totalRecords, avgReadLength, err := getTotalRecordsAndAvgReadLength(tempFile.Name())
+		sankets, err := prepareJob(job, &opts)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to get total records and average read length: %v", err))
+			job.Finish(err)
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to load sankets: %v", err))
 		}
 
-		// Re-open the temp file for reading
-		fastqFile, err = os.Open(tempFile.Name())
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Failed to re-open the temp file")
+		// Everything past spooling runs in the background for async uploads
+		if upload.FormValue("async") == "true" {
+			handedOff = true
+			if err := launchJob(job, spools, upload.Stats(), sankets, opts); err != nil {
+				job.Finish(err)
+				return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+			}
+			c.Location(jobPath(job.ID))
+			return c.Status(fiber.StatusAccepted).JSON(job.Status())
 		}
-		defer fastqFile.Close()
 
-		// Process the FASTQ file
-		tempParquetFile := "output.parquet" // Consider generating a unique file name
-		if err := processFastqStream(fastqFile, sankets, tempParquetFile, totalRecords, avgReadLength); err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to process FASTQ file: %v", err))
+		err = runJob(job, spools, upload.Stats(), sankets, opts)
+		job.Finish(err)
+		if errors.Is(context.Cause(job.Context()), errShutdown) {
+			c.Set(fiber.HeaderRetryAfter, "30")
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Server shut down before the job finished; resubmit shortly")
+		}
+		if errors.Is(err, context.Canceled) {
+			return c.Status(fiber.StatusConflict).SendString("Job canceled")
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Upload processing failed: %v", err))
 		}
 
-		// Return the Parquet file
-		return c.Download(tempParquetFile)
+		// Return the output file
+		auditJob(c, AuditResultDownloaded, job, map[string]any{"file": job.DownloadName()})
+		return c.Download(job.Output(), job.DownloadName())
 	})
 
-	log.Fatal(app.Listen(":3000"))
+	admin := api.Group("/admin", requireAdmin)
+	admin.Post("/keys", handleKeyCreate)
+	admin.Get("/keys", handleKeyList)
+	admin.Delete("/keys/:id", handleKeyRevoke)
+	admin.Get("/panel", handlePanelGet)
+	admin.Post("/panel/reload", handlePanelReload)
+	admin.Get("/retention", handleRetentionStatus)
+	admin.Post("/retention/run", handleRetentionRun)
+	admin.Get("/audit", handleAuditList)
+
+	api.Post("/classify", handleClassify)
+	api.Get("/graphql", handleGraphQL)
+	api.Post("/graphql", handleGraphQL)
+	api.Post("/classify/batch", handleClassifyBatch)
+	api.Post("/jobs", handleRemoteJob)
+	api.Get("/jobs", handleJobList)
+	api.Get("/jobs/:id", handleJobStatus)
+	api.Delete("/jobs/:id", handleJobCancel)
+	api.Get("/jobs/:id/result", handleJobResult)
+	api.Get("/jobs/:id/summary", handleJobSummary)
+	api.Get("/jobs/:id/bundle", handleJobBundle)
+	api.Get("/jobs/:id/logs", handleJobLogs)
+	api.Get("/jobs/:id/progress", upgradeJobProgress, handleJobProgressWS)
+	api.Get("/jobs/:id/events", handleJobEvents)
+
+	go func() {
+		if err := serve(app, &listen); err != nil {
+			fatal("server stopped", "error", err)
+		}
+	}()
+
+	// A second signal kills the server without waiting
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	reloadPanelOnSIGHUP(signals)
+	if retention > 0 {
+		startJanitor(signals)
+	}
+	<-signals.Done()
+	stop()
+	shutdown(app, *shutdownTimeout)
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/s3blob"
+)
+
+// bucketSchemes are the object storage URLs -output-bucket accepts, e.g.
+// s3://results?region=eu-west-1&prefix=bhedi/, gs://results or azblob://results.
+// Credentials come from the provider's usual environment variables or config files.
+var bucketSchemes = map[string]bool{"s3": true, "gs": true, "azblob": true, "file": true}
+
+// resultBucket receives the results of finished jobs when -output-bucket is
+// set; nil keeps them in -output-dir
+var resultBucket *blob.Bucket
+
+// bucketLocation prefixes the output of a job kept in resultBucket, followed by its key
+const bucketLocation = "bucket:"
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// openBucket opens the object storage bucket at rawURL
+func openBucket(ctx context.Context, rawURL string) (*blob.Bucket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !bucketSchemes[u.Scheme] {
+		return nil, fmt.Errorf("invalid bucket URL %q (expected s3://, gs://, azblob:// or file://)", rawURL)
+	}
+	bucket, err := blob.OpenBucket(ctx, rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("can't open bucket %s: %w", rawURL, err)
+	}
+	return bucket, nil
+}
+
+// bucketKey returns the object key of an output kept in resultBucket
+func bucketKey(output string) (string, bool) {
+	return strings.CutPrefix(output, bucketLocation)
+}
+
+// objectPrefix is where a job's files go in the bucket: <sample>/<job id>/,
+// the sample named by its metadata or else by the uploaded file, under
+// <workspace>/ for jobs outside the default workspace
+func objectPrefix(job *Job) string {
+	sample := strings.TrimSuffix(job.Params.Filename, filepath.Ext(job.Params.Filename))
+	if job.Params.Sample != nil && job.Params.Sample.Name != "" {
+		sample = job.Params.Sample.Name
+	}
+	sample = strings.Trim(unsafeKeyChars.ReplaceAllString(sample, "_"), "._")
+	if sample == "" {
+		sample = "unnamed"
+	}
+	prefix := sample + "/" + job.ID + "/"
+	if job.Params.Workspace != "" {
+		prefix = job.Params.Workspace + "/" + prefix
+	}
+	return prefix
+}
+
+// uploadFile copies the file at path to key
+func uploadFile(ctx context.Context, bucket *blob.Bucket, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opts := &blob.WriterOptions{ContentType: mime.TypeByExtension(filepath.Ext(path))}
+	if opts.ContentType == "" {
+		opts.ContentType = "application/octet-stream"
+	}
+	if err := bucket.Upload(ctx, key, f, opts); err != nil {
+		return fmt.Errorf("can't upload %s: %w", key, err)
+	}
+	return nil
+}
+
+// uploadResult copies a finished job's output and summary to resultBucket and
+// returns the output's new location
+func uploadResult(ctx context.Context, job *Job, output string) (string, error) {
+	prefix := objectPrefix(job)
+	key := prefix + job.DownloadName()
+	if err := uploadFile(ctx, resultBucket, key, output); err != nil {
+		return "", err
+	}
+	summary := job.Summary()
+	summary.State = JobDone // uploaded just before the job is marked done
+	summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = resultBucket.WriteAll(ctx, prefix+"summary.json", summaryJSON, &blob.WriterOptions{ContentType: fiber.MIMEApplicationJSON})
+	if err != nil {
+		return "", fmt.Errorf("can't upload %ssummary.json: %w", prefix, err)
+	}
+	return bucketLocation + key, nil
+}
+
+// openResult opens a job's output, on local disk or in resultBucket
+func openResult(ctx context.Context, output string) (io.ReadCloser, int64, error) {
+	key, ok := bucketKey(output)
+	if !ok {
+		f, err := os.Open(output)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}
+	if resultBucket == nil {
+		return nil, 0, fmt.Errorf("result is kept in an output bucket, but no -output-bucket is set")
+	}
+	r, err := resultBucket.NewReader(ctx, key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, r.Size(), nil
+}
+
+// sendResult sends a job's output as a download named downloadName
+func sendResult(c *fiber.Ctx, output, downloadName string) error {
+	if _, ok := bucketKey(output); !ok {
+		return c.Download(output, downloadName)
+	}
+	r, size, err := openResult(c.UserContext(), output)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).SendString(fmt.Sprintf("Can't fetch the result from the output bucket: %v", err))
+	}
+	c.Attachment(downloadName)
+	return c.SendStream(r, int(size)) // closed once sent
+}
+
+// removeBucketResult deletes the objects under a job's prefix in resultBucket
+// and returns how many bytes they used
+func removeBucketResult(ctx context.Context, output string) (int, int64, error) {
+	key, ok := bucketKey(output)
+	if !ok || resultBucket == nil {
+		return 0, 0, nil
+	}
+	prefix := path.Dir(key) + "/"
+	var files int
+	var size int64
+	iter := resultBucket.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return files, size, err
+		}
+		if err := resultBucket.Delete(ctx, obj.Key); err != nil {
+			return files, size, err
+		}
+		files++
+		size += obj.Size
+	}
+	return files, size, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// bundleManifest is manifest.json in a result bundle, written last so it can
+// list the checksums of everything before it
+type bundleManifest struct {
+	JobID     string          `json:"job_id"`
+	Sample    *SampleMetadata `json:"sample,omitempty"`
+	Version   string          `json:"bhedi_version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Files     []bundleFile    `json:"files"`
+}
+
+// bundleFile describes one file of a result bundle
+type bundleFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// reportTemplate renders report.html, a human-readable view of the summary
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(rate float64) string { return fmt.Sprintf("%.1f%%", rate*100) },
+	"score":   func(score float64) string { return fmt.Sprintf("%.3f", score) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>bhedi report {{with .Summary.Sample}}{{.Name}}{{else}}{{$.Status.ID}}{{end}}</title>
+  <style>
+    body { font-family: sans-serif; margin: 2em; }
+    table { border-collapse: collapse; }
+    th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+    td.n { text-align: right; }
+  </style>
+</head>
+<body>
+  <h1>bhedi serotyping report</h1>
+  <table>
+    <tr><th>Job</th><td>{{.Status.ID}}</td></tr>
+    <tr><th>File</th><td>{{.Status.Params.Filename}}</td></tr>
+    {{with .Summary.Sample}}<tr><th>Sample</th><td>{{.Name}}</td></tr>
+    {{with .CollectionDate}}<tr><th>Collected</th><td>{{.}}</td></tr>{{end}}
+    {{with .Location}}<tr><th>Location</th><td>{{.}}</td></tr>{{end}}{{end}}
+    <tr><th>Finished</th><td>{{with .Status.FinishedAt}}{{.Format "2006-01-02 15:04 MST"}}{{end}}</td></tr>
+    <tr><th>Reads</th><td>{{.Summary.ReadsProcessed}}</td></tr>
+    <tr><th>Matched reads</th><td>{{.Summary.MatchedReads}} ({{percent .Summary.MatchRate}})</td></tr>
+    <tr><th>Call</th><td><strong>{{or .Summary.Call "none"}}</strong></td></tr>
+  </table>
+  <h2>Serotypes</h2>
+  <table>
+    <tr><th>Serotype</th><th>Reads</th><th>Sanket hits</th><th>Mean BScore</th></tr>
+    {{range .Summary.Serotypes}}<tr><td>{{.Serotype}}</td><td class="n">{{.Reads}}</td><td class="n">{{.Matches}}</td><td class="n">{{score .MeanBScore}}</td></tr>
+    {{else}}<tr><td colspan="4">No reads matched a sanket</td></tr>{{end}}
+  </table>
+  <p>bhedi {{.Version}}</p>
+</body>
+</html>
+`))
+
+// bundleWriter adds files to a zip, recording each one's size and checksum
+type bundleWriter struct {
+	zw    *zip.Writer
+	files []bundleFile
+}
+
+// add copies r into the bundle as name
+func (b *bundleWriter) add(name string, r io.Reader) error {
+	w, err := b.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return fmt.Errorf("can't add %s to the bundle: %w", name, err)
+	}
+	b.files = append(b.files, bundleFile{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))})
+	return nil
+}
+
+// writeBundle writes the job's result, summary.json, report.html and manifest.json as a zip to w
+func writeBundle(w io.Writer, job *Job, output, downloadName string) error {
+	status := job.Status()
+	summary := job.Summary()
+	bundle := &bundleWriter{zw: zip.NewWriter(w)}
+
+	f, _, err := openResult(context.Background(), output)
+	if err != nil {
+		return fmt.Errorf("can't open the result: %w", err)
+	}
+	err = bundle.add(downloadName, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := bundle.add("summary.json", bytes.NewReader(summaryJSON)); err != nil {
+		return err
+	}
+
+	var report bytes.Buffer
+	err = reportTemplate.Execute(&report, map[string]any{"Status": status, "Summary": summary, "Version": version})
+	if err != nil {
+		return fmt.Errorf("can't render the report: %w", err)
+	}
+	if err := bundle.add("report.html", &report); err != nil {
+		return err
+	}
+
+	manifest, err := json.MarshalIndent(bundleManifest{
+		JobID:     job.ID,
+		Sample:    job.Params.Sample,
+		Version:   version,
+		CreatedAt: time.Now().UTC(),
+		Files:     bundle.files,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := bundle.add("manifest.json", bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+	return bundle.zw.Close()
+}
+
+// handleJobBundle serves GET /jobs/:id/bundle: the result file, summary JSON,
+// an HTML report and a manifest with their checksums, in one zip streamed as
+// it is built
+func handleJobBundle(c *fiber.Ctx) error {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	job.mu.Lock()
+	state, output, downloadName := job.state, job.output, job.downloadName
+	job.mu.Unlock()
+	if state != JobDone {
+		return c.Status(fiber.StatusConflict).SendString(fmt.Sprintf("Job is %s, no result available", state))
+	}
+	if _, inBucket := bucketKey(output); !inBucket {
+		if _, err := os.Stat(output); err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Result file not found")
+		}
+	}
+	c.Attachment(job.ID + "-bundle.zip")
+	auditJob(c, AuditResultDownloaded, job, map[string]any{"file": job.ID + "-bundle.zip"})
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := writeBundle(w, job, output, downloadName); err != nil {
+			job.logger().Error("can't write the result bundle", "error", err)
+		}
+		w.Flush()
+	})
+	return nil
+}
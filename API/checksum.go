@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// checksums hashes a spool file as it is written
+type checksums struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newChecksums() *checksums {
+	return &checksums{md5: md5.New(), sha256: sha256.New()}
+}
+
+// Writer returns w, also feeding everything written through the hashes
+func (c *checksums) Writer(w io.Writer) io.Writer {
+	return io.MultiWriter(w, c.md5, c.sha256)
+}
+
+func (c *checksums) MD5() string    { return hex.EncodeToString(c.md5.Sum(nil)) }
+func (c *checksums) SHA256() string { return hex.EncodeToString(c.sha256.Sum(nil)) }
+
+// verifyChecksums compares the spooled files against the expected MD5 and
+// SHA-256 values, each a comma-separated list in file order; empty lists skip the check
+func verifyChecksums(files []spooledFile, md5s, sha256s string) error {
+	for _, check := range []struct {
+		algorithm string
+		expected  string
+		actual    func(spooledFile) string
+	}{
+		{"md5", md5s, func(f spooledFile) string { return f.MD5 }},
+		{"sha256", sha256s, func(f spooledFile) string { return f.SHA256 }},
+	} {
+		if check.expected == "" {
+			continue
+		}
+		expected := strings.Split(check.expected, ",")
+		if len(expected) != len(files) {
+			return fmt.Errorf("got %d %s checksums for %d files", len(expected), check.algorithm, len(files))
+		}
+		for i, file := range files {
+			want := strings.ToLower(strings.TrimSpace(expected[i]))
+			if got := check.actual(file); got != want {
+				return fmt.Errorf("%s checksum mismatch for %s: expected %s, got %s; the upload was truncated or corrupted", check.algorithm, file.Filename, want, got)
+			}
+		}
+	}
+	return nil
+}
+
+// expectedChecksums reads the md5 and sha256 fields, falling back to the
+// X-Checksum-MD5 and X-Checksum-SHA256 headers
+func expectedChecksums(header func(key string, defaultValue ...string) string, field formField) (md5s, sha256s string) {
+	return field("md5", header("X-Checksum-MD5")), field("sha256", header("X-Checksum-SHA256"))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Size caps of POST /classify and POST /classify/batch
+const (
+	maxClassifyLength = 4 << 20 // bases in one sequence
+	maxClassifyBatch  = 5000    // sequences in one batch
+)
+
+// classifyRequest is the JSON body of POST /classify. BScore normalizes
+// coverage by the size of the run a read came from; without total_reads and
+// read_length the sequence is scored as a run of its own.
+type classifyRequest struct {
+	ID         string  `json:"id"`
+	Sequence   string  `json:"sequence"`
+	TotalReads int     `json:"total_reads"`
+	ReadLength float64 `json:"read_length"`
+}
+
+// classifyMatch is one sanket found in a classified sequence
+type classifyMatch struct {
+	SID      string  `json:"sid"`
+	Sanket   string  `json:"sanket"`
+	Serotype string  `json:"serotype"`
+	SLen     int     `json:"s_len"`
+	SSRCount string  `json:"ssr_count"`
+	MLenAvg  string  `json:"mlen_avg"`
+	MRCAvg   string  `json:"mrc_avg"`
+	PCount   string  `json:"p_count"`
+	PLenAvg  string  `json:"plen_avg"`
+	BScore   float64 `json:"b_score"`
+}
+
+// classifyResult is the response of POST /classify
+type classifyResult struct {
+	ID            string          `json:"id,omitempty"`
+	Length        int             `json:"length"`
+	GCPercentage  float64         `json:"gc_percentage"`
+	TotalCoverage int             `json:"total_coverage"`
+	BScore        float64         `json:"b_score"`        // best match
+	Call          string          `json:"call,omitempty"` // serotype with the most matches
+	Matches       []classifyMatch `json:"matches"`
+}
+
+// normalizeSequence uppercases seq and drops whitespace, rejecting anything
+// that isn't a nucleotide code
+func normalizeSequence(seq string) (string, error) {
+	seq = strings.Join(strings.Fields(strings.ToUpper(seq)), "")
+	if seq == "" {
+		return "", errors.New("expected a sequence")
+	}
+	if len(seq) > maxClassifyLength {
+		return "", fmt.Errorf("sequence is longer than %d bases", maxClassifyLength)
+	}
+	if i := strings.IndexFunc(seq, func(r rune) bool { return !strings.ContainsRune("ACGTUNRYKMSWBDHV-", r) }); i >= 0 {
+		return "", fmt.Errorf("invalid base %q at position %d", seq[i], i+1)
+	}
+	// Sankets are DNA: read RNA as DNA and drop alignment gaps
+	return strings.NewReplacer("U", "T", "-", "").Replace(seq), nil
+}
+
+// classifySequence scores one sequence against the sankets
+func classifySequence(req classifyRequest, sankets map[string]SanketInfo) (classifyResult, error) {
+	seq, err := normalizeSequence(req.Sequence)
+	if err != nil {
+		return classifyResult{}, err
+	}
+	totalReads, readLength := req.TotalReads, req.ReadLength
+	if totalReads <= 0 {
+		totalReads = 1
+	}
+	if readLength <= 0 {
+		readLength = float64(len(seq))
+	}
+
+	record := processRecord([]byte(seq), req.ID, sankets, readLength, totalReads)
+	result := classifyResult{
+		ID:            req.ID,
+		Length:        len(seq),
+		GCPercentage:  record.GCPercentage,
+		TotalCoverage: record.TotalCoverage,
+		Matches:       make([]classifyMatch, 0, len(record.Matches)),
+	}
+	perSerotype := make(map[string]int)
+	for _, m := range record.Matches {
+		result.Matches = append(result.Matches, classifyMatch{
+			SID:      m.SID,
+			Sanket:   m.Sanket,
+			Serotype: m.Serotype,
+			SLen:     m.SLen,
+			SSRCount: m.SSRCount,
+			MLenAvg:  m.MLenAvg,
+			MRCAvg:   m.MRCAvg,
+			PCount:   m.PCount,
+			PLenAvg:  m.PLenAvg,
+			BScore:   m.BScore,
+		})
+		if m.BScore > result.BScore {
+			result.BScore = m.BScore
+		}
+		perSerotype[m.Serotype]++
+		if n := perSerotype[m.Serotype]; n > perSerotype[result.Call] || (n == perSerotype[result.Call] && m.Serotype < result.Call) {
+			result.Call = m.Serotype
+		}
+	}
+	sort.Slice(result.Matches, func(i, k int) bool {
+		a, b := result.Matches[i], result.Matches[k]
+		if a.BScore != b.BScore {
+			return a.BScore > b.BScore
+		}
+		return a.SID < b.SID
+	})
+	return result, nil
+}
+
+// handleClassify serves POST /classify: one sequence in, its sanket matches,
+// GC% and BScore out, without a job
+func handleClassify(c *fiber.Ctx) error {
+	var req classifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %v", err))
+	}
+	sankets := panelFor(requestWorkspace(c)).Sankets
+	result, err := classifySequence(req, sankets)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	return c.JSON(result)
+}
+
+// handleClassifyBatch serves POST /classify/batch: a JSON array of {id,
+// sequence} objects classified in one go, results in input order. The batch
+// is scored as one run (its size and shortest sequence) unless ?total_reads=
+// and ?read_length= say otherwise.
+func handleClassifyBatch(c *fiber.Ctx) error {
+	var reqs []classifyRequest
+	if err := c.BodyParser(&reqs); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body (expected a JSON array of {id, sequence} objects): %v", err))
+	}
+	if len(reqs) == 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Expected at least one sequence")
+	}
+	if len(reqs) > maxClassifyBatch {
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("Too many sequences (%d, at most %d per batch)", len(reqs), maxClassifyBatch))
+	}
+
+	totalReads := c.QueryInt("total_reads", len(reqs))
+	readLength, err := strconv.ParseFloat(c.Query("read_length", "0"), 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("invalid read_length %q", c.Query("read_length")))
+	}
+	for i := range reqs {
+		seq, err := normalizeSequence(reqs[i].Sequence)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("sequence %d (%s): %v", i+1, reqs[i].ID, err))
+		}
+		if c.Query("read_length") == "" && (readLength == 0 || float64(len(seq)) < readLength) {
+			readLength = float64(len(seq))
+		}
+		reqs[i].Sequence = seq
+	}
+
+	sankets := panelFor(requestWorkspace(c)).Sankets
+	results := make([]classifyResult, len(reqs))
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < availableCPUs(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				req := reqs[i]
+				req.TotalReads, req.ReadLength = totalReads, readLength
+				results[i], _ = classifySequence(req, sankets) // already validated
+			}
+		}()
+	}
+	for i := range reqs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return c.JSON(results)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// sniffSize is how much of a file is inspected before it is spooled
+const sniffSize = 64 << 10
+
+// contentError rejects a file that isn't FASTQ or FASTA
+type contentError struct {
+	Filename string
+	Problem  string
+}
+
+func (e *contentError) Error() string {
+	return fmt.Sprintf("%s %s; expected FASTQ or FASTA, optionally gzipped", e.Filename, e.Problem)
+}
+
+// sniffContent checks the first bytes of r look like FASTQ or FASTA, plain or
+// gzipped, so a wrong file is rejected before it is spooled in full. Archives
+// are let through with their kind (see detectArchive) for the caller to expand.
+// The returned reader yields the whole stream, sniffed bytes included.
+func sniffContent(r io.Reader, filename string) (io.Reader, string, error) {
+	buffered := bufio.NewReaderSize(r, sniffSize)
+	head, err := buffered.Peek(sniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, "", err
+	}
+	if len(head) == 0 {
+		return buffered, "", nil // empty files are counted as zero reads
+	}
+	if kind := detectArchive(head); kind != "" {
+		return buffered, kind, nil
+	}
+	if err := checkContent(head); err != nil {
+		return nil, "", &contentError{Filename: filename, Problem: err.Error()}
+	}
+	return buffered, "", nil
+}
+
+// detectArchive returns the archive kind head starts, or "" for other content
+func detectArchive(head []byte) string {
+	isTar := func(b []byte) bool { return len(b) >= 262 && string(b[257:262]) == "ustar" }
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return archiveZip
+	case isTar(head):
+		return archiveTar
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		if inner, _ := gunzipHead(head); isTar(inner) {
+			return archiveTarGz
+		}
+	}
+	return ""
+}
+
+// checkContent describes what head looks like when it isn't FASTQ or FASTA
+func checkContent(head []byte) error {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return checkGzip(head)
+	case bytes.HasPrefix(head, []byte("BAM\x01")):
+		return errors.New("looks like a BAM file")
+	case bytes.HasPrefix(head, []byte("CRAM")):
+		return errors.New("looks like a CRAM file")
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return errors.New("looks bzip2-compressed")
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return errors.New("looks zstd-compressed")
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return errors.New("looks xz-compressed")
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return errors.New("looks like a zip archive")
+	}
+
+	text := bytes.TrimLeft(head, " \t\r\n")
+	if len(text) == 0 || text[0] == '@' || text[0] == '>' {
+		return nil
+	}
+	line := text
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	switch {
+	case !utf8.Valid(line):
+		return errors.New("looks like a binary file")
+	case bytes.Contains(line, []byte(",")):
+		return fmt.Errorf("looks like CSV (starts with %q)", truncate(line))
+	case bytes.Contains(line, []byte("\t")):
+		return fmt.Errorf("looks like a tab-separated file (starts with %q)", truncate(line))
+	}
+	return fmt.Errorf("starts with %q instead of '@' or '>'", truncate(line))
+}
+
+// checkGzip checks the decompressed start of a gzip stream
+func checkGzip(head []byte) error {
+	inner, err := gunzipHead(head)
+	if len(inner) == 0 {
+		if err != nil {
+			return fmt.Errorf("is not valid gzip: %v", err)
+		}
+		return nil
+	}
+	if bytes.HasPrefix(inner, []byte("BAM\x01")) {
+		return errors.New("looks like a BAM file") // BAM is gzip (BGZF) compressed
+	}
+	if err := checkContent(inner); err != nil {
+		return fmt.Errorf("is gzipped but %v", err)
+	}
+	return nil
+}
+
+// gunzipHead decompresses as much of a truncated gzip stream as it can
+func gunzipHead(head []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(head))
+	if err != nil {
+		return nil, err
+	}
+	inner := make([]byte, sniffSize)
+	n, err := io.ReadFull(zr, inner)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return inner[:n], err
+}
+
+func truncate(line []byte) string {
+	if len(line) > 40 {
+		return string(line[:40]) + "..."
+	}
+	return string(line)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	_ "embed"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// dashboardPage is the web dashboard: an upload form, the job list with
+// progress, per-sample summary charts and download links. It is one
+// self-contained page calling the same API as every other client, so it works
+// offline and needs no separate deployment.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// serveDashboard adds the dashboard at /ui, and sends browsers opening the
+// server's root there
+func serveDashboard(router fiber.Router) {
+	router.Get("/ui", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return c.Send(dashboardPage)
+	})
+	router.Get("/", func(c *fiber.Ctx) error {
+		return c.Redirect("ui")
+	})
+}
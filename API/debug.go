@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+)
+
+// mountPprof serves the net/http/pprof profiles under /debug/pprof/. They
+// reveal internals, so with -admin-key set only the admin key may fetch them.
+func mountPprof(app *fiber.App) {
+	prefix := apiPrefix + "/debug/pprof" // negotiateVersion has added the version
+	app.Use(prefix, func(c *fiber.Ctx) error {
+		if adminKey != "" && !isAdmin(requestSecret(c)) {
+			return c.Status(fiber.StatusForbidden).SendString("Admin key required")
+		}
+		return c.Next()
+	})
+	app.Use(pprof.New(pprof.Config{Prefix: apiPrefix}))
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/graphql-go/graphql"
+)
+
+// graphqlSchema answers POST /graphql with the jobs this instance knows,
+// their sample metadata and classification summaries, so dashboards can ask
+// e.g. for serotype proportions across this week's samples without
+// downloading result files
+var graphqlSchema graphql.Schema
+
+// resolve builds a field reading its value from a source of type T
+func resolve[T any](t graphql.Output, description string, get func(T) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type:        t,
+		Description: description,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(T)), nil
+		},
+	}
+}
+
+// timeOrNil keeps unset times null instead of the zero time
+func timeOrNil(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+// intOrNil maps an unset count to null
+func intOrNil(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// serotypeRow is a serotype's counts within a set of matched reads
+type serotypeRow struct {
+	SerotypeSummary
+	matchedReads int64
+}
+
+func serotypeRows(summary Summary) []serotypeRow {
+	rows := make([]serotypeRow, len(summary.Serotypes))
+	for i, s := range summary.Serotypes {
+		rows[i] = serotypeRow{s, summary.MatchedReads}
+	}
+	return rows
+}
+
+// serotypeTotals is the merged summary of the jobs a query selected
+type serotypeTotals struct {
+	jobs    int
+	summary Summary
+}
+
+// mergeSummaries adds up summaries as if their reads came from one job
+func mergeSummaries(summaries []Summary) Summary {
+	tally := newSummaryTally()
+	for _, s := range summaries {
+		tally.reads += s.ReadsProcessed
+		tally.matched += s.MatchedReads
+		for _, serotype := range s.Serotypes {
+			t, ok := tally.serotypes[serotype.Serotype]
+			if !ok {
+				t = &serotypeTally{}
+				tally.serotypes[serotype.Serotype] = t
+			}
+			t.reads += serotype.Reads
+			t.matches += serotype.Matches
+			t.bscoreTotal += serotype.MeanBScore * float64(serotype.Matches)
+		}
+	}
+	return tally.Summary()
+}
+
+// jobFilterArgs are the arguments jobs and serotypeTotals select jobs by
+var jobFilterArgs = graphql.FieldConfigArgument{
+	"state":           {Type: graphql.String, Description: "queued, running, done, failed or canceled"},
+	"sample":          {Type: graphql.String, Description: "Sample name, case-insensitive"},
+	"location":        {Type: graphql.String, Description: "Collection location, case-insensitive"},
+	"tags":            {Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Description: "Tags that must all be present"},
+	"collectedFrom":   {Type: graphql.String, Description: "Earliest collection date, YYYY-MM-DD"},
+	"collectedTo":     {Type: graphql.String, Description: "Latest collection date, YYYY-MM-DD"},
+	"submittedAfter":  {Type: graphql.String, Description: "Earliest submission, YYYY-MM-DD or RFC 3339"},
+	"submittedBefore": {Type: graphql.String, Description: "Latest submission (exclusive), YYYY-MM-DD or RFC 3339"},
+	"limit":           {Type: graphql.Int, Description: "Most jobs to select, newest first; 0 for all"},
+}
+
+// parseSubmitted reads a submittedAfter/submittedBefore argument
+func parseSubmitted(args map[string]interface{}, name string) (time.Time, error) {
+	value, _ := args[name].(string)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(collectionDateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q (expected YYYY-MM-DD or RFC 3339)", name, value)
+	}
+	return t, nil
+}
+
+// selectJobs returns the jobs matching jobFilterArgs, newest first
+func selectJobs(scope workspaceScope, args map[string]interface{}, defaultLimit int) ([]*Job, error) {
+	str := func(name string) string {
+		value, _ := args[name].(string)
+		return value
+	}
+	filter := sampleFilter{
+		name:     str("sample"),
+		location: str("location"),
+		from:     str("collectedFrom"),
+		to:       str("collectedTo"),
+	}
+	if tags, ok := args["tags"].([]interface{}); ok {
+		for _, tag := range tags {
+			filter.tags = append(filter.tags, tag.(string))
+		}
+	}
+	for _, date := range []string{filter.from, filter.to} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(collectionDateLayout, date); err != nil {
+			return nil, fmt.Errorf("invalid date %q (expected YYYY-MM-DD)", date)
+		}
+	}
+	after, err := parseSubmitted(args, "submittedAfter")
+	if err != nil {
+		return nil, err
+	}
+	before, err := parseSubmitted(args, "submittedBefore")
+	if err != nil {
+		return nil, err
+	}
+	limit := defaultLimit
+	if value, ok := args["limit"].(int); ok {
+		limit = value
+	}
+
+	var selected []*Job
+	for _, job := range jobs.List(str("state")) {
+		if limit > 0 && len(selected) == limit {
+			break
+		}
+		created := job.Status().CreatedAt
+		if (!after.IsZero() && created.Before(after)) || (!before.IsZero() && !created.Before(before)) {
+			continue
+		}
+		if scope.sees(job) && filter.match(job.Params.Sample) {
+			selected = append(selected, job)
+		}
+	}
+	return selected, nil
+}
+
+func init() {
+	sampleType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Sample",
+		Fields: graphql.Fields{
+			"name":           resolve(graphql.String, "", func(s *SampleMetadata) interface{} { return s.Name }),
+			"collectionDate": resolve(graphql.String, "YYYY-MM-DD", func(s *SampleMetadata) interface{} { return s.CollectionDate }),
+			"location":       resolve(graphql.String, "", func(s *SampleMetadata) interface{} { return s.Location }),
+			"tags":           resolve(graphql.NewList(graphql.String), "", func(s *SampleMetadata) interface{} { return s.Tags }),
+		},
+	})
+
+	serotypeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "SerotypeCount",
+		Fields: graphql.Fields{
+			"serotype":   resolve(graphql.String, "", func(s serotypeRow) interface{} { return s.Serotype }),
+			"reads":      resolve(graphql.Int, "Reads with at least one sanket of this serotype", func(s serotypeRow) interface{} { return s.Reads }),
+			"matches":    resolve(graphql.Int, "Sanket hits; a read can hit several", func(s serotypeRow) interface{} { return s.Matches }),
+			"meanBScore": resolve(graphql.Float, "", func(s serotypeRow) interface{} { return s.MeanBScore }),
+			"proportion": resolve(graphql.Float, "Share of the matched reads that hit this serotype", func(s serotypeRow) interface{} {
+				if s.matchedReads == 0 {
+					return 0.0
+				}
+				return float64(s.Reads) / float64(s.matchedReads)
+			}),
+		},
+	})
+
+	summaryFields := func(get func(interface{}) Summary) graphql.Fields {
+		field := func(t graphql.Output, description string, value func(Summary) interface{}) *graphql.Field {
+			return &graphql.Field{
+				Type:        t,
+				Description: description,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return value(get(p.Source)), nil
+				},
+			}
+		}
+		return graphql.Fields{
+			"readsProcessed": field(graphql.Int, "", func(s Summary) interface{} { return s.ReadsProcessed }),
+			"matchedReads":   field(graphql.Int, "", func(s Summary) interface{} { return s.MatchedReads }),
+			"matchRate":      field(graphql.Float, "", func(s Summary) interface{} { return s.MatchRate }),
+			"call":           field(graphql.String, "Serotype hit by the most reads", func(s Summary) interface{} { return s.Call }),
+			"serotypes":      field(graphql.NewList(serotypeType), "Ordered by read count", func(s Summary) interface{} { return serotypeRows(s) }),
+		}
+	}
+
+	summaryType := graphql.NewObject(graphql.ObjectConfig{
+		Name:   "Summary",
+		Fields: summaryFields(func(source interface{}) Summary { return source.(Summary) }),
+	})
+
+	totalsFields := summaryFields(func(source interface{}) Summary { return source.(serotypeTotals).summary })
+	totalsFields["jobs"] = resolve(graphql.Int, "Jobs added up", func(t serotypeTotals) interface{} { return t.jobs })
+	totalsType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SerotypeTotals",
+		Description: "The summaries of the selected jobs added up",
+		Fields:      totalsFields,
+	})
+
+	jobType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Job",
+		Fields: graphql.Fields{
+			"id":              resolve(graphql.ID, "", func(j *Job) interface{} { return j.ID }),
+			"state":           resolve(graphql.String, "", func(j *Job) interface{} { return j.Status().State }),
+			"error":           resolve(graphql.String, "", func(j *Job) interface{} { return j.Status().Error }),
+			"filename":        resolve(graphql.String, "", func(j *Job) interface{} { return j.Params.Filename }),
+			"files":           resolve(graphql.NewList(graphql.String), "", func(j *Job) interface{} { return j.Params.Files }),
+			"format":          resolve(graphql.String, "", func(j *Job) interface{} { return j.Params.Format }),
+			"user":            resolve(graphql.String, "", func(j *Job) interface{} { return j.Params.User }),
+			"workspace":       resolve(graphql.String, "Empty for the default workspace", func(j *Job) interface{} { return j.Params.Workspace }),
+			"priority":        resolve(graphql.Int, "", func(j *Job) interface{} { return j.Params.Priority }),
+			"archive":         resolve(graphql.String, "The uploaded archive the files came from", func(j *Job) interface{} { return j.Params.Archive }),
+			"sample":          resolve(sampleType, "", func(j *Job) interface{} { return j.Params.Sample }),
+			"readsProcessed":  resolve(graphql.Int, "", func(j *Job) interface{} { return j.Status().ReadsProcessed }),
+			"totalReads":      resolve(graphql.Int, "", func(j *Job) interface{} { return j.Status().TotalReads }),
+			"percentComplete": resolve(graphql.Float, "", func(j *Job) interface{} { return j.Status().PercentComplete }),
+			"queuePosition":   resolve(graphql.Int, "Place in line while queued, 1 being next", func(j *Job) interface{} { return intOrNil(j.Status().QueuePosition) }),
+			"createdAt":       resolve(graphql.DateTime, "", func(j *Job) interface{} { return j.Status().CreatedAt }),
+			"startedAt":       resolve(graphql.DateTime, "", func(j *Job) interface{} { return timeOrNil(j.Status().StartedAt) }),
+			"finishedAt":      resolve(graphql.DateTime, "", func(j *Job) interface{} { return timeOrNil(j.Status().FinishedAt) }),
+			"result":          resolve(graphql.String, "Download path once done", func(j *Job) interface{} { return j.Status().Result }),
+			"summary":         resolve(summaryType, "", func(j *Job) interface{} { return j.Summary() }),
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"job": &graphql.Field{
+				Type: jobType,
+				Args: graphql.FieldConfigArgument{
+					"id": {Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					job, ok := jobs.Get(p.Args["id"].(string))
+					if !ok || !contextScope(p.Context).sees(job) {
+						return nil, nil
+					}
+					return job, nil
+				},
+			},
+			"jobs": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(jobType))),
+				Description: "Jobs, newest first; limit defaults to 100",
+				Args:        jobFilterArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return selectJobs(contextScope(p.Context), p.Args, 100)
+				},
+			},
+			"serotypeTotals": &graphql.Field{
+				Type:        graphql.NewNonNull(totalsType),
+				Description: "The summaries of the selected jobs added up; limit defaults to all",
+				Args:        jobFilterArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					selected, err := selectJobs(contextScope(p.Context), p.Args, 0)
+					if err != nil {
+						return nil, err
+					}
+					summaries := make([]Summary, len(selected))
+					for i, job := range selected {
+						summaries[i] = job.Summary()
+					}
+					return serotypeTotals{jobs: len(selected), summary: mergeSummaries(summaries)}, nil
+				},
+			},
+		},
+	})
+
+	var err error
+	graphqlSchema, err = graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		panic(fmt.Sprintf("invalid GraphQL schema: %v", err))
+	}
+}
+
+// handleGraphQL serves GET and POST /graphql
+func handleGraphQL(c *fiber.Ctx) error {
+	var req struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if c.Method() == fiber.MethodPost {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %v", err))
+		}
+	} else {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+	}
+	if req.Query == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Expected a query")
+	}
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  req.Query,
+		OperationName:  req.OperationName,
+		VariableValues: req.Variables,
+		Context:        withScope(c.UserContext(), requestScope(c)),
+	})
+	return c.JSON(result)
+}
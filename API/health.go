@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// healthTimeout bounds each readiness check so a hung dependency fails the
+// probe instead of stalling it
+const healthTimeout = 2 * time.Second
+
+// healthCheck returns nil when one dependency is usable
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthReport is the JSON body of /healthz and /readyz
+type healthReport struct {
+	Status string            `json:"status"` // ok or fail
+	Checks map[string]string `json:"checks"` // "ok" or what failed
+}
+
+// checkSankets checks a sanket panel is loaded for jobs to classify against
+func checkSankets(context.Context) error {
+	if panel := activePanel(); panel == nil || len(panel.Sankets) == 0 {
+		return fmt.Errorf("no sanket panel loaded")
+	}
+	return nil
+}
+
+// checkWritable creates and removes a file in dir
+func checkWritable(dir string) func(context.Context) error {
+	return func(context.Context) error {
+		file, err := os.CreateTemp(dir, "healthz-*.tmp")
+		if err != nil {
+			return err
+		}
+		file.Close()
+		return os.Remove(file.Name())
+	}
+}
+
+// checkScheduler fails when the scheduler can't admit jobs, e.g. deadlocked
+func checkScheduler(ctx context.Context) error {
+	responded := make(chan struct{})
+	go func() {
+		scheduler.mu.Lock()
+		scheduler.mu.Unlock()
+		close(responded)
+	}()
+	select {
+	case <-responded:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("scheduler not responding")
+	}
+}
+
+// checkStore pings the job database
+func checkStore(ctx context.Context) error {
+	return jobs.store.db.PingContext(ctx)
+}
+
+// checkQueue pings Redis and checks every queue worker is still running
+func checkQueue(ctx context.Context) error {
+	if err := queue.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("can't reach Redis: %w", err)
+	}
+	if alive := int(queue.alive.Load()); alive < queue.workers {
+		return fmt.Errorf("%d of %d queue workers running", alive, queue.workers)
+	}
+	return nil
+}
+
+// readinessChecks are the dependencies /readyz checks on this instance
+func readinessChecks() []healthCheck {
+	checks := []healthCheck{
+		{"sankets", checkSankets},
+		{"spool_dir", checkWritable(spoolDir)},
+		{"output_dir", checkWritable(outputDir)},
+		{"scheduler", checkScheduler},
+		{"accepting_jobs", checkAcceptingJobs},
+	}
+	if jobs.store != nil {
+		checks = append(checks, healthCheck{"database", checkStore})
+	}
+	if queue != nil {
+		checks = append(checks, healthCheck{"queue", checkQueue})
+	}
+	return checks
+}
+
+// runHealthChecks runs checks concurrently and answers 200 if all pass, 503 otherwise
+func runHealthChecks(c *fiber.Ctx, checks []healthCheck) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), healthTimeout)
+	defer cancel()
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for _, check := range checks {
+		go func(check healthCheck) {
+			results <- result{check.name, check.check(ctx)}
+		}(check)
+	}
+	report := healthReport{Status: "ok", Checks: make(map[string]string, len(checks))}
+	for _, check := range checks {
+		report.Checks[check.name] = "timed out"
+	}
+wait:
+	for range checks {
+		select {
+		case r := <-results:
+			report.Checks[r.name] = "ok"
+			if r.err != nil {
+				report.Checks[r.name] = r.err.Error()
+			}
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	for _, status := range report.Checks {
+		if status != "ok" {
+			report.Status = "fail"
+		}
+	}
+	if report.Status != "ok" {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(report)
+	}
+	return c.JSON(report)
+}
+
+// handleLiveness serves GET /healthz: the process is up and its scheduler
+// responsive. Restarting helps only when this fails, so it leaves out the
+// dependencies /readyz checks.
+func handleLiveness(c *fiber.Ctx) error {
+	return runHealthChecks(c, []healthCheck{{"scheduler", checkScheduler}})
+}
+
+// handleReadiness serves GET /readyz: the instance can take uploads
+func handleReadiness(c *fiber.Ctx) error {
+	return runHealthChecks(c, readinessChecks())
+}
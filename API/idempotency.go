@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxIdempotencyKeyLength caps the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// errKeyInFlight is returned by Claim while the first request with a key is still being received
+var errKeyInFlight = errors.New("a request with this Idempotency-Key is still in progress")
+
+// idempotencyID is what the registry tracks an idempotency key by. Keys are
+// picked by clients, so each workspace has its own.
+func idempotencyID(workspace, key string) string {
+	if key == "" || workspace == "" {
+		return key
+	}
+	return workspace + "/" + key
+}
+
+func (j *Job) idempotencyID() string {
+	return idempotencyID(j.Params.Workspace, j.Params.IdempotencyKey)
+}
+
+// Claim reserves an idempotency key of a workspace for a job about to be
+// submitted. If a job was already created with the key it is returned
+// instead, and the caller should answer with it rather than starting a duplicate.
+func (r *JobRegistry) Claim(workspace, key string) (*Job, error) {
+	key = idempotencyID(workspace, key)
+	r.mu.Lock()
+	id, taken := r.keys[key]
+	if !taken {
+		r.keys[key] = "" // pending until the job is created
+		r.mu.Unlock()
+		return nil, nil
+	}
+	r.mu.Unlock()
+	if id == "" {
+		return nil, errKeyInFlight
+	}
+	if job, ok := r.Get(id); ok {
+		return job, nil
+	}
+	// The job is gone, so the key is free again
+	r.mu.Lock()
+	r.keys[key] = ""
+	r.mu.Unlock()
+	return nil, nil
+}
+
+// Release frees a key claimed by a request that ended without creating a job
+func (r *JobRegistry) Release(workspace, key string) {
+	if key == "" {
+		return
+	}
+	key = idempotencyID(workspace, key)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keys[key] == "" {
+		delete(r.keys, key)
+	}
+}
+
+// claimIdempotencyKey handles the Idempotency-Key header of a submission. It
+// returns the key to put in the job params, or done=true once it has answered
+// the request itself: with the earlier job for a repeated key, or an error.
+// The caller must Release the key when it returns without creating a job.
+func claimIdempotencyKey(c *fiber.Ctx) (key string, done bool, err error) {
+	key = c.Get("Idempotency-Key")
+	if key == "" {
+		return "", false, nil
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return "", true, c.Status(fiber.StatusBadRequest).SendString("Idempotency-Key is too long")
+	}
+	job, err := jobs.Claim(requestWorkspace(c), key)
+	if err != nil {
+		return "", true, c.Status(fiber.StatusConflict).SendString(err.Error())
+	}
+	if job == nil {
+		return key, false, nil
+	}
+	c.Set("Idempotent-Replayed", "true")
+	if job.Params.Archive != "" {
+		// An archive upload started several jobs under the key
+		var statuses []JobStatus
+		for _, j := range jobs.WithKey(job.Params.Workspace, key) {
+			statuses = append(statuses, j.Status())
+		}
+		return "", true, c.JSON(statuses)
+	}
+	c.Set("X-Job-ID", job.ID)
+	c.Location(jobPath(job.ID))
+	return "", true, c.JSON(job.Status())
+}
+
+// WithKey returns the jobs of a workspace submitted with an idempotency key, oldest first
+func (r *JobRegistry) WithKey(workspace, key string) []*Job {
+	var matched []*Job
+	list := r.List("")
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].Params.Workspace == workspace && list[i].Params.IdempotencyKey == key {
+			matched = append(matched, list[i])
+		}
+	}
+	return matched
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A panel index is written by the CLI's index build command: the panel's sankets already checked, parsed and sorted, so
+// a large panel loads in a fraction of the time its CSV takes. It starts with indexMagic, whose digit is the
+// layout's version, then has little-endian uint32s: the length of the panel's PanelInfo as JSON, which follows;
+// the number of sankets; and per sanket its s_len and the offset and length of each of its text fields
+// (indexFields) in the text that ends the file.
+const (
+	indexPrefix     = "bhedi-index "
+	indexMagic      = indexPrefix + "1\n"
+	indexFieldCount = 8
+)
+
+// indexFields lists the text fields of a sanket in the order an index keeps them
+func indexFields(info *SanketInfo) [indexFieldCount]*string {
+	return [indexFieldCount]*string{&info.SID, &info.Serotype, &info.Sanket, &info.SSRCount, &info.MLenAvg, &info.MRCAvg, &info.PCount, &info.PLenAvg}
+}
+
+// isIndex reports whether the file at path is a panel index, of any version, rather than a CSV
+func isIndex(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	prefix := make([]byte, len(indexPrefix))
+	_, err = io.ReadFull(f, prefix)
+	return err == nil && string(prefix) == indexPrefix
+}
+
+// LoadIndex loads the sankets of a panel index and the fingerprint of the CSV it was built from. Every text
+// field is a slice of one string, so loading allocates little more than the file.
+func LoadIndex(path string) (map[string]SanketInfo, PanelInfo, error) {
+	var info PanelInfo
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, info, fmt.Errorf("error opening panel index: %w", err)
+	}
+	if !bytes.HasPrefix(data, []byte(indexPrefix)) {
+		return nil, info, fmt.Errorf("%s is not a panel index", path)
+	}
+	if !bytes.HasPrefix(data, []byte(indexMagic)) {
+		return nil, info, fmt.Errorf("%s was built by another version of bhedi; rebuild it with bhedi-cli index build", path)
+	}
+	corrupt := fmt.Errorf("%s is a truncated or corrupt panel index; rebuild it with bhedi-cli index build", path)
+	data = data[len(indexMagic):]
+	next := func() (int, bool) {
+		if len(data) < 4 {
+			return 0, false
+		}
+		v := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		return int(v), true
+	}
+
+	n, ok := next()
+	if !ok || n > len(data) || json.Unmarshal(data[:n], &info) != nil {
+		return nil, info, corrupt
+	}
+	data = data[n:]
+	if n, ok = next(); !ok || n > len(data)/(4*(1+2*indexFieldCount)) {
+		return nil, info, corrupt
+	}
+	entries := data[:n*4*(1+2*indexFieldCount)]
+	text := string(data[len(entries):])
+	data = entries
+	sankets := make(map[string]SanketInfo, n)
+	for i := 0; i < n; i++ {
+		var sanket SanketInfo
+		sanket.SLen, _ = next()
+		for _, field := range indexFields(&sanket) {
+			offset, _ := next()
+			length, _ := next()
+			if offset+length > len(text) {
+				return nil, info, corrupt
+			}
+			*field = text[offset : offset+length]
+		}
+		sanket.seq = []byte(sanket.Sanket)
+		sankets[sanket.SID] = sanket
+	}
+	return sankets, info, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// jobLogName is the file in each job directory its log is kept in
+const jobLogName = "job.log"
+
+// jobLogPath is where a job's log is kept; it lives in the job directory, so
+// it is shared between instances with the outputs and expires with them
+func jobLogPath(id string) string {
+	return filepath.Join(outputDir, id, jobLogName)
+}
+
+// jobLogFile appends each write to a job's log. Records are opened, written
+// and closed one at a time, so a job's log needs no file handle kept open and
+// any instance running the job can add to it.
+type jobLogFile string
+
+func (path jobLogFile) Write(p []byte) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(string(path)), 0o755); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(string(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Write(p)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// jobLogHandler sends a job's records both to the server log and to the job's
+// own log, where the user who submitted it can read them
+type jobLogHandler struct {
+	server slog.Handler
+	job    slog.Handler
+}
+
+func newJobLogHandler(id string) jobLogHandler {
+	return jobLogHandler{
+		server: slog.Default().Handler(),
+		job:    slog.NewTextHandler(jobLogFile(jobLogPath(id)), &slog.HandlerOptions{ReplaceAttr: omitJobID}),
+	}
+}
+
+// omitJobID leaves the job ID, the same on every line, out of the job's log
+func omitJobID(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) == 0 && attr.Key == "job_id" {
+		return slog.Attr{}
+	}
+	return attr
+}
+
+func (h jobLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.server.Enabled(ctx, level) || h.job.Enabled(ctx, level)
+}
+
+func (h jobLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	if h.server.Enabled(ctx, record.Level) {
+		errs = append(errs, h.server.Handle(ctx, record.Clone()))
+	}
+	if h.job.Enabled(ctx, record.Level) {
+		errs = append(errs, h.job.Handle(ctx, record))
+	}
+	return errors.Join(errs...)
+}
+
+func (h jobLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return jobLogHandler{server: h.server.WithAttrs(attrs), job: h.job.WithAttrs(attrs)}
+}
+
+func (h jobLogHandler) WithGroup(name string) slog.Handler {
+	return jobLogHandler{server: h.server.WithGroup(name), job: h.job.WithGroup(name)}
+}
+
+// handleJobLogs serves GET /jobs/:id/logs: what the job logged, such as
+// timings, skipped reads and the error it failed with, as text
+func handleJobLogs(c *fiber.Ctx) error {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	log, err := os.ReadFile(jobLogPath(job.ID))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return c.Status(fiber.StatusInternalServerError).SendString("Can't read the job log")
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.Send(log)
+}
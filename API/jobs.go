@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bhedi/output"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Job states reported by GET /jobs/:id
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// JobParams records what a job was asked to do
+type JobParams struct {
+	Filename          string          `json:"filename"`
+	Files             []string        `json:"files,omitempty"` // every uploaded file, when there are several
+	Mode              string          `json:"mode,omitempty"`  // sample or batch, when there are several files
+	Format            string          `json:"format"`
+	Schema            string          `json:"schema"`
+	Columns           []string        `json:"columns,omitempty"`
+	Compression       string          `json:"compression,omitempty"`
+	Workers           int             `json:"workers,omitempty"`            // reads classified at once, when lowered for this job
+	WriterParallelism int             `json:"writer_parallelism,omitempty"` // Parquet writer goroutines, when lowered for this job
+	Memory            string          `json:"memory,omitempty"`             // output buffer size, when lowered for this job
+	Timeout           string          `json:"timeout,omitempty"`            // longest the job may run, when set for this job
+	CallbackURL       string          `json:"callback_url,omitempty"`       // POSTed the summary when the job finishes
+	PublicURL         string          `json:"public_url,omitempty"`         // base URL of download links sent to the callback
+	APIKey            string          `json:"api_key,omitempty"`            // ID of the key the job was submitted with
+	Subject           string          `json:"subject,omitempty"`            // OIDC user the job was submitted by
+	Client            string          `json:"client,omitempty"`             // who submitted it, for quotas: key:<id>, oidc:<user> or ip:<addr>
+	RequestID         string          `json:"request_id,omitempty"`         // X-Request-ID of the submission
+	Workspace         string          `json:"workspace,omitempty"`          // the workspace the job belongs to, "" for the default
+	User              string          `json:"user"`                         // whose concurrency cap the job counts against
+	Priority          int             `json:"priority"`                     // higher runs first
+	Sample            *SampleMetadata `json:"sample,omitempty"`
+	Archive           string          `json:"archive,omitempty"` // the uploaded archive the files came from
+	// IdempotencyKey is the client's Idempotency-Key; resubmitting it returns this job
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// Job tracks one upload from spooling through classification
+type Job struct {
+	ID     string
+	Params JobParams
+
+	ctx    context.Context // canceled by DELETE /jobs/:id, or with errShutdown
+	cancel context.CancelCauseFunc
+
+	mu         sync.Mutex
+	state      string
+	err        string
+	totalReads int64
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+
+	output       string // result file on disk, <output-dir>/<id>/output.<ext>, served by GET /jobs/:id/result
+	downloadName string
+	tally        *summaryTally
+	summary      *Summary // summary of a job that isn't running in this process
+
+	store *jobStore   // nil when jobs aren't persisted
+	queue *redisQueue // nil unless jobs are shared through Redis
+
+	processed atomic.Int64 // advanced alongside the progress bar
+}
+
+// JobStatus is the JSON view of a job
+type JobStatus struct {
+	ID              string     `json:"id"`
+	State           string     `json:"state"`
+	Params          JobParams  `json:"params"`
+	ReadsProcessed  int64      `json:"reads_processed"`
+	TotalReads      int64      `json:"total_reads"`
+	PercentComplete float64    `json:"percent_complete"`
+	QueuePosition   int        `json:"queue_position,omitempty"` // place in line while queued, 1 being next
+	Error           string     `json:"error,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	Result          string     `json:"result,omitempty"` // download path once done
+}
+
+// Start moves the job to running once the total read count is known
+func (j *Job) Start(totalReads int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state = JobRunning
+	j.totalReads = int64(totalReads)
+	j.startedAt = time.Now()
+	j.persist()
+	j.logger().Info("job started", "files", max(len(j.Params.Files), 1), "total_reads", totalReads, "queued_for", j.startedAt.Sub(j.createdAt).Round(time.Millisecond))
+}
+
+// jobTimeout is the longest a job may run once started, -job-timeout; 0 for no limit
+var jobTimeout time.Duration
+
+// errJobTimeout fails jobs that run past their time limit
+var errJobTimeout = errors.New("job timed out")
+
+// TimeLimit returns how long the job may run: its own timeout, or the server's
+func (j *Job) TimeLimit() time.Duration {
+	if limit, err := time.ParseDuration(j.Params.Timeout); err == nil {
+		return limit
+	}
+	return jobTimeout
+}
+
+// SetOutput records where the job writes its result and the file name clients download it as
+func (j *Job) SetOutput(path, downloadName string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.output = path
+	j.downloadName = downloadName
+	j.persist()
+}
+
+// Output returns the path of the job's result file
+func (j *Job) Output() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.output
+}
+
+// DownloadName returns the file name clients download the result as
+func (j *Job) DownloadName() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.downloadName
+}
+
+// Record counts one more processed read towards progress and the summary
+func (j *Job) Record(result output.Result) {
+	j.mu.Lock()
+	j.tally.Add(result)
+	j.mu.Unlock()
+	j.processed.Add(1)
+}
+
+// Summary returns the classification summary so far
+func (j *Job) Summary() Summary {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	summary := j.tally.Summary()
+	if j.summary != nil {
+		summary = *j.summary
+	}
+	summary.JobID = j.ID
+	summary.State = j.state
+	summary.Sample = j.Params.Sample
+	return summary
+}
+
+// Context is canceled when the job is canceled
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// Cancel asks the workers to stop; it reports false if the job already finished
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.finished() {
+		return false
+	}
+	j.cancel(nil)
+	if j.queue != nil {
+		// The job may be running on another instance
+		if err := j.queue.RequestCancel(j.ID); err != nil {
+			j.logger().Error("can't request cancellation", "error", err)
+		}
+	}
+	return true
+}
+
+// finished reports whether the job reached a final state; callers hold j.mu
+func (j *Job) finished() bool {
+	return finalState(j.state)
+}
+
+// Finish marks the job done, canceled, or failed when err is non-nil
+func (j *Job) Finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.persist()
+	defer j.logFinish()
+	j.finishedAt = time.Now()
+	if errors.Is(err, context.Canceled) && errors.Is(context.Cause(j.ctx), errShutdown) {
+		err = errShutdown // aborted, not canceled by the client
+	}
+	j.cancel(nil) // release the context's resources
+	if j.Params.CallbackURL != "" {
+		go notifyCallback(j) // runs once Finish releases j.mu
+	}
+	if len(notifiers) > 0 {
+		go notifyChannels(j)
+	}
+	if errors.Is(err, context.Canceled) {
+		j.state = JobCanceled
+		return
+	}
+	if err != nil {
+		j.state = JobFailed
+		j.err = err.Error()
+		return
+	}
+	j.state = JobDone
+}
+
+// logFinish logs how a job ended; callers hold j.mu
+func (j *Job) logFinish() {
+	args := []any{"state", j.state, "reads_processed", j.processed.Load(), "total_reads", j.totalReads}
+	if !j.startedAt.IsZero() {
+		args = append(args, "duration", j.finishedAt.Sub(j.startedAt).Round(time.Millisecond))
+	}
+	if j.state == JobFailed {
+		j.logger().Error("job failed", append(args, "error", j.err)...)
+		return
+	}
+	if j.state == JobDone {
+		args = append(args, "output", j.output)
+	}
+	j.logger().Info("job finished", args...)
+}
+
+// logger returns a logger carrying the job's ID and sample name,
+// and writing to the job's own log as well as the server's
+func (j *Job) logger() *slog.Logger {
+	logger := slog.New(newJobLogHandler(j.ID)).With("job_id", j.ID)
+	if j.Params.RequestID != "" {
+		logger = logger.With("request_id", j.Params.RequestID)
+	}
+	if j.Params.Sample != nil && j.Params.Sample.Name != "" {
+		logger = logger.With("sample", j.Params.Sample.Name)
+	}
+	return logger
+}
+
+// Status returns a snapshot of the job for the API
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := JobStatus{
+		ID:             j.ID,
+		State:          j.state,
+		Params:         j.Params,
+		ReadsProcessed: j.processed.Load(),
+		TotalReads:     j.totalReads,
+		Error:          j.err,
+		CreatedAt:      j.createdAt,
+	}
+	if j.state == JobQueued {
+		status.QueuePosition, _ = scheduler.Position(j.ID)
+	}
+	if j.totalReads > 0 {
+		status.PercentComplete = float64(status.ReadsProcessed) / float64(j.totalReads) * 100
+	}
+	if j.state == JobDone {
+		status.PercentComplete = 100
+		status.Result = jobPath(j.ID) + "/result"
+	}
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		status.StartedAt = &startedAt
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+	return status
+}
+
+// persist saves the job to the store and the shared queue; callers hold j.mu
+func (j *Job) persist() {
+	record := j.record()
+	if j.store != nil {
+		if err := j.store.Save(record); err != nil {
+			j.logger().Error("can't save the job", "error", err)
+		}
+	}
+	j.publish(record)
+}
+
+// publish shares a job record with the other instances, if any
+func (j *Job) publish(record jobRecord) {
+	if j.queue == nil {
+		return
+	}
+	if err := j.queue.SaveRecord(record); err != nil {
+		j.logger().Error("can't publish the job", "error", err)
+	}
+}
+
+// record snapshots the job for persistence; callers hold j.mu
+func (j *Job) record() jobRecord {
+	summary := j.tally.Summary()
+	if j.summary != nil {
+		summary = *j.summary
+	}
+	return jobRecord{
+		ID:             j.ID,
+		State:          j.state,
+		Error:          j.err,
+		Params:         j.Params,
+		Output:         j.output,
+		DownloadName:   j.downloadName,
+		ReadsProcessed: j.processed.Load(),
+		TotalReads:     j.totalReads,
+		CreatedAt:      j.createdAt,
+		StartedAt:      j.startedAt,
+		FinishedAt:     j.finishedAt,
+		Summary:        &summary,
+	}
+}
+
+// JobRegistry holds the jobs known to this server
+type JobRegistry struct {
+	mu    sync.RWMutex
+	jobs  map[string]*Job
+	keys  map[string]string // idempotency key -> job ID, "" while being claimed
+	store *jobStore
+	queue *redisQueue
+
+	aborted error // set by Abort; jobs created afterwards are canceled with it
+}
+
+var jobs = &JobRegistry{jobs: make(map[string]*Job), keys: make(map[string]string)}
+
+// newJobID returns a random 128-bit hex identifier
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// UseStore persists jobs to store from now on and loads its history. Jobs that
+// were still queued or running when the server stopped are marked failed and
+// their partial output removed.
+func (r *JobRegistry) UseStore(store *jobStore) error {
+	records, err := store.Load()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store = store
+	for _, record := range records {
+		job := jobFromRecord(record)
+		job.store = store
+		if !finalState(job.state) {
+			job.state = JobFailed
+			job.err = "interrupted by a server restart"
+			removeOutput(job.ID, job.output) // partial output
+			job.finishedAt = time.Now()
+			job.persist()
+		}
+		r.jobs[job.ID] = job
+		if key := job.idempotencyID(); key != "" && r.keys[key] == "" {
+			r.keys[key] = job.ID
+		}
+	}
+	return nil
+}
+
+// jobFromRecord rebuilds a job that isn't running in this process
+func jobFromRecord(record jobRecord) *Job {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(nil)
+	job := &Job{
+		ID:           record.ID,
+		Params:       record.Params,
+		ctx:          ctx,
+		cancel:       cancel,
+		state:        record.State,
+		err:          record.Error,
+		totalReads:   record.TotalReads,
+		createdAt:    record.CreatedAt,
+		startedAt:    record.StartedAt,
+		finishedAt:   record.FinishedAt,
+		output:       record.Output,
+		downloadName: record.DownloadName,
+		tally:        newSummaryTally(),
+		summary:      record.Summary,
+	}
+	job.processed.Store(record.ReadsProcessed)
+	return job
+}
+
+// UseQueue shares job records through queue from now on
+func (r *JobRegistry) UseQueue(queue *redisQueue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue = queue
+}
+
+// Create registers a new queued job
+func (r *JobRegistry) Create(params JobParams) *Job {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	job := &Job{ID: newJobID(), Params: params, ctx: ctx, cancel: cancel, state: JobQueued, createdAt: time.Now(), tally: newSummaryTally()}
+	r.add(job)
+	return job
+}
+
+// Adopt registers a job picked off the shared queue so this instance can run it
+func (r *JobRegistry) Adopt(task jobTask) *Job {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	job := &Job{
+		ID:           task.ID,
+		Params:       task.Params,
+		ctx:          ctx,
+		cancel:       cancel,
+		state:        JobQueued,
+		createdAt:    task.CreatedAt,
+		output:       task.Output,
+		downloadName: task.DownloadName,
+		tally:        newSummaryTally(),
+	}
+	r.add(job)
+	return job
+}
+
+// add registers and saves a job
+func (r *JobRegistry) add(job *Job) {
+	r.mu.Lock()
+	job.store = r.store
+	job.queue = r.queue
+	r.jobs[job.ID] = job
+	if key := job.idempotencyID(); key != "" && r.keys[key] == "" {
+		r.keys[key] = job.ID // the first of the jobs an archive upload starts
+	}
+	if r.aborted != nil {
+		job.cancel(r.aborted)
+	}
+	r.mu.Unlock()
+	job.mu.Lock()
+	job.persist()
+	job.mu.Unlock()
+}
+
+// InFlight counts the jobs of this instance that haven't finished
+func (r *JobRegistry) InFlight() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := 0
+	for _, job := range r.jobs {
+		job.mu.Lock()
+		if !job.finished() {
+			n++
+		}
+		job.mu.Unlock()
+	}
+	return n
+}
+
+// Abort cancels every unfinished job of this instance, and any created later,
+// with cause; it returns how many it canceled
+func (r *JobRegistry) Abort(cause error) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aborted = cause
+	n := 0
+	for _, job := range r.jobs {
+		job.mu.Lock()
+		if !job.finished() {
+			job.cancel(cause)
+			n++
+		}
+		job.mu.Unlock()
+	}
+	return n
+}
+
+// Handoff forgets a job queued for any instance to run; from then on Get
+// follows it through the shared queue
+func (r *JobRegistry) Handoff(job *Job) {
+	r.mu.Lock()
+	delete(r.jobs, job.ID)
+	r.mu.Unlock()
+	if r.store != nil {
+		if err := r.store.Delete(job.ID); err != nil {
+			job.logger().Error("can't delete the handed off job", "error", err)
+		}
+	}
+}
+
+// List returns the jobs in state (all when empty), newest first
+func (r *JobRegistry) List(state string) []*Job {
+	r.mu.RLock()
+	list := make([]*Job, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		list = append(list, job)
+	}
+	r.mu.RUnlock()
+
+	filtered := list[:0]
+	for _, job := range list {
+		job.mu.Lock()
+		keep := state == "" || job.state == state
+		job.mu.Unlock()
+		if keep {
+			filtered = append(filtered, job)
+		}
+	}
+	sort.Slice(filtered, func(i, k int) bool {
+		return filtered[i].createdAt.After(filtered[k].createdAt)
+	})
+	return filtered
+}
+
+// Get looks up a job by ID, falling back to the shared queue for jobs run elsewhere
+func (r *JobRegistry) Get(id string) (*Job, bool) {
+	r.mu.RLock()
+	job, ok := r.jobs[id]
+	queue := r.queue
+	r.mu.RUnlock()
+	if ok || queue == nil {
+		return job, ok
+	}
+	record, ok, err := queue.LoadRecord(id)
+	if err != nil {
+		slog.Error("can't load the job", "job_id", id, "error", err)
+	}
+	if !ok {
+		return nil, false
+	}
+	job = jobFromRecord(record)
+	job.queue = queue
+	return job, true
+}
+
+// handleJobList serves GET /jobs: the caller's workspace's jobs, optionally
+// filtered by ?state= and sample metadata and capped by ?limit=. The admin
+// key sees every workspace, or one picked with ?workspace=.
+func handleJobList(c *fiber.Ctx) error {
+	filter, err := parseSampleFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	scope := requestScope(c)
+	if workspace, ok := c.Queries()["workspace"]; ok && scope.all {
+		scope = workspaceScope{name: workspace}
+	}
+	limit := c.QueryInt("limit", 100)
+	statuses := make([]JobStatus, 0)
+	for _, job := range jobs.List(c.Query("state")) {
+		if limit > 0 && len(statuses) == limit {
+			break
+		}
+		if scope.sees(job) && filter.match(job.Params.Sample) {
+			statuses = append(statuses, job.Status())
+		}
+	}
+	return c.JSON(statuses)
+}
+
+// handleJobStatus serves GET /jobs/:id
+func handleJobStatus(c *fiber.Ctx) error {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	return c.JSON(job.Status())
+}
+
+// handleJobCancel serves DELETE /jobs/:id
+func handleJobCancel(c *fiber.Ctx) error {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	if !job.Cancel() {
+		return c.Status(fiber.StatusConflict).SendString("Job already finished")
+	}
+	auditJob(c, AuditJobCanceled, job, nil)
+	return c.Status(fiber.StatusAccepted).JSON(job.Status())
+}
+
+// handleJobResult serves GET /jobs/:id/result, the output file of a finished job
+func handleJobResult(c *fiber.Ctx) error {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	job.mu.Lock()
+	state, output, downloadName := job.state, job.output, job.downloadName
+	job.mu.Unlock()
+	if signature := c.Query("signature"); signature != "" {
+		if err := verifyResultSignature(job.ID, c.Query("expires"), signature); err != nil {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+	}
+	if state != JobDone {
+		return c.Status(fiber.StatusConflict).SendString(fmt.Sprintf("Job is %s, no result available", state))
+	}
+	detail := map[string]any{"file": downloadName}
+	if c.Query("signature") != "" {
+		detail["via"] = "signed_link"
+	}
+	auditJob(c, AuditResultDownloaded, job, detail)
+	return sendResult(c, output, downloadName)
+}
+
+// handleJobSummary serves GET /jobs/:id/summary
+func handleJobSummary(c *fiber.Ctx) error {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	return c.JSON(job.Summary())
+}
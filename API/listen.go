@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// listenConfig says where and how the server accepts connections; set with
+// -addr, the -tls-* and -acme-* flags and -redirect-addr
+type listenConfig struct {
+	Addr         string
+	TLSCert      string   // PEM certificate chain file
+	TLSKey       string   // PEM private key file
+	ACMEDomains  []string // hostnames to get Let's Encrypt certificates for, instead of -tls-cert
+	ACMECache    string   // directory keeping issued certificates across restarts
+	ACMEEmail    string   // contact address given to the CA
+	RedirectAddr string   // plain HTTP address redirecting to HTTPS, and answering ACME HTTP-01 challenges
+}
+
+// redirectServer is the plain HTTP listener started for -redirect-addr, closed on shutdown
+var redirectServer *http.Server
+
+// validate rejects flag combinations the server can't serve
+func (cfg *listenConfig) validate() error {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("-tls-cert and -tls-key go together")
+	}
+	if cfg.TLSCert != "" && len(cfg.ACMEDomains) > 0 {
+		return errors.New("use either -tls-cert and -tls-key or -acme-domains, not both")
+	}
+	if cfg.RedirectAddr != "" && !cfg.tls() {
+		return errors.New("-redirect-addr needs TLS: set -tls-cert and -tls-key, or -acme-domains")
+	}
+	return nil
+}
+
+func (cfg *listenConfig) tls() bool {
+	return cfg.TLSCert != "" || len(cfg.ACMEDomains) > 0
+}
+
+// listen opens the server's listener, a TLS one when certificates are configured
+func (cfg *listenConfig) listen() (net.Listener, error) {
+	if !cfg.tls() {
+		return net.Listen("tcp", cfg.Addr)
+	}
+	var tlsConfig *tls.Config
+	var challenges http.Handler // answers HTTP-01 challenges on -redirect-addr
+	if len(cfg.ACMEDomains) > 0 {
+		if err := os.MkdirAll(cfg.ACMECache, 0o700); err != nil {
+			return nil, fmt.Errorf("can't create -acme-cache: %w", err)
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+			Cache:      autocert.DirCache(cfg.ACMECache),
+			Email:      cfg.ACMEEmail,
+		}
+		tlsConfig = manager.TLSConfig() // also answers TLS-ALPN-01 challenges on -addr
+		challenges = manager.HTTPHandler(nil)
+	} else {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't load the TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		_, port, _ := net.SplitHostPort(cfg.Addr)
+		challenges = redirectToHTTPS(port)
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+	ln, err := tls.Listen("tcp", cfg.Addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RedirectAddr != "" {
+		redirectServer = &http.Server{Addr: cfg.RedirectAddr, Handler: challenges, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			slog.Info("redirecting HTTP to HTTPS", "addr", cfg.RedirectAddr)
+			if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("redirect listener stopped", "error", err)
+			}
+		}()
+	}
+	return ln, nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL over HTTPS on port
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// proxyHeaderFor returns the header client addresses are taken from: header
+// when there are trusted proxies to set it, none otherwise
+func proxyHeaderFor(proxies []string, header string) string {
+	if len(proxies) == 0 {
+		return ""
+	}
+	return header
+}
+
+// serve accepts connections until the app shuts down
+func serve(app *fiber.App, cfg *listenConfig) error {
+	ln, err := cfg.listen()
+	if err != nil {
+		return err
+	}
+	slog.Info("listening", "addr", cfg.Addr, "tls", cfg.tls(), "api_version", apiVersion)
+	return app.Listener(ln)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Log formats for -log-format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// setupLogging sends structured logs to stderr as logfmt-style text or JSON
+// lines. Messages from the standard log package go through the same handler.
+func setupLogging(format string) error {
+	var handler slog.Handler
+	switch format {
+	case LogFormatText:
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: durationString})
+	default:
+		return fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// durationString writes durations as e.g. "1.5s" rather than nanoseconds
+func durationString(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.String(a.Key, a.Value.Duration().String())
+	}
+	return a
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestIDHeader carries a request's ID, so one failed request can be found in
+// the server log, its job's log and record from what the client was told
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps the X-Request-ID a client or proxy may pick
+const maxRequestIDLength = 128
+
+// assignRequestID gives each request an ID, keeping the X-Request-ID set by
+// the client or a proxy in front when it is sensible. The ID is echoed in the
+// response header and appended to plain text error messages.
+func assignRequestID(c *fiber.Ctx) error {
+	id := c.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = randomHex(8)
+	}
+	c.Locals("requestID", id)
+	c.Set(requestIDHeader, id)
+	err := c.Next() // errors are already answered by logRequests
+	resp := c.Response()
+	if resp.StatusCode() >= 400 && !resp.IsBodyStream() && strings.HasPrefix(string(resp.Header.ContentType()), fiber.MIMETextPlain) {
+		resp.AppendBodyString(fmt.Sprintf(" (request ID %s)", id))
+	}
+	return err
+}
+
+// validRequestID accepts IDs of printable characters that are safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID assigned to a request
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("requestID").(string)
+	return id
+}
+
+// requestLogger logs on behalf of a request, tagged with its ID
+func requestLogger(c *fiber.Ctx) *slog.Logger {
+	return slog.With("request_id", requestID(c))
+}
+
+// logRequests logs each request once it is answered
+func logRequests(c *fiber.Ctx) error {
+	start := time.Now()
+	method, path := c.Method(), strings.Clone(c.Path()) // the query is left out, it may hold credentials
+	err := c.Next()
+	if err != nil {
+		if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	requestLogger(c).Info("request",
+		"method", method,
+		"path", path,
+		"status", c.Response().StatusCode(),
+		"duration", time.Since(start).Round(time.Microsecond),
+		"ip", c.IP(),
+	)
+	return nil
+}
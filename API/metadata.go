@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is the bhedi release, overridden at build time with
+// -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// commit and buildDate describe the build, set like version with
+// -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=..."
+// or, when left empty, read from the VCS stamp go build embeds, which dates
+// the build by its commit
+var commit, buildDate string
+
+// buildInfo returns the release, commit and build date of the binary.
+// "(modified)" marks a commit built with uncommitted changes; anything
+// unknown is "unknown".
+func buildInfo() (release, revision, date string) {
+	release, revision, date = version, commit, buildDate
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return release, orUnknown(revision), orUnknown(date)
+	}
+	if release == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		release = info.Main.Version // go install bhedi@v1.2.3
+	}
+	var vcsRevision, vcsTime string
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			vcsRevision = setting.Value
+		case "vcs.time":
+			vcsTime = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" && vcsRevision != "" {
+		revision = vcsRevision[:min(len(vcsRevision), 12)]
+		if modified {
+			revision += " (modified)"
+		}
+	}
+	if date == "" {
+		date = vcsTime
+	}
+	return release, orUnknown(revision), orUnknown(date)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// PanelInfo identifies the sanket panel a result was produced with
+type PanelInfo struct {
+	Name     string // file name without extension, e.g. "sanket"
+	Version  string // short checksum, a content-derived revision of the panel
+	Checksum string // SHA-256 of the panel file
+	Sankets  int
+}
+
+// loadPanelInfo fingerprints the panel file at path
+func loadPanelInfo(path string, sankets map[string]SanketInfo) (PanelInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return PanelInfo{}, fmt.Errorf("error opening panel file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return PanelInfo{}, fmt.Errorf("error hashing panel file: %w", err)
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	name := filepath.Base(path)
+	return PanelInfo{
+		Name:     strings.TrimSuffix(name, filepath.Ext(name)),
+		Version:  checksum[:12],
+		Checksum: checksum,
+		Sankets:  len(sankets),
+	}, nil
+}
+
+// resultSchemaVersion is the version of the result files' layout, recorded as
+// bhedi.schema_version. It goes up when a column is renamed, retyped or
+// removed; added columns and metadata keep it.
+const resultSchemaVersion = 1
+
+// runMetadata builds the key-value metadata written into every result file
+// footer, for results of the given schema
+func runMetadata(panel PanelInfo, schema string) map[string]string {
+	params, _ := json.Marshal(scoring)
+	release, revision, date := buildInfo()
+	return map[string]string{
+		"bhedi.version":        release,
+		"bhedi.commit":         revision,
+		"bhedi.build_date":     date,
+		"bhedi.panel.name":     panel.Name,
+		"bhedi.panel.version":  panel.Version,
+		"bhedi.panel.checksum": "sha256:" + panel.Checksum,
+		"bhedi.panel.sankets":  strconv.Itoa(panel.Sankets),
+		"bhedi.scoring":        string(params),
+		"bhedi.schema":         schema,
+		"bhedi.schema_version": strconv.Itoa(resultSchemaVersion),
+		"bhedi.created_at":     time.Now().UTC().Format(time.RFC3339),
+	}
+}
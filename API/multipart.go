@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxFormValueSize caps each non-file form field of an upload
+const maxFormValueSize = 1 << 20
+
+// bodyLimit caps the size of an upload request; set with -body-limit
+var bodyLimit = byteSize(11 << 30) // slightly above 10 GB
+
+// errBodyTooLarge rejects uploads over bodyLimit
+var errBodyTooLarge = errors.New("request body too large")
+
+// byteSize is a flag.Value for sizes such as 500MB or 11GB, in binary units
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+func (s *byteSize) String() string {
+	for _, unit := range sizeUnits {
+		if int64(*s) >= unit.size && int64(*s)%unit.size == 0 {
+			return strconv.FormatInt(int64(*s)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if prefix := unit.suffix[:1]; unit.size > 1 && strings.HasSuffix(v, prefix) {
+			v, multiplier = strings.TrimSuffix(v, prefix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q (expected e.g. 500MB or 11GB)", value)
+	}
+	*s = byteSize(n * float64(multiplier))
+	return nil
+}
+
+// spooledFile is an uploaded file streamed to a spool file
+type spooledFile struct {
+	Filename string
+	Path     string
+	Stat     SpoolStat
+	MD5      string
+	SHA256   string
+}
+
+// streamedUpload is a multipart upload parsed straight off the request body
+type streamedUpload struct {
+	c           *fiber.Ctx
+	Files       []spooledFile // the "file" parts, in request order
+	Archive     *spooledFile  // an uploaded zip or tar(.gz), sent instead of files
+	ArchiveKind string
+	values      map[string]string
+}
+
+// streamUpload reads a multipart/form-data body part by part, copying "file"
+// parts directly into spool files so memory use stays bounded whatever the
+// upload size. The server runs with StreamRequestBody and without multipart
+// pre-parsing, so the body hasn't been read yet.
+func streamUpload(c *fiber.Ctx) (*streamedUpload, error) {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return nil, errors.New("expected a multipart/form-data request")
+	}
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	limited := &limitedBody{r: body, left: int64(bodyLimit)}
+	body = limited
+	client := clientID(c)
+	defer func() { usage.AddUpload(client, int64(bodyLimit)-max(limited.left, 0)) }()
+	if allowance := usage.Allowance(client); allowance >= 0 {
+		if int64(c.Request().Header.ContentLength()) > allowance {
+			return nil, errQuotaExceeded
+		}
+		body = &limitedBody{r: limited, left: allowance, err: errQuotaExceeded}
+	}
+
+	upload := &streamedUpload{c: c, values: make(map[string]string)}
+	reader := multipart.NewReader(body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return upload, nil
+		}
+		if err != nil {
+			upload.Remove()
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		err = upload.read(part)
+		part.Close()
+		if err != nil {
+			upload.Remove()
+			return nil, err
+		}
+	}
+}
+
+// limitBody rejects requests declaring a body over bodyLimit, which fasthttp
+// doesn't check for streamed bodies. Chunked uploads are counted as they are
+// read instead (see streamUpload).
+func limitBody(c *fiber.Ctx) error {
+	if int64(c.Request().Header.ContentLength()) > int64(bodyLimit) {
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("Request rejected: larger than the %v limit", &bodyLimit))
+	}
+	return c.Next()
+}
+
+// limitedBody fails with err (errBodyTooLarge if nil) once more than left bytes are read
+type limitedBody struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, b.exceeded()
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.r.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n, b.exceeded()
+	}
+	return n, err
+}
+
+func (b *limitedBody) exceeded() error {
+	if b.err != nil {
+		return b.err
+	}
+	return errBodyTooLarge
+}
+
+func (u *streamedUpload) read(part *multipart.Part) error {
+	if part.FileName() == "" {
+		value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+		if err != nil {
+			return fmt.Errorf("invalid multipart body: %w", err)
+		}
+		if len(value) > maxFormValueSize {
+			return fmt.Errorf("form field %q is too large", part.FormName())
+		}
+		u.values[part.FormName()] = string(value)
+		return nil
+	}
+	if part.FormName() != "file" {
+		_, err := io.Copy(io.Discard, part)
+		return err
+	}
+
+	content, kind, err := sniffContent(part, part.FileName())
+	if err != nil {
+		return err
+	}
+	if kind != "" || u.Archive != nil {
+		if kind == "" || u.Archive != nil || len(u.Files) > 0 {
+			return errors.New("send either one archive or FASTQ files, not both")
+		}
+		return u.spoolArchive(part.FileName(), kind, content)
+	}
+	tempFile, err := os.CreateTemp(spoolDir, "fastq-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	u.Files = append(u.Files, spooledFile{Filename: part.FileName(), Path: tempFile.Name()})
+	sums := newChecksums()
+	stat, err := spoolCounting(sums.Writer(tempFile), content)
+	file := &u.Files[len(u.Files)-1]
+	file.Stat, file.MD5, file.SHA256 = stat, sums.MD5(), sums.SHA256()
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save the uploaded file %q: %w", part.FileName(), err)
+	}
+	return nil
+}
+
+// spoolArchive saves an uploaded archive as is; it is expanded once its checksum is verified
+func (u *streamedUpload) spoolArchive(filename, kind string, r io.Reader) error {
+	tempFile, err := os.CreateTemp(spoolDir, "archive-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	u.Archive, u.ArchiveKind = &spooledFile{Filename: filename, Path: tempFile.Name()}, kind
+	sums := newChecksums()
+	_, err = io.Copy(sums.Writer(tempFile), r)
+	u.Archive.MD5, u.Archive.SHA256 = sums.MD5(), sums.SHA256()
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save the uploaded archive %q: %w", filename, err)
+	}
+	return nil
+}
+
+// Uploaded returns the files as sent: the archive, or the FASTQ files
+func (u *streamedUpload) Uploaded() []spooledFile {
+	if u.Archive != nil {
+		return []spooledFile{*u.Archive}
+	}
+	return u.Files
+}
+
+// FormValue returns a form field, falling back to the query string and then defaultValue
+func (u *streamedUpload) FormValue(key string, defaultValue ...string) string {
+	if value, ok := u.values[key]; ok {
+		return value
+	}
+	return u.c.Query(key, defaultValue...)
+}
+
+// Spools returns the spool file paths
+func (u *streamedUpload) Spools() []string {
+	spools := make([]string, 0, len(u.Files))
+	for _, file := range u.Files {
+		spools = append(spools, file.Path)
+	}
+	return spools
+}
+
+// Stats returns the read stats of the spool files
+func (u *streamedUpload) Stats() []SpoolStat {
+	stats := make([]SpoolStat, 0, len(u.Files))
+	for _, file := range u.Files {
+		stats = append(stats, file.Stat)
+	}
+	return stats
+}
+
+// Remove deletes the spool files
+func (u *streamedUpload) Remove() {
+	removeSpools(u.Spools())
+	if u.Archive != nil {
+		os.Remove(u.Archive.Path)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// notifier sends lab staff a message about a finished job over one channel
+type notifier interface {
+	channel() string
+	send(subject, text string) error
+}
+
+// notifiers are the channels set up with -slack-webhook and -smtp; empty
+// sends no notifications
+var notifiers []notifier
+
+// notifyStates are the final job states notifications are sent for, set with -notify-on
+var notifyStates = map[string]bool{JobDone: true, JobFailed: true}
+
+// parseNotifyStates reads the comma-separated -notify-on value
+func parseNotifyStates(value string) (map[string]bool, error) {
+	states := make(map[string]bool)
+	for _, state := range splitTags(value) {
+		if !finalState(state) {
+			return nil, fmt.Errorf("unknown job state %q (expected %s, %s or %s)", state, JobDone, JobFailed, JobCanceled)
+		}
+		states[state] = true
+	}
+	return states, nil
+}
+
+// slackNotifier posts to a Slack incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newSlackNotifier(webhookURL string) (*slackNotifier, error) {
+	if err := validateCallbackURL(webhookURL); err != nil {
+		return nil, fmt.Errorf("invalid -slack-webhook: %w", err)
+	}
+	return &slackNotifier{url: webhookURL, client: &http.Client{Timeout: webhookTimeout}}, nil
+}
+
+func (s *slackNotifier) channel() string { return "slack" }
+
+func (s *slackNotifier) send(subject, text string) error {
+	body, err := json.Marshal(map[string]string{"text": "*" + subject + "*\n" + text})
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack returned %s", resp.Status)
+	}
+	return nil
+}
+
+// emailNotifier sends plain text email through an SMTP server, using
+// STARTTLS when the server offers it
+type emailNotifier struct {
+	addr string // host:port
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+func newEmailNotifier(addr, from, to, user, password string) (*emailNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -smtp %q (expected host:port): %w", addr, err)
+	}
+	n := &emailNotifier{addr: addr, from: from, to: splitTags(to)}
+	if n.from == "" || len(n.to) == 0 {
+		return nil, fmt.Errorf("-smtp needs -smtp-from and -notify-email")
+	}
+	if user != "" {
+		n.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return n, nil
+}
+
+func (e *emailNotifier) channel() string { return "email" }
+
+func (e *emailNotifier) send(subject, text string) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(e.addr, e.auth, e.from, e.to, []byte(msg.String()))
+}
+
+// notificationText describes a finished job for lab staff: its sample, the
+// serotype call and where to get the result
+func notificationText(job *Job) (subject, text string) {
+	status := job.Status()
+	summary := job.Summary()
+	sample := status.Params.Filename
+	if status.Params.Sample != nil && status.Params.Sample.Name != "" {
+		sample = status.Params.Sample.Name
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Sample: %s\n", sample)
+	fmt.Fprintf(&b, "Job: %s\n", job.ID)
+	switch status.State {
+	case JobDone:
+		call := summary.Call
+		if call == "" {
+			call = "none"
+		}
+		subject = fmt.Sprintf("bhedi: %s done, serotype call %s", sample, call)
+		fmt.Fprintf(&b, "Serotype call: %s\n", call)
+		fmt.Fprintf(&b, "Matched reads: %d of %d (%.1f%%)\n", summary.MatchedReads, summary.ReadsProcessed, summary.MatchRate*100)
+		for _, s := range summary.Serotypes {
+			fmt.Fprintf(&b, "  serotype %s: %d reads\n", s.Serotype, s.Reads)
+		}
+		if publicURL != "" {
+			fmt.Fprintf(&b, "Result: %s\n", signedResultURL(publicURL, job.ID, time.Now().Add(linkTTL)))
+		}
+	case JobFailed:
+		subject = fmt.Sprintf("bhedi: %s failed", sample)
+		fmt.Fprintf(&b, "Error: %s\n", status.Error)
+	default:
+		subject = fmt.Sprintf("bhedi: %s %s", sample, status.State)
+	}
+	if publicURL != "" {
+		fmt.Fprintf(&b, "Status: %s%s\n", strings.TrimSuffix(publicURL, "/"), jobPath(job.ID))
+	}
+	return subject, b.String()
+}
+
+// notifyChannels tells every configured channel that job finished, retrying
+// each with backoff like webhooks
+func notifyChannels(job *Job) {
+	if !notifyStates[job.Status().State] {
+		return
+	}
+	subject, text := notificationText(job)
+	for _, n := range notifiers {
+		go func(n notifier) {
+			backoff := time.Second
+			for attempt := 1; attempt <= webhookAttempts; attempt++ {
+				err := n.send(subject, text)
+				if err == nil {
+					return
+				}
+				job.logger().Warn("notification failed", "channel", n.channel(), "attempt", attempt, "attempts", webhookAttempts, "error", err)
+				if attempt < webhookAttempts {
+					time.Sleep(backoff)
+					backoff *= 2
+				}
+			}
+		}(n)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// oidcConfig validates bearer tokens issued by an OIDC provider such as
+// Keycloak or Azure AD; set with the -oidc-* flags
+type oidcConfig struct {
+	Issuer         string
+	Audience       string   // expected aud, usually the client ID
+	UserClaim      string   // claim naming the user, falling back to sub
+	GroupClaim     string   // dotted path to a list claim, e.g. realm_access.roles
+	AllowedGroups  []string // when set, users need one of these groups
+	WorkspaceClaim string   // dotted path to a claim naming the user's workspace
+	verifier       *oidc.IDTokenVerifier
+}
+
+// oidcAuth is nil unless -oidc-issuer is set
+var oidcAuth *oidcConfig
+
+// initOIDC discovers the provider's signing keys
+func initOIDC(ctx context.Context, cfg *oidcConfig) error {
+	if cfg.Audience == "" {
+		return fmt.Errorf("-oidc-audience is required with -oidc-issuer")
+	}
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return fmt.Errorf("can't reach OIDC issuer %s: %w", cfg.Issuer, err)
+	}
+	cfg.verifier = provider.Verifier(&oidc.Config{ClientID: cfg.Audience})
+	return nil
+}
+
+// errOIDCForbidden rejects valid tokens of users outside the allowed groups,
+// or without a usable workspace claim
+type errOIDCForbidden struct{ user, reason string }
+
+func (e errOIDCForbidden) Error() string {
+	return fmt.Sprintf("%s %s", e.user, e.reason)
+}
+
+// Verify checks a bearer token's signature, issuer, audience and expiry and
+// returns the user it was issued to and their workspace
+func (cfg *oidcConfig) Verify(ctx context.Context, raw string) (user, workspace string, err error) {
+	token, err := cfg.verifier.Verify(ctx, raw)
+	if err != nil {
+		return "", "", err
+	}
+	var claims map[string]any
+	if err := token.Claims(&claims); err != nil {
+		return "", "", err
+	}
+	user, _ = claims[cfg.UserClaim].(string)
+	if user == "" {
+		user = token.Subject
+	}
+	if len(cfg.AllowedGroups) > 0 && !cfg.inAllowedGroup(claims) {
+		return "", "", errOIDCForbidden{user, "is not in a group allowed to use this server"}
+	}
+	if cfg.WorkspaceClaim != "" {
+		workspace, _ = claimValue(claims, cfg.WorkspaceClaim).(string)
+		if err := validateWorkspace(workspace); err != nil {
+			return "", "", errOIDCForbidden{user, fmt.Sprintf("has no usable %s claim: %v", cfg.WorkspaceClaim, err)}
+		}
+	}
+	return user, workspace, nil
+}
+
+// claimValue looks up a claim by its dotted path
+func claimValue(claims map[string]any, path string) any {
+	var value any = claims
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+func (cfg *oidcConfig) inAllowedGroup(claims map[string]any) bool {
+	groups, _ := claimValue(claims, cfg.GroupClaim).([]any)
+	for _, group := range groups {
+		for _, allowed := range cfg.AllowedGroups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestUser returns the OIDC user a request was made by, if any
+func requestUser(c *fiber.Ctx) string {
+	user, _ := c.Locals("oidcUser").(string)
+	return user
+}
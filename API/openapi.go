@@ -0,0 +1,67 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// openAPISpec describes the HTTP API for generating clients (e.g. with
+// openapi-generator for Python or R); keep it in step with the routes in main
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at the spec
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>bhedi API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// openAPIJSON converts the embedded spec to JSON
+func openAPIJSON() ([]byte, error) {
+	var spec interface{}
+	if err := yaml.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, fmt.Errorf("invalid openapi.yaml: %w", err)
+	}
+	return json.Marshal(spec)
+}
+
+// serveOpenAPI adds GET /openapi.yaml and /openapi.json, plus the Swagger UI
+// at /docs when swaggerUI is set
+func serveOpenAPI(router fiber.Router, swaggerUI bool) error {
+	specJSON, err := openAPIJSON()
+	if err != nil {
+		return err
+	}
+	router.Get("/openapi.yaml", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "application/yaml")
+		return c.Send(openAPISpec)
+	})
+	router.Get("/openapi.json", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(specJSON)
+	})
+	if swaggerUI {
+		router.Get("/docs", func(c *fiber.Ctx) error {
+			c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+			return c.SendString(swaggerUIPage)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"bhedi/output"
+)
+
+// OutputOptions controls the layout of a job's result files, through the output module the CLI writes with too,
+// and how the job runs. Format and schema come from the "format" and "schema" upload fields or -format.
+type OutputOptions struct {
+	output.Options
+	Workers int   // reads classified at once; 0 means one per CPU
+	Memory  int64 // bytes of rows buffered per Parquet row group, or of SQLite page cache; 0 means the library default
+}
+
+// Validate checks that the options name known values
+func (o OutputOptions) Validate() error {
+	if err := o.Options.Validate(); err != nil {
+		return err
+	}
+	if o.Workers < 0 || o.Memory < 0 {
+		return fmt.Errorf("workers and memory must be positive")
+	}
+	return nil
+}
+
+// workers returns how many reads to classify at once
+func (o OutputOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return availableCPUs()
+}
+
+// newOutputWriter creates the result file at path. The job's memory bounds both the Parquet row group and the
+// SQLite page cache, and the Parquet writer encodes on every CPU unless the job asked for fewer.
+func newOutputWriter(path string, opts OutputOptions) (output.Writer, error) {
+	writerOpts := opts.Options
+	writerOpts.RowGroupSize, writerOpts.CacheSize = opts.Memory, opts.Memory
+	if writerOpts.WriterParallelism == 0 {
+		writerOpts.WriterParallelism = availableCPUs()
+	}
+	return output.New(path, writerOpts)
+}
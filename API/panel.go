@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Panel is a validated sanket panel held in memory. Jobs take the current one
+// when they start and keep it to the end, so a reload never changes the panel
+// a running job classifies against.
+type Panel struct {
+	Path      string
+	Workspace string // "" for the default panel
+	Sankets   map[string]SanketInfo
+	Info      PanelInfo
+	LoadedAt  time.Time
+}
+
+// panelStatus is the JSON body of GET /admin/panel and POST /admin/panel/reload
+type panelStatus struct {
+	Workspace string    `json:"workspace,omitempty"`
+	Path      string    `json:"path"`
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Checksum  string    `json:"checksum"`
+	Sankets   int       `json:"sankets"`
+	LoadedAt  time.Time `json:"loaded_at"`
+}
+
+var (
+	currentPanel    atomic.Pointer[Panel]
+	workspacePanels atomic.Pointer[map[string]*Panel] // by workspace, replaced whole on reload
+	reloadMu        sync.Mutex                        // one reload at a time, so the last one wins
+)
+
+// workspacePanelDir holds a <workspace>.csv panel for each workspace that
+// doesn't use the default panel; set with -workspace-panels
+var workspacePanelDir string
+
+// activePanel returns the default panel
+func activePanel() *Panel {
+	return currentPanel.Load()
+}
+
+// panelFor returns the panel new jobs and classify requests of a workspace
+// use: its own, or else the default
+func panelFor(workspace string) *Panel {
+	if panels := workspacePanels.Load(); panels != nil && workspace != "" {
+		if panel, ok := (*panels)[workspace]; ok {
+			return panel
+		}
+	}
+	return activePanel()
+}
+
+// validateSankets rejects panels a job couldn't classify against, e.g. a
+// half-written or hand-edited file
+func validateSankets(sankets map[string]SanketInfo) error {
+	if len(sankets) == 0 {
+		return fmt.Errorf("panel has no sankets")
+	}
+	for sid, info := range sankets {
+		if info.Sanket == "" || strings.Trim(info.Sanket, "ACGT") != "" {
+			return fmt.Errorf("sanket %s: invalid sequence %q (expected A, C, G and T only)", sid, info.Sanket)
+		}
+		if info.SLen != len(info.Sanket) {
+			return fmt.Errorf("sanket %s: s_len %d doesn't match its %d-base sequence", sid, info.SLen, len(info.Sanket))
+		}
+		if info.Serotype == "" {
+			return fmt.Errorf("sanket %s: no serotype", sid)
+		}
+	}
+	return nil
+}
+
+// panelFile is the name findPanel looks for when -panel isn't set
+const panelFile = "sanket.csv"
+
+// panelSearchPath lists where findPanel looks for a panel nobody named
+func panelSearchPath() []string {
+	dirs := []string{"."}
+	if exe, err := os.Executable(); err == nil {
+		if exe, err = filepath.EvalSymlinks(exe); err == nil {
+			dirs = append(dirs, filepath.Dir(exe))
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "bhedi"))
+	}
+	paths := make([]string, len(dirs))
+	for i, dir := range dirs {
+		paths[i] = filepath.Join(dir, panelFile)
+	}
+	return paths
+}
+
+// findPanel returns path if set, else the first panel on the search path. A
+// named panel that doesn't exist is an error rather than a reason to search.
+func findPanel(path string) (string, error) {
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	candidates := panelSearchPath()
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no sanket panel found; set -panel or $BHEDI_PANEL (looked for %s)", strings.Join(candidates, ", "))
+}
+
+// loadPanel reads and validates the panel file at path, a CSV or an index built from one by bhedi-cli
+// index build. An index's panel is fingerprinted as the CSV it was built from, so results don't tell them apart.
+func loadPanel(path string) (*Panel, error) {
+	if isIndex(path) {
+		sankets, info, err := LoadIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateSankets(sankets); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return &Panel{Path: path, Sankets: sankets, Info: info, LoadedAt: time.Now()}, nil
+	}
+	sankets, err := LoadSankets(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSankets(sankets); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	info, err := loadPanelInfo(path, sankets)
+	if err != nil {
+		return nil, err
+	}
+	return &Panel{Path: path, Sankets: sankets, Info: info, LoadedAt: time.Now()}, nil
+}
+
+// loadWorkspacePanels loads every <workspace>.csv panel in dir
+func loadWorkspacePanels(dir string) (map[string]*Panel, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return nil, err
+	}
+	panels := make(map[string]*Panel, len(paths))
+	for _, path := range paths {
+		workspace := strings.TrimSuffix(filepath.Base(path), ".csv")
+		if err := validateWorkspace(workspace); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		panel, err := loadPanel(path)
+		if err != nil {
+			return nil, err
+		}
+		panel.Workspace = workspace
+		panels[workspace] = panel
+	}
+	return panels, nil
+}
+
+// reloadPanel loads the panel at path, or the current panel's file when path
+// is empty, and swaps it in as the panel of workspace ("" for the default).
+// A workspace without a panel yet falls back to its file in -workspace-panels.
+// On error the current panel stays in use.
+func reloadPanel(workspace, path string) (*Panel, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	previous := activePanel()
+	if workspace != "" {
+		if previous = panelFor(workspace); previous.Workspace != workspace {
+			previous = nil
+		}
+	}
+	if path == "" {
+		switch {
+		case previous != nil:
+			path = previous.Path
+		case workspacePanelDir != "":
+			path = filepath.Join(workspacePanelDir, workspace+".csv")
+		default:
+			return nil, fmt.Errorf("workspace %s has no panel of its own; give a path", workspace)
+		}
+	}
+	panel, err := loadPanel(path)
+	if err != nil {
+		return nil, err
+	}
+	panel.Workspace = workspace
+	if workspace == "" {
+		currentPanel.Store(panel)
+	} else {
+		panels := make(map[string]*Panel)
+		if current := workspacePanels.Load(); current != nil {
+			for name, p := range *current {
+				panels[name] = p
+			}
+		}
+		panels[workspace] = panel
+		workspacePanels.Store(&panels)
+	}
+	previousVersion := ""
+	if previous != nil {
+		previousVersion = previous.Info.Version
+	}
+	slog.Info("panel reloaded", "workspace", workspace, "path", panel.Path, "version", panel.Info.Version, "sankets", panel.Info.Sankets, "previous_version", previousVersion)
+	return panel, nil
+}
+
+// reloadWorkspacePanels reads -workspace-panels again, picking up added and
+// removed files, along with the workspace panels switched to other files
+// through POST /admin/panel/reload. On error every workspace keeps its
+// current panel.
+func reloadWorkspacePanels() (map[string]*Panel, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	panels := make(map[string]*Panel)
+	if workspacePanelDir != "" {
+		var err error
+		if panels, err = loadWorkspacePanels(workspacePanelDir); err != nil {
+			return nil, err
+		}
+	}
+	if current := workspacePanels.Load(); current != nil {
+		for workspace, previous := range *current {
+			if _, ok := panels[workspace]; ok || (workspacePanelDir != "" && filepath.Dir(previous.Path) == filepath.Clean(workspacePanelDir)) {
+				continue // in the directory, or removed from it
+			}
+			panel, err := loadPanel(previous.Path)
+			if err != nil {
+				return nil, err
+			}
+			panel.Workspace = workspace
+			panels[workspace] = panel
+		}
+	}
+	workspacePanels.Store(&panels)
+	slog.Info("workspace panels reloaded", "dir", workspacePanelDir, "workspaces", len(panels))
+	return panels, nil
+}
+
+func (p *Panel) status() panelStatus {
+	return panelStatus{
+		Workspace: p.Workspace,
+		Path:      p.Path,
+		Name:      p.Info.Name,
+		Version:   p.Info.Version,
+		Checksum:  p.Info.Checksum,
+		Sankets:   p.Info.Sankets,
+		LoadedAt:  p.LoadedAt,
+	}
+}
+
+// audit records that actor, from ip when through the API, put the panel in use
+func (p *Panel) audit(actor, ip string) {
+	audit.Record(AuditEvent{
+		Actor:     actor,
+		Workspace: p.Workspace,
+		IP:        ip,
+		Action:    AuditPanelReloaded,
+		Detail:    map[string]any{"path": p.Path, "version": p.Info.Version, "checksum": p.Info.Checksum, "sankets": p.Info.Sankets},
+	})
+}
+
+// reloadPanelOnSIGHUP reloads the panel files whenever the process gets SIGHUP
+func reloadPanelOnSIGHUP(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangups)
+		for {
+			select {
+			case <-hangups:
+				if panel, err := reloadPanel("", ""); err != nil {
+					slog.Error("can't reload the panel; keeping the current one", "error", err)
+				} else {
+					panel.audit("signal", "")
+				}
+				panels, err := reloadWorkspacePanels()
+				if err != nil {
+					slog.Error("can't reload the workspace panels; keeping the current ones", "error", err)
+				}
+				for _, panel := range panels {
+					panel.audit("signal", "")
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// handlePanelGet serves GET /admin/panel, the panel of ?workspace= or the default
+func handlePanelGet(c *fiber.Ctx) error {
+	return c.JSON(panelFor(c.Query("workspace")).status())
+}
+
+// handlePanelReload serves POST /admin/panel/reload. An optional JSON body
+// {"path": "...", "workspace": "..."} switches to another panel file, or
+// reloads a workspace's panel; otherwise the default panel's file is read again.
+func handlePanelReload(c *fiber.Ctx) error {
+	var req struct {
+		Path      string `json:"path"`
+		Workspace string `json:"workspace"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %v", err))
+		}
+	}
+	if req.Workspace != "" {
+		if err := validateWorkspace(req.Workspace); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+	}
+	panel, err := reloadPanel(req.Workspace, req.Path)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(fmt.Sprintf("Panel not reloaded: %v", err))
+	}
+	panel.audit(requestActor(c), c.IP())
+	return c.JSON(panel.status())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// progressInterval is how often live progress is pushed to clients
+const progressInterval = 500 * time.Millisecond
+
+// ProgressEvent is one live progress update for a job
+type ProgressEvent struct {
+	JobID           string           `json:"job_id"`
+	State           string           `json:"state"`
+	ReadsProcessed  int64            `json:"reads_processed"`
+	TotalReads      int64            `json:"total_reads"`
+	PercentComplete float64          `json:"percent_complete"`
+	MatchRate       float64          `json:"match_rate"`
+	ReadsPerSecond  float64          `json:"reads_per_second,omitempty"` // since the job started
+	ETASeconds      float64          `json:"eta_seconds,omitempty"`      // until it finishes, at that rate
+	Serotypes       map[string]int64 `json:"serotypes"`                  // running read count per serotype
+	Error           string           `json:"error,omitempty"`
+}
+
+// Progress snapshots the job as a ProgressEvent
+func (j *Job) Progress() ProgressEvent {
+	status := j.Status()
+	summary := j.Summary()
+	event := ProgressEvent{
+		JobID:           status.ID,
+		State:           status.State,
+		ReadsProcessed:  status.ReadsProcessed,
+		TotalReads:      status.TotalReads,
+		PercentComplete: status.PercentComplete,
+		MatchRate:       summary.MatchRate,
+		Serotypes:       make(map[string]int64, len(summary.Serotypes)),
+		Error:           status.Error,
+	}
+	for _, s := range summary.Serotypes {
+		event.Serotypes[s.Serotype] = s.Reads
+	}
+	if status.State == JobRunning && status.StartedAt != nil && status.ReadsProcessed > 0 {
+		if elapsed := time.Since(*status.StartedAt).Seconds(); elapsed > 0 {
+			event.ReadsPerSecond = float64(status.ReadsProcessed) / elapsed
+			event.ETASeconds = math.Round(float64(max(status.TotalReads-status.ReadsProcessed, 0)) / event.ReadsPerSecond)
+		}
+	}
+	return event
+}
+
+// finalState reports whether a job in state will make no further progress
+func finalState(state string) bool {
+	return state == JobDone || state == JobFailed || state == JobCanceled
+}
+
+// streamProgress calls send with a progress event every progressInterval until
+// the job reaches a final state (which is sent last) or send fails
+func streamProgress(job *Job, send func(ProgressEvent) error) error {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		event := job.Progress()
+		if err := send(event); err != nil {
+			return err
+		}
+		if finalState(event.State) {
+			return nil
+		}
+		<-ticker.C
+	}
+}
+
+// upgradeJobProgress only lets WebSocket handshakes for known jobs through
+func upgradeJobProgress(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	job, ok := jobForRequest(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	c.Locals("job", job)
+	return c.Next()
+}
+
+// handleJobProgressWS serves ws://…/jobs/:id/progress, one JSON ProgressEvent per message
+var handleJobProgressWS = websocket.New(func(conn *websocket.Conn) {
+	job := conn.Locals("job").(*Job)
+	err := streamProgress(job, func(event ProgressEvent) error {
+		return conn.WriteJSON(event)
+	})
+	if err != nil {
+		job.logger().Debug("progress stream closed", "error", err)
+		return
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+})
+
+// handleJobEvents serves GET /jobs/:id/events, the same progress events as a
+// Server-Sent Events stream for clients that can't use WebSockets
+func handleJobEvents(c *fiber.Ctx) error {
+	job, ok := jobForRequest(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		err := streamProgress(job, func(event ProgressEvent) error {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			return w.Flush() // fails once the client has gone away
+		})
+		if err != nil {
+			job.logger().Debug("progress stream closed", "error", err)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys shared by every bhedi instance using the same queue
+const (
+	queueKey        = "bhedi:queue"       // list of pending jobTasks
+	processingKey   = "bhedi:processing:" // + instance: tasks an instance is running
+	instanceKey     = "bhedi:instance:"   // + instance: heartbeat, expires when the instance dies
+	jobRecordKey    = "bhedi:job:"        // + job ID: latest jobRecord as JSON
+	jobCancelKey    = "bhedi:cancel:"     // + job ID: set by DELETE /jobs/:id
+	instanceTTL     = 30 * time.Second    // how long a silent instance keeps its tasks
+	jobRecordTTL    = 7 * 24 * time.Hour  // how long job records stay in Redis
+	queuePollPeriod = 5 * time.Second     // how long a worker blocks waiting for a task
+)
+
+// queue is the shared job queue, nil unless -redis is set
+var queue *redisQueue
+
+// jobTask is everything an instance needs to run a queued job
+type jobTask struct {
+	ID           string        `json:"id"`
+	Params       JobParams     `json:"params"`
+	Opts         OutputOptions `json:"opts"`
+	Spools       []string      `json:"spools"` // uploaded FASTQs, on storage shared by all instances
+	Stats        []SpoolStat   `json:"stats"`
+	Output       string        `json:"output"`
+	DownloadName string        `json:"download_name"`
+	CreatedAt    time.Time     `json:"created_at"`
+	Attempts     int           `json:"attempts"` // retries so far
+}
+
+// newJobTask describes job for the queue
+func newJobTask(job *Job, spools []string, stats []SpoolStat, opts OutputOptions) jobTask {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return jobTask{
+		ID:           job.ID,
+		Params:       job.Params,
+		Opts:         opts,
+		Spools:       spools,
+		Stats:        stats,
+		Output:       job.output,
+		DownloadName: job.downloadName,
+		CreatedAt:    job.createdAt,
+	}
+}
+
+// redisQueue shares async jobs between bhedi instances. Tasks are moved
+// atomically from the queue to a per-instance processing list while they run,
+// and moved back if the instance stops heartbeating, so every task is run at
+// least once.
+type redisQueue struct {
+	client     *redis.Client
+	instance   string
+	processing string
+	retries    int
+
+	workers int          // started by Start
+	alive   atomic.Int32 // workers still running, for /readyz
+	stopped context.Context
+	stop    context.CancelFunc // stops workers taking new tasks
+}
+
+// newRedisQueue connects to the Redis server at url
+func newRedisQueue(url string, retries int) (*redisQueue, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("can't reach Redis: %w", err)
+	}
+	host, _ := os.Hostname()
+	instance := host + "-" + newJobID()[:8]
+	stopped, stop := context.WithCancel(context.Background())
+	return &redisQueue{
+		client:     client,
+		instance:   instance,
+		processing: processingKey + instance,
+		retries:    retries,
+		stopped:    stopped,
+		stop:       stop,
+	}, nil
+}
+
+// Enqueue publishes a queued record for the task and pushes it onto the queue
+func (q *redisQueue) Enqueue(task jobTask) error {
+	record := jobRecord{
+		ID:           task.ID,
+		State:        JobQueued,
+		Params:       task.Params,
+		Output:       task.Output,
+		DownloadName: task.DownloadName,
+		CreatedAt:    task.CreatedAt,
+	}
+	if err := q.SaveRecord(record); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return q.client.LPush(context.Background(), queueKey, payload).Err()
+}
+
+// SaveRecord shares the latest state of a job with every instance
+func (q *redisQueue) SaveRecord(record jobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := q.client.Set(context.Background(), jobRecordKey+record.ID, data, jobRecordTTL).Err(); err != nil {
+		return fmt.Errorf("can't publish job record: %w", err)
+	}
+	return nil
+}
+
+// LoadRecord fetches the shared record of a job
+func (q *redisQueue) LoadRecord(id string) (jobRecord, bool, error) {
+	var record jobRecord
+	data, err := q.client.Get(context.Background(), jobRecordKey+id).Bytes()
+	if err == redis.Nil {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, fmt.Errorf("can't load job record: %w", err)
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, false, fmt.Errorf("invalid job record: %w", err)
+	}
+	return record, true, nil
+}
+
+// RequestCancel flags a job for cancellation on whichever instance runs it
+func (q *redisQueue) RequestCancel(id string) error {
+	if err := q.client.Set(context.Background(), jobCancelKey+id, 1, jobRecordTTL).Err(); err != nil {
+		return fmt.Errorf("can't request cancellation: %w", err)
+	}
+	return nil
+}
+
+// cancelRequested reports whether DELETE /jobs/:id was called on any instance
+func (q *redisQueue) cancelRequested(id string) bool {
+	n, err := q.client.Exists(context.Background(), jobCancelKey+id).Result()
+	return err == nil && n > 0
+}
+
+// Start runs workers queued jobs at a time and keeps this instance's heartbeat
+func (q *redisQueue) Start(workers int) {
+	q.heartbeat()
+	go func() {
+		for range time.Tick(instanceTTL / 3) {
+			q.heartbeat()
+			q.reap()
+		}
+	}()
+	q.workers = workers
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+func (q *redisQueue) heartbeat() {
+	if err := q.client.Set(context.Background(), instanceKey+q.instance, 1, instanceTTL).Err(); err != nil {
+		slog.Error("redis heartbeat failed", "error", err)
+	}
+}
+
+// reap puts the tasks of instances that stopped heartbeating back on the queue
+func (q *redisQueue) reap() {
+	ctx := context.Background()
+	iter := q.client.Scan(ctx, 0, processingKey+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		instance := strings.TrimPrefix(key, processingKey)
+		if instance == q.instance {
+			continue
+		}
+		if alive, err := q.client.Exists(ctx, instanceKey+instance).Result(); err != nil || alive > 0 {
+			continue
+		}
+		for {
+			err := q.client.LMove(ctx, key, queueKey, "RIGHT", "RIGHT").Err()
+			if err == redis.Nil {
+				break
+			}
+			if err != nil {
+				slog.Error("can't requeue tasks of a stopped instance", "instance", instance, "error", err)
+				break
+			}
+			slog.Warn("requeued a task of a stopped instance", "instance", instance)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("can't scan for stopped instances", "error", err)
+	}
+}
+
+// Stop makes the workers exit once their current task is done
+func (q *redisQueue) Stop() {
+	q.stop()
+}
+
+// work runs queued tasks one after another until Stop is called
+func (q *redisQueue) work() {
+	q.alive.Add(1)
+	defer q.alive.Add(-1)
+	ctx := context.Background()
+	for {
+		payload, err := q.client.BLMove(q.stopped, queueKey, q.processing, "RIGHT", "LEFT", queuePollPeriod).Result()
+		if q.stopped.Err() != nil && err != nil {
+			return
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			slog.Error("can't take a task from the queue", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		var task jobTask
+		if err := json.Unmarshal([]byte(payload), &task); err != nil {
+			slog.Error("dropping invalid task", "error", err)
+		} else {
+			q.run(task)
+		}
+		if err := q.client.LRem(ctx, q.processing, 1, payload).Err(); err != nil {
+			slog.Error("can't remove finished task", "job_id", task.ID, "error", err)
+		}
+	}
+}
+
+// run processes one task, putting it back on the queue if it fails and has retries left
+func (q *redisQueue) run(task jobTask) {
+	job := jobs.Adopt(task)
+	if q.cancelRequested(task.ID) {
+		removeSpools(task.Spools)
+		job.Finish(context.Canceled)
+		return
+	}
+
+	stop := make(chan struct{})
+	go q.watch(job, stop)
+	panel := panelFor(task.Params.Workspace)
+	task.Opts.Metadata = runMetadata(panel.Info, task.Opts.Schema)
+	err := runJob(job, task.Spools, task.Stats, panel.Sankets, task.Opts)
+	close(stop)
+
+	if errors.Is(context.Cause(job.Context()), errShutdown) {
+		// Interrupted by this instance shutting down: start over elsewhere
+		// without using up a retry
+		jobs.Handoff(job)
+		if err := q.Enqueue(task); err == nil {
+			job.logger().Info("job requeued for another instance")
+			return
+		}
+		job.logger().Error("can't requeue", "error", err)
+	}
+	// Timeouts aren't retried: the job would only run out of time again
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, errJobTimeout) && task.Attempts < q.retries {
+		job.logger().Warn("job failed, retrying", "attempt", task.Attempts+1, "attempts", q.retries+1, "error", err)
+		task.Attempts++
+		jobs.Handoff(job)
+		if err := q.Enqueue(task); err == nil {
+			return
+		}
+		job.logger().Error("can't requeue", "error", err)
+	}
+	removeSpools(task.Spools)
+	job.Finish(err)
+}
+
+// watch shares a running job's progress and picks up cancellation requests
+// made on other instances until stop is closed
+func (q *redisQueue) watch(job *Job, stop <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		job.mu.Lock()
+		record := job.record()
+		job.mu.Unlock()
+		job.publish(record)
+		if q.cancelRequested(job.ID) {
+			job.Cancel()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Per-client limits; 0 turns each off
+var (
+	clientRateLimit  int      // requests per minute of clients without an API key, -rate-limit
+	dailyUploadQuota byteSize // bytes a client may upload or have fetched per UTC day, -daily-upload-quota
+	maxActiveJobs    int      // queued plus running jobs per client, -max-active-jobs
+)
+
+// errQuotaExceeded stops an upload that runs past the client's daily quota
+var errQuotaExceeded = errors.New("daily upload quota exceeded")
+
+// clientID identifies who is behind a request for rate limits and quotas:
+// the API key or OIDC user when authenticated, the remote address otherwise.
+// Unlike the user field it can't be picked by the client.
+func clientID(c *fiber.Ctx) string {
+	if key := requestKey(c); key != nil {
+		return "key:" + key.ID
+	}
+	if user := requestUser(c); user != "" {
+		return "oidc:" + user
+	}
+	return "ip:" + c.IP()
+}
+
+// usageTracker counts each client's requests and uploaded bytes. Everything
+// resets at midnight UTC, which also keeps the maps from growing for ever.
+type usageTracker struct {
+	mu       sync.Mutex
+	day      string
+	uploaded map[string]int64
+	limiters map[string]*rateLimiter
+}
+
+var usage = &usageTracker{}
+
+// rollover starts a new day's counts when the date changed; callers hold u.mu
+func (u *usageTracker) rollover() {
+	if today := time.Now().UTC().Format(time.DateOnly); today != u.day {
+		u.day = today
+		u.uploaded = make(map[string]int64)
+		u.limiters = make(map[string]*rateLimiter)
+	}
+}
+
+// Allow applies -rate-limit to a client
+func (u *usageTracker) Allow(client string) (bool, time.Duration) {
+	u.mu.Lock()
+	u.rollover()
+	limiter, ok := u.limiters[client]
+	if !ok {
+		limiter = newRateLimiter(clientRateLimit)
+		u.limiters[client] = limiter
+	}
+	u.mu.Unlock()
+	return limiter.Allow()
+}
+
+// AddUpload counts bytes a client uploaded or had fetched
+func (u *usageTracker) AddUpload(client string, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	u.uploaded[client] += n
+}
+
+// Allowance is how many more bytes a client may upload today, or -1 without a quota
+func (u *usageTracker) Allowance(client string) int64 {
+	if dailyUploadQuota == 0 {
+		return -1
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	return max(int64(dailyUploadQuota)-u.uploaded[client], 0)
+}
+
+// rateLimit applies -rate-limit to clients without an API key; keys have their own limit
+func rateLimit(c *fiber.Ctx) error {
+	if clientRateLimit == 0 || requestKey(c) != nil || isPublicPath(c) {
+		return c.Next()
+	}
+	if ok, wait := usage.Allow(clientID(c)); !ok {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return c.Status(fiber.StatusTooManyRequests).SendString(fmt.Sprintf("Rate limit of %d requests per minute exceeded", clientRateLimit))
+	}
+	return c.Next()
+}
+
+// checkQuota refuses a new submission from a client already at its active
+// job cap, whose workspace is at its cap, or out of upload quota for the day,
+// and any submission while -max-queued jobs are already waiting
+func checkQuota(c *fiber.Ctx) error {
+	client := clientID(c)
+	if maxActiveJobs > 0 {
+		if active := jobs.Active(client); active >= maxActiveJobs {
+			return fmt.Errorf("too many active jobs (%d of %d); wait for some to finish", active, maxActiveJobs)
+		}
+	}
+	if maxWorkspaceJobs > 0 {
+		if active := jobs.ActiveInWorkspace(requestWorkspace(c)); active >= maxWorkspaceJobs {
+			return fmt.Errorf("too many active jobs in this workspace (%d of %d); wait for some to finish", active, maxWorkspaceJobs)
+		}
+	}
+	if maxQueued > 0 {
+		if waiting := scheduler.Waiting(); waiting >= maxQueued {
+			c.Set(fiber.HeaderRetryAfter, queueFullRetryAfter)
+			return fmt.Errorf("server busy: %d jobs already waiting to run; retry later", waiting)
+		}
+	}
+	if usage.Allowance(client) == 0 {
+		return fmt.Errorf("daily upload quota of %v used up; it resets at midnight UTC", &dailyUploadQuota)
+	}
+	return nil
+}
+
+// Active counts the queued and running jobs submitted by client
+func (r *JobRegistry) Active(client string) int {
+	active := 0
+	for _, job := range r.List("") {
+		job.mu.Lock()
+		if job.Params.Client == client && !finalState(job.state) {
+			active++
+		}
+		job.mu.Unlock()
+	}
+	return active
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// remoteJobRequest is the JSON body of POST /jobs. The URLs are fetched by the
+// server; they are never stored or echoed back since presigned URLs carry credentials.
+type remoteJobRequest struct {
+	URL               string   `json:"url"`
+	URLs              []string `json:"urls"`
+	Format            string   `json:"format"`
+	Schema            string   `json:"schema"`
+	Columns           string   `json:"columns"`
+	Mode              string   `json:"mode"`
+	User              string   `json:"user"`
+	Priority          int      `json:"priority"`
+	Workers           int      `json:"workers"`
+	WriterParallelism int      `json:"writer_parallelism"`
+	Memory            string   `json:"memory"`
+	Timeout           string   `json:"timeout"`
+	CallbackURL       string   `json:"callback_url"`
+	Sample            string   `json:"sample"`
+	CollectionDate    string   `json:"collection_date"`
+	Location          string   `json:"location"`
+	Tags              []string `json:"tags"`
+	MD5               string   `json:"md5"` // expected checksums, comma-separated in url order
+	SHA256            string   `json:"sha256"`
+}
+
+// field looks up a request value the way jobOptions expects
+func (r remoteJobRequest) field(key string, defaultValue ...string) string {
+	values := map[string]string{
+		"format":          r.Format,
+		"schema":          r.Schema,
+		"columns":         r.Columns,
+		"mode":            r.Mode,
+		"user":            r.User,
+		"memory":          r.Memory,
+		"timeout":         r.Timeout,
+		"callback_url":    r.CallbackURL,
+		"md5":             r.MD5,
+		"sha256":          r.SHA256,
+		"sample":          r.Sample,
+		"collection_date": r.CollectionDate,
+		"location":        r.Location,
+		"tags":            strings.Join(r.Tags, ","),
+	}
+	if r.Priority != 0 {
+		values["priority"] = strconv.Itoa(r.Priority)
+	}
+	if r.Workers != 0 {
+		values["workers"] = strconv.Itoa(r.Workers)
+	}
+	if r.WriterParallelism != 0 {
+		values["writer_parallelism"] = strconv.Itoa(r.WriterParallelism)
+	}
+	if value := values[key]; value != "" {
+		return value
+	}
+	if len(defaultValue) > 0 {
+		return defaultValue[0]
+	}
+	return ""
+}
+
+// fetchAllowed lists the private networks POST /jobs may fetch from, e.g. an
+// in-house object store; set with -fetch-allow. Any other address that isn't public is refused.
+var fetchAllowed []netip.Prefix
+
+// errFetchBlocked refuses a fetch from a loopback, private or link-local address, such as cloud metadata
+// endpoints, which clients must not reach through the server
+var errFetchBlocked = errors.New("address is not public; the server only fetches from public addresses and -fetch-allow")
+
+// parseFetchAllowed reads -fetch-allow: comma-separated IPs or CIDRs
+func parseFetchAllowed(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range splitTags(value) {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%q is neither an IP nor a CIDR", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// checkFetchAddress refuses to connect to addresses that aren't public unless -fetch-allow lists them. It runs
+// on every connection, after DNS resolution and for each redirect, so neither a hostname nor a redirect gets round it.
+func checkFetchAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap()
+	if addr.IsGlobalUnicast() && !addr.IsPrivate() {
+		return nil
+	}
+	for _, prefix := range fetchAllowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	return errFetchBlocked
+}
+
+// fetchClient fetches POST /jobs URLs. It ignores proxy settings, as the address check would otherwise see the
+// proxy's, and bounds connecting and waiting for a response; the body then takes as long as the job allows.
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, Control: checkFetchAddress}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	},
+}
+
+// remoteFilename names a fetched file after the last path element of its URL
+func remoteFilename(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return u.Host
+	}
+	return name
+}
+
+// handleRemoteJob serves POST /jobs: the server downloads the FASTQ files
+// from the given HTTP(S) URLs (e.g. presigned S3 links) and then classifies
+// them like an async upload
+func handleRemoteJob(c *fiber.Ctx) error {
+	key, done, err := claimIdempotencyKey(c)
+	if done {
+		return err
+	}
+	defer jobs.Release(requestWorkspace(c), key)
+
+	if err := checkQuota(c); err != nil {
+		return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+	}
+
+	var req remoteJobRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %v", err))
+	}
+	rawURLs := req.URLs
+	if req.URL != "" {
+		rawURLs = append([]string{req.URL}, rawURLs...)
+	}
+	if len(rawURLs) == 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Expected a url or urls to fetch")
+	}
+	var urls []*url.URL
+	var filenames []string
+	for _, raw := range rawURLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid url (expected an absolute http or https URL)")
+		}
+		urls = append(urls, u)
+		filenames = append(filenames, remoteFilename(u))
+	}
+
+	opts, params, err := jobOptions(c, req.field, filenames)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	params.IdempotencyKey = key
+	job := jobs.Create(params)
+	c.Set("X-Job-ID", job.ID)
+	sources := make([]string, len(urls))
+	for i, u := range urls {
+		sources[i] = redactURL(u)
+	}
+	auditSubmission(c, job, map[string]any{"urls": sources})
+
+	sankets, err := prepareJob(job, &opts)
+	if err != nil {
+		job.Finish(err)
+		return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to load sankets: %v", err))
+	}
+
+	// The job stays queued while its files download
+	md5s, sha256s := expectedChecksums(c.Get, req.field)
+	go func() {
+		files, err := fetchAll(job.Context(), urls, params.Client)
+		if err == nil {
+			if err = verifyChecksums(files, md5s, sha256s); err != nil {
+				for _, file := range files {
+					os.Remove(file.Path)
+				}
+			}
+		}
+		if err == nil {
+			spools := make([]string, 0, len(files))
+			stats := make([]SpoolStat, 0, len(files))
+			for _, file := range files {
+				spools = append(spools, file.Path)
+				stats = append(stats, file.Stat)
+			}
+			err = launchJob(job, spools, stats, sankets, opts)
+		}
+		if err != nil {
+			job.Finish(err)
+		}
+	}()
+
+	c.Location(jobPath(job.ID))
+	return c.Status(fiber.StatusAccepted).JSON(job.Status())
+}
+
+// fetchAll downloads every URL to a spool file, counting reads on the way and
+// charging the bytes to client's upload quota
+func fetchAll(ctx context.Context, urls []*url.URL, client string) ([]spooledFile, error) {
+	var files []spooledFile
+	for _, u := range urls {
+		file, err := fetchToSpool(ctx, u, client)
+		if err != nil {
+			for _, f := range files {
+				os.Remove(f.Path)
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func fetchToSpool(ctx context.Context, u *url.URL, client string) (spooledFile, error) {
+	// Errors name the host and path only; the query may hold a signature
+	where := u.Host + u.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return spooledFile{}, fmt.Errorf("failed to fetch %s: %w", where, err)
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return spooledFile{}, ctx.Err()
+		}
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return spooledFile{}, fmt.Errorf("failed to fetch %s: %w", where, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return spooledFile{}, fmt.Errorf("failed to fetch %s: %s", where, resp.Status)
+	}
+	if resp.ContentLength > int64(bodyLimit) {
+		return spooledFile{}, fmt.Errorf("failed to fetch %s: larger than the %v limit", where, &bodyLimit)
+	}
+	// Files are held to -body-limit, as uploads are, and bytes are charged to
+	// the quota as they arrive, so a fetch failing partway still counts, and
+	// one running past the quota stops there
+	limited := &limitedBody{r: resp.Body, left: int64(bodyLimit), err: fmt.Errorf("larger than the %v limit", &bodyLimit)}
+	var body io.Reader = limited
+	defer func() { usage.AddUpload(client, int64(bodyLimit)-max(limited.left, 0)) }()
+	if allowance := usage.Allowance(client); allowance >= 0 {
+		if resp.ContentLength > allowance {
+			return spooledFile{}, fmt.Errorf("failed to fetch %s: %w", where, errQuotaExceeded)
+		}
+		body = &limitedBody{r: limited, left: allowance, err: errQuotaExceeded}
+	}
+
+	content, kind, err := sniffContent(body, remoteFilename(u))
+	if err == nil && kind != "" {
+		err = &contentError{Filename: remoteFilename(u), Problem: "is a " + kind + " archive, which only POST /upload expands"}
+	}
+	if err != nil {
+		var contentErr *contentError
+		if errors.As(err, &contentErr) {
+			return spooledFile{}, err
+		}
+		return spooledFile{}, fmt.Errorf("failed to fetch %s: %w", where, err)
+	}
+	tempFile, err := os.CreateTemp(spoolDir, "fastq-*.tmp")
+	if err != nil {
+		return spooledFile{}, fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	file := spooledFile{Filename: remoteFilename(u), Path: tempFile.Name()}
+	sums := newChecksums()
+	file.Stat, err = spoolCounting(sums.Writer(tempFile), content)
+	file.MD5, file.SHA256 = sums.MD5(), sums.SHA256()
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Path)
+		if ctx.Err() != nil {
+			return spooledFile{}, ctx.Err()
+		}
+		return spooledFile{}, fmt.Errorf("failed to fetch %s: %w", where, err)
+	}
+	return file, nil
+}
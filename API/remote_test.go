@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestCheckFetchAddress(t *testing.T) {
+	defer func(allowed []netip.Prefix) { fetchAllowed = allowed }(fetchAllowed)
+	fetchAllowed = []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+
+	for _, tt := range []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"169.254.169.254:80", false}, // cloud metadata
+		{"[fe80::1]:80", false},
+		{"10.0.0.1:80", false},
+		{"172.16.5.4:80", false},
+		{"192.168.1.1:80", false},
+		{"[fd00::1]:80", false},
+		{"224.0.0.1:80", false},
+		// IPv4-mapped IPv6 is the IPv4 address underneath
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:169.254.169.254]:80", false},
+		{"[::ffff:192.168.1.1]:80", false},
+		{"[::ffff:93.184.216.34]:443", true},
+		// -fetch-allow opens its networks and no others
+		{"10.1.2.3:9000", true},
+		{"[::ffff:10.1.2.3]:9000", true},
+		{"10.2.0.1:9000", false},
+	} {
+		err := checkFetchAddress("tcp", tt.address, nil)
+		if tt.allowed && err != nil {
+			t.Errorf("%s refused: %v", tt.address, err)
+		} else if !tt.allowed && err != errFetchBlocked {
+			t.Errorf("%s: got %v, want it refused", tt.address, err)
+		}
+	}
+
+	if err := checkFetchAddress("tcp", "example.org:443", nil); err == nil {
+		t.Error("an address that isn't an IP and port was accepted")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// janitorInterval is how often expired jobs and stale temp files are removed
+const janitorInterval = time.Hour
+
+// retention is how long finished jobs and their results are kept; 0 keeps them forever
+var retention time.Duration
+
+var (
+	jobDirPattern   = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	spoolPatterns   = []string{"fastq-*.tmp", "archive-*.tmp"}
+	janitorMu       sync.Mutex
+	lastCleanup     *cleanupReport
+	cleanupTotals   cleanupReport
+	cleanupTotalsAt = time.Now()
+)
+
+// cleanupReport counts what one janitor run removed
+type cleanupReport struct {
+	RanAt          time.Time `json:"ran_at"`
+	JobsExpired    int       `json:"jobs_expired"`
+	FilesRemoved   int       `json:"files_removed"`
+	BytesReclaimed int64     `json:"bytes_reclaimed"`
+}
+
+// retentionStatus is the JSON body of GET /admin/retention
+type retentionStatus struct {
+	Retention string         `json:"retention"` // "0s" when jobs are kept forever
+	LastRun   *cleanupReport `json:"last_run,omitempty"`
+	Since     time.Time      `json:"since"` // when Total started counting
+	Total     cleanupReport  `json:"total"`
+}
+
+// Expire forgets the jobs that finished before cutoff, deleting their records,
+// and returns them
+func (r *JobRegistry) Expire(cutoff time.Time) []*Job {
+	r.mu.Lock()
+	var expired []*Job
+	for id, job := range r.jobs {
+		job.mu.Lock()
+		old := job.finished() && job.finishedAt.Before(cutoff)
+		job.mu.Unlock()
+		if !old {
+			continue
+		}
+		delete(r.jobs, id)
+		if key := job.idempotencyID(); key != "" && r.keys[key] == id {
+			delete(r.keys, key)
+		}
+		expired = append(expired, job)
+	}
+	r.mu.Unlock()
+	if r.store != nil {
+		for _, job := range expired {
+			if err := r.store.Delete(job.ID); err != nil {
+				job.logger().Error("can't delete the expired job", "error", err)
+			}
+		}
+	}
+	return expired
+}
+
+// diskUsage returns the bytes used by the file or directory tree at path
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// remove deletes path, counting what it frees in report
+func (report *cleanupReport) remove(path string) {
+	if _, err := os.Lstat(path); err != nil {
+		return // already gone
+	}
+	size := diskUsage(path)
+	if err := os.RemoveAll(path); err != nil {
+		slog.Error("can't remove expired file", "path", path, "error", err)
+		return
+	}
+	report.FilesRemoved++
+	report.BytesReclaimed += size
+}
+
+// cleanUp expires the jobs that finished more than retention ago along with
+// their results, and removes temp files left older than that: spooled uploads
+// and job directories no job owns, e.g. after a crash without -db
+func cleanUp(now time.Time) cleanupReport {
+	cutoff := now.Add(-retention)
+	report := cleanupReport{RanAt: now}
+	for _, job := range jobs.Expire(cutoff) {
+		report.JobsExpired++
+		audit.Record(AuditEvent{Actor: "retention", Workspace: job.Params.Workspace, Action: AuditJobExpired, JobID: job.ID})
+		output := job.Output()
+		if _, inBucket := bucketKey(output); inBucket {
+			files, size, err := removeBucketResult(context.Background(), output)
+			if err != nil {
+				slog.Error("can't remove the expired result from the output bucket", "job_id", job.ID, "error", err)
+			}
+			report.FilesRemoved += files
+			report.BytesReclaimed += size
+			output = jobLogPath(job.ID) // what is left on local disk
+		}
+		if output == "" {
+			continue
+		}
+		if dir := filepath.Dir(output); filepath.Base(dir) == job.ID {
+			report.remove(dir)
+		} else {
+			report.remove(output) // written before jobs had their own directory
+		}
+	}
+
+	dir := spoolDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	for _, pattern := range spoolPatterns {
+		paths, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && info.ModTime().Before(cutoff) {
+				report.remove(path)
+			}
+		}
+	}
+
+	entries, _ := os.ReadDir(outputDir)
+	for _, entry := range entries {
+		if !entry.IsDir() || !jobDirPattern.MatchString(entry.Name()) {
+			continue
+		}
+		if _, ok := jobs.Get(entry.Name()); ok {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+			report.remove(filepath.Join(outputDir, entry.Name()))
+		}
+	}
+	return report
+}
+
+// runJanitor cleans up once and records the report
+func runJanitor() cleanupReport {
+	janitorMu.Lock()
+	defer janitorMu.Unlock()
+	report := cleanUp(time.Now())
+	lastCleanup = &report
+	cleanupTotals.JobsExpired += report.JobsExpired
+	cleanupTotals.FilesRemoved += report.FilesRemoved
+	cleanupTotals.BytesReclaimed += report.BytesReclaimed
+	cleanupTotals.RanAt = report.RanAt
+	if report.JobsExpired > 0 || report.FilesRemoved > 0 {
+		slog.Info("cleaned up expired jobs and temp files", "jobs", report.JobsExpired, "files_removed", report.FilesRemoved,
+			"bytes_reclaimed", report.BytesReclaimed, "retention", retention)
+	}
+	return report
+}
+
+// startJanitor cleans up now and then every janitorInterval until ctx is done
+func startJanitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			runJanitor()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// handleRetentionStatus serves GET /admin/retention: the retention period and
+// what the janitor has removed
+func handleRetentionStatus(c *fiber.Ctx) error {
+	janitorMu.Lock()
+	defer janitorMu.Unlock()
+	return c.JSON(retentionStatus{
+		Retention: retention.String(),
+		LastRun:   lastCleanup,
+		Since:     cleanupTotalsAt,
+		Total:     cleanupTotals,
+	})
+}
+
+// handleRetentionRun serves POST /admin/retention/run: clean up now
+func handleRetentionRun(c *fiber.Ctx) error {
+	if retention <= 0 {
+		return c.Status(fiber.StatusConflict).SendString("Retention is off; start the server with -retention")
+	}
+	return c.JSON(runJanitor())
+}
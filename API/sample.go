@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// collectionDateLayout is the accepted collection_date format
+const collectionDateLayout = "2006-01-02"
+
+// SampleMetadata describes the sample behind a job, for surveillance bookkeeping
+type SampleMetadata struct {
+	Name           string   `json:"name,omitempty"`
+	CollectionDate string   `json:"collection_date,omitempty"` // YYYY-MM-DD
+	Location       string   `json:"location,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+}
+
+// parseSampleMetadata reads the sample, collection_date, location and tags
+// (comma-separated) fields; it returns nil when none are set
+func parseSampleMetadata(field formField) (*SampleMetadata, error) {
+	sample := &SampleMetadata{
+		Name:           strings.TrimSpace(field("sample")),
+		CollectionDate: strings.TrimSpace(field("collection_date")),
+		Location:       strings.TrimSpace(field("location")),
+		Tags:           splitTags(field("tags")),
+	}
+	if sample.CollectionDate != "" {
+		if _, err := time.Parse(collectionDateLayout, sample.CollectionDate); err != nil {
+			return nil, fmt.Errorf("invalid collection_date %q (expected YYYY-MM-DD)", sample.CollectionDate)
+		}
+	}
+	if sample.Name == "" && sample.CollectionDate == "" && sample.Location == "" && len(sample.Tags) == 0 {
+		return nil, nil
+	}
+	return sample, nil
+}
+
+// splitTags splits a comma-separated tag list, dropping blanks and repeats
+func splitTags(value string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// footerMetadata returns the sample fields as result file metadata
+func (s *SampleMetadata) footerMetadata() map[string]string {
+	metadata := make(map[string]string)
+	if s == nil {
+		return metadata
+	}
+	for key, value := range map[string]string{
+		"bhedi.sample.name":            s.Name,
+		"bhedi.sample.collection_date": s.CollectionDate,
+		"bhedi.sample.location":        s.Location,
+		"bhedi.sample.tags":            strings.Join(s.Tags, ","),
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// sampleFilter selects jobs by sample metadata in GET /jobs
+type sampleFilter struct {
+	name, location string
+	tags           []string
+	from, to       string // collection date range, inclusive
+}
+
+// parseSampleFilter reads the ?sample=, ?location=, ?tag=, ?collected_from=
+// and ?collected_to= query values
+func parseSampleFilter(c *fiber.Ctx) (sampleFilter, error) {
+	filter := sampleFilter{
+		name:     c.Query("sample"),
+		location: c.Query("location"),
+		tags:     splitTags(c.Query("tag")),
+		from:     c.Query("collected_from"),
+		to:       c.Query("collected_to"),
+	}
+	for _, date := range []string{filter.from, filter.to} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(collectionDateLayout, date); err != nil {
+			return filter, fmt.Errorf("invalid date %q (expected YYYY-MM-DD)", date)
+		}
+	}
+	return filter, nil
+}
+
+func (f sampleFilter) empty() bool {
+	return f.name == "" && f.location == "" && len(f.tags) == 0 && f.from == "" && f.to == ""
+}
+
+// match reports whether a job's sample passes the filter; names and
+// locations match case-insensitively and every tag must be present
+func (f sampleFilter) match(s *SampleMetadata) bool {
+	if f.empty() {
+		return true
+	}
+	if s == nil {
+		return false
+	}
+	if f.name != "" && !strings.EqualFold(f.name, s.Name) {
+		return false
+	}
+	if f.location != "" && !strings.EqualFold(f.location, s.Location) {
+		return false
+	}
+	for _, tag := range f.tags {
+		found := false
+		for _, t := range s.Tags {
+			found = found || t == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	// YYYY-MM-DD dates compare correctly as strings
+	if f.from != "" && (s.CollectionDate == "" || s.CollectionDate < f.from) {
+		return false
+	}
+	if f.to != "" && (s.CollectionDate == "" || s.CollectionDate > f.to) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Scheduler admits jobs to run under a global and a per-user concurrency cap.
+// Waiting jobs are started highest priority first; among equal priorities the
+// user with the fewest running jobs goes first, then the oldest submission,
+// so one user's large batch can't starve everyone else.
+type Scheduler struct {
+	mu         sync.Mutex
+	maxRunning int // 0 means unlimited
+	userMax    int // 0 means unlimited
+	running    int
+	perUser    map[string]int
+	waiting    []*schedulerEntry
+	enqueued   map[string]*schedulerEntry // entries added by Enqueue that Wait hasn't picked up yet
+	seq        uint64
+}
+
+type schedulerEntry struct {
+	job      string
+	user     string
+	priority int
+	seq      uint64
+	start    chan struct{} // closed when admitted
+}
+
+// maxQueued caps the jobs waiting for a slot, so a burst of submissions is
+// turned away instead of piling up spooled uploads; set with -max-queued, 0
+// for no cap
+var maxQueued int
+
+// queueFullRetryAfter is the Retry-After, in seconds, sent with submissions
+// refused because the queue is full
+const queueFullRetryAfter = "30"
+
+// scheduler schedules the async and sync jobs of this instance
+var scheduler = NewScheduler(0, 0)
+
+// NewScheduler creates a scheduler with the given caps (0 for unlimited)
+func NewScheduler(maxRunning, userMax int) *Scheduler {
+	return &Scheduler{maxRunning: maxRunning, userMax: userMax, perUser: make(map[string]int), enqueued: make(map[string]*schedulerEntry)}
+}
+
+// Enqueue puts a job in line before it is ready to Wait, so the position of a
+// job just accepted in the background can be reported straight away
+func (s *Scheduler) Enqueue(job, user string, priority int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.enqueued[job]; !ok {
+		s.enqueued[job] = s.add(job, user, priority)
+	}
+}
+
+// Wait blocks until the job may run and returns a func to call when it is done.
+// It returns ctx.Err() if ctx is canceled while the job is still waiting.
+func (s *Scheduler) Wait(ctx context.Context, job, user string, priority int) (release func(), err error) {
+	s.mu.Lock()
+	entry, ok := s.enqueued[job]
+	if ok {
+		delete(s.enqueued, job)
+	} else {
+		entry = s.add(job, user, priority)
+	}
+	s.mu.Unlock()
+
+	release = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running--
+		if s.perUser[user]--; s.perUser[user] == 0 {
+			delete(s.perUser, user)
+		}
+		s.dispatch()
+	}
+
+	select {
+	case <-entry.start:
+		return release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		admitted := false
+		select {
+		case <-entry.start:
+			admitted = true // admitted while being canceled
+		default:
+			s.remove(entry)
+		}
+		s.mu.Unlock()
+		if admitted {
+			release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// add puts a job in line and starts whatever may run; callers hold s.mu
+func (s *Scheduler) add(job, user string, priority int) *schedulerEntry {
+	s.seq++
+	entry := &schedulerEntry{job: job, user: user, priority: priority, seq: s.seq, start: make(chan struct{})}
+	s.waiting = append(s.waiting, entry)
+	s.dispatch()
+	return entry
+}
+
+// Position returns where a waiting job is in line, 1 being next, and false
+// once it has started or if it never waited here. It counts the jobs that
+// would start ahead of it were slots free now; a job at its user's cap may
+// still be passed by later jobs of other users.
+func (s *Scheduler) Position(job string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entry *schedulerEntry
+	for _, e := range s.waiting {
+		if e.job == job {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
+		return 0, false
+	}
+	position := 1
+	for _, e := range s.waiting {
+		if e != entry && s.before(e, entry) {
+			position++
+		}
+	}
+	return position, true
+}
+
+// Waiting counts the jobs waiting for a slot
+func (s *Scheduler) Waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiting)
+}
+
+// dispatch starts waiting jobs while there is room; callers hold s.mu
+func (s *Scheduler) dispatch() {
+	for s.maxRunning == 0 || s.running < s.maxRunning {
+		next := s.next()
+		if next == nil {
+			return
+		}
+		s.remove(next)
+		s.running++
+		s.perUser[next.user]++
+		close(next.start)
+	}
+}
+
+// next picks the waiting job to start, or nil if every waiting user is at their cap
+func (s *Scheduler) next() *schedulerEntry {
+	var best *schedulerEntry
+	for _, e := range s.waiting {
+		if s.userMax > 0 && s.perUser[e.user] >= s.userMax {
+			continue
+		}
+		if best == nil || s.before(e, best) {
+			best = e
+		}
+	}
+	return best
+}
+
+// before reports whether a should start ahead of b
+func (s *Scheduler) before(a, b *schedulerEntry) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if ra, rb := s.perUser[a.user], s.perUser[b.user]; ra != rb {
+		return ra < rb
+	}
+	return a.seq < b.seq
+}
+
+func (s *Scheduler) remove(entry *schedulerEntry) {
+	for i, e := range s.waiting {
+		if e == entry {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return
+		}
+	}
+}
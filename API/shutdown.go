@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// errShutdown fails the jobs still running when the shutdown timeout runs out
+var errShutdown = errors.New("interrupted by a server shutdown")
+
+// abortGrace is how long aborted jobs get to remove their partial output
+const abortGrace = 10 * time.Second
+
+// shuttingDown is set once SIGTERM or SIGINT arrives
+var shuttingDown atomic.Bool
+
+// refuseNewJobs turns job submissions away while the server shuts down, so
+// clients retry on another instance; status, summary and result requests
+// keep working until the jobs in flight are done
+func refuseNewJobs(c *fiber.Ctx) error {
+	if !shuttingDown.Load() || c.Method() != fiber.MethodPost {
+		return c.Next()
+	}
+	switch c.Path() {
+	case apiPrefix + "/upload", apiPrefix + "/jobs":
+		c.Set(fiber.HeaderRetryAfter, "30")
+		c.Set(fiber.HeaderConnection, "close")
+		return c.Status(fiber.StatusServiceUnavailable).SendString("Server is shutting down; retry shortly")
+	}
+	return c.Next()
+}
+
+// checkAcceptingJobs fails /readyz during shutdown so load balancers stop
+// sending new work
+func checkAcceptingJobs(context.Context) error {
+	if shuttingDown.Load() {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// waitFor polls until done reports true or timeout passes
+func waitFor(timeout time.Duration, done func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return true
+}
+
+// shutdown stops the server gracefully: new jobs are refused, jobs in flight
+// get up to timeout to finish and write their output, and the rest are
+// aborted, their partial output and spooled uploads removed. Jobs taken from
+// the Redis queue are put back on it for another instance instead.
+func shutdown(app *fiber.App, timeout time.Duration) {
+	shuttingDown.Store(true)
+	if queue != nil {
+		queue.Stop()
+	}
+	slog.Info("shutting down", "jobs_in_flight", jobs.InFlight(), "timeout", timeout)
+	if !waitFor(timeout, func() bool { return jobs.InFlight() == 0 }) {
+		aborted := jobs.Abort(errShutdown)
+		slog.Warn("aborting jobs still in flight", "jobs", aborted)
+		if !waitFor(abortGrace, func() bool { return jobs.InFlight() == 0 }) {
+			slog.Error("jobs didn't stop in time; their partial output may remain", "jobs", jobs.InFlight())
+		}
+	}
+	if queue != nil {
+		waitFor(abortGrace, func() bool { return queue.alive.Load() == 0 })
+	}
+
+	// Finish the requests still open, e.g. sync uploads returning their result
+	if err := app.ShutdownWithTimeout(abortGrace); err != nil {
+		slog.Error("can't close open connections", "error", err)
+	}
+	if redirectServer != nil {
+		redirectServer.Close()
+	}
+	if jobs.store != nil {
+		if err := jobs.store.Close(); err != nil {
+			slog.Error("can't close the job database", "error", err)
+		}
+	}
+	if queue != nil {
+		queue.client.Close()
+	}
+	if resultBucket != nil {
+		resultBucket.Close()
+	}
+	slog.Info("shut down")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/shenwei356/bio/seqio/fastx"
+)
+
+// SpoolStat is the read count and read length of one spooled FASTQ, the
+// figures BScore normalizes coverage with
+type SpoolStat struct {
+	Records int `json:"records"`
+	// ReadLength is the shortest read, the seqkit stats column (min_len)
+	// the scoring has always used as the average read length
+	ReadLength float64 `json:"read_length"`
+}
+
+// combineStats merges the stats of files classified as one sample
+func combineStats(stats []SpoolStat) SpoolStat {
+	var total SpoolStat
+	for i, stat := range stats {
+		if i == 0 || stat.ReadLength < total.ReadLength {
+			total.ReadLength = stat.ReadLength
+		}
+		total.Records += stat.Records
+	}
+	return total
+}
+
+// spoolCounting copies an upload to w while counting its reads in the same
+// pass, so the spool file never has to be read just for stats. Gzipped
+// uploads are decompressed for counting only; w gets the bytes as sent.
+func spoolCounting(w io.Writer, r io.Reader) (SpoolStat, error) {
+	pr, pw := io.Pipe()
+	counted := make(chan SpoolStat, 1)
+	countErr := make(chan error, 1)
+	go func() {
+		stat, err := countReads(pr)
+		io.Copy(io.Discard, pr) // keep the copy going if counting stopped early
+		counted <- stat
+		countErr <- err
+	}()
+
+	_, err := io.Copy(io.MultiWriter(w, pw), r)
+	pw.CloseWithError(err)
+	stat := <-counted
+	if err != nil {
+		return SpoolStat{}, err
+	}
+	if err := <-countErr; err != nil {
+		return SpoolStat{}, fmt.Errorf("invalid FASTQ: %w", err)
+	}
+	return stat, nil
+}
+
+// countReads counts the reads of a FASTQ stream and finds the shortest
+func countReads(r io.Reader) (SpoolStat, error) {
+	var stat SpoolStat
+	reader, err := fastx.NewReaderFromIO(nil, r, "")
+	if err != nil {
+		if err == io.EOF {
+			return stat, nil // empty upload
+		}
+		return stat, err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return stat, nil
+		}
+		if err != nil {
+			return stat, err
+		}
+		length := float64(len(record.Seq.Seq))
+		if stat.Records == 0 || length < stat.ReadLength {
+			stat.ReadLength = length
+		}
+		stat.Records++
+	}
+}
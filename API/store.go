@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// jobStore persists job records in SQLite so history survives a restart
+type jobStore struct {
+	db *sql.DB
+}
+
+const jobStoreSchema = `CREATE TABLE IF NOT EXISTS jobs (
+	id              TEXT PRIMARY KEY,
+	state           TEXT NOT NULL,
+	error           TEXT NOT NULL DEFAULT '',
+	params          TEXT NOT NULL DEFAULT '{}',
+	output          TEXT NOT NULL DEFAULT '',
+	download_name   TEXT NOT NULL DEFAULT '',
+	reads_processed INTEGER NOT NULL DEFAULT 0,
+	total_reads     INTEGER NOT NULL DEFAULT 0,
+	summary         TEXT NOT NULL DEFAULT '',
+	created_at      TEXT NOT NULL,
+	started_at      TEXT NOT NULL DEFAULT '',
+	finished_at     TEXT NOT NULL DEFAULT ''
+)`
+
+const keyStoreSchema = `CREATE TABLE IF NOT EXISTS api_keys (
+	id         TEXT PRIMARY KEY,
+	name       TEXT NOT NULL,
+	hash       TEXT NOT NULL UNIQUE,
+	rate_limit INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL,
+	workspace  TEXT NOT NULL DEFAULT ''
+)`
+
+// auditStoreSchema keeps the audit log append-only: the triggers refuse any
+// update or delete, whoever makes it
+const auditStoreSchema = `CREATE TABLE IF NOT EXISTS audit_log (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	time      TEXT NOT NULL,
+	actor     TEXT NOT NULL,
+	workspace TEXT NOT NULL DEFAULT '',
+	ip        TEXT NOT NULL DEFAULT '',
+	action    TEXT NOT NULL,
+	job_id    TEXT NOT NULL DEFAULT '',
+	detail    TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;`
+
+// keyStoreMigrations bring api_keys tables made by older versions up to date
+var keyStoreMigrations = []string{
+	`ALTER TABLE api_keys ADD COLUMN workspace TEXT NOT NULL DEFAULT ''`,
+}
+
+// openJobStore opens (creating if needed) the job database at path
+func openJobStore(path string) (*jobStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open job database: %w", err)
+	}
+	db.SetMaxOpenConns(1) // SQLite allows a single writer
+	if _, err := db.Exec(jobStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't create jobs table: %w", err)
+	}
+	if _, err := db.Exec(keyStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't create api_keys table: %w", err)
+	}
+	if _, err := db.Exec(auditStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't create audit_log table: %w", err)
+	}
+	for _, migration := range keyStoreMigrations {
+		if _, err := db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("can't update api_keys table: %w", err)
+		}
+	}
+	return &jobStore{db: db}, nil
+}
+
+// jobRecord is the persisted form of a Job
+type jobRecord struct {
+	ID             string
+	State          string
+	Error          string
+	Params         JobParams
+	Output         string
+	DownloadName   string
+	ReadsProcessed int64
+	TotalReads     int64
+	Summary        *Summary
+	CreatedAt      time.Time
+	StartedAt      time.Time
+	FinishedAt     time.Time
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
+
+// Save inserts or replaces a job record
+func (s *jobStore) Save(r jobRecord) error {
+	params, err := json.Marshal(r.Params)
+	if err != nil {
+		return err
+	}
+	var summary []byte
+	if r.Summary != nil {
+		if summary, err = json.Marshal(r.Summary); err != nil {
+			return err
+		}
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO jobs
+		(id, state, error, params, output, download_name, reads_processed, total_reads, summary, created_at, started_at, finished_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.State, r.Error, string(params), r.Output, r.DownloadName, r.ReadsProcessed, r.TotalReads,
+		string(summary), formatTime(r.CreatedAt), formatTime(r.StartedAt), formatTime(r.FinishedAt))
+	if err != nil {
+		return fmt.Errorf("can't save job %s: %w", r.ID, err)
+	}
+	return nil
+}
+
+// Delete removes a job record
+func (s *jobStore) Delete(id string) error {
+	if _, err := s.db.Exec(`DELETE FROM jobs WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("can't delete job %s: %w", id, err)
+	}
+	return nil
+}
+
+// Load returns every stored job record
+func (s *jobStore) Load() ([]jobRecord, error) {
+	rows, err := s.db.Query(`SELECT id, state, error, params, output, download_name, reads_processed,
+		total_reads, summary, created_at, started_at, finished_at FROM jobs`)
+	if err != nil {
+		return nil, fmt.Errorf("can't load jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var records []jobRecord
+	for rows.Next() {
+		var r jobRecord
+		var params, summary, createdAt, startedAt, finishedAt string
+		if err := rows.Scan(&r.ID, &r.State, &r.Error, &params, &r.Output, &r.DownloadName, &r.ReadsProcessed,
+			&r.TotalReads, &summary, &createdAt, &startedAt, &finishedAt); err != nil {
+			return nil, fmt.Errorf("can't load jobs: %w", err)
+		}
+		if err := json.Unmarshal([]byte(params), &r.Params); err != nil {
+			return nil, fmt.Errorf("job %s has invalid params: %w", r.ID, err)
+		}
+		if summary != "" {
+			r.Summary = &Summary{}
+			if err := json.Unmarshal([]byte(summary), r.Summary); err != nil {
+				return nil, fmt.Errorf("job %s has an invalid summary: %w", r.ID, err)
+			}
+		}
+		r.CreatedAt = parseTime(createdAt)
+		r.StartedAt = parseTime(startedAt)
+		r.FinishedAt = parseTime(finishedAt)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Close closes the database
+func (s *jobStore) Close() error {
+	return s.db.Close()
+}
+
+// SaveKey stores an API key by its hash
+func (s *jobStore) SaveKey(key *APIKey) error {
+	_, err := s.db.Exec(`INSERT INTO api_keys (id, name, hash, rate_limit, created_at, workspace) VALUES (?, ?, ?, ?, ?, ?)`,
+		key.ID, key.Name, key.hash, key.RateLimit, formatTime(key.CreatedAt), key.Workspace)
+	if err != nil {
+		return fmt.Errorf("can't save API key %s: %w", key.ID, err)
+	}
+	return nil
+}
+
+// DeleteKey removes an API key
+func (s *jobStore) DeleteKey(id string) error {
+	if _, err := s.db.Exec(`DELETE FROM api_keys WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("can't delete API key %s: %w", id, err)
+	}
+	return nil
+}
+
+// LoadKeys returns every stored API key
+func (s *jobStore) LoadKeys() ([]*APIKey, error) {
+	rows, err := s.db.Query(`SELECT id, name, hash, rate_limit, created_at, workspace FROM api_keys`)
+	if err != nil {
+		return nil, fmt.Errorf("can't load API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key := &APIKey{}
+		var createdAt string
+		if err := rows.Scan(&key.ID, &key.Name, &key.hash, &key.RateLimit, &createdAt, &key.Workspace); err != nil {
+			return nil, fmt.Errorf("can't load API keys: %w", err)
+		}
+		key.CreatedAt = parseTime(createdAt)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// AppendAudit adds an event to the audit log
+func (s *jobStore) AppendAudit(e AuditEvent) error {
+	var detail []byte
+	if len(e.Detail) > 0 {
+		var err error
+		if detail, err = json.Marshal(e.Detail); err != nil {
+			return err
+		}
+	}
+	_, err := s.db.Exec(`INSERT INTO audit_log (time, actor, workspace, ip, action, job_id, detail) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		formatTime(e.Time), e.Actor, e.Workspace, e.IP, e.Action, e.JobID, string(detail))
+	if err != nil {
+		return fmt.Errorf("can't save audit event: %w", err)
+	}
+	return nil
+}
+
+// LoadAudit returns the audit events matching filter, newest first
+func (s *jobStore) LoadAudit(filter auditFilter) ([]AuditEvent, error) {
+	query := `SELECT id, time, actor, workspace, ip, action, job_id, detail FROM audit_log WHERE 1 = 1`
+	var args []any
+	for column, value := range map[string]string{"action": filter.Action, "actor": filter.Actor, "workspace": filter.Workspace, "job_id": filter.JobID} {
+		if value != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, value)
+		}
+	}
+	// Times are stored as RFC 3339 in UTC, so they compare as strings
+	if !filter.Since.IsZero() {
+		query += " AND time >= ?"
+		args = append(args, formatTime(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		query += " AND time < ?"
+		args = append(args, formatTime(filter.Until))
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("can't load the audit log: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]AuditEvent, 0)
+	for rows.Next() {
+		var e AuditEvent
+		var at, detail string
+		if err := rows.Scan(&e.ID, &at, &e.Actor, &e.Workspace, &e.IP, &e.Action, &e.JobID, &detail); err != nil {
+			return nil, fmt.Errorf("can't load the audit log: %w", err)
+		}
+		e.Time = parseTime(at)
+		if detail != "" {
+			if err := json.Unmarshal([]byte(detail), &e.Detail); err != nil {
+				return nil, fmt.Errorf("audit event %d has invalid detail: %w", e.ID, err)
+			}
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"bhedi/output"
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultOpts are the output options used when a submission doesn't override them
+var defaultOpts OutputOptions
+
+// jobMemory is the output buffer of each job, set with -job-memory; it
+// defaults to the Parquet writer's own row group size
+var jobMemory = byteSize(128 << 20)
+
+// parquetPageSize is the page size of every job's Parquet files, set with
+// -parquet-page-size; it defaults to the Parquet writer's own
+var parquetPageSize = byteSize(8 << 10)
+
+// formField looks up a submitted field, falling back to defaultValue
+type formField func(key string, defaultValue ...string) string
+
+// jobOptions reads the output options and job parameters every way of
+// submitting a job accepts; filenames are the names of the submitted files
+func jobOptions(c *fiber.Ctx, field formField, filenames []string) (OutputOptions, JobParams, error) {
+	var err error
+	opts := defaultOpts
+	opts.Format = field("format", defaultOpts.Format)
+	opts.Schema = field("schema", defaultOpts.Schema)
+	if opts.Columns, err = output.ParseColumns(field("columns")); err != nil {
+		return opts, JobParams{}, err
+	}
+	if opts.Workers, err = jobLimit(field, "workers", defaultOpts.Workers); err != nil {
+		return opts, JobParams{}, err
+	}
+	if opts.WriterParallelism, err = jobLimit(field, "writer_parallelism", defaultOpts.WriterParallelism); err != nil {
+		return opts, JobParams{}, err
+	}
+	if opts.Memory, err = jobMemoryLimit(field); err != nil {
+		return opts, JobParams{}, err
+	}
+	if err := opts.Validate(); err != nil {
+		return opts, JobParams{}, err
+	}
+	timeout, err := jobTimeLimit(field)
+	if err != nil {
+		return opts, JobParams{}, err
+	}
+
+	params := JobParams{
+		Filename:    filenames[0],
+		Format:      opts.Format,
+		Schema:      opts.Schema,
+		Columns:     opts.Columns,
+		Compression: opts.Compression,
+	}
+	if opts.Workers != defaultOpts.Workers {
+		params.Workers = opts.Workers
+	}
+	if opts.WriterParallelism != defaultOpts.WriterParallelism {
+		params.WriterParallelism = opts.WriterParallelism
+	}
+	if opts.Memory != defaultOpts.Memory {
+		memory := byteSize(opts.Memory)
+		params.Memory = memory.String()
+	}
+	if timeout > 0 {
+		params.Timeout = timeout.String()
+	}
+	// Jobs count against their API key or OIDC user unless the submission names one
+	user := c.IP()
+	if key := requestKey(c); key != nil {
+		params.APIKey, user = key.ID, key.Name
+	} else if subject := requestUser(c); subject != "" {
+		params.Subject, user = subject, subject
+	}
+	params.User = field("user", user)
+	params.Client = clientID(c)
+	params.RequestID = requestID(c)
+	params.Workspace = requestWorkspace(c)
+	if len(filenames) > 1 {
+		params.Mode = field("mode", UploadSample)
+		if params.Mode != UploadSample && params.Mode != UploadBatch {
+			return opts, params, fmt.Errorf("unknown mode %q (expected %s or %s)", params.Mode, UploadSample, UploadBatch)
+		}
+		params.Files = filenames
+	}
+	if priority := field("priority"); priority != "" {
+		if params.Priority, err = strconv.Atoi(priority); err != nil {
+			return opts, params, fmt.Errorf("invalid priority %q (expected an integer, higher runs first)", priority)
+		}
+	}
+	if params.Sample, err = parseSampleMetadata(field); err != nil {
+		return opts, params, err
+	}
+	if params.CallbackURL = field("callback_url"); params.CallbackURL != "" {
+		if err := validateCallbackURL(params.CallbackURL); err != nil {
+			return opts, params, err
+		}
+		params.PublicURL = publicURL
+		if params.PublicURL == "" {
+			params.PublicURL = c.BaseURL()
+		}
+	}
+	return opts, params, nil
+}
+
+// jobLimit reads a per-job concurrency setting, which may lower the server's
+// limit but not raise it
+func jobLimit(field formField, key string, limit int) (int, error) {
+	value := field(key)
+	if value == "" {
+		return limit, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q (expected a positive integer)", key, value)
+	}
+	if n > limit {
+		return 0, fmt.Errorf("%s %d is over this server's limit of %d", key, n, limit)
+	}
+	return n, nil
+}
+
+// jobMemoryLimit reads the memory field, which may lower -job-memory but not raise it
+func jobMemoryLimit(field formField) (int64, error) {
+	value := field("memory")
+	if value == "" {
+		return defaultOpts.Memory, nil
+	}
+	var memory byteSize
+	if err := memory.Set(value); err != nil || memory < 1<<20 {
+		return 0, fmt.Errorf("invalid memory %q (expected a size of at least 1MB, e.g. 64MB)", value)
+	}
+	if int64(memory) > defaultOpts.Memory {
+		return 0, fmt.Errorf("memory %v is over this server's limit of %v", &memory, &jobMemory)
+	}
+	return int64(memory), nil
+}
+
+// jobTimeLimit reads the timeout field, which may lower -job-timeout but not
+// raise it; 0 leaves the job to the server's limit
+func jobTimeLimit(field formField) (time.Duration, error) {
+	value := field("timeout")
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q (expected a duration such as 90m or 6h)", value)
+	}
+	if jobTimeout > 0 && timeout > jobTimeout {
+		return 0, fmt.Errorf("timeout %v is over this server's limit of %v", timeout, jobTimeout)
+	}
+	return timeout, nil
+}
+
+// prepareJob takes the workspace's current sanket panel, records it in the output metadata and
+// picks the job's output file. A batch comes back as a zip with one output per file.
+func prepareJob(job *Job, opts *OutputOptions) (map[string]SanketInfo, error) {
+	panel := panelFor(job.Params.Workspace)
+	opts.Metadata = runMetadata(panel.Info, opts.Schema)
+	for key, value := range job.Params.Sample.footerMetadata() {
+		opts.Metadata[key] = value
+	}
+
+	ext := opts.Extension()
+	if job.Params.Mode == UploadBatch {
+		ext = ".zip"
+	}
+	// Each job gets its own directory, so concurrent jobs never share a path
+	job.SetOutput(filepath.Join(outputDir, job.ID, "output"+ext), "output"+ext)
+	return panel.Sankets, nil
+}
+
+// launchJob runs a job in the background, on the shared queue when there is
+// one. It takes ownership of the spool files, removing them when done or on error.
+func launchJob(job *Job, spools []string, stats []SpoolStat, sankets map[string]SanketInfo, opts OutputOptions) error {
+	if queue != nil {
+		// Hand the job to whichever instance picks it off the shared queue
+		if err := queue.Enqueue(newJobTask(job, spools, stats, opts)); err != nil {
+			removeSpools(spools)
+			return fmt.Errorf("failed to queue the job: %w", err)
+		}
+		jobs.Handoff(job)
+		return nil
+	}
+	scheduler.Enqueue(job.ID, job.Params.User, job.Params.Priority)
+	go func() {
+		defer removeSpools(spools)
+		job.Finish(runJob(job, spools, stats, sankets, opts))
+	}()
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+
+	"bhedi/output"
+)
+
+// SerotypeSummary aggregates the reads that hit one serotype
+type SerotypeSummary struct {
+	Serotype   string  `json:"serotype"`
+	Reads      int64   `json:"reads"`   // reads with at least one sanket of this serotype
+	Matches    int64   `json:"matches"` // sanket hits, a read can hit several
+	MeanBScore float64 `json:"mean_b_score"`
+}
+
+// Summary is the JSON view of a job's classification so far
+type Summary struct {
+	JobID          string            `json:"job_id"`
+	State          string            `json:"state"`
+	ReadsProcessed int64             `json:"reads_processed"`
+	MatchedReads   int64             `json:"matched_reads"`
+	MatchRate      float64           `json:"match_rate"`
+	Call           string            `json:"call,omitempty"` // serotype with the most reads
+	Serotypes      []SerotypeSummary `json:"serotypes"`
+	Sample         *SampleMetadata   `json:"sample,omitempty"`
+}
+
+type serotypeTally struct {
+	reads       int64
+	matches     int64
+	bscoreTotal float64
+}
+
+// summaryTally accumulates per-read results; callers serialize access
+type summaryTally struct {
+	reads     int64
+	matched   int64
+	serotypes map[string]*serotypeTally
+}
+
+func newSummaryTally() *summaryTally {
+	return &summaryTally{serotypes: make(map[string]*serotypeTally)}
+}
+
+// Add counts one processed read
+func (t *summaryTally) Add(result output.Result) {
+	t.reads++
+	if !result.MatchesFound {
+		return
+	}
+	t.matched++
+	seen := make(map[string]bool)
+	for _, match := range result.Matches {
+		s, ok := t.serotypes[match.Serotype]
+		if !ok {
+			s = &serotypeTally{}
+			t.serotypes[match.Serotype] = s
+		}
+		s.matches++
+		s.bscoreTotal += match.BScore
+		if !seen[match.Serotype] {
+			seen[match.Serotype] = true
+			s.reads++
+		}
+	}
+}
+
+// Summary snapshots the tally, serotypes ordered by read count
+func (t *summaryTally) Summary() Summary {
+	summary := Summary{
+		ReadsProcessed: t.reads,
+		MatchedReads:   t.matched,
+		Serotypes:      make([]SerotypeSummary, 0, len(t.serotypes)),
+	}
+	if t.reads > 0 {
+		summary.MatchRate = float64(t.matched) / float64(t.reads)
+	}
+	for serotype, s := range t.serotypes {
+		summary.Serotypes = append(summary.Serotypes, SerotypeSummary{
+			Serotype:   serotype,
+			Reads:      s.reads,
+			Matches:    s.matches,
+			MeanBScore: s.bscoreTotal / float64(s.matches),
+		})
+	}
+	sort.Slice(summary.Serotypes, func(i, j int) bool {
+		a, b := summary.Serotypes[i], summary.Serotypes[j]
+		if a.Reads != b.Reads {
+			return a.Reads > b.Reads
+		}
+		return a.Serotype < b.Serotype
+	})
+	if len(summary.Serotypes) > 0 {
+		summary.Call = summary.Serotypes[0].Serotype
+	}
+	return summary
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiVersion is the API version the routes implement, mounted under apiPrefix.
+// Within a version, changes are additive only (new endpoints, optional
+// parameters and response fields); anything that would break a client, such
+// as renaming a result column or changing the job model, needs a new version.
+const apiVersion = 1
+
+var apiPrefix = "/v" + strconv.Itoa(apiVersion)
+
+// supportedVersions are the versions this server still serves
+var supportedVersions = map[int]bool{apiVersion: true}
+
+var (
+	versionPathPattern   = regexp.MustCompile(`^/v([0-9]+)(/|$)`)
+	versionAcceptPattern = regexp.MustCompile(`application/vnd\.bhedi\.v([0-9]+)\+json`)
+)
+
+// jobPath is where a job's status is served
+func jobPath(id string) string {
+	return apiPrefix + "/jobs/" + id
+}
+
+// requestedVersion reads the version a request asks for in its API-Version
+// header (1 or v1) or Accept header (application/vnd.bhedi.v1+json), 0 for none
+func requestedVersion(c *fiber.Ctx) (int, error) {
+	if value := c.Get("API-Version"); value != "" {
+		version, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(value), "v"))
+		if err != nil || version < 1 {
+			return 0, fmt.Errorf("invalid API-Version %q (expected e.g. 1)", value)
+		}
+		return version, nil
+	}
+	if m := versionAcceptPattern.FindStringSubmatch(c.Get(fiber.HeaderAccept)); m != nil {
+		version, _ := strconv.Atoi(m[1])
+		return version, nil
+	}
+	return 0, nil
+}
+
+// supportedList names the supported versions for error messages
+func supportedList() string {
+	var names []string
+	for version := 1; len(names) < len(supportedVersions); version++ {
+		if supportedVersions[version] {
+			names = append(names, "v"+strconv.Itoa(version))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// negotiateVersion routes every request to a versioned endpoint. Requests
+// under /v1/ are served as is; unprefixed ones, which scripts written before
+// versioning use, go to the version asked for in the headers, v1 by default,
+// so existing clients keep working when a new version is added.
+func negotiateVersion(c *fiber.Ctx) error {
+	path := c.Path()
+	if m := versionPathPattern.FindStringSubmatch(path); m != nil {
+		version, _ := strconv.Atoi(m[1])
+		if !supportedVersions[version] {
+			return c.Status(fiber.StatusNotFound).SendString(fmt.Sprintf("Unsupported API version v%d; this server supports %s", version, supportedList()))
+		}
+		c.Set("API-Version", m[1])
+		return c.Next()
+	}
+
+	version, err := requestedVersion(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if version == 0 {
+		version = apiVersion
+	}
+	if !supportedVersions[version] {
+		return c.Status(fiber.StatusNotAcceptable).SendString(fmt.Sprintf("Unsupported API version %d; this server supports %s", version, supportedList()))
+	}
+	c.Set("API-Version", strconv.Itoa(version))
+	c.Path("/v" + strconv.Itoa(version) + path)
+	return c.Next()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook delivery settings
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+)
+
+// signingKey signs download links and webhook bodies; set with -signing-key
+// or BHEDI_SIGNING_KEY, otherwise a random key is generated at startup
+var signingKey []byte
+
+// linkTTL is how long a signed download link stays valid
+var linkTTL = 24 * time.Hour
+
+// initSigningKey uses key, or a random key when it is empty
+func initSigningKey(key string) {
+	if key != "" {
+		signingKey = []byte(key)
+		return
+	}
+	signingKey = make([]byte, 32)
+	if _, err := rand.Read(signingKey); err != nil {
+		panic(err)
+	}
+	slog.Warn("no -signing-key set, signed download links only work on this instance until it restarts")
+}
+
+func sign(message string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedResultURL returns a download link for a job's result valid until expires
+func signedResultURL(baseURL, id string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return strings.TrimSuffix(baseURL, "/") + jobPath(id) + "/result?expires=" + exp + "&signature=" + sign(id+":"+exp)
+}
+
+// verifyResultSignature checks the expires and signature query values of a download link
+func verifyResultSignature(id, expires, signature string) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expires value")
+	}
+	if !hmac.Equal([]byte(sign(id+":"+expires)), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+	if time.Now().Unix() > exp {
+		return fmt.Errorf("download link expired")
+	}
+	return nil
+}
+
+// validateCallbackURL accepts absolute http(s) URLs only
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback_url %q (expected an absolute http or https URL)", raw)
+	}
+	return nil
+}
+
+// WebhookPayload is POSTed to a job's callback URL when it finishes
+type WebhookPayload struct {
+	Job         JobStatus  `json:"job"`
+	Summary     Summary    `json:"summary"`
+	DownloadURL string     `json:"download_url,omitempty"` // signed, only for done jobs
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// notifyCallback POSTs the finished job to its callback URL, retrying with
+// backoff. The body is signed in the X-Bhedi-Signature header (sha256=<hex HMAC>)
+// with the signing key so receivers can check it came from this server.
+func notifyCallback(job *Job) {
+	payload := WebhookPayload{Job: job.Status(), Summary: job.Summary()}
+	if payload.Job.State == JobDone {
+		expires := time.Now().Add(linkTTL).UTC()
+		payload.DownloadURL = signedResultURL(job.Params.PublicURL, job.ID, expires)
+		payload.ExpiresAt = &expires
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		job.logger().Error("can't encode webhook", "error", err)
+		return
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	backoff := time.Second
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = postCallback(client, job.Params.CallbackURL, job.Params.RequestID, body)
+		if err == nil {
+			return
+		}
+		job.logger().Warn("webhook failed", "attempt", attempt, "attempts", webhookAttempts, "error", err)
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func postCallback(client *http.Client, callbackURL, requestID string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bhedi-Signature", "sha256="+sign(string(body)))
+	if requestID != "" {
+		req.Header.Set(requestIDHeader, requestID) // the submission's, to tie the callback to it
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
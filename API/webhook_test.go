@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyResultSignature(t *testing.T) {
+	defer func(key []byte) { signingKey = key }(signingKey)
+	signingKey = []byte("test key")
+
+	valid := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	later := strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10)
+	signature := sign("job1:" + valid)
+	tampered := []byte(signature)
+	tampered[0] ^= 1
+
+	for _, tt := range []struct {
+		name                   string
+		id, expires, signature string
+		ok                     bool
+	}{
+		{"valid", "job1", valid, signature, true},
+		{"tampered signature", "job1", valid, string(tampered), false},
+		{"another job's link", "job2", valid, signature, false},
+		{"expiry pushed back", "job1", later, signature, false},
+		{"expired", "job1", expired, sign("job1:" + expired), false},
+		{"no signature", "job1", valid, "", false},
+		{"bad expires", "job1", "soon", sign("job1:soon"), false},
+	} {
+		if err := verifyResultSignature(tt.id, tt.expires, tt.signature); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	// A link signedResultURL makes verifies, and stops once the key changes
+	link, err := url.Parse(signedResultURL("https://bhedi.example.org/", "job1", time.Now().Add(linkTTL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := link.Query()
+	if err := verifyResultSignature("job1", query.Get("expires"), query.Get("signature")); err != nil {
+		t.Errorf("signed link %s: %v", link, err)
+	}
+	signingKey = []byte("another key")
+	if err := verifyResultSignature("job1", query.Get("expires"), query.Get("signature")); err == nil {
+		t.Errorf("signed link %s verified with another key", link)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Workspaces let several labs share one server. Each API key, and each OIDC
+// user when -oidc-workspace-claim is set, belongs to one workspace and only
+// sees the jobs, results and panel of that workspace. Keys without one, and
+// OIDC users while the claim isn't configured, share the default workspace
+// "". The admin key, and every client of a server without authentication,
+// sees all workspaces.
+
+// maxWorkspaceJobs caps the queued plus running jobs of each workspace, so one
+// lab can't fill a shared server; set with -max-workspace-jobs, 0 for no cap
+var maxWorkspaceJobs int
+
+var workspaceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// validateWorkspace checks a workspace name, which is also used in panel file
+// names and bucket keys
+func validateWorkspace(name string) error {
+	if !workspaceName.MatchString(name) {
+		return fmt.Errorf("invalid workspace %q (expected up to 64 letters, digits, _ and -)", name)
+	}
+	return nil
+}
+
+// workspaceScope is what a request may see: one workspace, or all of them
+type workspaceScope struct {
+	name string
+	all  bool
+}
+
+// requestScope returns the workspace a request was authenticated into
+func requestScope(c *fiber.Ctx) workspaceScope {
+	name, scoped := c.Locals("workspace").(string)
+	return workspaceScope{name: name, all: !scoped}
+}
+
+// requestWorkspace returns the workspace new jobs of a request go into
+func requestWorkspace(c *fiber.Ctx) string {
+	return requestScope(c).name
+}
+
+// sees reports whether the scope includes job
+func (s workspaceScope) sees(job *Job) bool {
+	return s.all || job.Params.Workspace == s.name
+}
+
+// jobForRequest looks up the job named by the :id route parameter. Jobs of
+// other workspaces are reported as not found rather than forbidden, so their
+// IDs can't be probed.
+func jobForRequest(c *fiber.Ctx) (*Job, bool) {
+	job, ok := jobs.Get(c.Params("id"))
+	if !ok || !requestScope(c).sees(job) {
+		return nil, false
+	}
+	return job, true
+}
+
+type scopeKey struct{}
+
+// withScope carries a request's workspace scope into GraphQL resolvers
+func withScope(ctx context.Context, scope workspaceScope) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope)
+}
+
+// contextScope returns the scope set by withScope; contexts without one see
+// every workspace
+func contextScope(ctx context.Context) workspaceScope {
+	scope, ok := ctx.Value(scopeKey{}).(workspaceScope)
+	if !ok {
+		return workspaceScope{all: true}
+	}
+	return scope
+}
+
+// ActiveInWorkspace counts the queued and running jobs of a workspace
+func (r *JobRegistry) ActiveInWorkspace(workspace string) int {
+	active := 0
+	for _, job := range r.List("") {
+		job.mu.Lock()
+		if job.Params.Workspace == workspace && !finalState(job.state) {
+			active++
+		}
+		job.mu.Unlock()
+	}
+	return active
+}
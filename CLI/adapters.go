@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Adapter sequences -trim-adapters knows by name. Adapters ligated before
+// the insert are searched for near the start of a read, as 5' adapters;
+// the rest at its end, as 3' adapters, including the reverse complement of
+// the ONT adapter, which reads running through the whole molecule end with.
+var knownAdapters = map[string][]adapter{
+	"illumina": {
+		{Sequence: "AGATCGGAAGAGC"},       // TruSeq, both reads
+		{Sequence: "CTGTCTCTTATACACATCT"}, // Nextera
+		{Sequence: "TGGAATTCTCGG"},        // small RNA
+	},
+	"ont": {
+		{Sequence: "AATGTACTTCGTTCAGTTACGTATTGCT", Front: true}, // ligation kit adapter
+		{Sequence: "AGCAATACGTAACTGAACGAAGTACATT"},              // its reverse complement
+	},
+}
+
+// adapterMinOverlap is the fewest bases of a 3' adapter a read may end with
+// for them to be trimmed, or of a 5' adapter a read may start with; shorter
+// overlaps are as likely to be chance
+const adapterMinOverlap = 8
+
+// adapterErrorRate allows a mismatch per 15 bases of an adapter, as
+// sequencing errors in it would otherwise hide it. Shorter adapters, such as
+// TruSeq's 13 bases, must match exactly: with a mismatch allowed, 13 bases
+// turn up by chance in about one read in a few thousand.
+const adapterErrorRate = 15
+
+// adapter is a sequence to trim from reads with everything past it, or for
+// a 5' adapter everything before it
+type adapter struct {
+	Sequence string
+	Front    bool
+}
+
+// adapterTrim removes adapters from reads before they are matched, so they
+// neither count towards a read's GC content nor hide a sanket's ends. The
+// zero value trims nothing.
+type adapterTrim struct {
+	Adapters []adapter
+	spec     string // as -trim-adapters gave them
+}
+
+// parseAdapters reads -trim-adapters: comma-separated names of known
+// adapters, or sequences of 3' adapters, each with a ^ in front for a 5' one
+func parseAdapters(spec string) (adapterTrim, error) {
+	t := adapterTrim{spec: spec}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		switch known, ok := knownAdapters[strings.ToLower(field)]; {
+		case field == "":
+		case ok:
+			t.Adapters = append(t.Adapters, known...)
+		default:
+			seq := strings.ToUpper(strings.TrimPrefix(field, "^"))
+			if len(seq) < adapterMinOverlap || strings.Trim(seq, "ACGT") != "" {
+				return t, fmt.Errorf("%q is neither a known adapter (%s) nor a sequence of at least %d bases of ACGT", field, adapterNames(), adapterMinOverlap)
+			}
+			t.Adapters = append(t.Adapters, adapter{Sequence: seq, Front: strings.HasPrefix(field, "^")})
+		}
+	}
+	return t, nil
+}
+
+// adapterNames lists the known adapters for errors and flag help
+func adapterNames() string {
+	names := make([]string, 0, len(knownAdapters))
+	for name := range knownAdapters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// String is the adapters as -trim-adapters gave them, for metadata and the
+// run report
+func (t adapterTrim) String() string {
+	return t.spec
+}
+
+// Set parses -trim-adapters, see parseAdapters
+func (t *adapterTrim) Set(spec string) (err error) {
+	*t, err = parseAdapters(spec)
+	return err
+}
+
+// bounds returns where the part of seq between its adapters starts and
+// ends: before the first 3' adapter found, in full or as the read's last
+// bases, and after the last 5' adapter found within barcodeWindow of the
+// start, or as its first bases
+func (t adapterTrim) bounds(seq []byte) (int, int) {
+	start, end := 0, len(seq)
+	for _, a := range t.Adapters {
+		limit := len(a.Sequence) / adapterErrorRate
+		seq := seq[start:end]
+		if a.Front {
+			window := seq[:min(len(seq), barcodeWindow)]
+			cut := 0
+			for p := 0; p+len(a.Sequence) <= len(window); p++ {
+				if mismatches(a.Sequence, window[p:], limit) <= limit {
+					cut = p + len(a.Sequence)
+				}
+			}
+			for k := min(len(a.Sequence)-1, len(seq)); cut == 0 && k >= adapterMinOverlap; k-- {
+				if tail := a.Sequence[len(a.Sequence)-k:]; mismatches(tail, seq, k/adapterErrorRate) <= k/adapterErrorRate {
+					cut = k
+				}
+			}
+			start += cut
+			continue
+		}
+		cut := len(seq)
+		for p := 0; p+len(a.Sequence) <= len(seq); p++ {
+			if mismatches(a.Sequence, seq[p:], limit) <= limit {
+				cut = p
+				break
+			}
+		}
+		for k := min(len(a.Sequence)-1, len(seq)); cut == len(seq) && k >= adapterMinOverlap; k-- {
+			if mismatches(a.Sequence[:k], seq[len(seq)-k:], k/adapterErrorRate) <= k/adapterErrorRate {
+				cut = len(seq) - k
+			}
+		}
+		end = start + cut
+	}
+	return start, end
+}
+
+// trim returns the part of seq between its adapters, see bounds
+func (t adapterTrim) trim(seq []byte) []byte {
+	start, end := t.bounds(seq)
+	return seq[start:end]
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAdapterBounds(t *testing.T) {
+	const (
+		insert  = "ACCGTGGTCAACCGTGGTCAACCGTGGTCAACCGTGGTCAACCGTGGTCA" // 50 bases no adapter overlaps
+		truseq  = "AGATCGGAAGAGC"
+		ontHead = "AATGTACTTCGTTCAGTTACGTATTGCT"
+		ontTail = "AGCAATACGTAACTGAACGAAGTACATT"
+	)
+	// mutate changes the bases of seq at the given positions
+	mutate := func(seq string, at ...int) string {
+		b := []byte(seq)
+		for _, i := range at {
+			b[i] = map[byte]byte{'A': 'C', 'C': 'G', 'G': 'T', 'T': 'A'}[b[i]]
+		}
+		return string(b)
+	}
+	ont, _ := parseAdapters("ont")
+	illumina, _ := parseAdapters("illumina")
+	tests := []struct {
+		name       string
+		adapters   adapterTrim
+		seq        string
+		start, end int
+	}{
+		{"no adapter", ont, insert, 0, 50},
+		{"full 3' adapter", illumina, insert + truseq + "GGGGG", 0, 50},
+		{"full 3' adapter at the end", ont, insert + ontTail, 0, 50},
+		{"3' adapter at position 0", illumina, truseq + insert, 0, 0},
+		{"partial 3' overlap", ont, insert + ontTail[:12], 0, 50},
+		{"shortest partial 3' overlap", ont, insert + ontTail[:adapterMinOverlap], 0, 50},
+		{"3' overlap too short", ont, insert + ontTail[:adapterMinOverlap-1], 0, 57},
+		{"read all 3' adapter start", ont, ontTail[:20], 0, 0},
+		{"3' mismatch at the limit", ont, insert + mutate(ontTail, 5) + insert, 0, 50},
+		{"3' mismatches over the limit", ont, insert + mutate(ontTail, 5, 20) + insert, 0, 128},
+		{"short adapter mismatch", illumina, insert + mutate(truseq, 3) + insert, 0, 113},
+		{"partial 3' mismatch at the limit", ont, insert + mutate(ontTail[:16], 10), 0, 50},
+		{"partial 3' mismatch over the limit", ont, insert + mutate(ontTail[:14], 10), 0, 64},
+		{"N matches any base", illumina, insert + "AGATCNGAAGAGC", 0, 50},
+		{"5' adapter at position 0", ont, ontHead + insert, 28, 78},
+		{"5' adapter after a barcode", ont, "GGGGGGGGGG" + ontHead + insert, 38, 88},
+		{"5' mismatch at the limit", ont, mutate(ontHead, 0) + insert, 28, 78},
+		{"partial 5' overlap", ont, ontHead[18:] + insert, 10, 60},
+		{"5' overlap too short", ont, ontHead[21:] + insert, 0, 57},
+		{"read all 5' adapter end", ont, ontHead[8:], 20, 20},
+		{"5' adapter past the barcode window", ont, strings.Repeat("G", barcodeWindow) + ontHead, 0, barcodeWindow + 28},
+		{"both ends", ont, ontHead + insert + ontTail, 28, 78},
+		{"partial both ends", ont, ontHead[14:] + insert + ontTail[:9], 14, 64},
+	}
+	for _, test := range tests {
+		start, end := test.adapters.bounds([]byte(test.seq))
+		if start != test.start || end != test.end {
+			t.Errorf("%s: bounds of %s = %d, %d, want %d, %d", test.name, test.seq, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestParseAdapters(t *testing.T) {
+	trim, err := parseAdapters("Illumina, ^acgtacgtac,GGCCAATTGG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(knownAdapters["illumina"]); len(trim.Adapters) != n+2 {
+		t.Fatalf("got %d adapters, want %d", len(trim.Adapters), n+2)
+	}
+	if got := trim.Adapters[len(trim.Adapters)-2]; got != (adapter{Sequence: "ACGTACGTAC", Front: true}) {
+		t.Errorf("^acgtacgtac is %+v", got)
+	}
+	if got := trim.Adapters[len(trim.Adapters)-1]; got != (adapter{Sequence: "GGCCAATTGG"}) {
+		t.Errorf("GGCCAATTGG is %+v", got)
+	}
+	for _, spec := range []string{"nextera", "ACGT", "ACGTNACGTA"} {
+		if _, err := parseAdapters(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+}
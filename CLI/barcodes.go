@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"bhedi/output"
+)
+
+// unclassifiedBarcode is the sample of reads no barcode of the sheet matches,
+// as the ONT basecallers name them
+const unclassifiedBarcode = "unclassified"
+
+// barcodeWindow is how far into a read demultiplexing looks for a barcode;
+// ONT reads start with adapter and barcode, a few dozen bases in all
+const barcodeWindow = 150
+
+// barcode is one row of a barcode sheet
+type barcode struct {
+	Name     string // e.g. barcode01, or an Illumina index name
+	Sequence string // the barcode, or index1+index2 for dual Illumina indexes; empty for barcode directories
+	Sample   string // the sample sequenced with it, the barcode's name by default
+}
+
+// barcodeSheet assigns reads to the barcodes of a sheet
+type barcodeSheet struct {
+	barcodes   []barcode
+	mismatches int // most mismatched bases a barcode may match with
+}
+
+// readBarcodeSheet reads a barcode sheet: one barcode per line with its
+// sequence and optionally the sample, separated by tabs or commas:
+//
+//	# barcode	sequence	sample
+//	barcode01	AAGAAAGTTGTCGGTGTCTTTGTG	S1
+//	D701	ATTACTCG+TATAGCCT	S2
+//
+// Blank lines, # comments and a header line starting with "barcode" are
+// skipped. The sequence may be left out for input already split into barcode
+// directories.
+func readBarcodeSheet(path string, mismatches int) (*barcodeSheet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the barcode sheet: %w", err)
+	}
+	defer f.Close()
+	sheet := &barcodeSheet{mismatches: mismatches}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := "\t"
+		if !strings.Contains(line, sep) {
+			sep = ","
+		}
+		fields := strings.Split(line, sep)
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(sheet.barcodes) == 0 && strings.EqualFold(fields[0], "barcode") {
+			continue
+		}
+		if len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("barcode sheet line %d: expected a barcode, its sequence and optionally a sample", n)
+		}
+		b := barcode{Name: fields[0], Sample: fields[0]}
+		if len(fields) > 1 {
+			b.Sequence = strings.ToUpper(fields[1])
+		}
+		if len(fields) > 2 && fields[2] != "" {
+			b.Sample = fields[2]
+		}
+		if strings.Trim(b.Sequence, "ACGTN+") != "" || strings.Contains(b.Sequence, "++") {
+			return nil, fmt.Errorf("barcode sheet line %d: %s is not a DNA sequence", n, fields[1])
+		}
+		if seen[b.Name] {
+			return nil, fmt.Errorf("barcode sheet line %d: barcode %s is listed twice", n, b.Name)
+		}
+		if strings.ContainsAny(b.Sample, `/\`) || b.Sample == unclassifiedBarcode {
+			return nil, fmt.Errorf("barcode sheet line %d: invalid sample name %q", n, b.Sample)
+		}
+		seen[b.Name] = true
+		sheet.barcodes = append(sheet.barcodes, b)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read the barcode sheet: %w", err)
+	}
+	if len(sheet.barcodes) == 0 {
+		return nil, fmt.Errorf("the barcode sheet %s lists no barcodes", path)
+	}
+	return sheet, nil
+}
+
+// checkSequences checks every barcode has a sequence to demultiplex by
+func (s *barcodeSheet) checkSequences() error {
+	for _, b := range s.barcodes {
+		if b.Sequence == "" {
+			return fmt.Errorf("barcode %s has no sequence to demultiplex reads by", b.Name)
+		}
+	}
+	return nil
+}
+
+// sampleOf returns the sample of the barcode called name, or name itself
+// when the sheet doesn't list it
+func (s *barcodeSheet) sampleOf(name string) string {
+	if s != nil {
+		for _, b := range s.barcodes {
+			if b.Name == name {
+				return b.Sample
+			}
+		}
+	}
+	return name
+}
+
+// illuminaIndex returns the index of an Illumina read header, the last field
+// of its comment, e.g. ATCACG+GCTAGC for "... 1:N:0:ATCACG+GCTAGC"
+func illuminaIndex(header string) string {
+	_, comment, ok := strings.Cut(header, " ")
+	if !ok {
+		return ""
+	}
+	index := comment[strings.LastIndexByte(comment, ':')+1:]
+	if index == "" || strings.Trim(index, "ACGTN+") != "" {
+		return "" // a sample number, not a sequence
+	}
+	return index
+}
+
+// mismatches counts the bases that differ between a and b, of equal length,
+// stopping once it passes limit
+func mismatches(a string, b []byte, limit int) int {
+	n := 0
+	for i := 0; i < len(a) && n <= limit; i++ {
+		if a[i] != b[i] && b[i] != 'N' {
+			n++
+		}
+	}
+	return n
+}
+
+// assign finds the barcode of a read: by the index in an Illumina header, or
+// else by the barcode near the start of the read, which is trimmed off with
+// whatever precedes it. A read matches the barcode with the fewest
+// mismatches, within the sheet's limit; reads matching none, or two equally
+// well, are unclassified.
+func (s *barcodeSheet) assign(header string, seq []byte) (sample string, trim int) {
+	best, bestDist, tied := -1, s.mismatches+1, false
+	consider := func(i, dist, end int) {
+		switch {
+		case dist < bestDist:
+			best, bestDist, tied, trim = i, dist, false, end
+		case dist == bestDist && i != best:
+			tied = true
+		}
+	}
+	if index := []byte(illuminaIndex(header)); len(index) > 0 {
+		for i, b := range s.barcodes {
+			if len(b.Sequence) == len(index) {
+				consider(i, mismatches(b.Sequence, index, s.mismatches), 0)
+			}
+		}
+	} else {
+		window := seq[:min(len(seq), barcodeWindow)]
+		for i, b := range s.barcodes {
+			for p := 0; p+len(b.Sequence) <= len(window); p++ {
+				if dist := mismatches(b.Sequence, window[p:p+len(b.Sequence)], s.mismatches); dist <= s.mismatches {
+					consider(i, dist, p+len(b.Sequence))
+				}
+			}
+		}
+	}
+	if best < 0 || tied {
+		return unclassifiedBarcode, 0
+	}
+	return s.barcodes[best].Sample, trim
+}
+
+// barcodeDirSamples names the samples of input split into one directory per
+// barcode, e.g. fastq_pass/barcode01/, after the barcode directory a file is
+// in, or the sample the sheet gives that barcode
+func barcodeDirSamples(inputs []inputFile, sheet *barcodeSheet) {
+	for i := range inputs {
+		if inputs[i].Dir == "" {
+			continue // not in a barcode directory
+		}
+		dir := strings.SplitN(filepath.ToSlash(inputs[i].Dir), "/", 2)[0]
+		inputs[i].Sample = sheet.sampleOf(dir)
+	}
+}
+
+// demuxWriter splits the results of a file by barcode, each barcode's going
+// to the results of its sample, named by filling the sample into {barcode}
+// and opened on first use. It is not safe for concurrent use.
+type demuxWriter struct {
+	dir     string
+	input   inputFile
+	opts    OutputOptions
+	writers map[string]output.Writer
+	reads   map[string]int // reads per sample
+}
+
+func newDemuxWriter(dir string, input inputFile, opts OutputOptions) *demuxWriter {
+	return &demuxWriter{dir: dir, input: input, opts: opts, writers: make(map[string]output.Writer), reads: make(map[string]int)}
+}
+
+// write adds a result to the results of sample, unless the output options
+// filter it out; it counts towards the sample's reads either way
+func (w *demuxWriter) write(sample string, result output.Result) error {
+	w.reads[sample]++
+	result, ok := w.opts.filter(result)
+	if !ok {
+		return nil
+	}
+	out, ok := w.writers[sample]
+	if !ok {
+		input := w.input
+		input.Sample = sample
+		input.Output = strings.ReplaceAll(input.Output, placeholderBarcode, serotypeFileName.Replace(sample))
+		var err error
+		if out, err = newResultWriter(w.dir, input, w.opts); err != nil {
+			return err
+		}
+		w.writers[sample] = out
+	}
+	return out.Write(result)
+}
+
+// Close closes every sample's results, returning the first error encountered
+func (w *demuxWriter) Close() error {
+	var firstErr error
+	for _, out := range w.writers {
+		if err := out.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// formatBarcodeReads formats reads per sample for logs, e.g. "S1:1200 S2:800
+// unclassified:30", most reads first
+func formatBarcodeReads(reads map[string]int) string {
+	samples := make([]string, 0, len(reads))
+	for sample := range reads {
+		samples = append(samples, sample)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if reads[samples[i]] != reads[samples[j]] {
+			return reads[samples[i]] > reads[samples[j]]
+		}
+		return samples[i] < samples[j]
+	})
+	parts := make([]string, len(samples))
+	for i, sample := range samples {
+		parts[i] = fmt.Sprintf("%s:%d", sample, reads[sample])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"bhedi/output"
+)
+
+// Shape of the dataset bench generates when given no FASTQ files
+const (
+	benchReadLength  = 1000
+	benchSeed        = 1
+	benchMatchedRate = 0.3 // share of reads carrying sankets, as in a sample with host background
+)
+
+// BenchResult is how one matcher backend did on the benchmark reads
+type BenchResult struct {
+	Matcher        string  `json:"matcher"`
+	BuildSeconds   float64 `json:"build_seconds"`
+	IndexBytes     uint64  `json:"index_bytes"` // heap the built matcher holds
+	Reads          int     `json:"reads"`
+	Seconds        float64 `json:"seconds"`
+	ReadsPerSec    float64 `json:"reads_per_second"`
+	AllocPerRead   float64 `json:"alloc_bytes_per_read"`
+	MatchedReads   int     `json:"matched_reads"`
+	Matches        int     `json:"matches"`
+	DifferingReads int     `json:"differing_reads"` // reads whose sankets differ from the first matcher's
+}
+
+// syntheticReads generates n random reads, benchMatchedRate of which carry
+// one to three sankets of the panel, the same reads for the same panel
+func syntheticReads(panel []SanketInfo, n int) []sampledRead {
+	rng := rand.New(rand.NewSource(benchSeed))
+	reads := make([]sampledRead, n)
+	seq := make([]byte, benchReadLength)
+	for i := range reads {
+		for j := range seq {
+			seq[j] = "ACGT"[rng.Intn(4)]
+		}
+		if len(panel) > 0 && rng.Float64() < benchMatchedRate {
+			for k := rng.Intn(3); k >= 0; k-- {
+				s := panel[rng.Intn(len(panel))].Sanket
+				if len(s) <= len(seq) {
+					copy(seq[rng.Intn(len(seq)-len(s)+1):], s)
+				}
+			}
+		}
+		reads[i] = sampledRead{id: fmt.Sprintf("synthetic_%d", i+1), seq: append([]byte(nil), seq...)}
+	}
+	return reads
+}
+
+// benchReads reads up to n reads from files, in turn
+func benchReads(files []string, n int) ([]sampledRead, error) {
+	var reads []sampledRead
+	for _, path := range files {
+		if len(reads) >= n {
+			break
+		}
+		sample, _, _, err := sampleReads(path, n-len(reads))
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", path, err)
+		}
+		reads = append(reads, sample...)
+	}
+	return reads, nil
+}
+
+// matchSignature hashes the sankets a read matched, to compare backends
+// without keeping every match
+func matchSignature(result output.Result) uint64 {
+	h := fnv.New64a()
+	for _, m := range result.Matches {
+		h.Write([]byte(m.SID))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// benchMatcher builds a backend from the panel's sankets, rather than any
+// index they were loaded from, and classifies reads with it on threads
+// workers, as run would, filling in signatures
+func benchMatcher(backend matcherBackend, sankets []SanketInfo, reads []sampledRead, threads int, signatures []uint64) BenchResult {
+	res := BenchResult{Matcher: backend.name, Reads: len(reads)}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	m := backend.build(&sanketIndex{Sankets: sankets})
+	res.BuildSeconds = time.Since(start).Seconds()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if after.HeapAlloc > before.HeapAlloc {
+		res.IndexBytes = after.HeapAlloc - before.HeapAlloc
+	}
+
+	avgReadLength := 0.0
+	for _, read := range reads {
+		avgReadLength += float64(len(read.seq)) / float64(len(reads))
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan int, threads)
+	runtime.ReadMemStats(&before)
+	start = time.Now()
+	for w := 0; w < threads; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			matched, matches := 0, 0
+			for i := range next {
+				result := processRecord(reads[i].seq, reads[i].id, m, avgReadLength, len(reads))
+				signatures[i] = matchSignature(result)
+				if result.MatchesFound {
+					matched++
+					matches += len(result.Matches)
+				}
+			}
+			mu.Lock()
+			res.MatchedReads += matched
+			res.Matches += matches
+			mu.Unlock()
+		}()
+	}
+	for i := range reads {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	res.Seconds = time.Since(start).Seconds()
+	runtime.ReadMemStats(&after)
+	if res.Seconds > 0 {
+		res.ReadsPerSec = float64(len(reads)) / res.Seconds
+	}
+	if len(reads) > 0 {
+		res.AllocPerRead = float64(after.TotalAlloc-before.TotalAlloc) / float64(len(reads))
+	}
+	runtime.KeepAlive(m)
+	return res
+}
+
+// benchFlags sets up the bench command: classify the same reads with every
+// matcher backend and report their speed, memory and whether they agree, to
+// pick the backend for a machine and panel. Without FASTQ files it generates
+// reads carrying sankets of the panel.
+func benchFlags(fs *flag.FlagSet) func(args []string) error {
+	panelFlags(fs)
+	matchers := fs.String("matchers", "", "Comma-separated matcher backends to compare: "+matcherNames()+" (default all those in this build)")
+	prefilter := fs.Bool("prefilter", false, "Also run each backend behind the prefilter run uses, as <matcher>+prefilter")
+	n := fs.Int("reads", 20000, "Reads to classify with each backend, the first of the FASTQ files given or generated")
+	threads := fs.Int("threads", availableCPUs(), "Workers classifying reads, as for run (default the number of CPUs, or the container's CPU quota if lower)")
+	fs.IntVar(threads, "t", availableCPUs(), "Short for -threads")
+	asJSON := fs.Bool("json", false, "Print the results as JSON rather than a table")
+
+	return func(args []string) error {
+		if *n < 1 || *threads < 1 {
+			return usagef("-reads and -threads must be at least 1")
+		}
+		var backends []matcherBackend
+		for _, b := range matcherBackends {
+			if !b.fallback {
+				backends = append(backends, b)
+			}
+		}
+		if *matchers != "" {
+			backends = nil
+			for _, name := range strings.Split(*matchers, ",") {
+				b, err := findMatcher(strings.TrimSpace(name))
+				if err != nil {
+					return usageError{err}
+				}
+				backends = append(backends, b)
+			}
+		}
+		if *prefilter {
+			var screened []matcherBackend
+			for _, b := range backends {
+				build := b.build
+				screened = append(screened, b, matcherBackend{name: b.name + "+prefilter", summary: b.summary, fallback: b.fallback,
+					build: func(idx *sanketIndex) matcher { return newPrefilter(idx, build(idx)) }})
+			}
+			backends = screened
+		}
+		panelCSV, err := findPanel(panelPath)
+		if err != nil {
+			return err
+		}
+		idx, err := loadPanel(panelCSV)
+		if err != nil {
+			return fmt.Errorf("can't load sankets: %w", err)
+		}
+
+		var reads []sampledRead
+		dataset := "synthetic"
+		if len(args) > 0 {
+			files, err := fastqFiles(args)
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return usagef("no FASTQ files in %s", strings.Join(args, ", "))
+			}
+			if reads, err = benchReads(files, *n); err != nil {
+				return err
+			}
+			dataset = strings.Join(args, ",")
+		} else {
+			reads = syntheticReads(idx.Sankets, *n)
+		}
+		if len(reads) == 0 {
+			return fmt.Errorf("%w: nothing to benchmark", errNoReads)
+		}
+		slog.Info("benchmarking", "reads", len(reads), "dataset", dataset, "panel", panelCSV, "sankets", len(idx.Sankets), "threads", *threads, "cpus", runtime.NumCPU(), "platform", runtime.GOOS+"/"+runtime.GOARCH)
+
+		var results []BenchResult
+		var reference []uint64
+		for i, backend := range backends {
+			signatures := make([]uint64, len(reads))
+			res := benchMatcher(backend, idx.Sankets, reads, *threads, signatures)
+			if i == 0 {
+				reference = signatures
+			} else {
+				for j := range signatures {
+					if signatures[j] != reference[j] {
+						res.DifferingReads++
+					}
+				}
+			}
+			slog.Debug("matcher done", "matcher", backend.name, "reads_per_second", int(res.ReadsPerSec))
+			results = append(results, res)
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(results); err != nil {
+				return err
+			}
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "matcher\tbuild\tindex_mb\treads_per_sec\talloc_per_read\tmatched_reads\tmatches\tparity")
+			for i, res := range results {
+				parity := "ok"
+				switch {
+				case i == 0:
+					parity = "reference"
+				case res.DifferingReads > 0:
+					parity = fmt.Sprintf("%d reads differ", res.DifferingReads)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%.1f\t%.0f\t%.0f B\t%d\t%d\t%s\n", res.Matcher, time.Duration(res.BuildSeconds*float64(time.Second)).Round(time.Millisecond),
+					float64(res.IndexBytes)/(1<<20), res.ReadsPerSec, res.AllocPerRead, res.MatchedReads, res.Matches, parity)
+			}
+			w.Flush()
+		}
+		for _, res := range results[1:] {
+			if res.DifferingReads > 0 {
+				return fmt.Errorf("%s finds other sankets than %s in %d of %d reads", res.Matcher, results[0].Matcher, res.DifferingReads, res.Reads)
+			}
+		}
+		return nil
+	}
+}
@@ -2,28 +2,28 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 
-	"github.com/cheggaaa/pb/v3"
+	"bhedi/output"
 	"github.com/shenwei356/bio/seqio/fastx"
-	"github.com/xitongsys/parquet-go-source/local"
-	"github.com/xitongsys/parquet-go/writer"
+	"gocloud.dev/blob"
 )
 
-// Define your structs here (SanketInfo, MatchInfo, ProcessRecordResult, ParquetRecord)
+// Define your structs here (SanketInfo; the result types are in bhedi/output)
 var coverageMapMutex sync.Mutex
-var parquetWriterMutex sync.Mutex // Mutex for the Parquet writer
 
 type SanketInfo struct {
 	SID      string // Add this line
@@ -37,47 +37,37 @@ type SanketInfo struct {
 	PLenAvg  string
 }
 
-type MatchInfo struct {
-	SID      string // Add this line
-	Sanket   string
-	Serotype string
-	SLen     int
-	SSRCount string
-	MLenAvg  string
-	MRCAvg   string
-	PCount   string
-	PLenAvg  string
-	BScore   float64 // Add this line
+// calculateGCPercentage returns the share of G and C bases in seq. bytes.Count
+// is vectorized on amd64 and arm64 (AVX2 or POPCNT, NEON) and plain Go
+// elsewhere, so two passes of it are many times faster than one of a loop.
+func calculateGCPercentage(seq []byte) float64 {
+	if len(seq) == 0 {
+		return 0 // a read trimmed to nothing
+	}
+	gcCount := bytes.Count(seq, []byte{'G'}) + bytes.Count(seq, []byte{'C'})
+	return (float64(gcCount) / float64(len(seq))) * 100
 }
 
-type ProcessRecordResult struct {
-	ReadID        string `parquet:"name=read_id, type=UTF8"`
-	Matches       []MatchInfo
-	GCPercentage  float64 `parquet:"name=gc_percentage, type=DOUBLE"`
-	TotalCoverage int     `parquet:"name=total_coverage, type=INT32"`
-	MatchesFound  bool
-	BScore        float64 `parquet:"name=b_score, type=DOUBLE"`
-}
-type ParquetRecord struct {
-	SID           string  `parquet:"name=sid, type=BYTE_ARRAY, convertedtype=UTF8"`
-	ReadID        string  `parquet:"name=read_id, type=BYTE_ARRAY, convertedtype=UTF8"`
-	MatchedSanket string  `parquet:"name=matched_sanket, type=BYTE_ARRAY, convertedtype=UTF8"`
-	Serotype      string  `parquet:"name=serotype, type=BYTE_ARRAY, convertedtype=UTF8"`
-	GCPercentage  float64 `parquet:"name=gc_percentage, type=DOUBLE"`
-	TotalCoverage int32   `parquet:"name=total_coverage, type=INT32"` // Changed to int32
-	SLen          int32   `parquet:"name=s_len, type=INT32"`          // Changed to int32
-	SSRCount      string  `parquet:"name=ssr_count, type=BYTE_ARRAY, convertedtype=UTF8"`
-	MLenAvg       string  `parquet:"name=mlen_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
-	MRCAvg        string  `parquet:"name=mrc_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
-	PCount        string  `parquet:"name=p_count, type=BYTE_ARRAY, convertedtype=UTF8"`
-	PLenAvg       string  `parquet:"name=plen_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
-	BScore        float64 `parquet:"name=b_score, type=DOUBLE"`
+// ScoringParams holds the constants of the BScore heuristic
+type ScoringParams struct {
+	GenomeSize          float64 `json:"genome_size" yaml:"genome_size" toml:"genome_size"`                               // Dengue virus genome size in base pairs
+	MaxSLen             float64 `json:"max_s_len" yaml:"max_s_len" toml:"max_s_len"`                                     // sanket length that earns the full sLen weight
+	TotalCoverageWeight float64 `json:"total_coverage_weight" yaml:"total_coverage_weight" toml:"total_coverage_weight"` // weight of normalized totalCoverage
+	SLenWeight          float64 `json:"s_len_weight" yaml:"s_len_weight" toml:"s_len_weight"`                            // weight of normalized sLen
+	BothCountsBase      float64 `json:"both_counts_base" yaml:"both_counts_base" toml:"both_counts_base"`                // base score when both ssrCount and pCount are present
+	OneCountBase        float64 `json:"one_count_base" yaml:"one_count_base" toml:"one_count_base"`                      // base score when only one of them is present
 }
 
-func calculateGCPercentage(seq string) float64 {
-	gcCount := strings.Count(seq, "G") + strings.Count(seq, "C")
-	return (float64(gcCount) / float64(len(seq))) * 100
+// scoring is the parameter set used by calculateBScore
+var scoring = ScoringParams{
+	GenomeSize:          11000.0,
+	MaxSLen:             25.0,
+	TotalCoverageWeight: 0.37,
+	SLenWeight:          0.4,
+	BothCountsBase:      0.35,
+	OneCountBase:        0.2,
 }
+
 func calculateBScore(totalCoverage, sLen int, ssrCount, pCount string, avgReadLength float64, totalRecords int) float64 {
 	// Convert string parameters to integers
 	ssrCountInt, err1 := strconv.Atoi(ssrCount)
@@ -94,13 +84,13 @@ func calculateBScore(totalCoverage, sLen int, ssrCount, pCount string, avgReadLe
 
 	// Check for presence of both ssrCount and pCount and adjust base score
 	if ssrCountInt > 0 && pCountInt > 0 {
-		baseScore += 0.35 // Assign a higher base score if both are present
+		baseScore += scoring.BothCountsBase // Assign a higher base score if both are present
 	} else if ssrCountInt > 0 || pCountInt > 0 {
-		baseScore += 0.2 // Assign a lower base score if only one is present
+		baseScore += scoring.OneCountBase // Assign a lower base score if only one is present
 	}
 
 	// Calculate maxTotalCoverage using the Lander/Waterman equation C = LN / G
-	genomeSize := 11000.0 // Dengue virus genome size in base pairs
+	genomeSize := scoring.GenomeSize // Dengue virus genome size in base pairs
 	maxTotalCoverage := (avgReadLength * float64(totalRecords)) / genomeSize
 
 	// Normalize and weight totalCoverage and sLen
@@ -108,12 +98,12 @@ func calculateBScore(totalCoverage, sLen int, ssrCount, pCount string, avgReadLe
 	maxExpectedCoverage := maxTotalCoverage // You might want to adjust this based on your dataset
 	normalizedTotalCoverage := math.Min(float64(totalCoverage)/maxExpectedCoverage, 1)
 
-	maxSLen := 25.0 // Adjust based on expected range
+	maxSLen := scoring.MaxSLen // Adjust based on expected range
 	normalizedSLen := math.Min(float64(sLen)/maxSLen, 1)
 
 	// Weighted contributions (adjust weights as needed)
-	totalCoverageWeight := 0.37 // Higher weight for totalCoverage
-	sLenWeight := 0.4           // Weight for sLen
+	totalCoverageWeight := scoring.TotalCoverageWeight // Higher weight for totalCoverage
+	sLenWeight := scoring.SLenWeight                   // Weight for sLen
 
 	// Calculate weighted contributions
 	weightedTotalCoverage := normalizedTotalCoverage * totalCoverageWeight
@@ -128,52 +118,38 @@ func calculateBScore(totalCoverage, sLen int, ssrCount, pCount string, avgReadLe
 	return bScore
 }
 
-func getTotalRecordsAndAvgReadLength(fastqPath string) (totalRecords int, avgReadLength float64, err error) {
-	cmd := exec.Command("seqkit", "stats", fastqPath, "--tabular")
-	output, err := cmd.Output()
+// getTotalRecordsAndAvgReadLength counts the reads of a FASTQ file for
+// BScore. avgReadLength is the shortest read's length: the min_len column of
+// the seqkit stats run counted with before, which the scoring has always used
+// as the average read length. Reads are measured trimmed, as they are matched.
+func getTotalRecordsAndAvgReadLength(fastqPath string, trim qualityTrim, adapters adapterTrim) (totalRecords int, avgReadLength float64, err error) {
+	stats, err := fastqStats(fastqPath, trim, adapters)
 	if err != nil {
 		return 0, 0, err
 	}
-	lines := strings.Split(string(output), "\n")
-	if len(lines) > 2 {
-		fields := strings.Fields(lines[1])
-		if len(fields) > 5 {
-			totalRecords, err = strconv.Atoi(fields[3])
-			if err != nil {
-				return 0, 0, fmt.Errorf("failed to parse total records: %w", err)
-			}
-			avgReadLength, err = strconv.ParseFloat(fields[5], 64)
-			if err != nil {
-				return 0, 0, fmt.Errorf("failed to parse average read length: %w", err)
-			}
-			return totalRecords, avgReadLength, nil
-		}
-	}
-	return 0, 0, fmt.Errorf("failed to parse seqkit stats output")
+	return stats.Reads, float64(stats.MinLen), nil
 }
 
-func processRecord(seq string, id string, sankets map[string]SanketInfo, avgReadLength float64, totalRecords int) ProcessRecordResult {
+func processRecord(seq []byte, id string, sankets matcher, avgReadLength float64, totalRecords int) output.Result {
 	gcPercentage := calculateGCPercentage(seq)
-	var matches []MatchInfo
+	var matches []output.Match
 	coverageMap := make(map[string]int)
 	matchesFound := false
-	for _, info := range sankets {
-		if strings.Contains(seq, info.Sanket) {
-			matchesFound = true
-			match := MatchInfo{
-				SID:      info.SID, // Add this line
-				Sanket:   info.Sanket,
-				Serotype: info.Serotype,
-				SLen:     info.SLen,
-				SSRCount: info.SSRCount,
-				MLenAvg:  info.MLenAvg,
-				MRCAvg:   info.MRCAvg,
-				PCount:   info.PCount,
-				PLenAvg:  info.PLenAvg,
-			}
-			matches = append(matches, match)
-			coverageMap[info.Serotype]++
+	for _, info := range sankets.Match(seq) {
+		matchesFound = true
+		match := output.Match{
+			SID:      info.SID, // Add this line
+			Sanket:   info.Sanket,
+			Serotype: info.Serotype,
+			SLen:     info.SLen,
+			SSRCount: info.SSRCount,
+			MLenAvg:  info.MLenAvg,
+			MRCAvg:   info.MRCAvg,
+			PCount:   info.PCount,
+			PLenAvg:  info.PLenAvg,
 		}
+		matches = append(matches, match)
+		coverageMap[info.Serotype]++
 	}
 	totalCoverage := 0
 	for _, count := range coverageMap {
@@ -183,7 +159,7 @@ func processRecord(seq string, id string, sankets map[string]SanketInfo, avgRead
 		// Pass the missing avgReadLength and totalRecords arguments
 		matches[i].BScore = calculateBScore(totalCoverage, match.SLen, match.SSRCount, match.PCount, avgReadLength, totalRecords)
 	}
-	return ProcessRecordResult{
+	return output.Result{
 		ReadID:        id,
 		Matches:       matches,
 		GCPercentage:  gcPercentage,
@@ -235,45 +211,170 @@ func LoadSankets(csvFilePath string) (map[string]SanketInfo, error) {
 	return sankets, nil
 }
 
-func processFastqFile(fastqPath string, sankets map[string]SanketInfo, outputDir string, totalRecords int, avgReadLength float64) error {
-	// Open the FASTQ file
-	fastqFile, err := os.Open(fastqPath)
-	if err != nil {
-		return fmt.Errorf("error opening FASTQ file: %w", err)
-	}
-	defer fastqFile.Close()
+// resultBuffer is about how many classified reads of a file may wait for its
+// writer; workers block once it is full, so results never pile up in memory.
+// They are handed over a batch at a time, so the writer doesn't pay for a
+// channel operation per read.
+const resultBuffer = 1024
+
+// Reads are handed to the worker pool in batches of readBatch reads, or
+// fewer holding batchBases bases, so the cost of a task is paid once per
+// batch while long reads don't hold much memory waiting
+const (
+	readBatch  = 1000
+	batchBases = 1 << 20
+)
+
+// batchSize returns the reads per batch for a file of total reads and the
+// given workers: readBatch, or less so a small file still gives every
+// worker a few batches
+func batchSize(total, workers int) int {
+	return min(readBatch, max(1, total/(4*workers)))
+}
 
-	// Generate the output Parquet file path
-	outputFileName := filepath.Base(fastqPath)
-	outputFileName = strings.TrimSuffix(outputFileName, filepath.Ext(outputFileName)) + ".parquet"
-	parquetFilePath := filepath.Join(outputDir, outputFileName)
+// fastqBatch is a batch of reads copied out of the reader's buffers, their
+// sequences back to back in one buffer. Batches are reused through
+// batchPool, so reading a file allocates little besides the read IDs the
+// results keep.
+type fastqBatch struct {
+	reads []fastqRead
+	seqs  []byte
+}
 
-	// Setup Parquet writer
-	fw, err := local.NewLocalFileWriter(parquetFilePath)
-	if err != nil {
-		return fmt.Errorf("can't create local file: %w", err)
-	}
-	defer fw.Close()
+// fastqRead is a read of a fastqBatch
+type fastqRead struct {
+	id         string
+	header     string // the whole header line, only kept when demultiplexing
+	start, end int    // the sequence in the batch's seqs
+}
 
-	pw, err := writer.NewParquetWriter(fw, new(ParquetRecord), 4)
-	if err != nil {
-		return fmt.Errorf("can't create parquet writer: %w", err)
+var batchPool = sync.Pool{New: func() any { return &fastqBatch{} }}
+
+// add copies a record into the batch, trimmed as trim says
+func (b *fastqBatch) add(record *fastx.Record, header bool, trim qualityTrim) {
+	read := fastqRead{id: string(record.ID), start: len(b.seqs)}
+	if header {
+		read.header = string(record.Name)
+	}
+	seq := record.Seq.Seq
+	if trim.Quality > 0 && len(record.Seq.Qual) == len(seq) {
+		seq = seq[:trim.keep(record.Seq.Qual)]
 	}
-	defer pw.WriteStop()
+	b.seqs = append(b.seqs, seq...)
+	read.end = len(b.seqs)
+	b.reads = append(b.reads, read)
+}
 
-	// Initialize the FASTX reader
-	reader, err := fastx.NewReaderFromIO(nil, fastqFile, "")
+// seq returns the sequence of the batch's i-th read
+func (b *fastqBatch) seq(i int) []byte {
+	return b.seqs[b.reads[i].start:b.reads[i].end]
+}
+
+// release empties the batch and returns it to batchPool; nothing may hold
+// on to its sequences
+func (b *fastqBatch) release() {
+	b.reads, b.seqs = b.reads[:0], b.seqs[:0]
+	batchPool.Put(b)
+}
+
+// sampleResult is a classified read on its way to the writer, with the
+// sample demultiplexing assigned it to. A batch's are handed over together.
+type sampleResult struct {
+	sample string
+	result output.Result
+}
+
+// processFastqFile classifies the reads of one FASTQ file into outputDir,
+// scoring them with norm, and returns how many it read. With a barcode sheet
+// to demultiplex by, each barcode's reads go to the results of its sample,
+// and the reads per sample are returned too. With a call tracker, reading
+// stops once the file's call is confident.
+func processFastqFile(pool *workerPool, input inputFile, sankets matcher, demux *barcodeSheet, outputDir string, norm normalization, opts OutputOptions, call *callTracker, bar progress) (int, map[string]int, error) {
+	fastqPath := input.Path
+	// Initialize the FASTX reader, which unpacks compressed files
+	reader, err := fastx.NewReader(nil, fastqPath, "")
 	if err != nil {
-		return fmt.Errorf("error initializing FASTX reader: %w", err)
+		return 0, nil, fmt.Errorf("error initializing FASTX reader: %w", err)
+	}
+	defer reader.Close()
+
+	// Setup the result writer under outputDir, where the -output-name template put it
+	var out output.Writer
+	var demuxOut *demuxWriter
+	write := func(sample string, result output.Result) error {
+		if result, ok := opts.filter(result); ok {
+			return out.Write(result)
+		}
+		return nil
+	}
+	closeOut := func() error { return out.Close() }
+	if demux != nil {
+		demuxOut = newDemuxWriter(outputDir, input, opts)
+		write, closeOut = demuxOut.write, demuxOut.Close
+	} else if out, err = newResultWriter(outputDir, input, opts); err != nil {
+		return 0, nil, err
 	}
 
-	// Initialize progress bar
-	bar := pb.StartNew(totalRecords)
 	defer bar.Finish()
 
-	// Setup concurrency control
+	// One goroutine writes the results as the workers classify them, so no
+	// worker waits on another's write. After an error the rest are drained
+	// unwritten and the file fails.
+	size := batchSize(norm.Reads, pool.size)
+	results := make(chan []sampleResult, max(1, resultBuffer/size))
+	written := make(chan error, 1)
+	go func() {
+		var err error
+		for batch := range results {
+			for _, r := range batch {
+				if err == nil {
+					err = write(r.sample, r.result)
+				}
+				call.add(r.result)
+			}
+		}
+		if closeErr := closeOut(); err == nil {
+			err = closeErr
+		}
+		written <- err
+	}()
+
+	// Reads are classified by the run's worker pool, a batch per task; wg
+	// tracks this file's
 	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 40) // Limit the number of concurrent goroutines
+	classify := func(batch *fastqBatch) {
+		defer wg.Done()
+		defer batch.release()
+		classified := make([]sampleResult, 0, len(batch.reads))
+		for i, read := range batch.reads {
+			seq := batch.seq(i)
+			var sample string
+			if demux != nil {
+				var trim int
+				sample, trim = demux.assign(read.header, seq)
+				if trim < len(seq) { // a read of nothing but its barcode keeps it
+					seq = seq[trim:]
+				}
+			}
+			if len(opts.Adapters.Adapters) > 0 {
+				seq = opts.Adapters.trim(seq)
+			}
+			result := processRecord(seq, read.id, sankets, norm.ReadLength, norm.Reads)
+			classified = append(classified, sampleResult{sample, result})
+			bar.Read(len(seq), result.MatchesFound) // Update progress bar
+		}
+		results <- classified
+	}
+	reads := 0
+	batch := batchPool.Get().(*fastqBatch)
+	submit := func() {
+		if len(batch.reads) > 0 {
+			b := batch
+			wg.Add(1)
+			pool.Submit(func() { classify(b) })
+			batch = batchPool.Get().(*fastqBatch)
+		}
+	}
 
 	for {
 		record, err := reader.Read()
@@ -281,126 +382,562 @@ func processFastqFile(fastqPath string, sankets map[string]SanketInfo, outputDir
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error reading FASTQ record: %w", err)
+			wg.Wait()
+			close(results)
+			<-written
+			return 0, nil, fmt.Errorf("error reading FASTQ record: %w", err)
+		}
+		if call.stop() { // the reads classified already settle the file's call
+			break
 		}
 
-		// Make deep copies of the data needed by the goroutine
-		seqCopy := string(record.Seq.Seq) // This is already a copy, but included for clarity
-		idCopy := string(record.ID)
-
-		wg.Add(1)
-		semaphore <- struct{}{} // Acquire a token
-
-		go func(seqCopy string, idCopy string) {
-			defer wg.Done()
-			result := processRecord(seqCopy, idCopy, sankets, avgReadLength, totalRecords)
-
-			if result.MatchesFound {
-				// Write each match as a separate record in the Parquet file
-				for _, match := range result.Matches {
-					parquetRecord := ParquetRecord{
-
-						SID:           match.SID,
-						ReadID:        result.ReadID,
-						MatchedSanket: match.Sanket,
-						Serotype:      match.Serotype,
-						GCPercentage:  result.GCPercentage,
-						TotalCoverage: int32(result.TotalCoverage),
-						SLen:          int32(match.SLen),
-						SSRCount:      match.SSRCount,
-						MLenAvg:       match.MLenAvg,
-						MRCAvg:        match.MRCAvg,
-						PCount:        match.PCount,
-						PLenAvg:       match.PLenAvg,
-						BScore:        match.BScore,
-					}
-					parquetWriterMutex.Lock()
-					if err := pw.Write(parquetRecord); err != nil {
-						log.Printf("error writing to Parquet file: %v", err)
-					}
-					parquetWriterMutex.Unlock()
-				}
-			} else {
-				// Write a record indicating no match was found
-				parquetWriterMutex.Lock()
-				if err := pw.Write(ParquetRecord{
-					ReadID:        result.ReadID,
-					MatchedSanket: "No Match Found",
-					Serotype:      "Unassigned",
-					GCPercentage:  result.GCPercentage,
-					TotalCoverage: 0,
-					SLen:          0,
-					SSRCount:      "",
-					MLenAvg:       "",
-					MRCAvg:        "",
-					PCount:        "",
-					PLenAvg:       "",
-					BScore:        0, // Use 0 as BScore for no match found
-				}); err != nil {
-					log.Printf("error writing to Parquet file: %v", err)
-				}
-				parquetWriterMutex.Unlock()
-			}
-
-			bar.Increment() // Update progress bar
-			<-semaphore     // Release the token
-		}(seqCopy, idCopy) // Pass the copies to the goroutine
+		// Copy what the worker needs, as the reader reuses its buffers
+		batch.add(record, demux != nil, opts.Trim)
+		reads++
+		if len(batch.reads) == size || len(batch.seqs) >= batchBases {
+			submit()
+		}
 	}
+	submit()
+	batch.release() // the empty one submit took
 
-	wg.Wait() // Wait for all goroutines to finish
+	wg.Wait() // Wait for this file's reads to finish
 	bar.Finish()
+	close(results)
+	if err := <-written; err != nil {
+		return 0, nil, fmt.Errorf("can't write the results: %w", err)
+	}
+	if demuxOut != nil {
+		return reads, demuxOut.reads, nil
+	}
+	return reads, nil, nil
+}
 
-	// Lock the mutex before stopping the Parquet writer
-	parquetWriterMutex.Lock()
-	if err := pw.WriteStop(); err != nil {
-		return fmt.Errorf("error finalizing Parquet file write: %w", err)
+// classifyToBucket classifies one FASTQ file into a temp directory, uploads
+// the results to bucket, keyed by their path in the directory, and returns
+// their keys, the reads and, when demultiplexing, the reads per sample
+func classifyToBucket(pool *workerPool, bucket *blob.Bucket, input inputFile, sankets matcher, demux *barcodeSheet, norm normalization, opts OutputOptions, call *callTracker, bar progress) ([]string, int, map[string]int, error) {
+	dir, err := os.MkdirTemp("", "bhedi-"+input.Sample+"-*")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("can't create a temp directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	reads, barcodeReads, err := processFastqFile(pool, input, sankets, demux, dir, norm, opts, call, bar)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	keys, err := uploadDir(context.Background(), bucket, dir, "")
+	if err != nil {
+		return nil, 0, nil, err
 	}
-	parquetWriterMutex.Unlock() // Unlock the mutex after stopping the writer
+	slog.Info("results uploaded", "sample", input.Sample, "output", filepath.ToSlash(input.Output), "files", len(keys))
+	return keys, reads, barcodeReads, nil
+}
 
-	return nil
+// runOptions are the flags of the commands that classify files, run and watch
+type runOptions struct {
+	fs                  *flag.FlagSet
+	inputDir, outputDir string
+	fileList            string // run only
+	sampleSheet         *string
+	opts                OutputOptions
+	columns             *string
+	partitionBy         *string
+	matcher             *string
+	prefilter           *bool
+	collapse            *bool
+	stopWhenConfident   *bool
+	confidence          *float64
+	confidentReads      *int
+	readWindow          *int
+	barcodes            *string
+	barcodeDirs         *bool
+	barcodeMismatches   *int
+	countFirst          *bool
+	recursive           *bool
+	include             *string
+	noProgress          *bool
+	overwrite           *bool
+	skipExisting        *bool
+	statePath           *string
+	reportPath          *string
+	threads             *int
+	jobs                *int
+}
+
+// defineRunFlags defines the flags run and watch share on fs
+func defineRunFlags(fs *flag.FlagSet) *runOptions {
+	o := &runOptions{fs: fs}
+	fs.StringVar(&o.inputDir, "i", "", "Input directory containing FASTQ files (.fastq or .fq, optionally .gz, .bz2, .xz or .zst), a single FASTQ file, or a glob pattern matching either, e.g. 'runs/*/fastq_pass'")
+	fs.StringVar(&o.outputDir, "o", "", "Output directory for result files, or an object storage bucket such as s3://results?region=eu-west-1&prefix=bhedi/ to upload them to, one <sample>/ prefix per file")
+	fs.StringVar(&o.opts.Format, "format", output.FormatParquet, "Output format: parquet, csv, json (newline-delimited) or sqlite")
+	fs.StringVar(&o.opts.Schema, "schema", output.SchemaFlat, "Parquet schema: flat (one row per match) or nested (one row per read)")
+	fs.StringVar(&o.opts.Compression, "parquet-compression", "snappy", "Parquet compression codec: zstd, snappy, gzip or none")
+	o.opts.RowGroupSize, o.opts.PageSize = 128<<20, 8<<10            // the Parquet library's defaults
+	o.opts.RowGroupSize = memoryShare(o.opts.RowGroupSize, 8, 1<<20) // in a container, an eighth of its memory at most
+	fs.Var((*byteSize)(&o.opts.RowGroupSize), "parquet-row-group-size", "Bytes of rows a Parquet file buffers in memory before writing them as a row group, e.g. 32MB to cap memory with many files at once, or 512MB for fewer, larger row groups")
+	fs.Var((*byteSize)(&o.opts.PageSize), "parquet-page-size", "Bytes per Parquet page; rows go to the encoders a few pages' worth at a time, so larger pages, e.g. 1MB, mean fewer, larger batches for samples with many matches")
+	fs.IntVar(&o.opts.WriterParallelism, "parquet-writer-parallelism", min(output.DefaultWriterParallelism, availableCPUs()), "Goroutines encoding each Parquet row group")
+	o.columns = fs.String("columns", "", "Comma-separated flat columns to write, e.g. read_id,serotype,b_score (default all)")
+	fs.Float64Var(&o.opts.MinBScore, "min-bscore", 0, "Don't write matches with a lower BScore, e.g. 0.6; reads left without a match are written as unmatched, unless -matched-only")
+	fs.IntVar(&o.opts.Trim.Quality, "trim-quality", 0, "Cut each read where the mean quality of -trim-window bases first drops below this Phred score before matching it, as Trimmomatic's SLIDINGWINDOW does, e.g. 20; 0 trims nothing")
+	fs.IntVar(&o.opts.Trim.Window, "trim-window", 4, "Bases whose mean quality -trim-quality checks")
+	fs.Var(&o.opts.Adapters, "trim-adapters", "Remove adapters from reads before matching them: comma-separated "+adapterNames()+" or sequences of 3' adapters, a 5' one with ^ in front, e.g. illumina or ont,^ACGTACGTAC")
+	fs.BoolVar(&o.opts.MatchedOnly, "matched-only", false, "Don't write reads without a match, most of the rows of most runs; the run report still counts every read")
+	o.partitionBy = fs.String("partition-by", "", "Write Hive-style partitions by serotype and/or sample, e.g. sample,serotype")
+	fs.StringVar(&o.opts.Name, "output-name", "", "Template for where each file's results go under -o, without the extension, e.g. '{sample}/{date}_{serotype}'; placeholders are {dir} (the input's subdirectory), {name} (the file list's output name, else the sample), {sample}, {date} (YYYY-MM-DD), {serotype} (one file per serotype) and {barcode} (one file per barcode's sample, with -barcodes). With -partition-by it names the partitions' directory (default {dir}/{name}, {dir}/{name}/{name} in a bucket, {dir} for local partitions, and {dir}/{name}/{barcode} when demultiplexing)")
+	o.overwrite = fs.Bool("overwrite", false, "Replace results that already exist; by default a file whose results exist fails")
+	o.skipExisting = fs.Bool("skip-existing", false, "Leave files whose results already exist unclassified")
+	o.recursive = fs.Bool("recursive", false, "Also classify FASTQ files in subdirectories of the input, e.g. fastq_pass/barcode01/; results keep the subdirectory under -o")
+	fs.BoolVar(o.recursive, "r", false, "Short for -recursive")
+	o.sampleSheet = fs.String("sample-sheet", "", "Sample sheet naming the samples sequenced, a CSV table or an Illumina sample sheet: per row a Sample_Name or Sample_ID, the FASTQ file (file), barcode directory (barcode) or index (index, index2) of its reads, and optionally collection_date, location and tags. Results are named after the samples and record their metadata; without -i the sheet's files are classified, and with it the files the sheet doesn't list are skipped")
+	o.barcodes = fs.String("barcodes", "", "Barcode sheet to demultiplex reads by: one barcode per line with its sequence and optionally the sample, separated by tabs or commas, e.g. 'barcode01,AAGAAAGTTGTCGGTGTCTTTGTG,S1'. Reads are assigned by the index of Illumina headers, or else the barcode in their first 150 bases, and results go to one file per sample, see {barcode}")
+	o.barcodeDirs = fs.Bool("barcode-dirs", false, "The input is already split into a directory per barcode, e.g. fastq_pass/barcode01/; classify every directory, naming each file's sample after its barcode, or the sample -barcodes gives it")
+	o.barcodeMismatches = fs.Int("barcode-mismatches", 1, "Mismatched bases a barcode may be found with; reads matching two barcodes equally well are unclassified")
+	o.include = fs.String("include", "", "Only classify FASTQ files whose name matches this glob pattern, e.g. '*_pass_*.fastq.gz'")
+	o.reportPath = fs.String("run-report", "", "Where to write the JSON report of the run: version, panel, flags, and per file the outcome, reads and timings (default <output dir>/"+runReportFile+", or "+runReportFile+" in the bucket)")
+	o.statePath = fs.String("state", "", "File recording which files have been classified (default <output dir>/"+runStateFile+", or "+runStateFile+" in the working directory for a bucket)")
+	panelFlags(fs)
+	o.countFirst = fs.Bool("count-first", false, "Count the reads of each file in a pass of its own before classifying it, so BScores are normalized by the exact read count and shortest read, as before; by default they are estimated from the first "+strconv.Itoa(normalizationSample)+" reads and classifying starts at once")
+	o.matcher = fs.String("matcher", matcherBackends[0].name, "How reads are matched against the panel: "+matcherNames()+"; all find the same sankets, and bench compares their speed")
+	o.readWindow = fs.Int("read-window", 16384, "Match reads longer than twice this many bases as windows of it in parallel, so ultra-long reads don't stall a worker; 0 matches every read whole")
+	o.stopWhenConfident = fs.Bool("stop-when-confident", false, "Stop reading a file once its serotype call is clear: -confident-reads reads have matched and -confidence of them call the same serotype. The results hold the reads classified until then")
+	o.confidence = fs.Float64("confidence", 0.95, "Share of a file's matched reads that must call one serotype for -stop-when-confident")
+	o.confidentReads = fs.Int("confident-reads", 1000, "Matched reads a file needs before -stop-when-confident may stop it")
+	o.collapse = fs.Bool("collapse-duplicates", false, "Match each distinct read sequence once and give identical reads its sankets, a large speedup for deep amplicon runs; every read is still written and counted")
+	o.prefilter = fs.Bool("prefilter", true, "Screen reads for the first bases of any sanket before matching them, so reads without any, such as host reads, skip the matcher; it never changes what is found")
+	o.threads = fs.Int("threads", availableCPUs(), "Reads classified at once, by a pool of this many workers shared by every file (default the number of CPUs, or the container's CPU quota if lower)")
+	fs.IntVar(o.threads, "t", availableCPUs(), "Short for -threads")
+	o.jobs = fs.Int("jobs", 1, "FASTQ files classified at once, sharing the -threads workers")
+	fs.IntVar(o.jobs, "j", 1, "Short for -jobs")
+	o.noProgress = fs.Bool("no-progress", false, "Don't show progress bars, or log progress when stderr isn't a terminal, e.g. on a batch system")
+	return o
 }
 
-func main() {
-	var inputDir, outputDir string
-	flag.StringVar(&inputDir, "i", "", "Input directory containing FASTQ files")
-	flag.StringVar(&outputDir, "o", "", "Output directory for result files")
-	flag.Parse()
+// runner classifies FASTQ files into an output directory or bucket, holding
+// what every file needs: the panel, the worker pool and the run state
+type runner struct {
+	outputDir   string
+	opts        OutputOptions
+	panelFile   string
+	sankets     matcher
+	samples     *sampleSheet    // with -sample-sheet
+	unlisted    map[string]bool // files the sample sheet doesn't list, warned about
+	barcodes    *barcodeSheet   // with -barcodes, or from the sample sheet
+	confident   *confidenceRule // with -stop-when-confident
+	barcodeDirs bool            // the input is split into barcode directories rather than demultiplexed
+	countFirst  bool            // count every file before classifying it rather than estimating its reads
+	bucket      *blob.Bucket    // nil for a local output directory
+	pool        *workerPool
+	state       *runState
+	existing    string // what to do about results already there: ExistingFail, ExistingOverwrite or ExistingSkip
+
+	showProgress bool
+	progress     *progressDisplay // of the files classifyAll is classifying
+	report       *runReport
+}
 
-	if inputDir == "" || outputDir == "" {
-		fmt.Println("Input and output directories must be specified.")
-		return
+// start checks the options, loads the panel and opens the output. With
+// resume, files the run state records as finished are skipped.
+func (o *runOptions) start(resume bool) (*runner, error) {
+	if (o.inputDir == "" && o.fileList == "" && *o.sampleSheet == "") || o.outputDir == "" {
+		return nil, usagef("input and output directories must be specified with -i (or -file-list or -sample-sheet) and -o")
+	}
+	if o.inputDir != "" && o.fileList != "" {
+		return nil, usagef("-i and -file-list can't be used together")
+	}
+	if o.fileList != "" && *o.sampleSheet != "" {
+		return nil, usagef("-file-list and -sample-sheet can't be used together; a file list's second column names the samples")
+	}
+	if *o.statePath == "" {
+		*o.statePath = runStateFile
+		if !isBucketURL(o.outputDir) {
+			*o.statePath = filepath.Join(o.outputDir, runStateFile)
+		}
+	}
+	if *o.threads < 1 || *o.jobs < 1 {
+		return nil, usagef("-threads and -jobs must be at least 1")
+	}
+	existing := ExistingFail
+	switch {
+	case *o.overwrite && *o.skipExisting:
+		return nil, usagef("-overwrite and -skip-existing can't be used together")
+	case *o.overwrite:
+		existing = ExistingOverwrite
+	case *o.skipExisting:
+		existing = ExistingSkip
+	}
+	backend, err := findMatcher(*o.matcher)
+	if err != nil {
+		return nil, usageError{err}
+	}
+	var confident *confidenceRule
+	if *o.stopWhenConfident {
+		if *o.confidence <= 0.5 || *o.confidence > 1 {
+			return nil, usagef("-confidence must be above 0.5 and at most 1")
+		}
+		if *o.confidentReads < 1 {
+			return nil, usagef("-confident-reads must be at least 1")
+		}
+		confident = &confidenceRule{Share: *o.confidence, Reads: *o.confidentReads}
+	}
+	if *o.readWindow < 0 {
+		return nil, usagef("-read-window can't be negative")
+	}
+	if *o.barcodeMismatches < 0 {
+		return nil, usagef("-barcode-mismatches can't be negative")
+	}
+	if o.opts.MinBScore < 0 {
+		return nil, usagef("-min-bscore can't be negative")
+	}
+	if *o.barcodeDirs && o.fileList != "" {
+		return nil, usagef("-barcode-dirs needs the barcode directories' parent in -i")
+	}
+	var samples *sampleSheet
+	var barcodes *barcodeSheet
+	if *o.sampleSheet != "" {
+		if samples, err = readSampleSheet(*o.sampleSheet, *o.barcodeMismatches); err != nil {
+			return nil, err
+		}
+		if samples.barcodes != nil && *o.barcodes != "" {
+			return nil, usagef("the sample sheet gives barcodes already; leave out -barcodes")
+		}
+		barcodes = samples.barcodes
+	}
+	if *o.barcodes != "" {
+		if barcodes, err = readBarcodeSheet(*o.barcodes, *o.barcodeMismatches); err != nil {
+			return nil, err
+		}
+	}
+	if barcodes != nil {
+		if !*o.barcodeDirs {
+			if err := barcodes.checkSequences(); err != nil {
+				return nil, usagef("can't demultiplex: %w; pass -barcode-dirs for input already split by barcode", err)
+			}
+		}
+	}
+	opts := o.opts
+	opts.Demux = barcodes != nil && !*o.barcodeDirs
+	if opts.Demux && confident != nil {
+		return nil, usagef("-stop-when-confident can't be used when demultiplexing, as a file's reads have several samples' calls")
+	}
+	if samples != nil {
+		opts.Samples = samples.samples
+	}
+	partitions, err := parseOutputPartitions(*o.partitionBy)
+	if err != nil {
+		return nil, usagef("invalid -partition-by: %w", err)
+	}
+	opts.PartitionBy = partitions
+	if opts.Columns, err = output.ParseColumns(*o.columns); err != nil {
+		return nil, usagef("invalid -columns: %w", err)
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, usagef("invalid output options: %w", err)
 	}
 
 	// Load sankets from CSV
-	sankets, err := LoadSankets("sanket.csv") // Specify the path to your CSV file
+	panelCSV, err := findPanel(panelPath)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := loadPanel(panelCSV)
 	if err != nil {
-		fmt.Printf("Failed to load sankets: %v\n", err)
-		return
+		return nil, fmt.Errorf("can't load sankets: %w", err)
+	}
+	panel := idx.Panel
+	opts.Metadata = runMetadata(panel, opts.Schema)
+	if opts.MinBScore > 0 {
+		opts.Metadata["bhedi.min_bscore"] = strconv.FormatFloat(opts.MinBScore, 'g', -1, 64)
+	}
+	if opts.Trim.Quality > 0 {
+		opts.Metadata["bhedi.quality_trim"] = opts.Trim.String()
+	}
+	if len(opts.Adapters.Adapters) > 0 {
+		opts.Metadata["bhedi.adapters"] = opts.Adapters.String()
+	}
+	if opts.MatchedOnly {
+		opts.Metadata["bhedi.matched_only"] = "true"
+	}
+	opts.Metadata["bhedi.scoring.normalization"] = "estimated"
+	if *o.countFirst {
+		opts.Metadata["bhedi.scoring.normalization"] = "counted"
+	}
+	slog.Debug("panel loaded", "file", panelCSV, "name", panel.Name, "version", panel.Version, "sankets", panel.Sankets)
+	built := time.Now()
+	m := backend.build(idx)
+	m = newWindowedMatcher(idx, m, *o.readWindow)
+	if *o.prefilter {
+		m = newPrefilter(idx, m)
+	}
+	if *o.collapse {
+		m = newCollapser(m)
 	}
+	slog.Debug("matcher built", "matcher", backend.name, "duration", time.Since(built).Round(time.Millisecond))
 
-	dirEntries, err := os.ReadDir(inputDir)
+	r := &runner{outputDir: o.outputDir, opts: opts, panelFile: panelCSV, sankets: m, samples: samples, barcodes: barcodes, confident: confident, barcodeDirs: *o.barcodeDirs,
+		countFirst: *o.countFirst, unlisted: make(map[string]bool), existing: existing, showProgress: !*o.noProgress}
+	reportPath := *o.reportPath
+	if reportPath == "" && !isBucketURL(o.outputDir) {
+		reportPath = filepath.Join(o.outputDir, runReportFile)
+	}
+	r.report = newRunReport(reportPath, panel, o.fs)
+	stateDir := o.outputDir
+	// With a bucket, each file's results are written to a temp directory and
+	// uploaded, so local disk only holds one sample at a time
+	if isBucketURL(o.outputDir) {
+		if r.bucket, err = openBucket(context.Background(), o.outputDir); err != nil {
+			return nil, fmt.Errorf("can't open the output bucket: %w", err)
+		}
+		stateDir = ""
+	}
+	if r.state, err = openRunState(*o.statePath, stateDir, runSettings(panel, opts, barcodes, confident, !*o.countFirst), resume); err != nil {
+		if r.bucket != nil {
+			r.bucket.Close()
+		}
+		return nil, err
+	}
+	r.pool = newWorkerPool(*o.threads)
+	return r, nil
+}
+
+// Close stops the workers and closes the output
+func (r *runner) Close() {
+	r.pool.Close()
+	if r.bucket != nil {
+		r.bucket.Close()
+	} else {
+		os.Remove(filepath.Join(r.outputDir, partialDir)) // unless another run is using it
+	}
+}
+
+// classify classifies one file, unless the run state says it's done already,
+// filling in rec
+func (r *runner) classify(input inputFile, rec *fileReport) error {
+	logger := slog.With("file", input.Path, "sample", input.Sample)
+	if file, ok := r.state.Finished(input.Path); ok {
+		logger.Info("already classified, skipping", "reads", file.Reads, "finished_at", file.FinishedAt)
+		rec.Status, rec.Reason, rec.Reads, rec.Outputs = FileSkipped, "finished by an earlier run", file.Reads, file.Outputs
+		return nil
+	}
+	existing, err := r.existingResults(input)
 	if err != nil {
-		fmt.Printf("Error reading directory %s: %v\n", inputDir, err)
-		return
+		logger.Error("can't look for existing results", "error", err)
+		return err
 	}
+	if len(existing) > 0 {
+		switch r.existing {
+		case ExistingSkip:
+			logger.Info("results exist, skipping", "output", existing[0])
+			rec.Status, rec.Reason, rec.Outputs = FileSkipped, "results exist", existing
+			return nil
+		case ExistingFail:
+			err := fmt.Errorf("%s already exists; pass -overwrite to replace it or -skip-existing to leave the file", existing[0])
+			logger.Error("classification failed", "error", err)
+			return err
+		}
+	}
+	// The reads and read length BScore normalizes by, which the progress bar
+	// counts towards too: estimated from the start of the file, or counted
+	// in a pass of their own with -count-first
+	count := estimateNormalization
+	if r.countFirst {
+		count = countNormalization
+	}
+	norm, err := count(input.Path, r.opts.Trim, r.opts.Adapters)
+	if err != nil {
+		logger.Error("can't count reads", "error", err)
+		return err
+	}
+	rec.Normalization = &norm
+	// Process the FASTQ file
+	logger.Info("classifying", "total_reads", norm.Reads, "read_length", norm.ReadLength, "estimated", norm.Estimated)
+	logger.Debug("results go to", "output", input.Output)
+	bar := r.progress.file(input.Path, input.Sample, norm.Reads)
+	defer bar.Finish()
+	start := time.Now()
+	call := r.confident.track()
+	var outputs []string
+	var totalRecords int
+	var barcodeReads map[string]int
+	if r.bucket != nil {
+		outputs, totalRecords, barcodeReads, err = classifyToBucket(r.pool, r.bucket, input, r.sankets, r.demux(), norm, r.opts, call, bar)
+	} else {
+		// Results are written aside and moved into place once complete
+		partial := filepath.Join(r.outputDir, partialDir, url.PathEscape(filepath.ToSlash(filepath.Join(input.Dir, input.Name))))
+		os.RemoveAll(partial) // left by a crashed run
+		if err = os.MkdirAll(partial, 0o755); err == nil {
+			totalRecords, barcodeReads, err = processFastqFile(r.pool, input, r.sankets, r.demux(), partial, norm, r.opts, call, bar)
+		}
+		if err == nil {
+			outputs, err = publishResults(partial, r.outputDir)
+		}
+		if err != nil {
+			os.RemoveAll(partial)
+		}
+	}
+	if err != nil {
+		logger.Error("classification failed", "error", err)
+		return err
+	}
+	duration := time.Since(start)
+	rec.Reads = totalRecords
+	logger.Info("classified", "reads", totalRecords, "duration", duration.Round(time.Millisecond))
+	if call.stoppedEarly() {
+		serotype, share := call.share()
+		logger.Info("stopped early on a confident call", "serotype", serotype, "share", share, "matched_at_call", call.matched)
+		rec.StoppedEarly = true
+	}
+	if barcodeReads != nil {
+		logger.Info("demultiplexed", "barcode_reads", formatBarcodeReads(barcodeReads))
+	}
+	rec.Outputs, rec.ClassifyTime, rec.Barcodes = outputs, duration.Seconds(), barcodeReads
+	if duration > 0 {
+		rec.ReadsPerSecond = float64(totalRecords) / duration.Seconds()
+	}
+	if err := r.state.Finish(input.Path, input.Sample, totalRecords, outputs); err != nil {
+		logger.Error("can't record the file as classified", "error", err)
+	}
+	return nil
+}
+
+// demux returns the barcode sheet reads are demultiplexed by, or nil
+func (r *runner) demux() *barcodeSheet {
+	if r.barcodeDirs {
+		return nil
+	}
+	return r.barcodes
+}
 
-	for _, entry := range dirEntries {
-		if !entry.IsDir() {
-			fileName := entry.Name()
-			if strings.HasSuffix(fileName, ".fastq") {
-				fastqPath := filepath.Join(inputDir, fileName)
-				// Get total records and average read length for progress bar and BScore calculation
-				totalRecords, avgReadLength, err := getTotalRecordsAndAvgReadLength(fastqPath)
+// discover finds the FASTQ files of -i, or else of the sample sheet, naming
+// the samples of barcode directories and of the files the sample sheet
+// lists. When the sheet maps files rather than barcodes to samples, the files
+// it doesn't list are left out.
+func (r *runner) discover(o *runOptions) ([]inputFile, error) {
+	if o.inputDir == "" {
+		return r.samples.files()
+	}
+	inputs, err := discoverInputs(o.inputDir, *o.recursive || r.barcodeDirs, *o.include)
+	if err != nil {
+		return nil, err
+	}
+	if r.barcodeDirs {
+		barcodeDirSamples(inputs, r.barcodes)
+		if r.samples != nil {
+			nameBySample(inputs)
+		}
+	}
+	if r.samples == nil || r.barcodes != nil {
+		return inputs, nil
+	}
+	inputs, unlisted := r.samples.assign(inputs)
+	for _, input := range unlisted {
+		if !r.unlisted[input.Path] {
+			r.unlisted[input.Path] = true
+			slog.Warn("not in the sample sheet, skipping", "file", input.Path)
+		}
+	}
+	return inputs, nil
+}
+
+// classifyAll classifies jobs files at a time, all feeding the same worker
+// pool, updates the run report and returns the files that failed
+func (r *runner) classifyAll(inputs []inputFile, jobs int) []inputFile {
+	r.progress = newProgressDisplay(len(inputs), r.showProgress)
+	defer r.progress.Stop()
+	queue := make(chan inputFile)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []inputFile
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for input := range queue {
+				rec := fileReport{File: input.Path, Sample: input.Sample, Status: FileClassified, StartedAt: time.Now().UTC()}
+				err := r.classify(input, &rec)
+				rec.Duration = time.Since(rec.StartedAt).Seconds()
 				if err != nil {
-					fmt.Printf("Failed to get total records and average read length for %s: %v\n", fastqPath, err)
-					continue
-				}
-				// Process the FASTQ file
-				if err := processFastqFile(fastqPath, sankets, outputDir, totalRecords, avgReadLength); err != nil {
-					fmt.Printf("Failed to process FASTQ file %s: %v\n", fastqPath, err)
+					rec.Status, rec.Error = FileFailed, err.Error()
+					mu.Lock()
+					failed = append(failed, input)
+					mu.Unlock()
 				}
+				r.report.add(rec)
+				r.progress.fileDone()
+			}
+		}()
+	}
+	for _, input := range inputs {
+		queue <- input
+	}
+	close(queue)
+	wg.Wait()
+	if err := r.writeReport(); err != nil {
+		slog.Error("can't write the run report", "error", err)
+	}
+	return failed
+}
+
+// runFlags sets up the run command: classify every FASTQ file of -i into -o
+func runFlags(fs *flag.FlagSet) func(args []string) error {
+	o := defineRunFlags(fs)
+	fs.StringVar(&o.fileList, "file-list", "", "Classify the FASTQ files listed in this file, or - for stdin, instead of -i: one path per line, optionally followed by a sample name and an output name, separated by tabs or commas")
+	resume := fs.Bool("resume", false, "Skip the files an earlier run with the same settings finished, e.g. after a crash; unfinished files are classified again from the start")
+	cpuProfile := fs.String("cpuprofile", "", "Write a CPU profile to this file, e.g. for a performance bug report")
+	memProfile := fs.String("memprofile", "", "Write a heap profile to this file when the run ends")
+	dryRun := fs.Bool("dry-run", false, "List the files that would be classified with their estimated reads and result size, check the panel and output, and exit")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return usagef("unexpected arguments %q; the input directory goes in -i", args)
+		}
+		stopProfiling, err := startProfiling(*cpuProfile, *memProfile)
+		if err != nil {
+			return err
+		}
+		defer stopProfiling()
+
+		r, err := o.start(*resume)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		var inputs []inputFile
+		if o.fileList != "" {
+			inputs, err = readFileList(o.fileList)
+		} else {
+			inputs, err = r.discover(o)
+		}
+		if err != nil {
+			return err
+		}
+		if r.samples != nil && r.barcodes == nil {
+			for _, line := range r.samples.unused(inputs) {
+				slog.Warn("the sample sheet lists a sample without files", "line", line)
+			}
+			if len(inputs) == 0 {
+				return fmt.Errorf("no FASTQ file of %s is in the sample sheet", o.inputDir)
 			}
 		}
+		if err := r.nameOutputs(inputs, time.Now()); err != nil {
+			return err
+		}
+		slog.Debug("found input files", "files", len(inputs))
+		if *dryRun {
+			return r.dryRun(inputs)
+		}
+		if failed := r.classifyAll(inputs, *o.jobs); len(failed) > 0 {
+			return fmt.Errorf("%d of %d files failed, first %s", len(failed), len(inputs), failed[0].Path)
+		}
+		if totals := r.report.totals(); totals.Reads == 0 && totals.Skipped == 0 {
+			return fmt.Errorf("%w: the input holds no FASTQ reads", errNoReads)
+		}
+		if c, ok := r.sankets.(*collapser); ok {
+			reads, duplicates := c.duplicates()
+			slog.Info("duplicate reads collapsed", "reads", reads, "duplicates", duplicates)
+		}
+		slog.Info("all analyses are complete")
+		return nil
 	}
-	fmt.Println("All analyses are complete.")
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// gcLoop is how calculateGCPercentage counted before it used bytes.Count
+func gcLoop(seq []byte) float64 {
+	gcCount := 0
+	for _, b := range seq {
+		if b == 'G' || b == 'C' {
+			gcCount++
+		}
+	}
+	return (float64(gcCount) / float64(len(seq))) * 100
+}
+
+// BenchmarkGC compares calculateGCPercentage with the loop it replaced, on
+// short-read and long-read lengths
+func BenchmarkGC(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{150, 1000, 10000, 100000} {
+		seq := []byte(randomBases(rng, n))
+		if got, want := calculateGCPercentage(seq), gcLoop(seq); got != want {
+			b.Fatalf("%d bases: calculateGCPercentage %v, loop %v", n, got, want)
+		}
+		for _, count := range []struct {
+			name string
+			gc   func([]byte) float64
+		}{{"loop", gcLoop}, {"bytes.Count", calculateGCPercentage}} {
+			b.Run(fmt.Sprintf("%s/%d", count.name, n), func(b *testing.B) {
+				b.SetBytes(int64(n))
+				for range b.N {
+					count.gc(seq)
+				}
+			})
+		}
+	}
+}
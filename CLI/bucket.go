@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/s3blob"
+)
+
+// bucketSchemes are the object storage URLs -o accepts in place of a
+// directory, e.g. s3://results?region=eu-west-1&prefix=bhedi/, gs://results or
+// azblob://results. Credentials come from the provider's usual environment
+// variables or config files.
+var bucketSchemes = map[string]bool{"s3": true, "gs": true, "azblob": true, "file": true}
+
+// isBucketURL reports whether dest names an object storage bucket
+func isBucketURL(dest string) bool {
+	u, err := url.Parse(dest)
+	return err == nil && bucketSchemes[u.Scheme]
+}
+
+// openBucket opens the object storage bucket at rawURL
+func openBucket(ctx context.Context, rawURL string) (*blob.Bucket, error) {
+	bucket, err := blob.OpenBucket(ctx, rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("can't open bucket %s: %w", rawURL, err)
+	}
+	return bucket, nil
+}
+
+// uploadFile copies the file at path to key
+func uploadFile(ctx context.Context, bucket *blob.Bucket, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opts := &blob.WriterOptions{ContentType: mime.TypeByExtension(filepath.Ext(path))}
+	if opts.ContentType == "" {
+		opts.ContentType = "application/octet-stream"
+	}
+	if err := bucket.Upload(ctx, key, f, opts); err != nil {
+		return fmt.Errorf("can't upload %s: %w", key, err)
+	}
+	return nil
+}
+
+// uploadDir copies every file under dir to the bucket, keyed by prefix plus
+// its path relative to dir, and returns the keys it uploaded
+func uploadDir(ctx context.Context, bucket *blob.Bucket, dir, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		if err := uploadFile(ctx, bucket, key, path); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
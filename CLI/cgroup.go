@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Where the container's limits are, as a cgroup v2 or v1 hierarchy mounted
+// at the usual place shows them to the processes inside it
+const (
+	cgroupCPUMax       = "/sys/fs/cgroup/cpu.max"
+	cgroupMemoryMax    = "/sys/fs/cgroup/memory.max"
+	cgroupV1CPUQuota   = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1CPUPeriod  = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+	cgroupV1MemoryMax  = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+	cgroupV1NoMemLimit = 1 << 62 // v1 reports no limit as a number near the largest int64
+)
+
+// containerLimits are the CPU quota and memory limit of the container the
+// process runs in, 0 where there is none
+type containerLimits struct {
+	CPUs   float64
+	Memory int64
+}
+
+// container is what fitToContainer found, for the defaults that scale with
+// the CPUs and memory to hand
+var container containerLimits
+
+// readCgroupInts reads the whitespace-separated fields of a cgroup file,
+// reporting false for a missing file or "max", which is no limit
+func readCgroupInts(path string) ([]int64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var values []int64
+	for _, field := range strings.Fields(string(data)) {
+		v, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, len(values) > 0
+}
+
+// detectContainer reads the CPU quota and memory limit of the cgroup the
+// process runs in
+func detectContainer() containerLimits {
+	var limits containerLimits
+	if v, ok := readCgroupInts(cgroupCPUMax); ok && len(v) == 2 && v[0] > 0 && v[1] > 0 {
+		limits.CPUs = float64(v[0]) / float64(v[1])
+	} else if quota, ok := readCgroupInts(cgroupV1CPUQuota); ok && quota[0] > 0 {
+		if period, ok := readCgroupInts(cgroupV1CPUPeriod); ok && period[0] > 0 {
+			limits.CPUs = float64(quota[0]) / float64(period[0])
+		}
+	}
+	if v, ok := readCgroupInts(cgroupMemoryMax); ok && v[0] > 0 {
+		limits.Memory = v[0]
+	} else if v, ok := readCgroupInts(cgroupV1MemoryMax); ok && v[0] > 0 && v[0] < cgroupV1NoMemLimit {
+		limits.Memory = v[0]
+	}
+	return limits
+}
+
+// fitToContainer sizes the Go runtime to the container: GOMAXPROCS to its
+// CPU quota, rounded up, and the garbage collector's memory limit to 90% of
+// its memory limit, so a pod allowed 2 CPUs of a 64-core node runs 2
+// workers rather than 64 and collects garbage before it is killed for
+// running out of memory. $GOMAXPROCS and $GOMEMLIMIT still win.
+func fitToContainer() {
+	container = detectContainer()
+	if container.CPUs > 0 && os.Getenv("GOMAXPROCS") == "" {
+		procs := max(1, int(math.Ceil(container.CPUs)))
+		if procs < runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(procs)
+		}
+	}
+	if container.Memory > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(container.Memory / 10 * 9)
+	}
+}
+
+// availableCPUs is how many reads can be classified at once: the CPUs, or
+// the container's CPU quota if lower
+func availableCPUs() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// memoryShare returns def, or the container's memory limit divided by
+// share if that is smaller, but at least floor
+func memoryShare(def, share, floor int64) int64 {
+	if container.Memory == 0 {
+		return def
+	}
+	return max(floor, min(def, container.Memory/share))
+}
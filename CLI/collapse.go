@@ -0,0 +1,70 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+// collapseMaxBases bounds the read sequences a collapser keeps, 256 MB of
+// them; once it is reached, sequences not seen yet are matched every time
+const collapseMaxBases = 256 << 20
+
+// collapseShards is how many separately locked parts a collapser's cache is
+// split into, so workers seldom wait on each other
+const collapseShards = 64
+
+// collapser matches each distinct read sequence once: identical reads, as
+// amplicon runs have by the thousand, get the sankets their first copy
+// matched. Every read is still scored and written as its own row, so counts
+// and summaries are those of matching them all. The cache is shared by every
+// file of the run.
+type collapser struct {
+	next   matcher
+	seed   maphash.Seed
+	shards [collapseShards]collapseShard
+	bases  atomic.Int64 // bases of the sequences cached
+	reads  atomic.Int64 // reads matched
+	hits   atomic.Int64 // reads matched from the cache
+}
+
+type collapseShard struct {
+	mu    sync.RWMutex
+	found map[string][]*SanketInfo
+}
+
+func newCollapser(m matcher) *collapser {
+	c := &collapser{next: m, seed: maphash.MakeSeed()}
+	for i := range c.shards {
+		c.shards[i].found = make(map[string][]*SanketInfo)
+	}
+	return c
+}
+
+// Match returns the sankets of an identical read matched before, which
+// processRecord only reads, or matches seq and keeps them while there is room
+func (c *collapser) Match(seq []byte) []*SanketInfo {
+	c.reads.Add(1)
+	shard := &c.shards[maphash.Bytes(c.seed, seq)%collapseShards]
+	shard.mu.RLock()
+	found, ok := shard.found[string(seq)] // looked up without a copy
+	shard.mu.RUnlock()
+	if ok {
+		c.hits.Add(1)
+		return found
+	}
+	found = c.next.Match(seq)
+	if c.bases.Load()+int64(len(seq)) <= collapseMaxBases {
+		c.bases.Add(int64(len(seq)))
+		shard.mu.Lock()
+		shard.found[string(seq)] = found
+		shard.mu.Unlock()
+	}
+	return found
+}
+
+// duplicates returns the reads matched so far and how many of them were
+// duplicates matched from the cache
+func (c *collapser) duplicates() (reads, duplicates int64) {
+	return c.reads.Load(), c.hits.Load()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// command is a subcommand with its own flags and help
+type command struct {
+	name    string
+	args    string // what follows the flags, for the usage line
+	summary string
+	// setup defines the command's flags on fs and returns the func running it
+	// with the arguments left after them
+	setup func(fs *flag.FlagSet) func(args []string) error
+	// subcommands are the commands of a command of commands, such as index,
+	// which has no setup of its own
+	subcommands []command
+}
+
+// commands lists the subcommands in the order help shows them
+var commands = []command{
+	{"run", "-i <input dir> -o <output dir>", "Classify every FASTQ file of a directory against the sanket panel", runFlags, nil},
+	{"watch", "-i <input dir> -o <output dir>", "Classify FASTQ files as they appear in a directory, e.g. beside a sequencer", watchFlags, nil},
+	{"build-db", "-i <sankets.csv> -o <panel.csv>", "Check a sanket table and write it out as a panel for run", buildDBFlags, nil},
+	{name: "index", args: "<command>", summary: "Work with panel indexes, which run, watch and the API load in place of a panel, for large panels", subcommands: []command{
+		{"build", "-p <panel.csv> [-o <panel.bidx>]", "Compile a panel into an index that run, watch and the API load in place of it", buildIndexFlags, nil},
+	}},
+	{"report", "<result file or dir>...", "Summarize the serotypes found in existing result files, per sample", reportFlags, nil},
+	{"convert", "<result file or dir>...", "Convert result files to another format, keeping chosen columns and matching rows", convertFlags, nil},
+	{"filter", "<result file or dir>...", "Copy result files keeping only reads above a BScore, of chosen serotypes or meeting conditions", filterFlags, nil},
+	{"merge", "-o <combined.parquet> <result file or dir>...", "Combine result files into one Parquet file with a sample column", mergeFlags, nil},
+	{"diff", "<old results> <new results>", "Compare two result sets, e.g. before and after a panel update, per sample and per read", diffFlags, nil},
+	{"stats", "<fastq file>...", "Count the reads of FASTQ files and their mean length", statsFlags, nil},
+	{"validate", "[<fastq file or dir>...]", "Check the panel, and FASTQ files if given, before a long run", validateFlags, nil},
+	{"validate-output", "<result file or dir>...", "Check result files: schema, metadata, row groups and read counts", validateOutputFlags, nil},
+	{"bench", "[<fastq file or dir>...]", "Compare the speed, memory and agreement of the matcher backends on this machine", benchFlags, nil},
+	{"simulate", "-ref <serotype>=<fasta> -o <reads.fastq>", "Write FASTQ reads drawn from reference genomes in chosen serotype shares, to check a setup end to end", simulateFlags, nil},
+	{"version", "", "Print the version, commit and build date, and the panel run would load", versionFlags, nil},
+	{"self-update", "", "Replace this executable with the latest release, checked against its signed checksums", selfUpdateFlags, nil},
+}
+
+// commandAliases maps names commands went by before to how they are called
+// now, for scripts written against them
+var commandAliases = map[string][]string{
+	"build-index": {"index", "build"},
+}
+
+// Exit statuses, for pipelines such as Nextflow or Snakemake to tell why a
+// command failed
+const (
+	exitOK      = 0
+	exitUsage   = 1 // bad command, flags, arguments or config file
+	exitFailed  = 2 // the command ran but failed, e.g. a file couldn't be read or classified
+	exitNoReads = 3 // run found no reads to classify
+)
+
+// usageError is a mistake in how a command was called rather than a failure
+// of the command itself
+type usageError struct{ err error }
+
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
+
+// usagef formats a usageError
+func usagef(format string, args ...any) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
+
+// errNoReads is returned by a run that found no reads at all to classify
+var errNoReads = errors.New("no reads were classified")
+
+// exitStatus maps a command's error to its exit status
+func exitStatus(err error) int {
+	var usage usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, errNoReads):
+		return exitNoReads
+	default:
+		return exitFailed
+	}
+}
+
+// program is the name the binary was started as, for usage messages
+var program = filepath.Base(os.Args[0])
+
+func main() {
+	fitToContainer()
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	switch name := args[0]; {
+	case name == "help" || name == "-h" || name == "-help" || name == "--help":
+		if len(args) > 1 {
+			if cmd, _, ok := findCommand(args[1:]); ok {
+				cmd.usage()
+				return
+			}
+		}
+		usage()
+		return
+	case strings.HasPrefix(name, "-"):
+		// Scripts written before subcommands pass run's flags directly
+		fmt.Fprintf(os.Stderr, "%s: flags without a command are deprecated; use %s run %s\n", program, program, strings.Join(args, " "))
+		args = append([]string{"run"}, args...)
+	}
+
+	cmd, rest, ok := findCommand(args)
+	switch {
+	case !ok:
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", program, strings.TrimSpace(cmd.name+" "+rest[0]))
+		if cmd.subcommands != nil {
+			cmd.usage()
+		} else {
+			usage()
+		}
+		os.Exit(exitUsage)
+	case cmd.subcommands != nil:
+		cmd.usage()
+		os.Exit(exitUsage)
+	}
+	os.Exit(cmd.execute(rest))
+}
+
+// findCommand finds the command args name, descending into commands of
+// commands such as index build, and returns it with the arguments after its
+// name. When a name isn't known, it returns false with the command of
+// commands it isn't one of, if any, and the arguments from that name on.
+func findCommand(args []string) (command, []string, bool) {
+	if alias, ok := commandAliases[args[0]]; ok {
+		args = append(append([]string(nil), alias...), args[1:]...)
+	}
+	var cmd command
+	list := commands
+	for i, name := range args {
+		found := false
+		for _, c := range list {
+			if c.name == name {
+				if cmd.name != "" {
+					c.name = cmd.name + " " + c.name
+				}
+				cmd, found = c, true
+				break
+			}
+		}
+		if !found {
+			return cmd, args[i:], false
+		}
+		if cmd.subcommands == nil {
+			return cmd, args[i+1:], true
+		}
+		list = cmd.subcommands
+	}
+	return cmd, nil, true // a command of commands, without one of them
+}
+
+// usage prints the command's flags, or for a command of commands lists them
+func (c command) usage() {
+	if c.subcommands == nil {
+		c.flagSet().Usage()
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s %s %s [flags] [arguments]\n\n%s.\n\nCommands:\n", program, c.name, c.args, c.summary)
+	for _, sub := range c.subcommands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", sub.name, sub.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s help %s <command> for its flags.\n", program, c.name)
+}
+
+// usage lists the commands
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", program)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s help <command> for its flags.\n", program)
+}
+
+// flagSet returns the command's flags, with the logging flags and -config
+// shared by every command
+func (c command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(program+" "+c.name, flag.ContinueOnError)
+	fs.String("log-format", LogFormatText, "Log format: text or json")
+	fs.String("log-level", "info", "Least severe messages logged: debug, info, warn or error")
+	fs.Bool("quiet", false, "Only log warnings and errors, without progress; short for -log-level warn")
+	fs.Bool("verbose", false, "Also log debugging messages; short for -log-level debug")
+	fs.String("config", "", "Read settings from a YAML or TOML file, e.g. bhedi.yaml; flags given here override it")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n\n%s.\n\nFlags:\n", program, c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses flags that follow the arguments too, as in
+// convert results.parquet -to csv, and returns the arguments. Everything
+// after -- is an argument.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	args = fs.Args()
+	var positional []string
+	for len(args) > 0 {
+		positional = append(positional, args[0])
+		rest := args[1:]
+		if err := fs.Parse(rest); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if consumed := len(rest) - len(args); consumed > 0 && rest[consumed-1] == "--" {
+			return append(positional, args...), nil
+		}
+	}
+	return positional, nil
+}
+
+// execute parses the command's flags, runs it and returns the exit status
+func (c command) execute(args []string) int {
+	fs := c.flagSet()
+	run := c.setup(fs)
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage // the flag package has printed the error and usage
+	}
+	if path := fs.Lookup("config").Value.String(); path != "" {
+		cfg, err := loadConfig(path)
+		if err == nil {
+			err = cfg.apply(fs)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	level, err := logLevel(fs.Lookup("log-level").Value.String(), fs.Lookup("quiet").Value.String() == "true", fs.Lookup("verbose").Value.String() == "true")
+	if err == nil {
+		err = setupLogging(fs.Lookup("log-format").Value.String(), level)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if path := fs.Lookup("config").Value.String(); path != "" {
+		slog.Debug("settings read from the config file", "file", path)
+	}
+	if container.CPUs > 0 || container.Memory > 0 {
+		slog.Debug("fitted to the container", "cpu_quota", container.CPUs, "memory_limit", container.Memory, "gomaxprocs", availableCPUs())
+	}
+	err = run(args)
+	if err != nil {
+		slog.Error(c.name+" failed", "error", err)
+	}
+	return exitStatus(err)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"bhedi/output"
+)
+
+// confidenceRule is when -stop-when-confident stops reading a file: once at
+// least Reads reads have matched and Share of them call the same serotype,
+// the sample's call is clear and the rest of the file can't change it
+type confidenceRule struct {
+	Share float64
+	Reads int
+}
+
+// callTracker follows the serotype call of one file as its results are
+// written, for the reader to stop at once it is confident. Its counts are
+// kept by the file's writer goroutine alone.
+type callTracker struct {
+	rule      confidenceRule
+	serotypes map[string]int // matched reads by the serotype they call
+	matched   int
+	call      string
+	confident atomic.Bool
+	cut       bool // reading stopped before the end of the file
+}
+
+// track starts following a file's call, or returns nil without a rule
+func (rule *confidenceRule) track() *callTracker {
+	if rule == nil {
+		return nil
+	}
+	return &callTracker{rule: *rule, serotypes: make(map[string]int)}
+}
+
+// add counts a read's call, the serotype of its best-scoring match as
+// report has it, and checks whether the file's call is now confident
+func (t *callTracker) add(result output.Result) {
+	if t == nil || !result.MatchesFound || t.confident.Load() {
+		return
+	}
+	best := result.Matches[0]
+	for _, m := range result.Matches[1:] {
+		if m.BScore > best.BScore || m.BScore == best.BScore && m.Serotype < best.Serotype {
+			best = m
+		}
+	}
+	t.matched++
+	t.serotypes[best.Serotype]++
+	if t.serotypes[best.Serotype] > t.serotypes[t.call] || t.serotypes[best.Serotype] == t.serotypes[t.call] && best.Serotype < t.call {
+		t.call = best.Serotype
+	}
+	if t.matched >= t.rule.Reads && float64(t.serotypes[t.call]) >= t.rule.Share*float64(t.matched) {
+		t.confident.Store(true)
+	}
+}
+
+// stop reports whether the file's call is confident, so reading it stops
+// here and the read just read is skipped with the rest. The reader asks
+// only once it has that read, so a file read to its end never counts as
+// stopped early.
+func (t *callTracker) stop() bool {
+	if t == nil || !t.confident.Load() {
+		return false
+	}
+	t.cut = true
+	return true
+}
+
+// stoppedEarly reports whether reading the file stopped before its end
+func (t *callTracker) stoppedEarly() bool {
+	return t != nil && t.cut
+}
+
+// share returns the file's call and the share of matched reads calling it
+func (t *callTracker) share() (string, float64) {
+	if t.matched == 0 {
+		return "", 0
+	}
+	return t.call, float64(t.serotypes[t.call]) / float64(t.matched)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a run's settings kept in a file, so a pipeline passes
+// -config bhedi.yaml instead of a dozen flags and the run can be repeated
+// from that one file. Keys are the flag names with underscores for dashes.
+// Flags given on the command line win over the file.
+type Config struct {
+	Input                    string        `yaml:"input" toml:"input"`
+	FileList                 string        `yaml:"file_list" toml:"file_list"`
+	Output                   string        `yaml:"output" toml:"output"`
+	Panel                    string        `yaml:"panel" toml:"panel"`
+	Threads                  int           `yaml:"threads" toml:"threads"`
+	Jobs                     int           `yaml:"jobs" toml:"jobs"`
+	Format                   string        `yaml:"format" toml:"format"`
+	Schema                   string        `yaml:"schema" toml:"schema"`
+	ParquetCompression       string        `yaml:"parquet_compression" toml:"parquet_compression"`
+	ParquetRowGroupSize      string        `yaml:"parquet_row_group_size" toml:"parquet_row_group_size"` // a size such as 32MB
+	ParquetPageSize          string        `yaml:"parquet_page_size" toml:"parquet_page_size"`
+	ParquetWriterParallelism int           `yaml:"parquet_writer_parallelism" toml:"parquet_writer_parallelism"`
+	Columns                  []string      `yaml:"columns" toml:"columns"`
+	PartitionBy              []string      `yaml:"partition_by" toml:"partition_by"`
+	OutputName               string        `yaml:"output_name" toml:"output_name"`
+	Overwrite                bool          `yaml:"overwrite" toml:"overwrite"`
+	SkipExisting             bool          `yaml:"skip_existing" toml:"skip_existing"`
+	Include                  string        `yaml:"include" toml:"include"`
+	Recursive                bool          `yaml:"recursive" toml:"recursive"`
+	Matcher                  string        `yaml:"matcher" toml:"matcher"`
+	Barcodes                 string        `yaml:"barcodes" toml:"barcodes"`
+	BarcodeDirs              bool          `yaml:"barcode_dirs" toml:"barcode_dirs"`
+	BarcodeMismatches        *int          `yaml:"barcode_mismatches" toml:"barcode_mismatches"` // 0, exact barcodes, differs from leaving it out
+	SampleSheet              string        `yaml:"sample_sheet" toml:"sample_sheet"`
+	MinBScore                float64       `yaml:"min_bscore" toml:"min_bscore"`
+	MatchedOnly              bool          `yaml:"matched_only" toml:"matched_only"`
+	CountFirst               bool          `yaml:"count_first" toml:"count_first"`
+	CollapseDuplicates       bool          `yaml:"collapse_duplicates" toml:"collapse_duplicates"`
+	StopWhenConfident        bool          `yaml:"stop_when_confident" toml:"stop_when_confident"`
+	Confidence               float64       `yaml:"confidence" toml:"confidence"`
+	ConfidentReads           int           `yaml:"confident_reads" toml:"confident_reads"`
+	TrimQuality              int           `yaml:"trim_quality" toml:"trim_quality"`
+	TrimWindow               int           `yaml:"trim_window" toml:"trim_window"`
+	TrimAdapters             []string      `yaml:"trim_adapters" toml:"trim_adapters"`
+	ReadWindow               *int          `yaml:"read_window" toml:"read_window"` // 0, reads matched whole, differs from leaving it out
+	Prefilter                *bool         `yaml:"prefilter" toml:"prefilter"`     // on by default, so only false says anything
+	LogFormat                string        `yaml:"log_format" toml:"log_format"`
+	LogLevel                 string        `yaml:"log_level" toml:"log_level"`
+	NoProgress               bool          `yaml:"no_progress" toml:"no_progress"`
+	Scoring                  ScoringParams `yaml:"scoring" toml:"scoring"` // BScore constants; ones left out keep their defaults
+}
+
+// flagAliases maps short flags to the flag they stand for
+var flagAliases = map[string]string{"p": "panel", "t": "threads", "j": "jobs", "r": "recursive"}
+
+// loadConfig reads a YAML (.yaml, .yml) or TOML (.toml) config file.
+// Unknown keys are errors, so a typo doesn't silently fall back to a default.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the config file: %w", err)
+	}
+	cfg := &Config{Scoring: scoring}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF { // io.EOF: an empty file
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("invalid config file %s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return nil, fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Threads < 0 || cfg.Jobs < 0 || cfg.ParquetWriterParallelism < 0 {
+		return fmt.Errorf("threads, jobs and parquet_writer_parallelism must be positive")
+	}
+	if cfg.BarcodeMismatches != nil && *cfg.BarcodeMismatches < 0 {
+		return fmt.Errorf("barcode_mismatches can't be negative")
+	}
+	if cfg.ReadWindow != nil && *cfg.ReadWindow < 0 {
+		return fmt.Errorf("read_window can't be negative")
+	}
+	if cfg.Scoring.GenomeSize <= 0 || cfg.Scoring.MaxSLen <= 0 {
+		return fmt.Errorf("scoring genome_size and max_s_len must be positive")
+	}
+	return nil
+}
+
+// apply sets the flags of fs the command line left unset from the file, then
+// the BScore constants, which have no flags. Keys for flags fs doesn't have
+// are ignored, so one file serves every command.
+func (cfg *Config) apply(fs *flag.FlagSet) error {
+	values := map[string]string{
+		"i":                      cfg.Input,
+		"file-list":              cfg.FileList,
+		"o":                      cfg.Output,
+		"panel":                  cfg.Panel,
+		"format":                 cfg.Format,
+		"schema":                 cfg.Schema,
+		"parquet-compression":    cfg.ParquetCompression,
+		"parquet-row-group-size": cfg.ParquetRowGroupSize,
+		"parquet-page-size":      cfg.ParquetPageSize,
+		"columns":                strings.Join(cfg.Columns, ","),
+		"partition-by":           strings.Join(cfg.PartitionBy, ","),
+		"output-name":            cfg.OutputName,
+		"include":                cfg.Include,
+		"matcher":                cfg.Matcher,
+		"barcodes":               cfg.Barcodes,
+		"sample-sheet":           cfg.SampleSheet,
+		"trim-adapters":          strings.Join(cfg.TrimAdapters, ","),
+		"log-format":             cfg.LogFormat,
+		"log-level":              cfg.LogLevel,
+	}
+	if cfg.Threads > 0 {
+		values["threads"] = strconv.Itoa(cfg.Threads)
+	}
+	if cfg.Jobs > 0 {
+		values["jobs"] = strconv.Itoa(cfg.Jobs)
+	}
+	if cfg.ParquetWriterParallelism > 0 {
+		values["parquet-writer-parallelism"] = strconv.Itoa(cfg.ParquetWriterParallelism)
+	}
+	if cfg.Overwrite {
+		values["overwrite"] = "true"
+	}
+	if cfg.SkipExisting {
+		values["skip-existing"] = "true"
+	}
+	if cfg.Recursive {
+		values["recursive"] = "true"
+	}
+	if cfg.BarcodeDirs {
+		values["barcode-dirs"] = "true"
+	}
+	if cfg.BarcodeMismatches != nil {
+		values["barcode-mismatches"] = strconv.Itoa(*cfg.BarcodeMismatches)
+	}
+	if cfg.MinBScore > 0 {
+		values["min-bscore"] = strconv.FormatFloat(cfg.MinBScore, 'g', -1, 64)
+	}
+	if cfg.MatchedOnly {
+		values["matched-only"] = "true"
+	}
+	if cfg.CountFirst {
+		values["count-first"] = "true"
+	}
+	if cfg.CollapseDuplicates {
+		values["collapse-duplicates"] = "true"
+	}
+	if cfg.StopWhenConfident {
+		values["stop-when-confident"] = "true"
+	}
+	if cfg.Confidence > 0 {
+		values["confidence"] = strconv.FormatFloat(cfg.Confidence, 'g', -1, 64)
+	}
+	if cfg.ConfidentReads > 0 {
+		values["confident-reads"] = strconv.Itoa(cfg.ConfidentReads)
+	}
+	if cfg.TrimQuality > 0 {
+		values["trim-quality"] = strconv.Itoa(cfg.TrimQuality)
+	}
+	if cfg.TrimWindow > 0 {
+		values["trim-window"] = strconv.Itoa(cfg.TrimWindow)
+	}
+	if cfg.ReadWindow != nil {
+		values["read-window"] = strconv.Itoa(*cfg.ReadWindow)
+	}
+	if cfg.Prefilter != nil {
+		values["prefilter"] = strconv.FormatBool(*cfg.Prefilter)
+	}
+	if cfg.NoProgress {
+		values["no-progress"] = "true"
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		if name, ok := flagAliases[f.Name]; ok {
+			given[name] = true
+		}
+		given[f.Name] = true
+	})
+	// -i and -file-list name the input either way, so one on the command line
+	// overrides the other in the file
+	if given["i"] || given["file-list"] {
+		given["i"], given["file-list"] = true, true
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if values[name] == "" || given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("invalid %s in the config file: %w", name, err)
+		}
+	}
+
+	scoring = cfg.Scoring
+	return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"bhedi/output"
+)
+
+// rowFilter is a -where condition on a flat column, e.g. b_score>=0.5 or
+// serotype!=Unassigned. Numeric columns compare as numbers; text columns
+// only with = and !=.
+type rowFilter struct {
+	column  output.Column
+	op      string
+	value   string
+	number  float64
+	numeric bool
+}
+
+// filterOps are the operators of a -where condition, longest first so <=
+// isn't read as <
+var filterOps = []string{"<=", ">=", "!=", "==", "=", "<", ">"}
+
+func parseRowFilter(expr string) (rowFilter, error) {
+	i := strings.IndexAny(expr, "<>!=")
+	if i <= 0 {
+		return rowFilter{}, fmt.Errorf("invalid condition %q (expected <column><op><value>, e.g. b_score>=0.5)", expr)
+	}
+	var f rowFilter
+	for _, op := range filterOps {
+		if strings.HasPrefix(expr[i:], op) {
+			f.op = op
+			break
+		}
+	}
+	if f.op == "" {
+		return rowFilter{}, fmt.Errorf("invalid condition %q (expected one of %s)", expr, strings.Join(filterOps, " "))
+	}
+	name := strings.TrimSpace(expr[:i])
+	f.value = strings.TrimSpace(expr[i+len(f.op):])
+	if f.op == "==" {
+		f.op = "="
+	}
+	found := false
+	for _, col := range output.FlatColumns {
+		if col.Name == name {
+			f.column, found = col, true
+		}
+	}
+	if !found {
+		return rowFilter{}, fmt.Errorf("unknown column %q in %q", name, expr)
+	}
+	f.numeric = f.column.SQL != "TEXT"
+	if f.numeric {
+		n, err := strconv.ParseFloat(f.value, 64)
+		if err != nil {
+			return rowFilter{}, fmt.Errorf("%s is numeric, so %q needs a number", name, expr)
+		}
+		f.number = n
+	} else if f.op != "=" && f.op != "!=" {
+		return rowFilter{}, fmt.Errorf("%s is text, so %q can only use = or !=", name, expr)
+	}
+	return f, nil
+}
+
+func (f rowFilter) String() string {
+	return f.column.Name + f.op + f.value
+}
+
+// match reports whether row meets the condition
+func (f rowFilter) match(row output.Record) bool {
+	value := f.column.Value(row)
+	if !f.numeric {
+		return (value.(string) == f.value) == (f.op == "=")
+	}
+	var n float64
+	switch v := value.(type) {
+	case int32:
+		n = float64(v)
+	case float64:
+		n = v
+	}
+	switch f.op {
+	case "=":
+		return n == f.number
+	case "!=":
+		return n != f.number
+	case "<":
+		return n < f.number
+	case "<=":
+		return n <= f.number
+	case ">":
+		return n > f.number
+	default:
+		return n >= f.number
+	}
+}
+
+// flatResult turns a flat row back into a result that writes the same row,
+// so conversion goes through run's own writers
+func flatResult(row output.Record) output.Result {
+	return output.Result{
+		ReadID:        row.ReadID,
+		GCPercentage:  row.GCPercentage,
+		TotalCoverage: int(row.TotalCoverage),
+		MatchesFound:  true, // unassigned rows too keep their values as read
+		Matches: []output.Match{{
+			SID: row.SID, Sanket: row.MatchedSanket, Serotype: row.Serotype, SLen: int(row.SLen),
+			SSRCount: row.SSRCount, MLenAvg: row.MLenAvg, MRCAvg: row.MRCAvg, PCount: row.PCount, PLenAvg: row.PLenAvg,
+			BScore: row.BScore,
+		}},
+	}
+}
+
+// nestedResult turns a flat row back into a read for the nested schema: the
+// row's match, or none for an Unassigned row
+func nestedResult(row output.Record) output.Result {
+	result := flatResult(row)
+	if row.Serotype == unassignedSerotype {
+		result.MatchesFound, result.Matches = false, nil
+	}
+	return result
+}
+
+// conversion is a result file and where its converted copy goes
+type conversion struct {
+	input, output string
+}
+
+// convertFlags sets up the convert command: rewrite result files of any
+// format as CSV, newline-delimited JSON, Parquet or SQLite with the flat
+// schema, for collaborators without Parquet tooling
+func convertFlags(fs *flag.FlagSet) func(args []string) error {
+	to := fs.String("to", output.FormatCSV, "Format to convert to: csv, json (newline-delimited), parquet or sqlite")
+	outPath := fs.String("o", "", "Output file, or directory when converting several files or a directory (default next to each input)")
+	columns := fs.String("columns", "", "Comma-separated flat columns to keep, e.g. read_id,serotype,b_score (default all)")
+	compression := fs.String("parquet-compression", "snappy", "Parquet compression codec: zstd, snappy, gzip or none")
+	overwrite := fs.Bool("overwrite", false, "Replace converted files that already exist")
+	var filters []rowFilter
+	fs.Func("where", "Keep only rows meeting a condition such as serotype=3, b_score>=0.5 or serotype!=Unassigned; repeat to require several", func(expr string) error {
+		f, err := parseRowFilter(expr)
+		if err == nil {
+			filters = append(filters, f)
+		}
+		return err
+	})
+
+	return func(args []string) error {
+		if len(args) == 0 {
+			return usagef("no result files given")
+		}
+		opts := OutputOptions{Options: output.Options{Format: *to, Schema: output.SchemaFlat, Compression: *compression}}
+		var err error
+		if opts.Columns, err = output.ParseColumns(*columns); err != nil {
+			return usagef("invalid -columns: %w", err)
+		}
+		if err := opts.Validate(); err != nil {
+			return usageError{err}
+		}
+
+		conversions, err := planConversions(args, *outPath, opts.Extension())
+		if err != nil {
+			return err
+		}
+		for _, c := range conversions {
+			if _, err := os.Stat(c.output); err == nil && !*overwrite {
+				return fmt.Errorf("%s exists; pass -overwrite to replace it", c.output)
+			}
+		}
+		keep := func(row output.Record) bool {
+			for _, f := range filters {
+				if !f.match(row) {
+					return false
+				}
+			}
+			return true
+		}
+		for _, c := range conversions {
+			metadata, err := resultMetadata(c.input)
+			if err != nil {
+				return fmt.Errorf("can't convert %s: %w", c.input, err)
+			}
+			metadata["bhedi.converted_from"] = filepath.Base(c.input)
+			if len(filters) > 0 {
+				conditions := make([]string, len(filters))
+				for i, f := range filters {
+					conditions[i] = f.String()
+				}
+				metadata["bhedi.converted_where"] = strings.Join(conditions, " AND ")
+			}
+			opts.Metadata = metadata
+			rows, kept, err := convertResults(c, opts, keep)
+			if err != nil {
+				return fmt.Errorf("can't convert %s: %w", c.input, err)
+			}
+			slog.Info("converted", "file", c.input, "output", c.output, "rows", rows, "kept", kept)
+		}
+		return nil
+	}
+}
+
+// planConversions pairs every result file found in args with its output:
+// beside the input without -o, at -o when converting one file, else under
+// the -o directory at the file's path relative to the argument it was found
+// in, which keeps the partition directories of partitioned results apart
+func planConversions(args []string, output, ext string) ([]conversion, error) {
+	var conversions []conversion
+	seen := make(map[string]string)
+	for _, arg := range args {
+		files, err := resultFiles([]string{arg})
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			c := conversion{input: file, output: strings.TrimSuffix(file, filepath.Ext(file)) + ext}
+			if output != "" {
+				if outInfo, err := os.Stat(output); len(args) == 1 && !info.IsDir() && (err != nil || !outInfo.IsDir()) {
+					c.output = output
+				} else {
+					rel := filepath.Base(file)
+					if info.IsDir() {
+						rel, _ = filepath.Rel(arg, file)
+					}
+					c.output = filepath.Join(output, strings.TrimSuffix(rel, filepath.Ext(rel))+ext)
+				}
+			}
+			if same, err := sameFile(c.input, c.output); err == nil && same {
+				if file != arg {
+					continue // found in a directory already in the format
+				}
+				return nil, usagef("%s is already %s; pass -o to write the copy elsewhere", c.input, strings.TrimPrefix(ext, "."))
+			}
+			if other, ok := seen[c.output]; ok {
+				return nil, fmt.Errorf("%s and %s would both be converted to %s", other, c.input, c.output)
+			}
+			seen[c.output] = c.input
+			conversions = append(conversions, c)
+		}
+	}
+	if len(conversions) == 0 {
+		return nil, usagef("no result files in %s", strings.Join(args, ", "))
+	}
+	return conversions, nil
+}
+
+// sameFile reports whether two paths name the same existing file
+func sameFile(a, b string) (bool, error) {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(ia, ib), nil
+}
+
+// convertResults copies the rows of c.input that keep accepts into c.output,
+// with the metadata of opts where the format holds any. With the nested
+// schema, the rows kept of each read make up one row again. It returns the
+// rows read and kept. The output is written to a temp file and renamed, so a
+// failed conversion leaves no partial file.
+func convertResults(c conversion, opts OutputOptions, keep func(output.Record) bool) (rows, kept int, err error) {
+	results, err := openResults(c.input)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer results.Close()
+	partitions := resultPartitions(c.input)
+	if err := os.MkdirAll(filepath.Dir(c.output), 0o755); err != nil {
+		return 0, 0, err
+	}
+	tmp := filepath.Join(filepath.Dir(c.output), "."+filepath.Base(c.output)+".tmp")
+	out, err := output.New(tmp, opts.Options)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp) // fails harmlessly once renamed
+
+	droppedSample := false
+	var read output.Result // the nested row being gathered
+	for {
+		row, err := results.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return rows, kept, err
+		}
+		rows++
+		if row.Serotype == "" {
+			row.Serotype = partitions["serotype"] // a partition column isn't stored in the file
+		}
+		if !keep(row.Record) {
+			continue
+		}
+		if row.Sample != "" && !droppedSample {
+			slog.Warn("the sample column of merged results isn't kept; query the merged file or convert the per-sample files", "file", c.input)
+			droppedSample = true
+		}
+		kept++
+		if opts.Schema != output.SchemaNested {
+			err = out.Write(flatResult(row.Record))
+		} else if read.ReadID != row.ReadID || kept == 1 {
+			if kept > 1 {
+				err = out.Write(read)
+			}
+			read = nestedResult(row.Record)
+		} else {
+			read.Matches = append(read.Matches, nestedResult(row.Record).Matches...)
+		}
+		if err != nil {
+			out.Close()
+			return rows, kept, err
+		}
+	}
+	if opts.Schema == output.SchemaNested && kept > 0 {
+		err = out.Write(read)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return rows, kept, err
+	}
+	return rows, kept, os.Rename(tmp, c.output)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Kinds of read changes diff reports
+const (
+	ChangeSerotype = "serotype" // the best match's serotype changed, or the read gained or lost its match
+	ChangeBScore   = "b_score"  // same serotype, BScore moved by more than -threshold
+	ChangeOnlyOld  = "only_old" // the read is missing from the new results
+	ChangeOnlyNew  = "only_new" // the read is missing from the old results
+)
+
+// noCall stands for the call of a sample without a matched read, or of a read
+// missing from one side
+const noCall = "-"
+
+const diffTSVHeader = "sample\tread_id\tchange\told_serotype\tnew_serotype\told_b_score\tnew_b_score"
+
+// readChange is a read whose call differs between two result sets
+type readChange struct {
+	sample, readID, change string
+	old, new               readCall
+}
+
+// sampleDiff compares one sample's results
+type sampleDiff struct {
+	sample               string
+	oldReport, newReport SampleReport
+	inOld, inNew         bool
+	changes              []readChange
+	changedBy            map[string]int // reads per kind of change
+}
+
+// diffSample compares the calls of every read of a sample. A nil tally
+// stands for a sample missing from one side.
+func diffSample(sample string, before, after *sampleTally, threshold float64) sampleDiff {
+	d := sampleDiff{sample: sample, inOld: before != nil, inNew: after != nil, changedBy: make(map[string]int)}
+	if before == nil {
+		before = &sampleTally{calls: map[string]readCall{}}
+	} else {
+		d.oldReport = before.report(sample)
+	}
+	if after == nil {
+		after = &sampleTally{calls: map[string]readCall{}}
+	} else {
+		d.newReport = after.report(sample)
+	}
+	add := func(readID, change string, o, n readCall) {
+		d.changes = append(d.changes, readChange{sample, readID, change, o, n})
+		d.changedBy[change]++
+	}
+	for id, o := range before.calls {
+		n, ok := after.calls[id]
+		switch {
+		case !ok:
+			add(id, ChangeOnlyOld, o, readCall{serotype: noCall})
+		case o.serotype != n.serotype:
+			add(id, ChangeSerotype, o, n)
+		case math.Abs(o.bscore-n.bscore) > threshold:
+			add(id, ChangeBScore, o, n)
+		}
+	}
+	for id, n := range after.calls {
+		if _, ok := before.calls[id]; !ok {
+			add(id, ChangeOnlyNew, readCall{serotype: noCall}, n)
+		}
+	}
+	sort.Slice(d.changes, func(i, j int) bool { return d.changes[i].readID < d.changes[j].readID })
+	return d
+}
+
+// callOf is a sample's call for the table, - when it has none
+func callOf(r SampleReport, present bool) string {
+	if !present || r.Call == "" {
+		return noCall
+	}
+	return r.Call
+}
+
+// diffFlags sets up the diff command: compare two result sets, e.g. before and
+// after a panel or scoring change, per sample and per read. A read has
+// changed when the serotype of its best match differs, or its best BScore
+// moved by more than -threshold.
+func diffFlags(fs *flag.FlagSet) func(args []string) error {
+	threshold := fs.Float64("threshold", 0.05, "Smallest change of a read's best BScore that counts, when its serotype stays the same")
+	readsPath := fs.String("reads", "", `Write every changed read as TSV to this file, or to stdout instead of the sample table with "-"`)
+	failOnChange := fs.Bool("fail-on-change", false, "Exit with status 2 when a sample's call or any read changed, for checks in CI")
+
+	return func(args []string) error {
+		if len(args) != 2 {
+			return usagef("expected the old and the new results, got %d arguments", len(args))
+		}
+		if *threshold < 0 {
+			return usagef("-threshold can't be negative")
+		}
+		before, err := loadTallies(args[:1], true)
+		if err != nil {
+			return err
+		}
+		after, err := loadTallies(args[1:], true)
+		if err != nil {
+			return err
+		}
+		samples := append([]string(nil), before.samples...)
+		for _, sample := range after.samples {
+			if _, ok := before.bySample[sample]; !ok {
+				samples = append(samples, sample)
+			}
+		}
+
+		var reads *csv.Writer
+		if *readsPath != "" {
+			out := io.Writer(os.Stdout)
+			if *readsPath != "-" {
+				f, err := os.Create(*readsPath)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+			reads = csv.NewWriter(out)
+			reads.Comma = '\t'
+			fmt.Fprintln(out, diffTSVHeader)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if *readsPath != "-" {
+			fmt.Fprintln(w, "sample\told_reads\tnew_reads\told_call\tnew_call\told_match_rate\tnew_match_rate\tserotype_changed\tb_score_changed\tonly_old\tonly_new")
+		}
+		callsChanged, readsChanged := 0, 0
+		for _, sample := range samples {
+			d := diffSample(sample, before.bySample[sample], after.bySample[sample], *threshold)
+			oldCall, newCall := callOf(d.oldReport, d.inOld), callOf(d.newReport, d.inNew)
+			if oldCall != newCall {
+				callsChanged++
+				slog.Warn("call changed", "sample", sample, "old", oldCall, "new", newCall)
+			}
+			readsChanged += len(d.changes)
+			if *readsPath != "-" {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%.3f\t%.3f\t%d\t%d\t%d\t%d\n", sample, d.oldReport.Reads, d.newReport.Reads, oldCall, newCall,
+					d.oldReport.MatchRate, d.newReport.MatchRate, d.changedBy[ChangeSerotype], d.changedBy[ChangeBScore], d.changedBy[ChangeOnlyOld], d.changedBy[ChangeOnlyNew])
+			}
+			if reads != nil {
+				for _, c := range d.changes {
+					reads.Write([]string{c.sample, c.readID, c.change, c.old.serotype, c.new.serotype, bscoreText(c.old), bscoreText(c.new)})
+				}
+			}
+		}
+		w.Flush()
+		if reads != nil {
+			reads.Flush()
+			if err := reads.Error(); err != nil {
+				return fmt.Errorf("can't write the changed reads: %w", err)
+			}
+		}
+		slog.Info("compared", "samples", len(samples), "calls_changed", callsChanged, "reads_changed", readsChanged, "threshold", *threshold)
+		if *failOnChange && (callsChanged > 0 || readsChanged > 0) {
+			return fmt.Errorf("%d calls and %d reads changed", callsChanged, readsChanged)
+		}
+		return nil
+	}
+}
+
+// bscoreText formats a read's BScore for the TSV, empty when the read is
+// missing
+func bscoreText(c readCall) string {
+	if c.serotype == noCall {
+		return ""
+	}
+	return strconv.FormatFloat(c.bscore, 'g', 6, 64)
+}
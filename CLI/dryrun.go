@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/xopen"
+)
+
+// dryRunSample is how many reads of each file a dry run reads and classifies
+// to estimate the file's read count and result size
+const dryRunSample = 10000
+
+// countingReader counts the bytes read through it. It is an io.ByteReader,
+// so a gzip reader on top takes only the bytes it decompresses.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// sampledRead is a read kept by sampleReads
+type sampledRead struct {
+	id   string
+	seq  []byte
+	qual []byte
+}
+
+// sampleReads reads up to n reads of a FASTQ file. estimate is the number of
+// reads in the whole file, scaled from the share of the file the sample took
+// up; exact is true when the sample is the whole file.
+func sampleReads(path string, n int) (reads []sampledRead, estimate int, exact bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	buffered := bufio.NewReader(f)
+	counter := &countingReader{r: buffered}
+	var unpacked io.ReadCloser
+	if isGzip, _ := xopen.IsGzip(buffered); isGzip {
+		// Not xopen's parallel reader, whose read-ahead would throw off the count
+		unpacked, err = gzip.NewReader(counter)
+	} else {
+		unpacked, err = xopen.Buf(counter) // detects other compression
+	}
+	if errors.Is(err, xopen.ErrNoContent) {
+		return nil, 0, true, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer unpacked.Close()
+	reader, err := fastx.NewReaderFromIO(nil, unpacked, "")
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("error initializing FASTX reader: %w", err)
+	}
+	for len(reads) < n {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return reads, len(reads), true, nil
+		}
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("error reading FASTQ record: %w", err)
+		}
+		reads = append(reads, sampledRead{id: string(record.ID), seq: append([]byte(nil), record.Seq.Seq...), qual: append([]byte(nil), record.Seq.Qual...)})
+	}
+	// The count includes what the readers buffered ahead, so this errs low
+	return reads, int(float64(len(reads)) * float64(info.Size()) / float64(counter.n)), false, nil
+}
+
+// estimateOutputSize classifies reads into a temp directory with the run's
+// output options and returns the bytes written per read
+func (r *runner) estimateOutputSize(input inputFile, reads []sampledRead) (float64, error) {
+	if len(reads) == 0 {
+		return 0, nil
+	}
+	dir, err := os.MkdirTemp("", "bhedi-dry-run-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	out, err := newResultWriter(dir, input, r.opts)
+	if err != nil {
+		return 0, err
+	}
+	avgReadLength := 0.0
+	for _, read := range reads {
+		avgReadLength += float64(len(read.seq)) / float64(len(reads))
+	}
+	for _, read := range reads {
+		if err := out.Write(processRecord(read.seq, read.id, r.sankets, avgReadLength, len(reads))); err != nil {
+			out.Close()
+			return 0, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	var size int64
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil {
+			size += info.Size()
+		}
+		return err
+	})
+	return float64(size) / float64(len(reads)), err
+}
+
+// checkOutput checks results could be written to the output directory or
+// bucket, without creating anything there
+func (r *runner) checkOutput() error {
+	if r.bucket != nil {
+		ok, err := r.bucket.IsAccessible(context.Background())
+		if err != nil {
+			return fmt.Errorf("can't reach the output bucket: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("the output bucket doesn't exist")
+		}
+		return nil
+	}
+	// The nearest directory that exists has to take new files
+	dir := r.outputDir
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s isn't a directory", dir)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) || filepath.Dir(dir) == dir {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+	f, err := os.CreateTemp(dir, ".bhedi-dry-run-*")
+	if err != nil {
+		return fmt.Errorf("can't write to the output directory: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// dryRun reports what a run would do: the panel's problems, whether the
+// output is writable, and per file the results' location, its estimated read
+// count and result size. Nothing is classified or written.
+func (r *runner) dryRun(inputs []inputFile) error {
+	failed := 0
+	sankets, err := checkPanelFile(r.panelFile)
+	if err != nil {
+		slog.Error("panel check failed", "error", err)
+		failed++
+	} else {
+		slog.Info("panel ok", "file", r.panelFile, "sankets", sankets)
+	}
+	if err := r.checkOutput(); err != nil {
+		slog.Error("output check failed", "output", r.outputDir, "error", err)
+		failed++
+	} else {
+		slog.Info("output ok", "output", r.outputDir)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "file\tsample\toutput\treads\test_size\taction")
+	var totalReads int
+	var totalSize float64
+	todo := 0
+	for _, input := range inputs {
+		output := input.Output + r.opts.Extension()
+		if len(r.opts.PartitionBy) > 0 {
+			output = input.Output + string(filepath.Separator)
+		}
+		if r.bucket != nil {
+			output = filepath.ToSlash(output)
+		} else {
+			output = filepath.Join(r.outputDir, output)
+		}
+		if file, ok := r.state.Finished(input.Path); ok {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t-\tskip, finished %s\n", input.Path, input.Sample, output, file.Reads, file.FinishedAt.Format("2006-01-02 15:04"))
+			continue
+		}
+		existing, err := r.existingResults(input)
+		if err != nil {
+			return fmt.Errorf("can't look for existing results: %w", err)
+		}
+		if len(existing) > 0 && r.existing != ExistingOverwrite {
+			action := "skip, results exist"
+			if r.existing == ExistingFail {
+				slog.Error("results exist; pass -overwrite or -skip-existing", "file", input.Path, "output", existing[0])
+				failed++
+				action = "fails, results exist"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t%s\n", input.Path, input.Sample, output, action)
+			continue
+		}
+		reads, estimate, exact, err := sampleReads(input.Path, dryRunSample)
+		if err != nil {
+			slog.Error("can't read the file", "file", input.Path, "error", err)
+			failed++
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\tfails\n", input.Path, input.Sample, output)
+			continue
+		}
+		perRead, err := r.estimateOutputSize(input, reads)
+		if err != nil {
+			return fmt.Errorf("can't estimate the result size: %w", err)
+		}
+		size := perRead * float64(estimate)
+		count := fmt.Sprintf("~%d", estimate)
+		if exact {
+			count = fmt.Sprint(estimate)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\tclassify\n", input.Path, input.Sample, output, count, byteCount(size))
+		totalReads += estimate
+		totalSize += size
+		todo++
+	}
+	fmt.Fprintf(w, "total: %d files\t\t\t~%d\t%s\t%d to classify\n", len(inputs), totalReads, byteCount(totalSize), todo)
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// byteCount formats a size in bytes for people, e.g. 1.5 GB
+func byteCount(n float64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 4 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", n/unit, "kMGTP"[exp])
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bhedi/output"
+)
+
+// filteredSuffix marks the copies filter writes beside their input, e.g.
+// S1.filtered.parquet
+const filteredSuffix = ".filtered"
+
+// readFilter is what filter keeps of result files: rows of matches of the
+// given serotypes with a BScore of at least minBScore that meet every -where
+// condition
+type readFilter struct {
+	minBScore   float64
+	serotypes   []string
+	matchedOnly bool
+	where       []rowFilter
+}
+
+// serotypeKey compares serotypes as the panel names them or with a DENV
+// prefix, so DENV2, DENV-2 and 2 are the same
+func serotypeKey(serotype string) string {
+	key := strings.ToUpper(strings.TrimSpace(serotype))
+	key = strings.TrimPrefix(key, "DENV")
+	return strings.TrimPrefix(key, "-")
+}
+
+// keep reports whether the filter keeps row
+func (f readFilter) keep(row output.Record) bool {
+	if row.BScore < f.minBScore || f.matchedOnly && row.Serotype == unassignedSerotype {
+		return false
+	}
+	if len(f.serotypes) > 0 {
+		found := false
+		for _, serotype := range f.serotypes {
+			found = found || serotypeKey(serotype) == serotypeKey(row.Serotype)
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, w := range f.where {
+		if !w.match(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the filter for the bhedi.filter metadata key
+func (f readFilter) String() string {
+	var conditions []string
+	if f.minBScore > 0 {
+		conditions = append(conditions, fmt.Sprintf("b_score>=%g", f.minBScore))
+	}
+	if len(f.serotypes) > 0 {
+		conditions = append(conditions, "serotype in ("+strings.Join(f.serotypes, ",")+")")
+	}
+	if f.matchedOnly {
+		conditions = append(conditions, "serotype!="+unassignedSerotype)
+	}
+	for _, w := range f.where {
+		conditions = append(conditions, w.String())
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// resultFormat returns the output format and schema a result file was
+// written in: by its extension, and for the schema its metadata or, for
+// JSON, which has none, its first row
+func resultFormat(path string, metadata map[string]string) (format, schema string) {
+	for f, ext := range output.Extensions {
+		if filepath.Ext(path) == ext {
+			format = f
+		}
+	}
+	schema = output.SchemaFlat
+	switch {
+	case metadata["bhedi.schema"] == output.SchemaNested:
+		schema = output.SchemaNested
+	case format == output.FormatJSON:
+		if f, err := os.Open(path); err == nil {
+			line, _ := bufio.NewReader(f).ReadString('\n')
+			f.Close()
+			if strings.Contains(line, `"matches_found"`) {
+				schema = output.SchemaNested
+			}
+		}
+	}
+	return format, schema
+}
+
+// filterFlags sets up the filter command: copy result files keeping only the
+// matches above a BScore, of some serotypes or meeting other conditions, in
+// their own format and schema, for the routine post-filters of an analysis
+func filterFlags(fs *flag.FlagSet) func(args []string) error {
+	var f readFilter
+	fs.Float64Var(&f.minBScore, "min-bscore", 0, "Keep only matches with at least this BScore, e.g. 0.6; Unassigned rows have none")
+	fs.Func("serotype", "Keep only matches of these serotypes, comma-separated and as the panel names them or with a DENV prefix, e.g. 2 or DENV2,DENV3; repeat to add more", func(v string) error {
+		for _, serotype := range strings.Split(v, ",") {
+			if serotype = strings.TrimSpace(serotype); serotype != "" {
+				f.serotypes = append(f.serotypes, serotype)
+			}
+		}
+		return nil
+	})
+	fs.BoolVar(&f.matchedOnly, "matched-only", false, "Drop the rows of reads without a match")
+	fs.Func("where", "Keep only rows meeting a condition such as gc_percentage<60 or sid!=S12, as for convert; repeat to require several", func(expr string) error {
+		w, err := parseRowFilter(expr)
+		if err == nil {
+			f.where = append(f.where, w)
+		}
+		return err
+	})
+	outPath := fs.String("o", "", "Output file, or directory when filtering several files or a directory (default <name>"+filteredSuffix+".<ext> next to each input)")
+	compression := fs.String("parquet-compression", "snappy", "Parquet compression codec: zstd, snappy, gzip or none")
+	overwrite := fs.Bool("overwrite", false, "Replace filtered files that already exist")
+
+	return func(args []string) error {
+		if len(args) == 0 {
+			return usagef("no result files given")
+		}
+		if f.String() == "" {
+			return usagef("no filter given; pass -min-bscore, -serotype, -matched-only or -where")
+		}
+		if _, ok := output.ParquetCodecs[*compression]; !ok {
+			return usagef("unknown parquet compression %q (expected zstd, snappy, gzip or none)", *compression)
+		}
+		// Each file keeps its format, so plan the outputs without an
+		// extension and add the input's
+		planned, err := planConversions(args, *outPath, "")
+		if err != nil {
+			return err
+		}
+		explicit := make(map[string]bool)
+		for _, arg := range args {
+			explicit[arg] = true
+		}
+		var conversions []conversion
+		for _, c := range planned {
+			ext := filepath.Ext(c.input)
+			if strings.HasSuffix(strings.TrimSuffix(c.input, ext), filteredSuffix) && !explicit[c.input] {
+				continue // an earlier filter's copy
+			}
+			switch {
+			case *outPath == "":
+				c.output += filteredSuffix + ext
+			case c.output != *outPath:
+				c.output += ext
+			}
+			if _, err := os.Stat(c.output); err == nil && !*overwrite {
+				return fmt.Errorf("%s exists; pass -overwrite to replace it", c.output)
+			}
+			conversions = append(conversions, c)
+		}
+		if len(conversions) == 0 {
+			return usagef("no result files to filter in %s", strings.Join(args, ", "))
+		}
+
+		for _, c := range conversions {
+			rows, kept, err := filterResults(c, f, *compression)
+			if err != nil {
+				return fmt.Errorf("can't filter %s: %w", c.input, err)
+			}
+			slog.Info("filtered", "file", c.input, "output", c.output, "rows", rows, "kept", kept)
+		}
+		return nil
+	}
+}
+
+// filterResults copies the rows of c.input that f keeps into c.output, in the
+// input's format and schema with its metadata, and returns the rows read and
+// kept. Merged Parquet files keep their sample column.
+func filterResults(c conversion, f readFilter, compression string) (rows, kept int, err error) {
+	metadata, err := resultMetadata(c.input)
+	if err != nil {
+		return 0, 0, err
+	}
+	metadata["bhedi.filtered_from"] = filepath.Base(c.input)
+	metadata["bhedi.filter"] = f.String()
+	format, schema := resultFormat(c.input, metadata)
+	opts := OutputOptions{Options: output.Options{Format: format, Schema: schema, Compression: compression, Metadata: metadata}}
+	keep := func(row output.Record) bool {
+		rows++
+		return f.keep(row)
+	}
+	if format == output.FormatParquet && metadata["bhedi.merged_samples"] != "" {
+		kept, err = mergeResults([]string{c.input}, []string{""}, c.output, opts, keep)
+		return rows, kept, err
+	}
+	_, kept, err = convertResults(c, opts, keep)
+	return rows, kept, err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// fmBlock is how many rows of the BWT share a checkpoint of symbol counts;
+// counting a symbol up to a row scans at most this many bytes past one
+const fmBlock = 32
+
+// FM-index symbols: the separator, which sorts first, and the four bases
+const (
+	fmSep = iota
+	fmA
+	fmC
+	fmG
+	fmT
+	fmSymbols
+)
+
+// fmMatcher is an FM-index of the panel: the Burrows-Wheeler transform of
+// its sankets joined by separators, #S1#S2#...#Sn#. A sanket ending at a
+// position of a read is found by extending the read leftwards from there
+// through the index, one base per step, which stops as soon as no sanket
+// ends in what has been read; the rows whose suffix a separator precedes
+// then name the sankets that match whole. Its cost depends on how far reads
+// agree with the panel rather than on its size or how many lengths its
+// sankets have, which may suit very large panels. Experimental; bench
+// compares it with the other backends.
+type fmMatcher struct {
+	sankets []SanketInfo
+	bwt     []uint8               // the transform, one symbol per row
+	occ     [][fmSymbols]uint32   // per fmBlock rows, each symbol's count before them
+	first   [fmSymbols + 1]uint32 // the first row of each symbol's suffixes
+	starts  []int32               // by rank among the rows a separator precedes, the sanket there
+	others  []int32               // sankets the index can't hold, empty or with other bases, searched for directly
+	seqs    map[int32][]byte      // the sequences of others
+	maxLen  int                   // the longest sanket
+}
+
+// fmCodes maps A, C, G and T to their symbols and every other byte to 0,
+// which no read base can be
+var fmCodes = func() (codes [256]uint8) {
+	codes['A'], codes['C'], codes['G'], codes['T'] = fmA, fmC, fmG, fmT
+	return codes
+}()
+
+func newFMMatcher(idx *sanketIndex) matcher {
+	m := &fmMatcher{sankets: idx.Sankets, seqs: make(map[int32][]byte)}
+	// The text, with the sanket starting at each position
+	text := []uint8{fmSep}
+	startOf := make(map[int32]int32, len(m.sankets))
+	for i, info := range m.sankets {
+		if info.Sanket == "" || strings.Trim(info.Sanket, "ACGT") != "" {
+			m.others = append(m.others, int32(i))
+			m.seqs[int32(i)] = []byte(info.Sanket)
+			continue
+		}
+		m.maxLen = max(m.maxLen, len(info.Sanket))
+		startOf[int32(len(text))] = int32(i)
+		for _, b := range []byte(info.Sanket) {
+			text = append(text, fmCodes[b])
+		}
+		text = append(text, fmSep)
+	}
+
+	// Sort the suffixes. Separators compare by position, as if each were a
+	// symbol of its own, so no comparison reads past the next separator.
+	sa := make([]int32, len(text))
+	for i := range sa {
+		sa[i] = int32(i)
+	}
+	sort.Slice(sa, func(x, y int) bool {
+		a, b := sa[x], sa[y]
+		for {
+			ca, cb := text[a], text[b]
+			if ca != cb {
+				return ca < cb
+			}
+			if ca == fmSep {
+				return a < b
+			}
+			a, b = a+1, b+1
+		}
+	})
+
+	m.bwt = make([]uint8, len(text))
+	m.occ = make([][fmSymbols]uint32, len(text)/fmBlock+1)
+	var counts [fmSymbols]uint32
+	for row, pos := range sa {
+		if row%fmBlock == 0 {
+			m.occ[row/fmBlock] = counts
+		}
+		prev := len(text) - 1 // the text wraps around, its last separator before its first
+		if pos > 0 {
+			prev = int(pos) - 1
+		}
+		c := text[prev]
+		m.bwt[row] = c
+		counts[c]++
+		if c == fmSep {
+			if sanket, ok := startOf[pos]; ok {
+				m.starts = append(m.starts, sanket)
+			} else {
+				m.starts = append(m.starts, -1) // the text's first separator
+			}
+		}
+	}
+	if len(text)%fmBlock == 0 {
+		m.occ[len(text)/fmBlock] = counts // for counting up to the last row, which starts no block
+	}
+	for c := 0; c < fmSymbols; c++ {
+		m.first[c+1] = m.first[c] + counts[c]
+	}
+	return m
+}
+
+// rank counts symbol c in the first row rows of the transform
+func (m *fmMatcher) rank(c uint8, row uint32) uint32 {
+	n := m.occ[row/fmBlock][c]
+	for _, b := range m.bwt[row-row%fmBlock : row] {
+		if b == c {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *fmMatcher) Match(seq []byte) []*SanketInfo {
+	var hits []int32
+	for _, i := range m.others {
+		if bytes.Contains(seq, m.seqs[i]) {
+			hits = append(hits, i)
+		}
+	}
+	for end := len(seq); end > 0; end-- {
+		// The rows of suffixes starting with a separator, narrowed to those
+		// starting with seq[start:end] and one as start moves left
+		lo, hi := m.first[fmSep], m.first[fmSep+1]
+		for start := end - 1; start >= 0 && end-start <= m.maxLen; start-- {
+			c := fmCodes[seq[start]]
+			if c == 0 {
+				break
+			}
+			lo, hi = m.first[c]+m.rank(c, lo), m.first[c]+m.rank(c, hi)
+			if lo >= hi {
+				break
+			}
+			// Rows a separator precedes are sankets equal to seq[start:end]
+			for s, e := m.rank(fmSep, lo), m.rank(fmSep, hi); s < e; s++ {
+				hits = append(hits, m.starts[s])
+			}
+		}
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i] < hits[j] })
+	found := make([]*SanketInfo, 0, len(hits))
+	for i, hit := range hits {
+		if i == 0 || hit != hits[i-1] { // a sanket found more than once
+			found = append(found, &m.sankets[hit])
+		}
+	}
+	return found
+}
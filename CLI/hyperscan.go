@@ -0,0 +1,192 @@
+//go:build hyperscan
+
+package main
+
+/*
+#cgo pkg-config: libhs
+#include <stdlib.h>
+#include <hs.h>
+
+// bhedi_hits collects the ids of the patterns a scan matched. Each pattern
+// matches at most once (HS_FLAG_SINGLEMATCH), so room for every pattern is
+// enough.
+typedef struct {
+	unsigned int *ids;
+	size_t n, cap;
+} bhedi_hits;
+
+static int bhedi_on_match(unsigned int id, unsigned long long from, unsigned long long to, unsigned int flags, void *ctx) {
+	bhedi_hits *h = ctx;
+	if (h->n < h->cap) {
+		h->ids[h->n++] = id;
+	}
+	return 0;
+}
+
+static bhedi_hits *bhedi_hits_new(size_t cap) {
+	bhedi_hits *h = malloc(sizeof(bhedi_hits));
+	if (h == NULL) {
+		return NULL;
+	}
+	h->ids = malloc((cap ? cap : 1) * sizeof(unsigned int));
+	if (h->ids == NULL) {
+		free(h);
+		return NULL;
+	}
+	h->n = 0;
+	h->cap = cap;
+	return h;
+}
+
+static void bhedi_hits_free(bhedi_hits *h) {
+	free(h->ids);
+	free(h);
+}
+
+static hs_error_t bhedi_scan(const hs_database_t *db, const char *data, unsigned int len, hs_scratch_t *scratch, bhedi_hits *h) {
+	h->n = 0;
+	return hs_scan(db, data, len, 0, scratch, bhedi_on_match, h);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+func init() {
+	matcherBackends = append(matcherBackends, matcherBackend{name: "hyperscan",
+		summary: "scan each read once for every sanket with Hyperscan (or Vectorscan), vectorized multi-pattern matching",
+		build:   newHyperscanMatcher})
+}
+
+// hyperscanMatcher compiles the sankets into a Hyperscan database of
+// literals, which finds them all in one vectorized pass over a read. Scans
+// need scratch space of their own, so each worker takes one from a pool.
+type hyperscanMatcher struct {
+	sankets []SanketInfo
+	ids     []int32 // the sankets compiled, by pattern id
+	empty   []int32 // empty sankets, which every read contains as for scanMatcher; Hyperscan can't compile them
+	db      *C.hs_database_t
+	proto   *C.hs_scratch_t // cloned for each worker's scans
+	scratch sync.Pool       // of *hyperscanScratch
+}
+
+// hyperscanScratch is one worker's scratch space and hits
+type hyperscanScratch struct {
+	s    *C.hs_scratch_t
+	hits *C.bhedi_hits
+}
+
+// newHyperscanMatcher compiles the panel's sankets, or falls back to the
+// kmer backend if Hyperscan can't
+func newHyperscanMatcher(idx *sanketIndex) matcher {
+	m, err := compileHyperscan(idx)
+	if err != nil {
+		slog.Warn("can't use hyperscan, matching with kmer instead", "error", err)
+		return newKmerMatcher(idx)
+	}
+	return m
+}
+
+func compileHyperscan(idx *sanketIndex) (*hyperscanMatcher, error) {
+	m := &hyperscanMatcher{sankets: idx.Sankets}
+	var exprs []*C.char
+	var lens []C.size_t
+	var flags, ids []C.uint
+	defer func() {
+		for _, expr := range exprs {
+			C.free(unsafe.Pointer(expr))
+		}
+	}()
+	for i, info := range idx.Sankets {
+		if info.Sanket == "" {
+			m.empty = append(m.empty, int32(i))
+			continue
+		}
+		exprs = append(exprs, C.CString(info.Sanket))
+		lens = append(lens, C.size_t(len(info.Sanket)))
+		flags = append(flags, C.HS_FLAG_SINGLEMATCH)
+		ids = append(ids, C.uint(len(m.ids)))
+		m.ids = append(m.ids, int32(i))
+	}
+	if len(m.ids) == 0 {
+		return m, nil // only empty sankets, if any: nothing to scan for
+	}
+
+	// The arrays handed to Hyperscan live in C memory, as cgo requires of
+	// pointers to pointers
+	n := len(exprs)
+	cExprs := (**C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+	defer C.free(unsafe.Pointer(cExprs))
+	copy(unsafe.Slice(cExprs, n), exprs)
+	cLens := (*C.size_t)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.size_t(0)))))
+	defer C.free(unsafe.Pointer(cLens))
+	copy(unsafe.Slice(cLens, n), lens)
+	cFlags := (*C.uint)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.uint(0)))))
+	defer C.free(unsafe.Pointer(cFlags))
+	copy(unsafe.Slice(cFlags, n), flags)
+	cIDs := (*C.uint)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.uint(0)))))
+	defer C.free(unsafe.Pointer(cIDs))
+	copy(unsafe.Slice(cIDs, n), ids)
+
+	var compileErr *C.hs_compile_error_t
+	if C.hs_compile_lit_multi(cExprs, cFlags, cIDs, cLens, C.uint(n), C.HS_MODE_BLOCK, nil, &m.db, &compileErr) != C.HS_SUCCESS {
+		err := fmt.Errorf("can't compile the sankets: %s", C.GoString(compileErr.message))
+		C.hs_free_compile_error(compileErr)
+		return nil, err
+	}
+	if C.hs_alloc_scratch(m.db, &m.proto) != C.HS_SUCCESS {
+		C.hs_free_database(m.db)
+		return nil, fmt.Errorf("can't allocate scratch space")
+	}
+	runtime.SetFinalizer(m, func(m *hyperscanMatcher) {
+		C.hs_free_scratch(m.proto)
+		C.hs_free_database(m.db)
+	})
+	return m, nil
+}
+
+// scratchSpace takes a worker's scratch space from the pool, or clones one
+func (m *hyperscanMatcher) scratchSpace() *hyperscanScratch {
+	if s, ok := m.scratch.Get().(*hyperscanScratch); ok {
+		return s
+	}
+	s := &hyperscanScratch{hits: C.bhedi_hits_new(C.size_t(len(m.ids)))}
+	if s.hits == nil || C.hs_clone_scratch(m.proto, &s.s) != C.HS_SUCCESS {
+		panic("hyperscan: out of memory for scratch space")
+	}
+	runtime.SetFinalizer(s, func(s *hyperscanScratch) {
+		C.hs_free_scratch(s.s)
+		C.bhedi_hits_free(s.hits)
+	})
+	return s
+}
+
+func (m *hyperscanMatcher) Match(seq []byte) []*SanketInfo {
+	hits := append([]int32(nil), m.empty...)
+	if len(m.ids) > 0 && len(seq) > 0 {
+		s := m.scratchSpace()
+		if err := C.bhedi_scan(m.db, (*C.char)(unsafe.Pointer(&seq[0])), C.uint(len(seq)), s.s, s.hits); err != C.HS_SUCCESS {
+			panic(fmt.Sprintf("hyperscan: scan failed with error %d", int(err)))
+		}
+		for _, id := range unsafe.Slice(s.hits.ids, s.hits.n) {
+			hits = append(hits, m.ids[id])
+		}
+		m.scratch.Put(s)
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i] < hits[j] })
+	found := make([]*SanketInfo, 0, len(hits))
+	for _, hit := range hits {
+		found = append(found, &m.sankets[hit])
+	}
+	return found
+}
@@ -0,0 +1,17 @@
+//go:build !hyperscan
+
+package main
+
+import "log/slog"
+
+// Without the hyperscan build tag there is no Hyperscan to link against, so
+// -matcher hyperscan matches with kmer, after saying so
+func init() {
+	matcherBackends = append(matcherBackends, matcherBackend{name: "hyperscan",
+		summary: "not in this build, which needs -tags hyperscan and libhs; matches with kmer instead",
+		build: func(idx *sanketIndex) matcher {
+			slog.Warn("this bhedi-cli was built without hyperscan, matching with kmer instead; build it with -tags hyperscan to use it")
+			return newKmerMatcher(idx)
+		},
+		fallback: true})
+}
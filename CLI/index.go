@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// indexMagic starts every index file; the digit is the layout's version,
+// bumped when it changes so an old index is rebuilt rather than misread
+const (
+	indexPrefix = "bhedi-index "
+	indexMagic  = indexPrefix + "1\n"
+)
+
+// indexExt is the extension index build gives an index by default
+const indexExt = ".bidx"
+
+// sanketIndex is a panel ready for matching: its sankets in SID order, the
+// fingerprint of the CSV they came from, and, once built, the kmer backend's
+// hash of them. index build writes the sankets to disk already checked,
+// parsed and sorted, so that run, watch and the API load a large panel in a
+// fraction of the time its CSV takes.
+type sanketIndex struct {
+	Panel   PanelInfo
+	Sankets []SanketInfo
+	Lengths []int              // the distinct sanket lengths, shortest first
+	Kmers   map[string][]int32 // sanket sequence to its sankets' positions in Sankets
+	Empty   []int32            // empty sankets, see kmerMatcher
+}
+
+// indexKmers hashes the sankets by sequence for the kmer backend, unless
+// they are already. Sequences are nearly all distinct, so their positions
+// share one array.
+func (idx *sanketIndex) indexKmers() {
+	if idx.Kmers != nil {
+		return
+	}
+	idx.Kmers = make(map[string][]int32, len(idx.Sankets))
+	positions := make([]int32, len(idx.Sankets))
+	seen := make(map[int]bool)
+	for i, info := range idx.Sankets {
+		if info.Sanket == "" {
+			idx.Empty = append(idx.Empty, int32(i))
+			continue
+		}
+		positions[i] = int32(i)
+		if same, ok := idx.Kmers[info.Sanket]; ok {
+			idx.Kmers[info.Sanket] = append(same, int32(i))
+		} else {
+			idx.Kmers[info.Sanket] = positions[i : i+1 : i+1]
+		}
+		if !seen[len(info.Sanket)] {
+			seen[len(info.Sanket)] = true
+			idx.Lengths = append(idx.Lengths, len(info.Sanket))
+		}
+	}
+	sort.Ints(idx.Lengths)
+}
+
+// isIndex reports whether the file at path is an index, of any version,
+// rather than a CSV
+func isIndex(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	prefix := make([]byte, len(indexPrefix))
+	_, err = io.ReadFull(f, prefix)
+	return err == nil && string(prefix) == indexPrefix
+}
+
+// An index file is indexMagic, then little-endian uint32s: the length of
+// the panel's PanelInfo as JSON, which follows; the number of sankets; and
+// per sanket its s_len and the offset and length of each of its text fields
+// (indexFields) in the text that ends the file.
+const indexFieldCount = 8
+
+// indexFields lists the text fields of a sanket in the order an index keeps
+// them
+func indexFields(info *SanketInfo) [indexFieldCount]*string {
+	return [indexFieldCount]*string{&info.SID, &info.Serotype, &info.Sanket, &info.SSRCount, &info.MLenAvg, &info.MRCAvg, &info.PCount, &info.PLenAvg}
+}
+
+// encodeIndex lays out the index's panel and sankets as an index file
+func encodeIndex(idx *sanketIndex) ([]byte, error) {
+	header, err := json.Marshal(idx.Panel)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	var text strings.Builder
+	put := func(v int) { binary.Write(&buf, binary.LittleEndian, uint32(v)) }
+	buf.WriteString(indexMagic)
+	put(len(header))
+	buf.Write(header)
+	put(len(idx.Sankets))
+	for i := range idx.Sankets {
+		put(idx.Sankets[i].SLen)
+		for _, field := range indexFields(&idx.Sankets[i]) {
+			put(text.Len())
+			put(len(*field))
+			text.WriteString(*field)
+		}
+	}
+	buf.WriteString(text.String())
+	return buf.Bytes(), nil
+}
+
+// readIndex loads an index written by index build. Every text field is a
+// slice of one string, so loading allocates little more than the file.
+func readIndex(path string) (*sanketIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening panel index: %w", err)
+	}
+	if !bytes.HasPrefix(data, []byte(indexPrefix)) {
+		return nil, fmt.Errorf("%s is not a panel index", path)
+	}
+	if !bytes.HasPrefix(data, []byte(indexMagic)) {
+		return nil, fmt.Errorf("%s was built by another version of bhedi; rebuild it with bhedi-cli index build", path)
+	}
+	corrupt := fmt.Errorf("%s is a truncated or corrupt panel index; rebuild it with bhedi-cli index build", path)
+	data = data[len(indexMagic):]
+	next := func() (int, bool) {
+		if len(data) < 4 {
+			return 0, false
+		}
+		v := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		return int(v), true
+	}
+
+	idx := &sanketIndex{}
+	n, ok := next()
+	if !ok || n > len(data) || json.Unmarshal(data[:n], &idx.Panel) != nil {
+		return nil, corrupt
+	}
+	data = data[n:]
+	if n, ok = next(); !ok || n > len(data)/(4*(1+2*indexFieldCount)) {
+		return nil, corrupt
+	}
+	entries := data[:n*4*(1+2*indexFieldCount)]
+	text := string(data[len(entries):])
+	data = entries
+	idx.Sankets = make([]SanketInfo, n)
+	for i := range idx.Sankets {
+		idx.Sankets[i].SLen, _ = next()
+		for _, field := range indexFields(&idx.Sankets[i]) {
+			offset, _ := next()
+			length, _ := next()
+			if offset+length > len(text) {
+				return nil, corrupt
+			}
+			*field = text[offset : offset+length]
+		}
+	}
+	return idx, nil
+}
+
+// loadPanel loads the panel at path, a CSV or an index built from one, with
+// its fingerprint. A CSV's sankets are left for the matcher to hash.
+func loadPanel(path string) (*sanketIndex, error) {
+	if isIndex(path) {
+		return readIndex(path)
+	}
+	sankets, err := LoadSankets(path)
+	if err != nil {
+		return nil, err
+	}
+	panel, err := loadPanelInfo(path, sankets)
+	if err != nil {
+		return nil, err
+	}
+	return &sanketIndex{Panel: panel, Sankets: sortedSankets(sankets)}, nil
+}
+
+// checkPanelFile checks the panel at path as validate and dry runs do, and
+// returns its sankets. An index was checked when it was built, so it only
+// has to load.
+func checkPanelFile(path string) (int, error) {
+	if isIndex(path) {
+		idx, err := readIndex(path)
+		if err != nil {
+			return 0, err
+		}
+		return len(idx.Sankets), nil
+	}
+	rows, err := readPanelRows(path)
+	if err != nil {
+		return 0, err
+	}
+	problems, _ := checkPanel(rows, false)
+	return len(rows), logPanelProblems(path, problems)
+}
+
+// buildIndexFlags sets up the index build command: check a panel and write
+// it out as an index that run, watch and the API load in place of it
+func buildIndexFlags(fs *flag.FlagSet) func(args []string) error {
+	panelFlags(fs)
+	output := fs.String("o", "", "Index to write (default the panel's name with "+indexExt+", next to it)")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return usagef("unexpected arguments %q", args)
+		}
+		panelCSV, err := findPanel(panelPath)
+		if err != nil {
+			return err
+		}
+		if isIndex(panelCSV) {
+			return usagef("%s is already an index; give the panel CSV it was built from", panelCSV)
+		}
+		if *output == "" {
+			*output = strings.TrimSuffix(panelCSV, filepath.Ext(panelCSV)) + indexExt
+		}
+		// A panel run would misread makes an index it would misread too
+		rows, err := readPanelRows(panelCSV)
+		if err != nil {
+			return err
+		}
+		problems, _ := checkPanel(rows, false)
+		if err := logPanelProblems(panelCSV, problems); err != nil {
+			return err
+		}
+
+		started := time.Now()
+		idx, err := loadPanel(panelCSV)
+		if err != nil {
+			return fmt.Errorf("can't load sankets: %w", err)
+		}
+		data, err := encodeIndex(idx)
+		if err != nil {
+			return fmt.Errorf("can't encode the index: %w", err)
+		}
+
+		// Write next to the destination and rename, so a failed build leaves any old index intact
+		tmp, err := os.CreateTemp(filepath.Dir(*output), ".index-*"+indexExt)
+		if err != nil {
+			return fmt.Errorf("can't write the index: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return fmt.Errorf("can't write the index: %w", err)
+		}
+		if err := tmp.Chmod(0o644); err != nil {
+			tmp.Close()
+			return fmt.Errorf("can't write the index: %w", err)
+		}
+		if err := tmp.Close(); err != nil {
+			return fmt.Errorf("can't write the index: %w", err)
+		}
+		if err := os.Rename(tmp.Name(), *output); err != nil {
+			return fmt.Errorf("can't write the index: %w", err)
+		}
+		slog.Info("index written", "file", *output, "panel", panelCSV, "version", idx.Panel.Version, "sankets", len(idx.Sankets),
+			"bytes", len(data), "duration", time.Since(started).Round(time.Millisecond))
+		return nil
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"bhedi/output"
+)
+
+// fastqExtensions are the endings of the FASTQ files run picks up, each also
+// accepted with one of compressionExtensions after it
+var fastqExtensions = []string{".fastq", ".fq"}
+
+// compressionExtensions are the compressed forms the FASTQ reader unpacks
+var compressionExtensions = []string{".gz", ".bz2", ".xz", ".zst"}
+
+// trimFastqExtension strips a FASTQ ending, and a compression one after it,
+// from name; ok is false when name doesn't have one
+func trimFastqExtension(name string) (base string, ok bool) {
+	for _, ext := range compressionExtensions {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	for _, ext := range fastqExtensions {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), true
+		}
+	}
+	return name, false
+}
+
+// isFastq reports whether name has a FASTQ ending, compressed or not
+func isFastq(name string) bool {
+	_, ok := trimFastqExtension(name)
+	return ok
+}
+
+// sampleName names a FASTQ file's sample after its file name, e.g. S1 for
+// S1.fastq.gz
+func sampleName(path string) string {
+	name := filepath.Base(path)
+	if base, ok := trimFastqExtension(name); ok {
+		return base
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// inputFile is a FASTQ file to classify
+type inputFile struct {
+	Path   string
+	Sample string
+	// Dir is the file's directory relative to the input directory it was found
+	// in, and so where under -o its results go, e.g. barcode01 for
+	// fastq_pass/barcode01/S1.fastq.gz
+	Dir string
+	// Name is the base name of the file's results, the sample unless a file
+	// list names them otherwise
+	Name string
+	// Output is where the results go, relative to -o and without the format's
+	// extension, from the -output-name template; see nameOutputs
+	Output string
+}
+
+// discoverInputs finds the FASTQ files of input: a file, a directory, or a
+// glob pattern matching either. Directories give the FASTQ files directly
+// inside them, or anywhere below with recursive. With include, only files
+// whose name matches that glob pattern are kept. Files come in a stable order,
+// and two files that would write the same results are an error.
+func discoverInputs(input string, recursive bool, include string) ([]inputFile, error) {
+	if include != "" {
+		if _, err := filepath.Match(include, ""); err != nil {
+			return nil, fmt.Errorf("invalid -include pattern %q: %w", include, err)
+		}
+	}
+	roots := []string{input}
+	if strings.ContainsAny(input, "*?[") {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %w", input, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("nothing matches %s", input)
+		}
+		roots = matches
+	}
+
+	var files []inputFile
+	keep := func(path, dir string) {
+		name := filepath.Base(path)
+		if !isFastq(name) {
+			return
+		}
+		if include != "" {
+			if ok, _ := filepath.Match(include, name); !ok {
+				return
+			}
+		}
+		files = append(files, inputFile{Path: path, Sample: sampleName(path), Dir: dir, Name: sampleName(path)})
+	}
+	for _, root := range roots {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the input: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, inputFile{Path: root, Sample: sampleName(root), Name: sampleName(root)})
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != root && !recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			dir, _ := filepath.Rel(root, filepath.Dir(path))
+			if dir == "." {
+				dir = ""
+			}
+			keep(path, dir)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't read the input directory: %w", err)
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Dir != files[j].Dir {
+			return files[i].Dir < files[j].Dir
+		}
+		return files[i].Path < files[j].Path
+	})
+	return files, checkOutputNames(files)
+}
+
+// checkOutputNames returns an error when two files would write the same
+// results
+func checkOutputNames(files []inputFile) error {
+	seen := make(map[string]string)
+	for _, f := range files {
+		key := filepath.Join(f.Dir, f.Name)
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("%s and %s would both write the results of sample %s", other, f.Path, key)
+		}
+		seen[key] = f.Path
+	}
+	return nil
+}
+
+// readFileList reads the FASTQ files to classify from a file list, or from
+// stdin when path is "-". Each line holds a path, optionally followed by the
+// sample name and the results' name, separated by tabs or commas:
+//
+//	# path	sample	output
+//	runs/A/reads.fastq.gz	S1
+//	runs/B/reads.fastq.gz	S2	plate2/S2
+//
+// The sample defaults to the file's name and the output to the sample; an
+// output may put the results in a subdirectory of -o. Relative paths are
+// taken from the list's directory. Blank lines, # comments and a header line
+// starting with "path" are skipped.
+func readFileList(path string) ([]inputFile, error) {
+	var r io.Reader = os.Stdin
+	base := ""
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the file list: %w", err)
+		}
+		defer f.Close()
+		r = f
+		base = filepath.Dir(path)
+	}
+
+	var files []inputFile
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := "\t"
+		if !strings.Contains(line, sep) {
+			sep = ","
+		}
+		fields := strings.Split(line, sep)
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(files) == 0 && strings.EqualFold(fields[0], "path") {
+			continue
+		}
+		if len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("file list line %d: expected a path, optionally followed by a sample and an output name", n)
+		}
+		input := inputFile{Path: fields[0], Sample: sampleName(fields[0])}
+		if !filepath.IsAbs(input.Path) {
+			input.Path = filepath.Join(base, input.Path)
+		}
+		if len(fields) > 1 && fields[1] != "" {
+			input.Sample = fields[1]
+		}
+		input.Name = input.Sample
+		if len(fields) > 2 && fields[2] != "" {
+			output := filepath.Clean(fields[2])
+			if filepath.IsAbs(output) || output == ".." || strings.HasPrefix(output, ".."+string(filepath.Separator)) {
+				return nil, fmt.Errorf("file list line %d: output %s must stay inside the output directory", n, fields[2])
+			}
+			input.Dir, input.Name = filepath.Split(trimOutputExtension(output))
+			input.Dir = filepath.Clean(input.Dir)
+			if input.Dir == "." {
+				input.Dir = ""
+			}
+		}
+		if strings.ContainsAny(input.Sample, `/\`) || input.Name == "" {
+			return nil, fmt.Errorf("file list line %d: invalid sample or output name", n)
+		}
+		files = append(files, input)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read the file list: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("the file list %s names no files", path)
+	}
+	return files, checkOutputNames(files)
+}
+
+// trimOutputExtension strips a result file ending, such as .parquet, from an
+// output name
+func trimOutputExtension(name string) string {
+	for _, ext := range output.Extensions {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
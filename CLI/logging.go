@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Log formats for -log-format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logLevels maps -log-level values to levels
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logLevel picks the level from -log-level and its shorthands -quiet (warn)
+// and -verbose (debug)
+func logLevel(level string, quiet, verbose bool) (slog.Level, error) {
+	switch {
+	case quiet && verbose:
+		return 0, fmt.Errorf("-quiet and -verbose can't be used together")
+	case quiet:
+		return slog.LevelWarn, nil
+	case verbose:
+		return slog.LevelDebug, nil
+	}
+	l, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", level)
+	}
+	return l, nil
+}
+
+// setupLogging sends structured logs at level and above to stderr, above any
+// progress bars, as logfmt-style text or JSON lines. Messages from the
+// standard log package go through the same handler.
+func setupLogging(format string, level slog.Level) error {
+	var handler slog.Handler
+	switch format {
+	case LogFormatText:
+		handler = slog.NewTextHandler(terminal, &slog.HandlerOptions{Level: level})
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(terminal, &slog.HandlerOptions{Level: level, ReplaceAttr: durationString})
+	default:
+		return fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// durationString writes durations as e.g. "1.5s" rather than nanoseconds
+func durationString(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.String(a.Key, a.Value.Duration().String())
+	}
+	return a
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// matcher finds the sankets a read contains, each once, in SID order. It
+// takes the read as bytes, as the FASTQ reader holds it, so matching a read
+// allocates nothing for it.
+type matcher interface {
+	Match(seq []byte) []*SanketInfo
+}
+
+// matcherBackend is a way of matching reads against the panel, chosen with
+// -matcher. Every backend finds the same sankets; they differ in speed and
+// memory, which bench measures. A backend that needs a library this build
+// lacks falls back to another, which bench skips unless it is asked for.
+type matcherBackend struct {
+	name     string
+	summary  string
+	build    func(idx *sanketIndex) matcher
+	fallback bool // not in this build, so matching with another backend
+}
+
+// matcherBackends lists the backends, the default first. hyperscan adds
+// itself, see hyperscan.go.
+var matcherBackends = []matcherBackend{
+	{"scan", "search each read for every sanket in turn", newScanMatcher, false},
+	{"kmer", "look up every window of each read in a hash of the sankets, one per sanket length", newKmerMatcher, false},
+	{"prefix", "compare each position of each read with the sankets sharing its first bases", newPrefixMatcher, false},
+	{"fm", "experimental: extend each read leftwards from every position through an FM-index of the sankets", newFMMatcher, false},
+}
+
+// matcherNames lists the backends for flag help and errors
+func matcherNames() string {
+	names := make([]string, len(matcherBackends))
+	for i, b := range matcherBackends {
+		names[i] = b.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// findMatcher returns the backend called name
+func findMatcher(name string) (matcherBackend, error) {
+	for _, b := range matcherBackends {
+		if b.name == name {
+			return b, nil
+		}
+	}
+	return matcherBackend{}, fmt.Errorf("unknown matcher %q (expected one of %s)", name, matcherNames())
+}
+
+// sortedSankets returns the panel's sankets in SID order
+func sortedSankets(sankets map[string]SanketInfo) []SanketInfo {
+	sorted := make([]SanketInfo, 0, len(sankets))
+	for _, info := range sankets {
+		sorted = append(sorted, info)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].SID < sorted[j].SID })
+	return sorted
+}
+
+// scanMatcher searches a read for every sanket, which costs a pass over the
+// read per sanket but needs no index
+type scanMatcher struct {
+	sankets []SanketInfo
+	seqs    [][]byte // the sankets' sequences
+}
+
+func newScanMatcher(idx *sanketIndex) matcher {
+	m := &scanMatcher{sankets: idx.Sankets}
+	for _, info := range m.sankets {
+		m.seqs = append(m.seqs, []byte(info.Sanket))
+	}
+	return m
+}
+
+func (m *scanMatcher) Match(seq []byte) []*SanketInfo {
+	var found []*SanketInfo
+	for i := range m.sankets {
+		if bytes.Contains(seq, m.seqs[i]) {
+			found = append(found, &m.sankets[i])
+		}
+	}
+	return found
+}
+
+// kmerMatcher hashes the sankets by sequence, so a read costs one lookup per
+// position and distinct sanket length, however large the panel
+type kmerMatcher struct {
+	sankets []SanketInfo
+	lengths []int              // the distinct sanket lengths, shortest first
+	index   map[string][]int32 // sanket sequence to its sankets' positions in sankets
+	empty   []int32            // empty sankets, which every read contains as for scanMatcher; checkPanel reports them
+}
+
+// newKmerMatcher hashes the panel's sankets, unless they came hashed from an
+// index
+func newKmerMatcher(idx *sanketIndex) matcher {
+	idx.indexKmers()
+	return &kmerMatcher{sankets: idx.Sankets, lengths: idx.Lengths, index: idx.Kmers, empty: idx.Empty}
+}
+
+func (m *kmerMatcher) Match(seq []byte) []*SanketInfo {
+	hits := append([]int32(nil), m.empty...)
+	for i := range seq {
+		for _, n := range m.lengths {
+			if i+n > len(seq) {
+				break
+			}
+			hits = append(hits, m.index[string(seq[i:i+n])]...) // looked up without a copy
+		}
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i] < hits[j] })
+	found := make([]*SanketInfo, 0, len(hits))
+	for i, hit := range hits {
+		if i == 0 || hit != hits[i-1] { // a sanket found more than once
+			found = append(found, &m.sankets[hit])
+		}
+	}
+	return found
+}
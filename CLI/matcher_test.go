@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// sidsOf lists the SIDs of sankets a matcher found
+func sidsOf(found []*SanketInfo) []string {
+	sids := make([]string, len(found))
+	for i, info := range found {
+		sids[i] = info.SID
+	}
+	return sids
+}
+
+// testPanel makes an index of sankets with the given sequences, S0001 first
+func testPanel(seqs ...string) *sanketIndex {
+	sankets := make([]SanketInfo, len(seqs))
+	for i, seq := range seqs {
+		sankets[i] = SanketInfo{SID: fmt.Sprintf("S%04d", i+1), Serotype: "x", Sanket: seq, SLen: len(seq)}
+	}
+	return &sanketIndex{Sankets: sankets}
+}
+
+// randomBases returns n bases, now and then an N
+func randomBases(rng *rand.Rand, n int) string {
+	const bases = "ACGTACGTACGTACGTN"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = bases[rng.Intn(len(bases))]
+	}
+	return string(b)
+}
+
+// checkBackends checks that every backend finds in each read what scan does
+func checkBackends(t *testing.T, idx *sanketIndex, reads ...string) {
+	t.Helper()
+	scan := newScanMatcher(idx)
+	for _, b := range matcherBackends {
+		m := b.build(idx)
+		for _, read := range reads {
+			want := sidsOf(scan.Match([]byte(read)))
+			if got := sidsOf(m.Match([]byte(read))); !slices.Equal(got, want) {
+				var seqs []string
+				for _, info := range idx.Sankets {
+					seqs = append(seqs, info.Sanket)
+				}
+				t.Errorf("%s found %v in %s, scan %v; sankets %q", b.name, got, read, want, seqs)
+			}
+		}
+	}
+}
+
+func TestBackendsMatchScan(t *testing.T) {
+	// Without the hyperscan tag its backend warns each time it is built
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// The FM-index once lost its last checkpoint when its text filled whole
+	// blocks, 32 symbols here
+	checkBackends(t, testPanel("ACCGT", "TGTT", "CT", "AGAT", "TCGC", "AACTCA"), "NNTCTATGTTANTCANCGGCGACC")
+
+	rng := rand.New(rand.NewSource(1))
+	for range 500 {
+		seqs := make([]string, 1+rng.Intn(12))
+		for i := range seqs {
+			seqs[i] = randomBases(rng, 1+rng.Intn(8))
+		}
+		if rng.Intn(10) == 0 {
+			seqs[rng.Intn(len(seqs))] = ""
+		}
+		reads := make([]string, 5)
+		for i := range reads {
+			read := randomBases(rng, rng.Intn(40))
+			// Plant a sanket or two so most reads match something
+			for range rng.Intn(3) {
+				seq := seqs[rng.Intn(len(seqs))]
+				at := rng.Intn(len(read) + 1)
+				read = read[:at] + seq + read[at:]
+			}
+			reads[i] = read
+		}
+		checkBackends(t, testPanel(seqs...), reads...)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bhedi/output"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// sampleColumn is the column merge adds in front of the flat columns
+var sampleColumn = output.Column{Name: "sample", Tag: "type=BYTE_ARRAY, convertedtype=UTF8", SQL: "TEXT"}
+
+// mergedMetadata keeps the run metadata every input agrees on, such as the
+// panel and scoring, and records what was merged. Keys whose values differ
+// are dropped, with a warning for the panel revision, as results of
+// different panels don't compare.
+func mergedMetadata(files []string, samples []string) (map[string]string, error) {
+	var common map[string]string
+	var merged []string // the samples, including those of earlier merges
+	for i, file := range files {
+		metadata, err := resultMetadata(file)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the metadata of %s: %w", file, err)
+		}
+		fileSamples := []string{samples[i]}
+		if list := metadata["bhedi.merged_samples"]; list != "" {
+			fileSamples = strings.Split(list, ",")
+		}
+		for _, sample := range fileSamples {
+			if !contains(merged, sample) {
+				merged = append(merged, sample)
+			}
+		}
+		if len(metadata) == 0 {
+			continue // a format without metadata says nothing either way
+		}
+		if common == nil {
+			common = metadata
+			continue
+		}
+		for key, value := range common {
+			if metadata[key] != value {
+				if key == "bhedi.panel.checksum" {
+					slog.Warn("the results come from different panels", "file", file, "panel", metadata["bhedi.panel.version"], "other_panel", common["bhedi.panel.version"])
+				}
+				delete(common, key)
+			}
+		}
+	}
+	if common == nil {
+		common = make(map[string]string)
+	}
+	delete(common, "bhedi.converted_from")
+	sort.Strings(merged)
+	common["bhedi.created_at"] = time.Now().UTC().Format(time.RFC3339)
+	common["bhedi.merged_files"] = strconv.Itoa(len(files))
+	common["bhedi.merged_samples"] = strings.Join(merged, ",")
+	return common, nil
+}
+
+// mergeFlags sets up the merge command: concatenate result files of any
+// format into one Parquet file with the flat schema and a sample column, for
+// run-level analysis in a single query
+func mergeFlags(fs *flag.FlagSet) func(args []string) error {
+	outPath := fs.String("o", "", "Merged Parquet file to write, e.g. combined.parquet")
+	columns := fs.String("columns", "", "Comma-separated flat columns to keep besides sample, e.g. read_id,serotype,b_score (default all)")
+	compression := fs.String("parquet-compression", "snappy", "Parquet compression codec: zstd, snappy, gzip or none")
+	overwrite := fs.Bool("overwrite", false, "Replace the merged file if it already exists")
+
+	return func(args []string) error {
+		if *outPath == "" {
+			return usagef("-o is required")
+		}
+		opts := OutputOptions{Options: output.Options{Format: output.FormatParquet, Schema: output.SchemaFlat, Compression: *compression}}
+		var err error
+		if opts.Columns, err = output.ParseColumns(*columns); err != nil {
+			return usagef("invalid -columns: %w", err)
+		}
+		if err := opts.Validate(); err != nil {
+			return usageError{err}
+		}
+		found, err := resultFiles(args)
+		if err != nil {
+			return err
+		}
+		var files []string
+		for _, file := range found {
+			if same, err := sameFile(file, *outPath); err == nil && same {
+				continue // an earlier merge in the directory being merged
+			}
+			files = append(files, file)
+		}
+		if len(files) == 0 {
+			return usagef("no result files given")
+		}
+		if _, err := os.Stat(*outPath); err == nil && !*overwrite {
+			return fmt.Errorf("%s exists; pass -overwrite to replace it", *outPath)
+		}
+
+		samples := make([]string, len(files))
+		for i, file := range files {
+			samples[i] = resultSample(file, resultPartitions(file))
+		}
+		if opts.Metadata, err = mergedMetadata(files, samples); err != nil {
+			return err
+		}
+		rows, err := mergeResults(files, samples, *outPath, opts, nil)
+		if err != nil {
+			return err
+		}
+		slog.Info("merged", "files", len(files), "samples", strings.Count(opts.Metadata["bhedi.merged_samples"], ",")+1, "rows", rows, "output", *outPath)
+		return nil
+	}
+}
+
+// mergeResults writes the rows of files, each tagged with its sample, into a
+// Parquet file at path, only those keep accepts unless it is nil. It is
+// written to a temp file and renamed, so a failed merge leaves no partial
+// file.
+func mergeResults(files, samples []string, path string, opts OutputOptions, keep func(output.Record) bool) (int, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return 0, err
+		}
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	fw, err := local.NewLocalFileWriter(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("can't create local file: %w", err)
+	}
+	defer os.Remove(tmp) // fails harmlessly once renamed
+	columns := opts.SelectedColumns()
+	pw, err := writer.NewCSVWriter(output.ParquetMetadata(append([]output.Column{sampleColumn}, columns...)), fw, opts.Parallelism())
+	if err != nil {
+		fw.Close()
+		return 0, fmt.Errorf("can't create parquet writer: %w", err)
+	}
+	opts.TuneParquet(&pw.ParquetWriter)
+
+	rows := 0
+	for i, file := range files {
+		n, err := appendResults(pw, file, samples[i], columns, keep)
+		rows += n
+		if err != nil {
+			pw.WriteStop()
+			fw.Close()
+			return rows, fmt.Errorf("can't read %s: %w", file, err)
+		}
+	}
+	output.SetFooterMetadata(pw.Footer, opts.Metadata)
+	if err := pw.WriteStop(); err != nil {
+		fw.Close()
+		return rows, fmt.Errorf("error finalizing Parquet file write: %w", err)
+	}
+	if err := fw.Close(); err != nil {
+		return rows, err
+	}
+	return rows, os.Rename(tmp, path)
+}
+
+// appendResults writes the rows of one result file that keep accepts with
+// their sample in front
+func appendResults(pw *writer.CSVWriter, file, sample string, columns []output.Column, keep func(output.Record) bool) (int, error) {
+	results, err := openResults(file)
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	partitions := resultPartitions(file)
+	rows := 0
+	for {
+		row, err := results.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		if row.Serotype == "" {
+			row.Serotype = partitions["serotype"] // a partition column isn't stored in the file
+		}
+		if keep != nil && !keep(row.Record) {
+			continue
+		}
+		rowSample := sample
+		if row.Sample != "" {
+			rowSample = row.Sample // from an earlier merge
+		}
+		if err := pw.Write(append([]interface{}{rowSample}, output.ColumnValues(columns, row.Record)...)); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bhedi/output"
+	"gocloud.dev/blob"
+)
+
+// Placeholders of -output-name templates
+const (
+	placeholderDir      = "{dir}"      // the input file's subdirectory, e.g. barcode01
+	placeholderName     = "{name}"     // the file list's output name, or the sample
+	placeholderSample   = "{sample}"   // the sample
+	placeholderDate     = "{date}"     // the day the file is classified, e.g. 2024-06-01
+	placeholderSerotype = "{serotype}" // one result file per serotype
+	placeholderBarcode  = "{barcode}"  // one result file per barcode's sample, with -barcodes
+)
+
+var namePlaceholders = []string{placeholderDir, placeholderName, placeholderSample, placeholderDate, placeholderSerotype, placeholderBarcode}
+
+// Policies for results that already exist, chosen with -overwrite and
+// -skip-existing
+const (
+	ExistingFail      = "fail"
+	ExistingOverwrite = "overwrite"
+	ExistingSkip      = "skip"
+)
+
+// nameTemplate returns the -output-name template, or the default: results
+// keep the input file's subdirectory and are named after the sample, and in
+// a bucket every sample gets a prefix of its own. With -partition-by the
+// template names the directory the partitions go in. Demultiplexed results
+// go in a directory per input file, one file per barcode, unless partitioned
+// by sample.
+func (o OutputOptions) nameTemplate(bucket bool) string {
+	if o.Name != "" {
+		return o.Name
+	}
+	if o.Demux && !contains(o.PartitionBy, PartitionSample) {
+		if !bucket && len(o.PartitionBy) > 0 {
+			return "{dir}/{barcode}"
+		}
+		return "{dir}/{name}/{barcode}"
+	}
+	switch {
+	case bucket && len(o.PartitionBy) > 0:
+		return "{dir}/{name}"
+	case bucket:
+		return "{dir}/{name}/{name}"
+	case len(o.PartitionBy) > 0:
+		return "{dir}"
+	default:
+		return "{dir}/{name}"
+	}
+}
+
+// checkNameTemplate checks an -output-name template only uses known
+// placeholders and stays inside the output directory
+func checkNameTemplate(template string, opts OutputOptions) error {
+	rest := template
+	for _, p := range namePlaceholders {
+		rest = strings.ReplaceAll(rest, p, "x")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unknown placeholder in %q (expected %s)", template, strings.Join(namePlaceholders, ", "))
+	}
+	if path.IsAbs(filepath.ToSlash(template)) || strings.HasPrefix(path.Clean(filepath.ToSlash(template)), "..") {
+		return fmt.Errorf("%q must stay inside the output directory", template)
+	}
+	if strings.Contains(template, placeholderSerotype) && len(opts.PartitionBy) > 0 {
+		return fmt.Errorf("%s can't be used with partitioned output", placeholderSerotype)
+	}
+	switch barcode := strings.Contains(template, placeholderBarcode); {
+	case barcode && !opts.Demux:
+		return fmt.Errorf("%s needs reads demultiplexed with -barcodes", placeholderBarcode)
+	case !barcode && opts.Demux && template != "" && !contains(opts.PartitionBy, PartitionSample):
+		return fmt.Errorf("%q would mix the barcodes' results; add %s or partition by sample", template, placeholderBarcode)
+	}
+	return nil
+}
+
+// expandName fills in a template for input, leaving {serotype} and {barcode}
+// for the writers. The result is a path relative to the output directory,
+// without the format's extension.
+func expandName(template string, input inputFile, date time.Time) (string, error) {
+	name := strings.NewReplacer(
+		placeholderDir, filepath.ToSlash(input.Dir),
+		placeholderName, input.Name,
+		placeholderSample, input.Sample,
+		placeholderDate, date.Format("2006-01-02"),
+	).Replace(template)
+	name = path.Clean("/" + filepath.ToSlash(name))[1:] // an empty {dir} leaves no leading slash
+	if name == "" {
+		name = "."
+	}
+	if strings.HasPrefix(name, "..") {
+		return "", fmt.Errorf("the results of %s would go outside the output directory", input.Path)
+	}
+	return filepath.FromSlash(name), nil
+}
+
+// nameOutputs fills in every input's Output from the run's template and
+// returns an error when two files would write the same results. Partitions
+// in a local directory are shared on purpose, as their part files never
+// replace one another.
+func (r *runner) nameOutputs(inputs []inputFile, date time.Time) error {
+	template := r.opts.nameTemplate(r.bucket != nil)
+	shared := r.bucket == nil && len(r.opts.PartitionBy) > 0
+	seen := make(map[string]string)
+	for i := range inputs {
+		output, err := expandName(template, inputs[i], date)
+		if err != nil {
+			return err
+		}
+		if !shared && output == "." {
+			return fmt.Errorf("-output-name %q gives %s no file name", template, inputs[i].Path)
+		}
+		inputs[i].Output = output
+		if shared {
+			continue
+		}
+		if other, ok := seen[output]; ok {
+			return fmt.Errorf("%s and %s would both write %s; add {dir}, {name} or {sample} to -output-name", other, inputs[i].Path, output)
+		}
+		seen[output] = inputs[i].Path
+	}
+	return nil
+}
+
+// escapeGlob quotes the glob pattern characters in a name
+var escapeGlob = strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]")
+
+// existingResults returns results of input already in the output, other than
+// the ones this run's state recorded for it, which are its own to replace
+func (r *runner) existingResults(input inputFile) ([]string, error) {
+	output := filepath.ToSlash(input.Output)
+	if len(r.opts.PartitionBy) > 0 {
+		if r.bucket == nil {
+			return nil, nil // part files are added next to the existing ones
+		}
+		return existingKeys(r.bucket, writerPrefix(output+"/"), "")
+	}
+	pattern := escapeGlob.Replace(output) + r.opts.Extension()
+	for _, p := range []string{placeholderSerotype, placeholderBarcode} {
+		pattern = strings.ReplaceAll(pattern, escapeGlob.Replace(p), "*")
+	}
+	if r.bucket != nil {
+		return existingKeys(r.bucket, writerPrefix(output), pattern)
+	}
+	matches, err := filepath.Glob(filepath.Join(r.outputDir, filepath.FromSlash(pattern)))
+	if err != nil {
+		return nil, err
+	}
+	own := r.state.Outputs(input.Path)
+	var existing []string
+	for _, match := range matches {
+		rel, err := filepath.Rel(r.outputDir, match)
+		if err == nil && !contains(own, rel) {
+			existing = append(existing, rel)
+		}
+	}
+	return existing, nil
+}
+
+// writerPrefix returns the part of an output name before the placeholders
+// the writers fill in
+func writerPrefix(output string) string {
+	for _, p := range []string{placeholderSerotype, placeholderBarcode} {
+		if i := strings.Index(output, p); i >= 0 {
+			output = output[:i]
+		}
+	}
+	return output
+}
+
+// existingKeys lists the keys in bucket starting with prefix, keeping only
+// those matching pattern unless it is empty
+func existingKeys(bucket *blob.Bucket, prefix, pattern string) ([]string, error) {
+	var keys []string
+	iter := bucket.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(context.Background())
+		if errors.Is(err, io.EOF) {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't list the output bucket: %w", err)
+		}
+		if ok, _ := path.Match(pattern, obj.Key); ok || pattern == "" {
+			keys = append(keys, obj.Key)
+		}
+	}
+}
+
+// serotypeWriter is an output.Writer that writes the matches of each serotype
+// to a file of its own, named by filling the serotype into path and opened on
+// first use. Reads without a match go to the Unassigned file. It is not safe
+// for concurrent use.
+type serotypeWriter struct {
+	path    string
+	opts    OutputOptions
+	writers map[string]output.Writer
+}
+
+func newSerotypeWriter(file string, opts OutputOptions) *serotypeWriter {
+	return &serotypeWriter{path: file, opts: opts, writers: make(map[string]output.Writer)}
+}
+
+// serotypeFileName keeps a serotype from adding directories to a file name
+var serotypeFileName = strings.NewReplacer("/", "_", `\`, "_")
+
+// Write splits a result by the serotype of its matches
+func (w *serotypeWriter) Write(result output.Result) error {
+	if !result.MatchesFound {
+		return w.write("Unassigned", result)
+	}
+	var order []string
+	bySerotype := make(map[string][]output.Match)
+	for _, match := range result.Matches {
+		if _, ok := bySerotype[match.Serotype]; !ok {
+			order = append(order, match.Serotype)
+		}
+		bySerotype[match.Serotype] = append(bySerotype[match.Serotype], match)
+	}
+	for _, serotype := range order {
+		part := result
+		part.Matches = bySerotype[serotype]
+		if err := w.write(serotype, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *serotypeWriter) write(serotype string, result output.Result) error {
+	out, ok := w.writers[serotype]
+	if !ok {
+		file := strings.ReplaceAll(w.path, placeholderSerotype, serotypeFileName.Replace(serotype))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		var err error
+		if out, err = output.New(file, w.opts.Options); err != nil {
+			return err
+		}
+		w.writers[serotype] = out
+	}
+	return out.Write(result)
+}
+
+// Close closes every serotype's file, returning the first error encountered
+func (w *serotypeWriter) Close() error {
+	var firstErr error
+	for _, out := range w.writers {
+		if err := out.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// newResultWriter opens the writer for input's results under dir: one file,
+// one file per serotype, or Hive-style partition directories, recording the
+// sample and its metadata
+func newResultWriter(dir string, input inputFile, opts OutputOptions) (output.Writer, error) {
+	path := filepath.Join(dir, input.Output)
+	info, ok := opts.Samples[input.Sample]
+	if !ok {
+		info = sampleInfo{Name: input.Sample}
+	}
+	metadata := info.metadata()
+	for key, value := range opts.Metadata {
+		metadata[key] = value
+	}
+	opts.Metadata = metadata
+	switch {
+	case len(opts.PartitionBy) > 0:
+		return newPartitionedParquetWriter(path, input.Sample, opts), nil
+	case strings.Contains(input.Output, placeholderSerotype):
+		return newSerotypeWriter(path+opts.Extension(), opts), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return output.New(path+opts.Extension(), opts.Options)
+}
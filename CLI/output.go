@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bhedi/output"
+)
+
+// byteSize is a flag.Value for sizes such as 64MB or 8KB, in binary units, as
+// the API takes them
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+func (s *byteSize) String() string {
+	for _, unit := range sizeUnits {
+		if int64(*s) >= unit.size && int64(*s)%unit.size == 0 {
+			return strconv.FormatInt(int64(*s)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if prefix := unit.suffix[:1]; unit.size > 1 && strings.HasSuffix(v, prefix) {
+			v, multiplier = strings.TrimSuffix(v, prefix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q (expected e.g. 64MB or 8KB)", value)
+	}
+	*s = byteSize(n * float64(multiplier))
+	return nil
+}
+
+// OutputOptions controls the layout of the result files: how the output
+// module writes each file, and what the run puts in them
+type OutputOptions struct {
+	output.Options
+	PartitionBy []string              // Hive-style partition keys, outermost first; flat schema only
+	Name        string                // -output-name template; empty means the default, see nameTemplate
+	Demux       bool                  // reads are demultiplexed by barcode, see demuxWriter
+	Samples     map[string]sampleInfo // metadata of the samples by name, from -sample-sheet
+	MinBScore   float64               // matches scoring lower aren't written
+	MatchedOnly bool                  // reads without a match aren't written
+	Trim        qualityTrim           // reads are cut where their quality drops before they are matched
+	Adapters    adapterTrim           // and their adapters removed
+}
+
+// Validate checks that the options name known values
+func (o OutputOptions) Validate() error {
+	if err := o.Options.Validate(); err != nil {
+		return err
+	}
+	if len(o.PartitionBy) > 0 && (o.Schema != output.SchemaFlat || o.Format != output.FormatParquet) {
+		return fmt.Errorf("partitioned output requires the %s schema and %s format", output.SchemaFlat, output.FormatParquet)
+	}
+	if err := checkNameTemplate(o.Name, o); err != nil {
+		return fmt.Errorf("invalid output name: %w", err)
+	}
+	if o.RowGroupSize > 0 && o.PageSize > o.RowGroupSize {
+		return fmt.Errorf("parquet page size %v is over the row group size %v", (*byteSize)(&o.PageSize), (*byteSize)(&o.RowGroupSize))
+	}
+	if o.Trim.Quality < 0 || o.Trim.Quality > 0 && o.Trim.Window < 1 {
+		return fmt.Errorf("trim quality can't be negative, and its window must be at least 1 base")
+	}
+	return nil
+}
+
+// filter drops the matches of a read scoring below MinBScore, leaving a read
+// without any as unmatched, and reports whether the read is written at all:
+// with MatchedOnly, only when a match is left
+func (o OutputOptions) filter(result output.Result) (output.Result, bool) {
+	if o.MinBScore > 0 && result.MatchesFound {
+		var kept []output.Match
+		for _, match := range result.Matches {
+			if match.BScore >= o.MinBScore {
+				kept = append(kept, match)
+			}
+		}
+		result.Matches, result.MatchesFound = kept, len(kept) > 0
+	}
+	return result, result.MatchesFound || !o.MatchedOnly
+}
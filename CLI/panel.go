@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// panelColumns is the header of a panel CSV, in the order LoadSankets reads it
+var panelColumns = []string{"sid", "sanket", "s_len", "serotype", "ssr_count", "mlen_avg", "mrc_avg", "p_count", "plen_avg"}
+
+// panelFile is the name findPanel looks for when no panel is given
+const panelFile = "sanket.csv"
+
+// panelPath is the panel given with -panel, the config file or $BHEDI_PANEL;
+// empty to search for one
+var panelPath string
+
+// panelFlags defines -panel and its short form -p
+func panelFlags(fs *flag.FlagSet) {
+	fs.StringVar(&panelPath, "panel", os.Getenv("BHEDI_PANEL"), "Sanket panel CSV (default $BHEDI_PANEL, else the first "+panelFile+" in the working directory, next to the executable or in <user config dir>/bhedi)")
+	fs.StringVar(&panelPath, "p", os.Getenv("BHEDI_PANEL"), "Short for -panel")
+}
+
+// panelSearchPath lists where findPanel looks for a panel nobody named
+func panelSearchPath() []string {
+	dirs := []string{"."}
+	if exe, err := os.Executable(); err == nil {
+		if exe, err = filepath.EvalSymlinks(exe); err == nil {
+			dirs = append(dirs, filepath.Dir(exe))
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "bhedi"))
+	}
+	paths := make([]string, len(dirs))
+	for i, dir := range dirs {
+		paths[i] = filepath.Join(dir, panelFile)
+	}
+	return paths
+}
+
+// findPanel returns path if set, else the first panel on the search path. A
+// named panel that doesn't exist is an error rather than a reason to search.
+func findPanel(path string) (string, error) {
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("can't open the sanket panel: %w", err)
+		}
+		return path, nil
+	}
+	candidates := panelSearchPath()
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no sanket panel found; pass -panel or set $BHEDI_PANEL (looked for %s)", strings.Join(candidates, ", "))
+}
+
+// panelProblem is a row of a sanket table that run can't use, or would misread
+type panelProblem struct {
+	Line    int
+	SID     string
+	Problem string
+}
+
+// readPanelRows reads the rows of a sanket table, checking its header
+func readPanelRows(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening panel file: %w", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1 // checkPanel reports rows of the wrong width
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if strings.Join(header, ",") != strings.Join(panelColumns, ",") {
+		return nil, fmt.Errorf("%s has columns %s, expected %s", path, strings.Join(header, ","), strings.Join(panelColumns, ","))
+	}
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return rows, nil
+}
+
+// checkPanel finds the rows run would misread: missing fields, sequences with
+// bases other than ACGT, a wrong s_len, duplicate sids, or one sanket listed
+// under two serotypes. With fix, stray spaces, lower case sequences and wrong
+// s_len values are corrected in place instead of reported, and fixed counts
+// the rows changed.
+func checkPanel(rows [][]string, fix bool) (problems []panelProblem, fixed int) {
+	sids := make(map[string]int)
+	sequences := make(map[string]int) // sanket -> index of the first row with it
+	for i, row := range rows {
+		line := i + 2 // after the header, counting from 1
+		report := func(format string, args ...any) {
+			sid := ""
+			if len(row) > 0 {
+				sid = row[0]
+			}
+			problems = append(problems, panelProblem{Line: line, SID: sid, Problem: fmt.Sprintf(format, args...)})
+		}
+		if len(row) != len(panelColumns) {
+			report("has %d fields, expected %d", len(row), len(panelColumns))
+			continue
+		}
+
+		clean := make([]string, len(row))
+		for j, field := range row {
+			clean[j] = strings.TrimSpace(field)
+		}
+		clean[1] = strings.ToUpper(clean[1])
+		clean[2] = strconv.Itoa(len(clean[1]))
+		changed := strings.Join(clean, ",") != strings.Join(row, ",")
+		switch {
+		case changed && fix:
+			copy(row, clean)
+			fixed++
+		case clean[1] != row[1]:
+			report("sanket %q isn't upper case ACGT", row[1])
+		case clean[2] != row[2]:
+			report("s_len is %s but the sanket has %d bases", row[2], len(clean[1]))
+		case changed:
+			report("has spaces around a field")
+		}
+
+		sid, sanket, serotype := clean[0], clean[1], clean[3]
+		if sid == "" {
+			report("has no sid")
+		} else if first, ok := sids[sid]; ok {
+			report("repeats the sid of line %d", first+2)
+		} else {
+			sids[sid] = i
+		}
+		if sanket == "" {
+			report("has no sanket")
+		} else if strings.Trim(sanket, "ACGT") != "" {
+			report("sanket %q has bases other than A, C, G and T", sanket)
+		}
+		if serotype == "" {
+			report("has no serotype")
+		}
+		if first, ok := sequences[sanket]; ok && sanket != "" {
+			if other := strings.TrimSpace(rows[first][3]); other != serotype {
+				report("has the same sanket as %s, of serotype %s", strings.TrimSpace(rows[first][0]), other)
+			}
+		} else {
+			sequences[sanket] = i
+		}
+	}
+	return problems, fixed
+}
+
+// logPanelProblems logs each problem and returns an error counting them
+func logPanelProblems(path string, problems []panelProblem) error {
+	for _, p := range problems {
+		slog.Error("bad panel row", "file", path, "line", p.Line, "sid", p.SID, "problem", p.Problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s has %d bad rows", path, len(problems))
+	}
+	return nil
+}
+
+// buildDBFlags sets up the build-db command: check a sanket table, fix what
+// can be fixed and write it out, sorted by serotype and sid, as a panel
+func buildDBFlags(fs *flag.FlagSet) func(args []string) error {
+	input := fs.String("i", "", "Sanket table to read, a CSV with the panel's columns")
+	output := fs.String("o", "", "Panel CSV to write; nothing is written if the table has bad rows")
+
+	return func(args []string) error {
+		if *input == "" && len(args) == 1 {
+			*input = args[0]
+		} else if len(args) > 0 {
+			return usagef("unexpected arguments %q", args)
+		}
+		if *input == "" || *output == "" {
+			return usagef("the sanket table and the panel to write must be specified with -i and -o")
+		}
+		rows, err := readPanelRows(*input)
+		if err != nil {
+			return err
+		}
+		problems, fixed := checkPanel(rows, true)
+		if err := logPanelProblems(*input, problems); err != nil {
+			return err
+		}
+		sort.SliceStable(rows, func(a, b int) bool {
+			if rows[a][3] != rows[b][3] {
+				return rows[a][3] < rows[b][3]
+			}
+			return rows[a][0] < rows[b][0]
+		})
+
+		// Write next to the destination and rename, so a failed build leaves any old panel intact
+		tmp, err := os.CreateTemp(filepath.Dir(*output), ".panel-*.csv")
+		if err != nil {
+			return fmt.Errorf("can't write the panel: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		w := csv.NewWriter(tmp)
+		w.Write(panelColumns)
+		w.WriteAll(rows)
+		if err := w.Error(); err != nil {
+			tmp.Close()
+			return fmt.Errorf("can't write the panel: %w", err)
+		}
+		if err := tmp.Close(); err != nil {
+			return fmt.Errorf("can't write the panel: %w", err)
+		}
+		if err := os.Rename(tmp.Name(), *output); err != nil {
+			return fmt.Errorf("can't write the panel: %w", err)
+		}
+
+		perSerotype := make(map[string]int)
+		for _, row := range rows {
+			perSerotype[row[3]]++
+		}
+		slog.Info("panel written", "file", *output, "sankets", len(rows), "fixed_rows", fixed, "per_serotype", perSerotype)
+		return nil
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bhedi/output"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Partition keys accepted by -partition-by
+const (
+	PartitionSerotype = "serotype"
+	PartitionSample   = "sample"
+)
+
+// parseOutputPartitions splits and checks a -partition-by value
+func parseOutputPartitions(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key != PartitionSerotype && key != PartitionSample {
+			return nil, fmt.Errorf("unknown partition key %q (expected %s and/or %s)", key, PartitionSerotype, PartitionSample)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("partition key %q given twice", key)
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// hivePartitionValue escapes a value for use in a key=value directory name,
+// following the characters Hive itself escapes
+func hivePartitionValue(value string) string {
+	if value == "" {
+		return "__HIVE_DEFAULT_PARTITION__"
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 0x20 || c == 0x7f || strings.IndexByte("\"#%'*/:=?\\{[]^", c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+type parquetPartition struct {
+	fw source.ParquetFile
+	pw *writer.CSVWriter
+}
+
+// partitionedParquetWriter is an output.Writer that writes flat rows into Hive-style key=value directories,
+// opening one part file per partition on first use. Partition columns are dropped
+// from the data files since their values are encoded in the path.
+// It is not safe for concurrent use; callers hold the file's writer mutex.
+type partitionedParquetWriter struct {
+	root       string
+	sample     string
+	keys       []string
+	columns    []output.Column
+	opts       OutputOptions
+	partitions map[string]*parquetPartition
+}
+
+func newPartitionedParquetWriter(root, sample string, opts OutputOptions) *partitionedParquetWriter {
+	var columns []output.Column
+	for _, col := range opts.SelectedColumns() {
+		if col.Name == PartitionSerotype && contains(opts.PartitionBy, PartitionSerotype) {
+			continue
+		}
+		columns = append(columns, col)
+	}
+	return &partitionedParquetWriter{
+		root:       root,
+		sample:     sample,
+		keys:       opts.PartitionBy,
+		columns:    columns,
+		opts:       opts,
+		partitions: make(map[string]*parquetPartition),
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionDir returns the relative key=value directory for a row
+func (w *partitionedParquetWriter) partitionDir(record output.Record) string {
+	parts := make([]string, 0, len(w.keys))
+	for _, key := range w.keys {
+		value := w.sample
+		if key == PartitionSerotype {
+			value = record.Serotype
+		}
+		parts = append(parts, key+"="+hivePartitionValue(value))
+	}
+	return filepath.Join(parts...)
+}
+
+// open creates the next free part-NNN.parquet in a partition directory, so
+// several samples can share a serotype partition without clobbering each other
+func (w *partitionedParquetWriter) open(dir string) (*parquetPartition, error) {
+	fullDir := filepath.Join(w.root, dir)
+	if err := os.MkdirAll(fullDir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create partition directory: %w", err)
+	}
+	var path string
+	for i := 0; ; i++ {
+		path = filepath.Join(fullDir, fmt.Sprintf("part-%03d.parquet", i))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+	}
+	fw, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't create local file: %w", err)
+	}
+	pw, err := writer.NewCSVWriter(output.ParquetMetadata(w.columns), fw, w.opts.Parallelism())
+	if err != nil {
+		fw.Close()
+		return nil, fmt.Errorf("can't create parquet writer: %w", err)
+	}
+	w.opts.TuneParquet(&pw.ParquetWriter)
+	return &parquetPartition{fw: fw, pw: pw}, nil
+}
+
+// Write routes every row of a result to its partition
+func (w *partitionedParquetWriter) Write(result output.Result) error {
+	for _, record := range output.FlatRecords(result) {
+		dir := w.partitionDir(record)
+		partition, ok := w.partitions[dir]
+		if !ok {
+			var err error
+			if partition, err = w.open(dir); err != nil {
+				return err
+			}
+			w.partitions[dir] = partition
+		}
+		if err := partition.pw.Write(output.ColumnValues(w.columns, record)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finalizes every part file, returning the first error encountered
+func (w *partitionedParquetWriter) Close() error {
+	var firstErr error
+	for _, partition := range w.partitions {
+		output.SetFooterMetadata(partition.pw.Footer, w.opts.Metadata)
+		if err := partition.pw.WriteStop(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error finalizing Parquet file write: %w", err)
+		}
+		if err := partition.fw.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,39 @@
+package main
+
+import "sync"
+
+// workerPool is a fixed set of goroutines that run tasks, shared by every file
+// of a run so the number of goroutines stays at -threads however many reads
+// the input holds
+type workerPool struct {
+	tasks chan func()
+	size  int // workers
+	wg    sync.WaitGroup
+}
+
+// newWorkerPool starts n workers. Submit blocks once n tasks are waiting, so
+// the reader never gets far ahead of the workers.
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{tasks: make(chan func(), n), size: n}
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// Submit queues a task for the next free worker
+func (p *workerPool) Submit(task func()) {
+	p.tasks <- task
+}
+
+// Close stops the workers once the queued tasks are done
+func (p *workerPool) Close() {
+	close(p.tasks)
+	p.wg.Wait()
+}
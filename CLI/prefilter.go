@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math/bits"
+)
+
+// Shape of the prefilter's Bloom filter: bits per sanket and probes per
+// lookup. A read is looked up at every position, so each lookup has to be
+// wrong very rarely: at 128 bits per sanket and 3 probes, fewer than one in
+// 100,000 times for a panel of 100,000 sankets.
+const (
+	bloomBitsPerKey = 128
+	bloomMinBits    = 1 << 20
+	bloomProbes     = 3
+)
+
+// prefilter screens reads before the matcher: a read containing a sanket
+// contains its first k bases, so a read sharing none of the sankets' first
+// k-mers is unmatched without looking any further. The k-mers are kept in a
+// Bloom filter, which can only err towards letting a read through, so the
+// prefilter never changes what is found. In samples that are mostly host
+// reads most reads stop here. Those that don't are matched from where the
+// first sanket could start on.
+type prefilter struct {
+	next matcher
+	k    int      // the k-mer length: the shortest sanket's, at most 32
+	bits []uint64 // the Bloom filter, a power of two bits long
+	mask uint64   // selects a bit of bits
+}
+
+// newPrefilter puts a prefilter of the panel's sankets in front of m, or
+// returns m when the panel can't be screened: it has an empty sanket, which
+// every read contains, or one with bases other than ACGT
+func newPrefilter(idx *sanketIndex, m matcher) matcher {
+	k := 32
+	for _, info := range idx.Sankets {
+		k = min(k, len(info.Sanket))
+	}
+	if k == 0 || len(idx.Sankets) == 0 {
+		return m
+	}
+	size := max(bloomMinBits, 1<<bits.Len(uint(len(idx.Sankets)*bloomBitsPerKey-1)))
+	p := &prefilter{next: m, k: k, bits: make([]uint64, size/64), mask: uint64(size - 1)}
+	for _, info := range idx.Sankets {
+		kmer, ok := encodeKmer([]byte(info.Sanket[:k]))
+		if !ok {
+			return m
+		}
+		h1, h2 := kmerHashes(kmer)
+		for i := uint64(0); i < bloomProbes; i++ {
+			bit := (h1 + i*h2) & p.mask
+			p.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	return p
+}
+
+// baseCodes maps A, C, G and T to 0-3 and every other byte to 4
+var baseCodes = func() (codes [256]uint8) {
+	for i := range codes {
+		codes[i] = 4
+	}
+	codes['A'], codes['C'], codes['G'], codes['T'] = 0, 1, 2, 3
+	return codes
+}()
+
+// encodeKmer packs up to 32 bases two bits each, and reports whether they
+// were all A, C, G or T
+func encodeKmer(seq []byte) (uint64, bool) {
+	var kmer uint64
+	for _, b := range seq {
+		code := baseCodes[b]
+		if code > 3 {
+			return 0, false
+		}
+		kmer = kmer<<2 | uint64(code)
+	}
+	return kmer, true
+}
+
+// kmerHashes derives the Bloom filter's two hashes of a k-mer, from which
+// its probes are made
+func kmerHashes(kmer uint64) (uint64, uint64) {
+	// splitmix64's finalizer
+	h := kmer + 0x9e3779b97f4a7c15
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	h ^= h >> 31
+	return h, h>>32 | 1 // odd, so the probes differ
+}
+
+// firstCandidate returns where the first k-mer of seq the filter might hold
+// starts, or -1 if it holds none. No sanket starts before it. Sankets are
+// upper case, so a window with any other byte can't hold one.
+func (p *prefilter) firstCandidate(seq []byte) int {
+	var kmer uint64
+	kmerMask := uint64(1)<<(2*p.k) - 1
+	if p.k == 32 {
+		kmerMask = ^uint64(0)
+	}
+	valid := 0 // bases of the window so far since the last other byte
+	for i, b := range seq {
+		code := baseCodes[b]
+		if code > 3 {
+			valid = 0
+			continue
+		}
+		kmer = (kmer<<2 | uint64(code)) & kmerMask
+		if valid++; valid < p.k {
+			continue
+		}
+		h1, h2 := kmerHashes(kmer)
+		found := true
+		for i := uint64(0); i < bloomProbes && found; i++ {
+			bit := (h1 + i*h2) & p.mask
+			found = p.bits[bit/64]&(1<<(bit%64)) != 0
+		}
+		if found {
+			return i - p.k + 1
+		}
+	}
+	return -1
+}
+
+func (p *prefilter) Match(seq []byte) []*SanketInfo {
+	start := p.firstCandidate(seq)
+	if start < 0 {
+		return nil
+	}
+	return p.next.Match(seq[start:])
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// prefixMaxK caps how many first bases prefixMatcher buckets sankets by: its
+// bucket table has 4^k entries, 4 MB at 10
+const prefixMaxK = 10
+
+// prefixMatcher buckets the sankets by their first k bases, k being the
+// shortest sanket's length up to prefixMaxK. At each position of a read the
+// k bases from there pick a bucket, and only the few sankets in it are
+// compared with the read, rather than every sanket as scanMatcher does.
+// Unlike kmer it hashes no windows of the read, and one lookup serves every
+// sanket length.
+type prefixMatcher struct {
+	sankets []SanketInfo
+	k       int
+	offsets []int32  // bucket b's sankets are entries[offsets[b]:offsets[b+1]]
+	entries []int32  // positions in sankets, grouped by bucket
+	seqs    [][]byte // the sankets' sequences
+	others  []int32  // sankets that can't be bucketed, empty or with other bases, searched for directly
+}
+
+func newPrefixMatcher(idx *sanketIndex) matcher {
+	m := &prefixMatcher{sankets: idx.Sankets, seqs: make([][]byte, len(idx.Sankets)), k: prefixMaxK}
+	var bucketed []int32
+	for i, info := range m.sankets {
+		m.seqs[i] = []byte(info.Sanket)
+		if info.Sanket == "" || strings.Trim(info.Sanket, "ACGT") != "" {
+			m.others = append(m.others, int32(i))
+			continue
+		}
+		bucketed = append(bucketed, int32(i))
+		m.k = min(m.k, len(info.Sanket))
+	}
+	if len(bucketed) == 0 {
+		return m
+	}
+
+	// Count the sankets of each bucket, then place them after the buckets
+	// before theirs
+	buckets := make([]uint32, len(bucketed))
+	m.offsets = make([]int32, 1<<(2*m.k)+1)
+	for j, i := range bucketed {
+		kmer, _ := encodeKmer(m.seqs[i][:m.k])
+		buckets[j] = uint32(kmer)
+		m.offsets[kmer+1]++
+	}
+	for b := 1; b < len(m.offsets); b++ {
+		m.offsets[b] += m.offsets[b-1]
+	}
+	m.entries = make([]int32, len(bucketed))
+	next := append([]int32(nil), m.offsets[:len(m.offsets)-1]...)
+	for j, i := range bucketed {
+		m.entries[next[buckets[j]]] = i
+		next[buckets[j]]++
+	}
+	return m
+}
+
+func (m *prefixMatcher) Match(seq []byte) []*SanketInfo {
+	var hits []int32
+	for _, i := range m.others {
+		if bytes.Contains(seq, m.seqs[i]) {
+			hits = append(hits, i)
+		}
+	}
+	if m.entries != nil {
+		var kmer uint32
+		mask := uint32(1)<<(2*m.k) - 1
+		valid := 0 // bases of the window so far since the last other byte
+		for i, b := range seq {
+			code := baseCodes[b]
+			if code > 3 {
+				valid = 0
+				continue
+			}
+			kmer = (kmer<<2 | uint32(code)) & mask
+			if valid++; valid < m.k {
+				continue
+			}
+			start := i - m.k + 1
+			for _, s := range m.entries[m.offsets[kmer]:m.offsets[kmer+1]] {
+				if bytes.HasPrefix(seq[start:], m.seqs[s]) {
+					hits = append(hits, s)
+				}
+			}
+		}
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i] < hits[j] })
+	found := make([]*SanketInfo, 0, len(hits))
+	for i, hit := range hits {
+		if i == 0 || hit != hits[i-1] { // a sanket found more than once
+			found = append(found, &m.sankets[hit])
+		}
+	}
+	return found
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling writes a CPU profile to cpuPath while the run lasts and a
+// heap profile to memPath at the end; either may be empty. Call stop before
+// exiting.
+func startProfiling(cpuPath, memPath string) (stop func(), err error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		if cpuFile, err = os.Create(cpuPath); err != nil {
+			return nil, fmt.Errorf("can't create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("can't start CPU profile: %w", err)
+		}
+	}
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+			slog.Info("wrote CPU profile", "path", cpuPath)
+		}
+		if memPath != "" {
+			if err := writeHeapProfile(memPath); err != nil {
+				slog.Error("can't write heap profile", "error", err)
+				return
+			}
+			slog.Info("wrote heap profile", "path", memPath)
+		}
+	}, nil
+}
+
+func writeHeapProfile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	runtime.GC() // up-to-date allocation statistics
+	return pprof.WriteHeapProfile(file)
+}
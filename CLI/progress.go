@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/cheggaaa/pb/v3/termutil"
+	"github.com/mattn/go-isatty"
+)
+
+// progressLogInterval is how often progress is logged when stderr isn't a
+// terminal, where redrawn bars would fill the log with control characters
+const progressLogInterval = 30 * time.Second
+
+// progressRefresh is how often progress bars are redrawn
+const progressRefresh = 200 * time.Millisecond
+
+// overallTemplate draws the bar counting a run's finished files
+const overallTemplate pb.ProgressBarTemplate = `{{string . "prefix"}} {{counters . }} {{bar . }} {{percent . }} {{etime . }}`
+
+// fileTemplate draws a file's bar: its reads, and "rates", filled in as the
+// bar is drawn, their rate and the time left at it
+const fileTemplate pb.ProgressBarTemplate = `{{string . "prefix"}} {{counters . }} {{bar . }} {{percent . }} {{string . "rates"}}`
+
+// terminal is stderr as shared by logs and progress bars: a log line written
+// while bars are drawn erases them, and they are drawn again below it
+var terminal = &terminalWriter{w: os.Stderr}
+
+type terminalWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	lines int // lines of progress bars below the cursor
+}
+
+func (t *terminalWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.erase()
+	return t.w.Write(p)
+}
+
+// erase clears the bars drawn last; callers hold mu
+func (t *terminalWriter) erase() {
+	if t.lines > 0 {
+		fmt.Fprintf(t.w, "\033[%dA\r\033[J", t.lines)
+		t.lines = 0
+	}
+}
+
+// drawBars replaces the bars drawn last with lines
+func (t *terminalWriter) drawBars(lines []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.erase()
+	for _, line := range lines {
+		fmt.Fprintf(t.w, "\r%s\033[K\n", line)
+	}
+	t.lines = len(lines)
+}
+
+// keepBars leaves the bars drawn last on screen for good
+func (t *terminalWriter) keepBars() {
+	t.mu.Lock()
+	t.lines = 0
+	t.mu.Unlock()
+}
+
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// progress follows the reads of one file as they are classified: Read
+// counts one of bases bases, and whether it matched a sanket
+type progress interface {
+	Read(bases int, matched bool)
+	Finish()
+}
+
+// fileRates is how fast a file is being classified, for operators to tell a
+// slow run from a stuck one
+type fileRates struct {
+	reads, bases, matched atomic.Int64
+	start                 time.Time
+}
+
+func (r *fileRates) read(bases int, matched bool) {
+	r.reads.Add(1)
+	r.bases.Add(int64(bases))
+	if matched {
+		r.matched.Add(1)
+	}
+}
+
+// snapshot returns the reads and megabases classified per second so far,
+// and the share of the reads that matched
+func (r *fileRates) snapshot() (readsPerSec, mbasesPerSec, matched float64) {
+	reads := r.reads.Load()
+	if elapsed := time.Since(r.start).Seconds(); elapsed > 0 {
+		readsPerSec, mbasesPerSec = float64(reads)/elapsed, float64(r.bases.Load())/1e6/elapsed
+	}
+	if reads > 0 {
+		matched = float64(r.matched.Load()) / float64(reads)
+	}
+	return readsPerSec, mbasesPerSec, matched
+}
+
+// eta returns how long the rest of total reads will take at the rate so far
+func (r *fileRates) eta(total int64) time.Duration {
+	reads := r.reads.Load()
+	if reads == 0 || total <= reads {
+		return 0
+	}
+	return time.Duration(float64(time.Since(r.start)) / float64(reads) * float64(total-reads)).Round(time.Second)
+}
+
+// progressDisplay shows how far a run's files have got. On a terminal it
+// draws a bar per file being classified above an overall bar counting the
+// finished files; elsewhere each file's progress is logged every
+// progressLogInterval. Progress is info-level, so -quiet hides it, as does
+// -no-progress.
+type progressDisplay struct {
+	mu      sync.Mutex
+	bars    []*fileBar      // files being classified
+	overall *pb.ProgressBar // nil unless bars are drawn
+	logged  bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newProgressDisplay starts showing the progress of a run of files
+func newProgressDisplay(files int, enabled bool) *progressDisplay {
+	d := &progressDisplay{}
+	if !enabled || !slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+		return d
+	}
+	if !isTerminal(os.Stderr) {
+		d.logged = true
+		return d
+	}
+	d.overall = overallTemplate.New(files).Set("prefix", "files").Set(pb.Static, true).Start()
+	d.done, d.stopped = make(chan struct{}), make(chan struct{})
+	go d.refresh()
+	return d
+}
+
+// file starts following a file of total reads, named name on its bar. The
+// total may be an estimate; a file running past it grows it.
+func (d *progressDisplay) file(path, name string, total int) progress {
+	switch {
+	case d.overall != nil:
+		bar := &fileBar{display: d, bar: fileTemplate.New(total).Set("prefix", name).Set(pb.Static, true).Start()}
+		bar.start = time.Now()
+		d.mu.Lock()
+		d.bars = append(d.bars, bar)
+		d.mu.Unlock()
+		return bar
+	case d.logged:
+		p := &loggedProgress{file: path, total: total, done: make(chan struct{})}
+		p.start = time.Now()
+		go p.log()
+		return p
+	default:
+		return noProgress{}
+	}
+}
+
+// fileDone counts a file as finished, classified or not
+func (d *progressDisplay) fileDone() {
+	if d.overall != nil {
+		d.overall.Increment()
+	}
+}
+
+// Stop draws the bars a last time and leaves them on screen
+func (d *progressDisplay) Stop() {
+	if d.overall == nil {
+		return
+	}
+	close(d.done)
+	<-d.stopped
+	terminal.keepBars()
+}
+
+func (d *progressDisplay) refresh() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(progressRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			d.draw()
+			return
+		case <-ticker.C:
+			d.draw()
+		}
+	}
+}
+
+func (d *progressDisplay) draw() {
+	d.mu.Lock()
+	bars := make([]*pb.ProgressBar, 0, len(d.bars)+1)
+	for _, file := range d.bars {
+		readsPerSec, mbasesPerSec, matched := file.snapshot()
+		file.bar.Set("rates", fmt.Sprintf("%.0f reads/s %.1f Mb/s %.0f%% matched ETA %s", readsPerSec, mbasesPerSec, matched*100, file.eta(file.bar.Total())))
+		bars = append(bars, file.bar)
+	}
+	bars = append(bars, d.overall)
+	d.mu.Unlock()
+	width, err := termutil.TerminalWidth()
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	lines := make([]string, len(bars))
+	for i, bar := range bars {
+		bar.SetWidth(width - 1) // a full line would wrap on some terminals
+		lines[i] = strings.TrimRight(bar.String(), " ")
+	}
+	terminal.drawBars(lines)
+}
+
+// fileBar is a file's bar in a progressDisplay, removed once it finishes
+type fileBar struct {
+	fileRates
+	display *progressDisplay
+	bar     *pb.ProgressBar
+	once    sync.Once
+}
+
+func (p *fileBar) Read(bases int, matched bool) {
+	p.read(bases, matched)
+	if p.bar.Current() >= p.bar.Total() {
+		p.bar.SetTotal(p.bar.Current() + 1)
+	}
+	p.bar.Increment()
+}
+
+func (p *fileBar) Finish() {
+	p.once.Do(func() {
+		p.bar.Finish()
+		d := p.display
+		d.mu.Lock()
+		for i, bar := range d.bars {
+			if bar == p {
+				d.bars = append(d.bars[:i], d.bars[i+1:]...)
+				break
+			}
+		}
+		d.mu.Unlock()
+	})
+}
+
+type noProgress struct{}
+
+func (noProgress) Read(int, bool) {}
+func (noProgress) Finish()        {}
+
+// loggedProgress logs how far a file has got at intervals
+type loggedProgress struct {
+	fileRates
+	file  string
+	total int
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (p *loggedProgress) Read(bases int, matched bool) {
+	p.read(bases, matched)
+}
+
+func (p *loggedProgress) Finish() {
+	p.once.Do(func() { close(p.done) })
+}
+
+func (p *loggedProgress) log() {
+	ticker := time.NewTicker(progressLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			reads := p.reads.Load()
+			total := max(int64(p.total), reads) // the total may be an estimate
+			percent := 0.0
+			if total > 0 {
+				percent = float64(reads) / float64(total) * 100
+			}
+			readsPerSec, mbasesPerSec, matched := p.snapshot()
+			slog.Info("progress", "file", p.file, "reads", reads, "total_reads", total, "percent", int(percent), "elapsed", time.Since(p.start).Round(time.Second),
+				"reads_per_second", int(readsPerSec), "mbases_per_second", fmt.Sprintf("%.1f", mbasesPerSec), "matched", fmt.Sprintf("%.3f", matched), "eta", p.eta(total))
+		}
+	}
+}
@@ -0,0 +1,45 @@
+#!/bin/sh
+# Builds the release files self-update installs: bhedi-cli for each platform,
+# checksums.txt listing their SHA-256s, and checksums.txt.sig, the list's
+# Ed25519 signature. The binaries carry the public half of the signing key,
+# so later releases must be signed with the same key.
+#
+# Usage: BHEDI_RELEASE_KEY=/path/to/release.pem ./release.sh v1.2.3 [dir]
+#
+# BHEDI_RELEASE_KEY is the PEM Ed25519 private key the maintainers keep
+# outside the repository, made once with
+#   openssl genpkey -algorithm ed25519 -out release.pem
+# The files go to dir, dist by default; upload them all to the GitHub
+# release tagged with the version.
+set -eu
+
+version=${1:?usage: BHEDI_RELEASE_KEY=release.pem $0 <version> [dir]}
+dist=${2:-dist}
+key=${BHEDI_RELEASE_KEY:?set BHEDI_RELEASE_KEY to the release signing key}
+platforms=${BHEDI_PLATFORMS:-"linux/amd64 linux/arm64 darwin/amd64 darwin/arm64 windows/amd64"}
+
+cd "$(dirname "$0")"
+# The raw public key is the last 32 bytes of its DER encoding
+public=$(openssl pkey -in "$key" -pubout -outform DER | tail -c 32 | base64)
+commit=$(git rev-parse --short HEAD)
+date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+
+mkdir -p "$dist"
+for platform in $platforms; do
+	os=${platform%/*}
+	arch=${platform#*/}
+	name=bhedi-cli_${os}_${arch}
+	[ "$os" = windows ] && name=$name.exe
+	echo "building $name"
+	CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -trimpath -o "$dist/$name" -ldflags "\
+-X main.version=$version -X main.commit=$commit -X main.buildDate=$date \
+-X main.releaseKey=$public" .
+done
+
+cd "$dist"
+sha256sum bhedi-cli_* >checksums.txt
+openssl pkeyutl -sign -rawin -inkey "$key" -in checksums.txt -out checksums.txt.sig
+openssl pkey -in "$key" -pubout -out release.pub.pem
+openssl pkeyutl -verify -rawin -pubin -inkey release.pub.pem -in checksums.txt -sigfile checksums.txt.sig >/dev/null
+rm release.pub.pem
+echo "signed checksums.txt with release key $public"
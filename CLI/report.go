@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// unassignedSerotype marks the rows of reads without a match
+const unassignedSerotype = "Unassigned"
+
+// sampleTally counts the reads of one sample. Reads are kept as hashes of
+// their IDs, since with -partition-by serotype one read's rows are spread
+// over several files.
+type sampleTally struct {
+	reads       map[uint64]struct{}
+	matched     map[uint64]float64 // best BScore of each read with a match
+	perSerotype map[string]*serotypeTally
+	calls       map[string]readCall // by read ID; only kept for diff
+}
+
+// readCall is the serotype of a read's best match and its BScore, or
+// Unassigned and 0 for a read without a match
+type readCall struct {
+	serotype string
+	bscore   float64
+}
+
+// serotypeTally counts the matches of one serotype
+type serotypeTally struct {
+	reads       map[uint64]struct{} // reads with at least one match of the serotype
+	matches     int
+	bscoreTotal float64
+}
+
+func newSampleTally() *sampleTally {
+	return &sampleTally{reads: make(map[uint64]struct{}), matched: make(map[uint64]float64), perSerotype: make(map[string]*serotypeTally)}
+}
+
+func readHash(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()
+}
+
+// add counts one row
+func (t *sampleTally) add(row resultRecord) {
+	id := readHash(row.ReadID)
+	t.reads[id] = struct{}{}
+	if t.calls != nil {
+		call, ok := t.calls[row.ReadID]
+		// Matches beat Unassigned rows, then the best BScore wins, ties going
+		// to the first serotype by name
+		better := !ok || call.serotype == unassignedSerotype ||
+			row.Serotype != unassignedSerotype && (row.BScore > call.bscore || row.BScore == call.bscore && row.Serotype < call.serotype)
+		if better {
+			t.calls[row.ReadID] = readCall{row.Serotype, row.BScore}
+		}
+	}
+	if row.Serotype == unassignedSerotype {
+		return
+	}
+	if best, ok := t.matched[id]; !ok || row.BScore > best {
+		t.matched[id] = row.BScore
+	}
+	s, ok := t.perSerotype[row.Serotype]
+	if !ok {
+		s = &serotypeTally{reads: make(map[uint64]struct{})}
+		t.perSerotype[row.Serotype] = s
+	}
+	s.reads[id] = struct{}{}
+	s.matches++
+	s.bscoreTotal += row.BScore
+}
+
+// sampleTallies are the tallies of a report's samples, in the order first seen
+type sampleTallies struct {
+	bySample  map[string]*sampleTally
+	samples   []string
+	info      map[string]sampleInfo // metadata run recorded for the samples
+	keepCalls bool                  // keep every read's call, as diff needs
+}
+
+// tally returns the sample's tally, starting it if need be
+func (ts *sampleTallies) tally(sample string) *sampleTally {
+	t, ok := ts.bySample[sample]
+	if !ok {
+		t = newSampleTally()
+		if ts.keepCalls {
+			t.calls = make(map[string]readCall)
+		}
+		ts.bySample[sample] = t
+		ts.samples = append(ts.samples, sample)
+	}
+	return t
+}
+
+// addFile counts the rows of one result file under its sample, or under each
+// row's own sample in files made by merge. Hive partition directories stand
+// in for the columns they replace, e.g. serotype=3.
+func (ts *sampleTallies) addFile(results resultReader, path string) error {
+	partitions := resultPartitions(path)
+	sample := resultSample(path, partitions)
+	if metadata, err := resultMetadata(path); err == nil {
+		if info := sampleInfoOf(metadata); info.Name == sample {
+			if _, ok := ts.info[sample]; !ok {
+				ts.info[sample] = info
+			}
+		}
+	}
+	for {
+		row, err := results.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if row.Serotype == "" {
+			row.Serotype = partitions["serotype"]
+		}
+		if row.Sample != "" {
+			ts.tally(row.Sample).add(row)
+		} else {
+			ts.tally(sample).add(row)
+		}
+	}
+}
+
+// loadTallies tallies the result files found in args
+func loadTallies(args []string, keepCalls bool) (*sampleTallies, error) {
+	files, err := resultFiles(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, usagef("no result files in %s", strings.Join(args, ", "))
+	}
+	tallies := &sampleTallies{bySample: make(map[string]*sampleTally), info: make(map[string]sampleInfo), keepCalls: keepCalls}
+	for _, path := range files {
+		results, err := openResults(path)
+		if err != nil {
+			return nil, err
+		}
+		err = tallies.addFile(results, path)
+		results.Close()
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", path, err)
+		}
+	}
+	return tallies, nil
+}
+
+// serotypes lists the serotypes found, most reads first
+func (t *sampleTally) serotypes() []string {
+	names := make([]string, 0, len(t.perSerotype))
+	for name := range t.perSerotype {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if a, b := len(t.perSerotype[names[i]].reads), len(t.perSerotype[names[j]].reads); a != b {
+			return a > b
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// SerotypeReport is what report found of one serotype in a sample
+type SerotypeReport struct {
+	Serotype   string  `json:"serotype"`
+	Reads      int     `json:"reads"`   // reads with at least one sanket of this serotype
+	Matches    int     `json:"matches"` // sanket hits, a read can hit several
+	MeanBScore float64 `json:"mean_b_score"`
+}
+
+// HistogramBin counts the reads with a best BScore in [From, To)
+type HistogramBin struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Reads int     `json:"reads"`
+}
+
+// BScoreDistribution describes the best BScore of each matched read
+type BScoreDistribution struct {
+	Mean      float64        `json:"mean"`
+	P10       float64        `json:"p10"`
+	Median    float64        `json:"median"`
+	P90       float64        `json:"p90"`
+	Max       float64        `json:"max"`
+	Histogram []HistogramBin `json:"histogram"` // bins of 0.1 from 0 to 1; scores outside count in the end bins
+}
+
+// SampleReport is report's summary of one sample, in the shape of the API's
+// job summary
+type SampleReport struct {
+	Sample         string             `json:"sample"`
+	CollectionDate string             `json:"collection_date,omitempty"` // from the sample sheet of the run
+	Location       string             `json:"location,omitempty"`
+	Tags           []string           `json:"tags,omitempty"`
+	Reads          int                `json:"reads"`
+	MatchedReads   int                `json:"matched_reads"`
+	MatchRate      float64            `json:"match_rate"`
+	Call           string             `json:"call,omitempty"` // serotype with the most reads
+	Serotypes      []SerotypeReport   `json:"serotypes"`
+	BScore         BScoreDistribution `json:"b_score"`
+}
+
+// histogramBins is how many bins the BScore histogram splits 0 to 1 into
+const histogramBins = 10
+
+// report summarizes the tally
+func (t *sampleTally) report(sample string) SampleReport {
+	r := SampleReport{Sample: sample, Reads: len(t.reads), MatchedReads: len(t.matched), Serotypes: []SerotypeReport{}}
+	if r.Reads > 0 {
+		r.MatchRate = float64(r.MatchedReads) / float64(r.Reads)
+	}
+	for i, name := range t.serotypes() {
+		if i == 0 {
+			r.Call = name
+		}
+		s := t.perSerotype[name]
+		r.Serotypes = append(r.Serotypes, SerotypeReport{Serotype: name, Reads: len(s.reads), Matches: s.matches, MeanBScore: s.bscoreTotal / float64(s.matches)})
+	}
+
+	scores := make([]float64, 0, len(t.matched))
+	for _, score := range t.matched {
+		scores = append(scores, score)
+	}
+	sort.Float64s(scores)
+	r.BScore.Histogram = make([]HistogramBin, histogramBins)
+	for i := range r.BScore.Histogram {
+		r.BScore.Histogram[i] = HistogramBin{From: float64(i) / histogramBins, To: float64(i+1) / histogramBins}
+	}
+	if len(scores) == 0 {
+		return r
+	}
+	total := 0.0
+	for _, score := range scores {
+		total += score
+		bin := min(max(int(score*histogramBins), 0), histogramBins-1)
+		r.BScore.Histogram[bin].Reads++
+	}
+	r.BScore.Mean = total / float64(len(scores))
+	r.BScore.P10, r.BScore.Median, r.BScore.P90 = quantile(scores, 0.1), quantile(scores, 0.5), quantile(scores, 0.9)
+	r.BScore.Max = scores[len(scores)-1]
+	return r
+}
+
+// orDash stands in "-" for an empty table cell
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quantile returns the q-quantile of sorted values, by the nearest rank
+func quantile(sorted []float64, q float64) float64 {
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// resultPartitions returns the Hive partitions in a result file's path, e.g.
+// sample=S1 and serotype=3 for <dir>/sample=S1/serotype=3/part-000.parquet
+func resultPartitions(path string) map[string]string {
+	partitions := make(map[string]string)
+	for _, part := range strings.Split(filepath.ToSlash(filepath.Dir(path)), "/") {
+		if key, value, ok := strings.Cut(part, "="); ok {
+			partitions[key] = value
+		}
+	}
+	return partitions
+}
+
+// resultSample names the sample a result file belongs to: its sample=
+// partition, the sample run recorded in its metadata, or else its file name
+func resultSample(path string, partitions map[string]string) string {
+	if sample, ok := partitions["sample"]; ok {
+		return sample
+	}
+	if metadata, err := resultMetadata(path); err == nil && metadata[sampleNameKey] != "" {
+		return metadata[sampleNameKey]
+	}
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// resultFiles expands the arguments into result files, walking directories
+func resultFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		err := filepath.WalkDir(arg, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && d.Name() == partialDir {
+				return filepath.SkipDir // results of files still being classified
+			}
+			if path == arg && !d.IsDir() {
+				files = append(files, path) // named explicitly, so openResults judges it
+			} else if !d.IsDir() && resultExtensions[filepath.Ext(path)] {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// reportFlags sets up the report command: per sample, the reads, how many
+// matched, the serotype with the most reads, the reads of each serotype and
+// the distribution of BScores, read back from result files of any format
+func reportFlags(fs *flag.FlagSet) func(args []string) error {
+	asJSON := fs.Bool("json", false, "Print the summary as JSON, with each serotype's matches and mean BScore and a BScore histogram")
+
+	return func(args []string) error {
+		if len(args) == 0 {
+			return usagef("no result files given")
+		}
+		tallies, err := loadTallies(args, false)
+		if err != nil {
+			return err
+		}
+		reports := make([]SampleReport, len(tallies.samples))
+		withInfo := false
+		for i, sample := range tallies.samples {
+			reports[i] = tallies.bySample[sample].report(sample)
+			info := tallies.info[sample]
+			reports[i].CollectionDate, reports[i].Location, reports[i].Tags = info.CollectionDate, info.Location, info.Tags
+			withInfo = withInfo || info.CollectionDate != "" || info.Location != ""
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(reports)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		header := "sample\treads\tmatched\tmatch_rate\tcall\tb_score_p10/p50/p90\tserotype_reads"
+		if withInfo {
+			header = "sample\tcollection_date\tlocation\treads\tmatched\tmatch_rate\tcall\tb_score_p10/p50/p90\tserotype_reads"
+		}
+		fmt.Fprintln(w, header)
+		for _, r := range reports {
+			call, counts := r.Call, make([]string, len(r.Serotypes))
+			if call == "" {
+				call = "-"
+			}
+			for i, s := range r.Serotypes {
+				counts[i] = fmt.Sprintf("%s:%d", s.Serotype, s.Reads)
+			}
+			bscore := "-"
+			if r.MatchedReads > 0 {
+				bscore = fmt.Sprintf("%.2f/%.2f/%.2f", r.BScore.P10, r.BScore.Median, r.BScore.P90)
+			}
+			sample := r.Sample
+			if withInfo {
+				sample += "\t" + orDash(r.CollectionDate) + "\t" + orDash(r.Location)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.3f\t%s\t%s\t%s\n", sample, r.Reads, r.MatchedReads, r.MatchRate, call, bscore, strings.Join(counts, " "))
+		}
+		return w.Flush()
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"bhedi/output"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	_ "modernc.org/sqlite"
+)
+
+// resultReader reads a result file back as flat rows, whatever format and
+// schema run wrote it in. Columns left out with -columns stay zero.
+type resultReader interface {
+	Read() (resultRecord, error) // io.EOF after the last row
+	Close() error
+}
+
+// resultRecord is a flat row read back from a result file. Only files made
+// by merge have a sample column; Sample is empty for the others.
+type resultRecord struct {
+	output.Record
+	Sample string
+}
+
+// resultExtensions are the file extensions openResults reads
+var resultExtensions = map[string]bool{".parquet": true, ".csv": true, ".jsonl": true, ".sqlite": true}
+
+// openResults opens a result file by its extension
+func openResults(path string) (resultReader, error) {
+	switch filepath.Ext(path) {
+	case ".parquet":
+		return openParquetResults(path)
+	case ".csv":
+		return openCSVResults(path)
+	case ".jsonl":
+		return openJSONResults(path)
+	case ".sqlite":
+		return openSQLiteResults(path)
+	}
+	return nil, fmt.Errorf("%s isn't a result file (expected .parquet, .csv, .jsonl or .sqlite)", path)
+}
+
+// resultMetadata returns the key-value metadata run wrote into a Parquet
+// footer or SQLite metadata table; other formats have none
+func resultMetadata(path string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	switch filepath.Ext(path) {
+	case ".parquet":
+		r, err := openParquetResults(path)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, kv := range r.pr.Footer.KeyValueMetadata {
+			if kv.Value != nil {
+				metadata[kv.Key] = *kv.Value
+			}
+		}
+	case ".sqlite":
+		db, err := sql.Open("sqlite", path)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		var tables int
+		if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'metadata'").Scan(&tables); err != nil || tables == 0 {
+			return metadata, err
+		}
+		rows, err := db.Query("SELECT key, value FROM metadata")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key, value string
+			if err := rows.Scan(&key, &value); err != nil {
+				return nil, err
+			}
+			metadata[key] = value
+		}
+		return metadata, rows.Err()
+	}
+	return metadata, nil
+}
+
+// resultRow decodes a flat or a nested row; nested rows carry matches
+type resultRow struct {
+	output.Record
+	Sample       string               `json:"sample"`
+	MatchesFound *bool                `json:"matches_found"`
+	Matches      []output.NestedMatch `json:"matches"`
+}
+
+// flatRows returns the flat rows of a decoded row, expanding nested ones the
+// way run would have written them with the flat schema
+func (row resultRow) flatRows() []resultRecord {
+	if row.MatchesFound == nil {
+		return []resultRecord{{row.Record, row.Sample}}
+	}
+	result := output.Result{
+		ReadID:        row.ReadID,
+		GCPercentage:  row.GCPercentage,
+		TotalCoverage: int(row.TotalCoverage),
+		MatchesFound:  *row.MatchesFound,
+	}
+	for _, m := range row.Matches {
+		result.Matches = append(result.Matches, output.Match{
+			SID: m.SID, Sanket: m.MatchedSanket, Serotype: m.Serotype, SLen: int(m.SLen),
+			SSRCount: m.SSRCount, MLenAvg: m.MLenAvg, MRCAvg: m.MRCAvg, PCount: m.PCount, PLenAvg: m.PLenAvg,
+			BScore: m.BScore,
+		})
+	}
+	records := output.FlatRecords(result)
+	rows := make([]resultRecord, len(records))
+	for i, record := range records {
+		rows[i] = resultRecord{record, row.Sample}
+	}
+	return rows
+}
+
+// pendingRows hands out the flat rows of one decoded row at a time
+type pendingRows []resultRecord
+
+func (p *pendingRows) next() (resultRecord, bool) {
+	if len(*p) == 0 {
+		return resultRecord{}, false
+	}
+	row := (*p)[0]
+	*p = (*p)[1:]
+	return row, true
+}
+
+// parquetResults reads rows of any schema, going through the reader's
+// generated structs and JSON, which matches their field names to the json
+// tags of resultRow regardless of case
+type parquetResults struct {
+	file    source.ParquetFile
+	pr      *reader.ParquetReader
+	left    int64
+	batch   []interface{}
+	pending pendingRows
+}
+
+func openParquetResults(path string) (*parquetResults, error) {
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open %s: %w", path, err)
+	}
+	pr, err := reader.NewParquetReader(file, nil, 1)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can't read %s: %w", path, err)
+	}
+	return &parquetResults{file: file, pr: pr, left: pr.GetNumRows()}, nil
+}
+
+func (r *parquetResults) Read() (resultRecord, error) {
+	for {
+		if row, ok := r.pending.next(); ok {
+			return row, nil
+		}
+		if len(r.batch) == 0 {
+			if r.left == 0 {
+				return resultRecord{}, io.EOF
+			}
+			n := int(min(r.left, 1000))
+			batch, err := r.pr.ReadByNumber(n)
+			if err != nil {
+				return resultRecord{}, err
+			}
+			if len(batch) < n {
+				// parquet-go comes up short rather than failing on a corrupt page
+				return resultRecord{}, fmt.Errorf("read %d of %d rows; the file is corrupt", r.pr.GetNumRows()-r.left+int64(len(batch)), r.pr.GetNumRows())
+			}
+			r.batch, r.left = batch, r.left-int64(n)
+		}
+		data, err := json.Marshal(r.batch[0])
+		r.batch = r.batch[1:]
+		if err != nil {
+			return resultRecord{}, err
+		}
+		var row resultRow
+		if err := json.Unmarshal(data, &row); err != nil {
+			return resultRecord{}, err
+		}
+		r.pending = row.flatRows()
+	}
+}
+
+func (r *parquetResults) Close() error {
+	r.pr.ReadStop()
+	return r.file.Close()
+}
+
+// jsonResults reads newline-delimited JSON of either schema
+type jsonResults struct {
+	file    *os.File
+	dec     *json.Decoder
+	pending pendingRows
+}
+
+func openJSONResults(path string) (*jsonResults, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonResults{file: file, dec: json.NewDecoder(bufio.NewReader(file))}, nil
+}
+
+func (r *jsonResults) Read() (resultRecord, error) {
+	for {
+		if row, ok := r.pending.next(); ok {
+			return row, nil
+		}
+		var row resultRow
+		if err := r.dec.Decode(&row); err != nil {
+			return resultRecord{}, err
+		}
+		r.pending = row.flatRows()
+	}
+}
+
+func (r *jsonResults) Close() error {
+	return r.file.Close()
+}
+
+// setColumn sets a flat column from its text form; empty values stay zero
+func setColumn(r *resultRecord, name, value string) error {
+	if value == "" {
+		return nil
+	}
+	var err error
+	parseInt32 := func() int32 {
+		var n int64
+		n, err = strconv.ParseInt(value, 10, 32)
+		return int32(n)
+	}
+	parseFloat := func() float64 {
+		var f float64
+		f, err = strconv.ParseFloat(value, 64)
+		return f
+	}
+	switch name {
+	case "sample":
+		r.Sample = value
+	case "sid":
+		r.SID = value
+	case "read_id":
+		r.ReadID = value
+	case "matched_sanket":
+		r.MatchedSanket = value
+	case "serotype":
+		r.Serotype = value
+	case "gc_percentage":
+		r.GCPercentage = parseFloat()
+	case "total_coverage":
+		r.TotalCoverage = parseInt32()
+	case "s_len":
+		r.SLen = parseInt32()
+	case "ssr_count":
+		r.SSRCount = value
+	case "mlen_avg":
+		r.MLenAvg = value
+	case "mrc_avg":
+		r.MRCAvg = value
+	case "p_count":
+		r.PCount = value
+	case "plen_avg":
+		r.PLenAvg = value
+	case "b_score":
+		r.BScore = parseFloat()
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, value)
+	}
+	return nil
+}
+
+// csvResults reads flat CSV with a header line
+type csvResults struct {
+	file    *os.File
+	r       *csv.Reader
+	columns []string
+}
+
+func openCSVResults(path string) (*csvResults, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(bufio.NewReader(file))
+	columns, err := r.Read()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can't read the header of %s: %w", path, err)
+	}
+	r.ReuseRecord = true
+	return &csvResults{file: file, r: r, columns: columns}, nil
+}
+
+func (r *csvResults) Read() (resultRecord, error) {
+	var row resultRecord
+	fields, err := r.r.Read()
+	if err != nil {
+		return row, err
+	}
+	for i, name := range r.columns {
+		if err := setColumn(&row, name, fields[i]); err != nil {
+			return row, err
+		}
+	}
+	return row, nil
+}
+
+func (r *csvResults) Close() error {
+	return r.file.Close()
+}
+
+// sqliteResults reads the results table of a SQLite output
+type sqliteResults struct {
+	db      *sql.DB
+	rows    *sql.Rows
+	columns []string
+	values  []sql.NullString
+}
+
+func openSQLiteResults(path string) (*sqliteResults, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err // sql.Open would create it
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT * FROM results")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't read %s: %w", path, err)
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		db.Close()
+		return nil, err
+	}
+	return &sqliteResults{db: db, rows: rows, columns: columns, values: make([]sql.NullString, len(columns))}, nil
+}
+
+func (r *sqliteResults) Read() (resultRecord, error) {
+	var row resultRecord
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return row, err
+		}
+		return row, io.EOF
+	}
+	dest := make([]any, len(r.values))
+	for i := range r.values {
+		dest[i] = &r.values[i]
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return row, err
+	}
+	for i, name := range r.columns {
+		if err := setColumn(&row, name, r.values[i].String); err != nil {
+			return row, err
+		}
+	}
+	return row, nil
+}
+
+func (r *sqliteResults) Close() error {
+	r.rows.Close()
+	return r.db.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// runStateFile is where a run into a local directory records its progress
+const runStateFile = ".bhedi-run.json"
+
+// partialDir holds, under the output directory, the results of files still
+// being classified. They are moved into place once a file is done, so a crash
+// never leaves a truncated result that looks finished.
+const partialDir = ".bhedi-partial"
+
+// finishedFile is a FASTQ file a run classified completely
+type finishedFile struct {
+	Sample     string    `json:"sample"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	Reads      int       `json:"reads"`
+	FinishedAt time.Time `json:"finished_at"`
+	Outputs    []string  `json:"outputs,omitempty"` // result files, relative to the output directory
+}
+
+// runState records which files a run has finished, and with what settings, so
+// -resume can skip them after a crash. It is saved after every file.
+type runState struct {
+	path      string
+	outputDir string // "" for a bucket
+	mu        sync.Mutex
+
+	Settings string                  `json:"settings"` // runSettings of the run
+	Files    map[string]finishedFile `json:"files"`    // by absolute input path
+}
+
+// runSettings fingerprints what decides a run's results: the panel, the
+// BScore constants and whether it normalizes by estimates, the output options
+// and filters, the barcode sheet and the samples
+func runSettings(panel PanelInfo, opts OutputOptions, barcodes *barcodeSheet, confident *confidenceRule, estimated bool) string {
+	var sheet []barcode
+	mismatches := 0
+	if barcodes != nil {
+		sheet, mismatches = barcodes.barcodes, barcodes.mismatches
+	}
+	data, _ := json.Marshal(struct {
+		Panel       string
+		Scoring     ScoringParams
+		Format      string
+		Schema      string
+		Compression string
+		Columns     []string
+		PartitionBy []string
+		Name        string                `json:",omitempty"` // so states from before -output-name still match
+		Barcodes    []barcode             `json:",omitempty"` // and from before -barcodes
+		Mismatches  int                   `json:",omitempty"`
+		Samples     map[string]sampleInfo `json:",omitempty"` // and -sample-sheet
+		MinBScore   float64               `json:",omitempty"` // and -min-bscore
+		MatchedOnly bool                  `json:",omitempty"`
+		Estimated   bool                  `json:",omitempty"` // so states counted as with -count-first still match
+		Confident   *confidenceRule       `json:",omitempty"` // and from before -stop-when-confident
+		Trim        *qualityTrim          `json:",omitempty"` // and -trim-quality
+		Adapters    []adapter             `json:",omitempty"` // and -trim-adapters
+	}{panel.Checksum, scoring, opts.Format, opts.Schema, opts.Compression, opts.Columns, opts.PartitionBy, opts.Name, sheet, mismatches, opts.Samples, opts.MinBScore, opts.MatchedOnly, estimated, confident, trimSetting(opts.Trim), opts.Adapters.Adapters})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:12])
+}
+
+// openRunState starts the run state at path. With resume, the files an
+// earlier run with the same settings finished are kept; otherwise any earlier
+// state is replaced.
+func openRunState(path, outputDir, settings string, resume bool) (*runState, error) {
+	state := &runState{path: path, outputDir: outputDir, Settings: settings, Files: make(map[string]finishedFile)}
+	if !resume {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read the run state: %w", err)
+	}
+	var previous runState
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return nil, fmt.Errorf("invalid run state %s: %w", path, err)
+	}
+	if previous.Settings != settings {
+		return nil, fmt.Errorf("%s was written by a run with another panel, scoring or output options; run without -resume to start over", path)
+	}
+	for key, file := range previous.Files {
+		state.Files[key] = file
+	}
+	return state, nil
+}
+
+// Finished returns whether an earlier run finished the file at path, as it
+// is now
+func (s *runState) Finished(path string) (finishedFile, bool) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return finishedFile{}, false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return finishedFile{}, false
+	}
+	s.mu.Lock()
+	file, ok := s.Files[key]
+	s.mu.Unlock()
+	if !ok || file.Size != info.Size() || !file.ModTime.Equal(info.ModTime()) {
+		return finishedFile{}, false
+	}
+	return file, true
+}
+
+// Outputs returns the results the state records for the file at path
+func (s *runState) Outputs(path string) []string {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Files[key].Outputs
+}
+
+// Finish records the file at path as classified into outputs and saves the
+// state. Results an earlier run wrote for the file and this one didn't
+// replace, such as part files, are removed.
+func (s *runState) Finish(path, sample string, reads int, outputs []string) error {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.outputDir != "" {
+		for _, old := range s.Files[key].Outputs {
+			if !contains(outputs, old) {
+				os.Remove(filepath.Join(s.outputDir, old))
+			}
+		}
+	}
+	s.Files[key] = finishedFile{Sample: sample, Size: info.Size(), ModTime: info.ModTime(), Reads: reads, FinishedAt: time.Now().UTC(), Outputs: outputs}
+	return s.save()
+}
+
+// save writes the state next to its file and renames it into place, so a
+// crash while saving keeps the previous state
+func (s *runState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("can't save the run state: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("can't save the run state: %w", err)
+	}
+	return nil
+}
+
+// partFile matches the part files of partitioned output, which several
+// samples add to the same directory
+var partFile = regexp.MustCompile(`^part-\d+\.parquet$`)
+
+// publishResults moves a finished file's results from its partial directory
+// to the same place under root, returning their paths relative to root. Part
+// files take the next free part number rather than replacing one another
+// sample wrote.
+func publishResults(partial, root string) ([]string, error) {
+	var published []string
+	err := filepath.WalkDir(partial, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(partial, path)
+		if err != nil {
+			return err
+		}
+		target := rel
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(target)), 0o755); err != nil {
+			return err
+		}
+		if partFile.MatchString(entry.Name()) {
+			if target, err = linkPart(path, root, filepath.Dir(target)); err != nil {
+				return err
+			}
+			err = os.Remove(path)
+		} else {
+			err = os.Rename(path, filepath.Join(root, target))
+		}
+		published = append(published, target)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't move the results into place: %w", err)
+	}
+	return published, os.RemoveAll(partial)
+}
+
+// linkPart links path into dir under root as the first free part-NNN.parquet
+func linkPart(path, root, dir string) (string, error) {
+	for i := 0; ; i++ {
+		target := filepath.Join(dir, fmt.Sprintf("part-%03d.parquet", i))
+		err := os.Link(path, filepath.Join(root, target)) // fails rather than replacing an existing part
+		if err == nil {
+			return target, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+// runReportFile is the run report's name in the output directory or bucket
+const runReportFile = "run_report.json"
+
+// File statuses in a run report
+const (
+	FileClassified = "classified"
+	FileSkipped    = "skipped"
+	FileFailed     = "failed"
+)
+
+// fileReport is what a run did with one FASTQ file
+type fileReport struct {
+	File           string         `json:"file"`
+	Sample         string         `json:"sample"`
+	Status         string         `json:"status"`
+	Reason         string         `json:"reason,omitempty"` // why a file was skipped
+	Error          string         `json:"error,omitempty"`
+	Reads          int            `json:"reads"`
+	StoppedEarly   bool           `json:"stopped_early,omitempty"` // with -stop-when-confident, read only until the call was confident
+	Outputs        []string       `json:"outputs,omitempty"`       // result files, relative to the output directory
+	Barcodes       map[string]int `json:"barcodes,omitempty"`      // reads per barcode's sample, when demultiplexing
+	Normalization  *normalization `json:"bscore_normalization,omitempty"`
+	StartedAt      time.Time      `json:"started_at"`
+	Duration       float64        `json:"duration_seconds"`
+	ClassifyTime   float64        `json:"classify_seconds"` // reading, classifying and writing, without counting the reads
+	ReadsPerSecond float64        `json:"reads_per_second"`
+}
+
+// runTotals sums up a run report's files
+type runTotals struct {
+	Files          int     `json:"files"`
+	Classified     int     `json:"classified"`
+	Skipped        int     `json:"skipped"`
+	Failed         int     `json:"failed"`
+	Reads          int     `json:"reads"`
+	ReadsPerSecond float64 `json:"reads_per_second"` // classified reads over the run's duration
+}
+
+// runReport records how a run produced its results, so a pipeline can keep it
+// beside them: the version, panel, scoring and flags, and what became of
+// every file. It is written when the run ends, and by watch after every batch.
+type runReport struct {
+	mu   sync.Mutex
+	path string // local file, or "" to upload to the bucket
+
+	Tool       string            `json:"tool"`
+	Version    string            `json:"version"`
+	Commit     string            `json:"commit"`
+	BuildDate  string            `json:"build_date"`
+	Command    []string          `json:"command"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Duration   float64           `json:"duration_seconds"`
+	Panel      PanelInfo         `json:"panel"`
+	Scoring    ScoringParams     `json:"scoring"`
+	Parameters map[string]string `json:"parameters"` // every flag, as given or defaulted
+	Files      []fileReport      `json:"files"`
+	Samples    []sampleTotals    `json:"samples"`
+	Totals     runTotals         `json:"totals"`
+}
+
+// sampleTotals sums up the files of one sample, with its metadata from the
+// sample sheet
+type sampleTotals struct {
+	sampleInfo
+	Files int `json:"files"`
+	Reads int `json:"reads"` // classified; a demultiplexed file's are split by barcode
+}
+
+// newRunReport starts the report of a run with the flags of fs
+func newRunReport(path string, panel PanelInfo, fs *flag.FlagSet) *runReport {
+	params := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, short := flagAliases[f.Name]; !short {
+			params[f.Name] = f.Value.String()
+		}
+	})
+	release, revision, date := buildInfo()
+	return &runReport{
+		path:       path,
+		Tool:       "bhedi-cli",
+		Version:    release,
+		Commit:     revision,
+		BuildDate:  date,
+		Command:    os.Args,
+		StartedAt:  time.Now().UTC(),
+		Panel:      panel,
+		Scoring:    scoring,
+		Parameters: params,
+		Files:      []fileReport{},
+		Samples:    []sampleTotals{},
+	}
+}
+
+// add records a file's outcome
+func (rep *runReport) add(file fileReport) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.Files = append(rep.Files, file)
+}
+
+// totals sums up the files recorded so far
+func (rep *runReport) totals() runTotals {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return rep.sum()
+}
+
+// sum adds up the files; callers hold mu
+func (rep *runReport) sum() runTotals {
+	totals := runTotals{Files: len(rep.Files)}
+	for _, file := range rep.Files {
+		switch file.Status {
+		case FileClassified:
+			totals.Classified++
+			totals.Reads += file.Reads
+		case FileSkipped:
+			totals.Skipped++
+		case FileFailed:
+			totals.Failed++
+		}
+	}
+	if rep.Duration > 0 {
+		totals.ReadsPerSecond = float64(totals.Reads) / rep.Duration
+	}
+	return totals
+}
+
+// bySample sums up the files recorded so far per sample, by name; callers
+// hold mu
+func (rep *runReport) bySample(samples map[string]sampleInfo) []sampleTotals {
+	totals := make(map[string]*sampleTotals)
+	add := func(sample string, reads int) {
+		t, ok := totals[sample]
+		if !ok {
+			info, ok := samples[sample]
+			if !ok {
+				info = sampleInfo{Name: sample}
+			}
+			t = &sampleTotals{sampleInfo: info}
+			totals[sample] = t
+		}
+		t.Files++
+		t.Reads += reads
+	}
+	for _, file := range rep.Files {
+		reads := 0
+		if file.Status == FileClassified {
+			reads = file.Reads
+		}
+		if len(file.Barcodes) == 0 {
+			add(file.Sample, reads)
+			continue
+		}
+		for sample, n := range file.Barcodes {
+			add(sample, n)
+		}
+	}
+	list := make([]sampleTotals, 0, len(totals))
+	for _, t := range totals {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// writeReport brings the run report's totals up to date and writes it to its
+// file, or uploads it to the output bucket
+func (r *runner) writeReport() error {
+	rep := r.report
+	rep.mu.Lock()
+	rep.FinishedAt = time.Now().UTC()
+	rep.Duration = rep.FinishedAt.Sub(rep.StartedAt).Seconds()
+	sort.SliceStable(rep.Files, func(i, j int) bool { return rep.Files[i].File < rep.Files[j].File })
+	rep.Samples = rep.bySample(r.opts.Samples)
+	rep.Totals = rep.sum()
+	data, err := json.MarshalIndent(rep, "", "  ")
+	rep.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if r.bucket != nil && rep.path == "" {
+		if err := r.bucket.WriteAll(context.Background(), runReportFile, data, &blob.WriterOptions{ContentType: "application/json"}); err != nil {
+			return fmt.Errorf("can't upload the run report: %w", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(rep.path), 0o755); err != nil {
+		return fmt.Errorf("can't write the run report: %w", err)
+	}
+	tmp := rep.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("can't write the run report: %w", err)
+	}
+	if err := os.Rename(tmp, rep.path); err != nil {
+		return fmt.Errorf("can't write the run report: %w", err)
+	}
+	return nil
+}
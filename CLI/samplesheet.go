@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// collectionDateLayout is the accepted collection_date format, as for the API
+const collectionDateLayout = "2006-01-02"
+
+// sampleInfo describes a sample for surveillance bookkeeping, as the API's
+// sample metadata does
+type sampleInfo struct {
+	Name           string   `json:"name"`
+	CollectionDate string   `json:"collection_date,omitempty"` // YYYY-MM-DD
+	Location       string   `json:"location,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+}
+
+// metadata returns the sample's fields as result file metadata, under the
+// keys the API uses
+func (s sampleInfo) metadata() map[string]string {
+	metadata := make(map[string]string)
+	for key, value := range map[string]string{
+		sampleNameKey:                  s.Name,
+		"bhedi.sample.collection_date": s.CollectionDate,
+		"bhedi.sample.location":        s.Location,
+		"bhedi.sample.tags":            strings.Join(s.Tags, ","),
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// sampleInfoOf reads the sample fields back from result file metadata
+func sampleInfoOf(metadata map[string]string) sampleInfo {
+	return sampleInfo{
+		Name:           metadata[sampleNameKey],
+		CollectionDate: metadata["bhedi.sample.collection_date"],
+		Location:       metadata["bhedi.sample.location"],
+		Tags:           splitTags(metadata["bhedi.sample.tags"]),
+	}
+}
+
+// splitTags splits a tag list on commas and semicolons, dropping blanks and
+// repeats
+func splitTags(value string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+		if tag = strings.TrimSpace(tag); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// sampleRow is a line of a sample sheet
+type sampleRow struct {
+	line int
+	id   string // Sample_ID, which bcl2fastq starts file names with
+	name string
+	file string // absolute path, or "" when the row doesn't name a file
+}
+
+// sampleSheet maps FASTQ files or barcodes to the samples sequenced, and
+// holds each sample's metadata
+type sampleSheet struct {
+	rows     []sampleRow
+	samples  map[string]sampleInfo
+	barcodes *barcodeSheet // the rows with a barcode or index, nil if none has
+}
+
+// sampleSheetColumns maps the column names a sample sheet may use,
+// lower-cased, to the field they fill. Other columns, such as Illumina's
+// Sample_Project or Description, are ignored.
+var sampleSheetColumns = map[string]string{
+	"sample_id":       "id",
+	"sample_name":     "name",
+	"sample":          "name",
+	"file":            "file",
+	"path":            "file",
+	"fastq":           "file",
+	"barcode":         "barcode",
+	"index":           "index",
+	"sequence":        "index",
+	"index2":          "index2",
+	"collection_date": "collection_date",
+	"location":        "location",
+	"tags":            "tags",
+}
+
+// readSampleSheet reads a sample sheet: a CSV (or tab-separated) table with a
+// header line naming its columns, or an Illumina sample sheet, whose [Data]
+// section is read. Every row names a sample, by Sample_Name or else
+// Sample_ID, and maps to it a FASTQ file (file), the files bcl2fastq named
+// after its Sample_ID, a barcode directory (barcode), or the reads of an
+// index (index and index2, or an ONT barcode's sequence), optionally with
+// collection_date (YYYY-MM-DD), location and tags. Relative files are taken
+// from the sheet's directory.
+func readSampleSheet(path string, mismatches int) (*sampleSheet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the sample sheet: %w", err)
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	// An Illumina sheet keeps the samples in its [Data] section, up to the next
+	first := 0 // lines before the table
+	for i, line := range lines {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "[data]") {
+			first, lines = i+1, lines[i+1:]
+			for j, line := range lines {
+				if strings.HasPrefix(strings.TrimSpace(line), "[") {
+					lines = lines[:j]
+					break
+				}
+			}
+			break
+		}
+	}
+	r := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			if strings.Contains(line, "\t") {
+				r.Comma = '\t'
+			}
+			break
+		}
+	}
+
+	sheet := &sampleSheet{samples: make(map[string]sampleInfo)}
+	var columns map[string]int
+	barcodes := make(map[string]barcode)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read the sample sheet: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+		n := first + line
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue // Illumina pads lines with commas
+		}
+		if columns == nil {
+			columns = make(map[string]int)
+			for j, name := range record {
+				key := strings.ToLower(strings.NewReplacer(" ", "_", "-", "_").Replace(strings.TrimSpace(name)))
+				if field, ok := sampleSheetColumns[key]; ok {
+					if _, dup := columns[field]; !dup {
+						columns[field] = j
+					}
+				}
+			}
+			_, hasID := columns["id"]
+			_, hasName := columns["name"]
+			if !hasID && !hasName {
+				return nil, fmt.Errorf("the sample sheet %s has no Sample_ID or Sample_Name column", path)
+			}
+			continue
+		}
+		field := func(name string) string {
+			if j, ok := columns[name]; ok && j < len(record) {
+				return strings.TrimSpace(record[j])
+			}
+			return ""
+		}
+
+		row := sampleRow{line: n, id: field("id"), name: field("name")}
+		if row.name == "" {
+			row.name = row.id
+		}
+		if row.id == "" {
+			row.id = row.name
+		}
+		if row.name == "" {
+			return nil, fmt.Errorf("sample sheet line %d: no sample name", n)
+		}
+		if strings.ContainsAny(row.name, `/\`) || row.name == unclassifiedBarcode {
+			return nil, fmt.Errorf("sample sheet line %d: invalid sample name %q", n, row.name)
+		}
+		if row.file = field("file"); row.file != "" && !filepath.IsAbs(row.file) {
+			row.file = filepath.Join(filepath.Dir(path), row.file)
+		}
+		info := sampleInfo{Name: row.name, CollectionDate: field("collection_date"), Location: field("location"), Tags: splitTags(field("tags"))}
+		if info.CollectionDate != "" {
+			if _, err := time.Parse(collectionDateLayout, info.CollectionDate); err != nil {
+				return nil, fmt.Errorf("sample sheet line %d: invalid collection_date %q (expected YYYY-MM-DD)", n, info.CollectionDate)
+			}
+		}
+		if other, ok := sheet.samples[row.name]; ok && !reflect.DeepEqual(other, info) {
+			return nil, fmt.Errorf("sample sheet line %d: sample %s is listed again with other metadata", n, row.name)
+		}
+		sheet.samples[row.name] = info
+		sheet.rows = append(sheet.rows, row)
+
+		b := barcode{Name: field("barcode"), Sequence: strings.ToUpper(field("index")), Sample: row.name}
+		if index2 := strings.ToUpper(field("index2")); index2 != "" && b.Sequence != "" {
+			b.Sequence += "+" + index2
+		}
+		if b.Name == "" && b.Sequence == "" {
+			continue
+		}
+		if b.Name == "" {
+			b.Name = row.id
+		}
+		if strings.Trim(b.Sequence, "ACGTN+") != "" {
+			return nil, fmt.Errorf("sample sheet line %d: %s is not a DNA sequence", n, b.Sequence)
+		}
+		if other, ok := barcodes[b.Name]; ok {
+			if other != b {
+				return nil, fmt.Errorf("sample sheet line %d: barcode %s is given twice", n, b.Name)
+			}
+			continue // the same sample on another lane
+		}
+		barcodes[b.Name] = b
+		if sheet.barcodes == nil {
+			sheet.barcodes = &barcodeSheet{mismatches: mismatches}
+		}
+		sheet.barcodes.barcodes = append(sheet.barcodes.barcodes, b)
+	}
+	if len(sheet.rows) == 0 {
+		return nil, fmt.Errorf("the sample sheet %s lists no samples", path)
+	}
+	return sheet, nil
+}
+
+// files returns the FASTQ files the sheet names, for a run without -i
+func (s *sampleSheet) files() ([]inputFile, error) {
+	var inputs []inputFile
+	seen := make(map[string]bool)
+	for _, row := range s.rows {
+		if row.file == "" || seen[row.file] {
+			continue
+		}
+		seen[row.file] = true
+		inputs = append(inputs, inputFile{Path: row.file, Sample: row.name, Name: sampleName(row.file)})
+	}
+	if len(inputs) == 0 {
+		return nil, usagef("the sample sheet names no files; give the FASTQ files with -i")
+	}
+	return nameBySample(inputs), nil
+}
+
+// rowOf returns the row naming input: by its path, its file name, or, for
+// rows without a file, the Sample_ID the file is named after as is or as
+// bcl2fastq names it, e.g. S1_S1_L001_R1_001.fastq.gz
+func (s *sampleSheet) rowOf(input inputFile) (sampleRow, bool) {
+	name := sampleName(input.Path)
+	for _, row := range s.rows {
+		switch {
+		case row.file != "":
+			if abs, err := filepath.Abs(input.Path); err == nil && abs == row.file || filepath.Base(input.Path) == filepath.Base(row.file) {
+				return row, true
+			}
+		case name == row.id || name == row.name || strings.HasPrefix(name, row.id+"_S"):
+			return row, true
+		}
+	}
+	return sampleRow{}, false
+}
+
+// assign names the samples of the inputs the sheet lists, and returns the
+// others apart
+func (s *sampleSheet) assign(inputs []inputFile) (listed, unlisted []inputFile) {
+	for _, input := range inputs {
+		row, ok := s.rowOf(input)
+		if !ok {
+			unlisted = append(unlisted, input)
+			continue
+		}
+		input.Sample = row.name
+		listed = append(listed, input)
+	}
+	return nameBySample(listed), unlisted
+}
+
+// unused returns the lines of the rows naming no input, but for rows of
+// barcodes, whose reads are found in the files
+func (s *sampleSheet) unused(inputs []inputFile) []int {
+	used := make(map[int]bool)
+	for _, input := range inputs {
+		if row, ok := s.rowOf(input); ok {
+			used[row.line] = true
+		}
+	}
+	var lines []int
+	for _, row := range s.rows {
+		if !used[row.line] && !s.hasBarcode(row.name) {
+			lines = append(lines, row.line)
+		}
+	}
+	return lines
+}
+
+// hasBarcode reports whether a barcode of the sheet is sample's
+func (s *sampleSheet) hasBarcode(sample string) bool {
+	if s.barcodes != nil {
+		for _, b := range s.barcodes.barcodes {
+			if b.Sample == sample {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nameBySample names results after their sample when it is the sample's only
+// file; the files of a sample sequenced over several, such as lanes, keep
+// their own names in a directory named after it
+func nameBySample(inputs []inputFile) []inputFile {
+	files := make(map[string]int)
+	for _, input := range inputs {
+		files[input.Sample]++
+	}
+	for i := range inputs {
+		if files[inputs[i].Sample] == 1 {
+			inputs[i].Name = inputs[i].Sample
+		} else {
+			inputs[i].Dir = filepath.Join(inputs[i].Dir, inputs[i].Sample)
+		}
+	}
+	return inputs
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releaseURL is where self-update looks for the latest release, in the shape
+// of GitHub's releases API. A lab mirroring releases on its own network sets
+// $BHEDI_RELEASE_URL or -url instead.
+const releaseURL = "https://api.github.com/repos/pranjalpruthi/bhedi/releases/latest"
+
+// Files of a release: the binary for each platform, a sha256sum-style list of
+// their checksums, and the list's Ed25519 signature
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// releaseKey is the base64 Ed25519 public key releases are signed with, set
+// by release.sh with -ldflags "-X main.releaseKey=..." from the signing key
+// it is given. self-update installs nothing whose checksums it doesn't sign,
+// unless told to with -insecure: the checksums come from wherever the binary
+// does, so on their own they prove nothing about where it came from. A build
+// without a key, such as a plain go build, can only update with -insecure.
+var releaseKey string
+
+// updateTimeout bounds each request of a self-update, so a flaky connection
+// fails rather than hangs
+const updateTimeout = 10 * time.Minute
+
+// release is the part of a releases API response self-update reads
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// asset returns the download URL of the release's file called name
+func (r release) asset(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// binaryAsset is the name of this platform's binary in a release, e.g.
+// bhedi-cli_linux_amd64 or bhedi-cli_windows_amd64.exe
+func binaryAsset() string {
+	name := "bhedi-cli_" + runtime.GOOS + "_" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// selfUpdateFlags sets up the self-update command: fetch the latest release,
+// check the binary for this platform against the release's signed checksums,
+// and put it in place of the running executable
+func selfUpdateFlags(fs *flag.FlagSet) func(args []string) error {
+	url := fs.String("url", os.Getenv("BHEDI_RELEASE_URL"), "Release endpoint, in the shape of GitHub's releases API (default $BHEDI_RELEASE_URL, else the bhedi GitHub releases)")
+	check := fs.Bool("check", false, "Only report whether a newer release is out")
+	force := fs.Bool("force", false, "Install the release even if it isn't newer, or this is a development build")
+	insecure := fs.Bool("insecure", false, "Install the release without checking the signature of its checksums, e.g. from a mirror of builds of your own; the checksum is still checked")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return usagef("unexpected arguments %q", args)
+		}
+		if *url == "" {
+			*url = releaseURL
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+		defer cancel()
+
+		var rel release
+		data, err := download(ctx, *url)
+		if err == nil {
+			err = json.Unmarshal(data, &rel)
+		}
+		if err == nil && rel.Tag == "" {
+			err = fmt.Errorf("no tag_name in the response")
+		}
+		if err != nil {
+			return fmt.Errorf("can't look up the latest release: %w", err)
+		}
+		current, _, _ := buildInfo()
+		newer := compareVersions(rel.Tag, current) > 0
+		switch {
+		case *check:
+			if newer {
+				fmt.Printf("%s is out; this is %s\n", rel.Tag, current)
+			} else {
+				fmt.Printf("%s is up to date\n", current)
+			}
+			return nil
+		case current == "dev" && !*force:
+			return fmt.Errorf("this is a development build; pass -force to replace it with %s", rel.Tag)
+		case !newer && !*force:
+			slog.Info("already up to date", "version", current, "latest", rel.Tag)
+			return nil
+		}
+
+		name := binaryAsset()
+		binaryURL, ok := rel.asset(name)
+		if !ok {
+			return fmt.Errorf("release %s has no binary for %s/%s (%s)", rel.Tag, runtime.GOOS, runtime.GOARCH, name)
+		}
+		sum, err := releaseChecksum(ctx, rel, name, !*insecure)
+		if err != nil {
+			return err
+		}
+		slog.Info("downloading", "version", rel.Tag, "file", name)
+		binary, err := download(ctx, binaryURL)
+		if err != nil {
+			return fmt.Errorf("can't download %s: %w", name, err)
+		}
+		if got := sha256.Sum256(binary); hex.EncodeToString(got[:]) != sum {
+			return fmt.Errorf("%s doesn't match its checksum; the download is corrupt or was tampered with", name)
+		}
+		exe, err := replaceExecutable(binary)
+		if err != nil {
+			return fmt.Errorf("can't replace %s: %w", exe, err)
+		}
+		slog.Info("updated", "from", current, "to", rel.Tag, "executable", exe)
+		return nil
+	}
+}
+
+// releaseChecksum returns the SHA-256 of the release's file called name from
+// its checksums file, after checking the file's signature against
+// releaseKey unless verify is false
+func releaseChecksum(ctx context.Context, rel release, name string, verify bool) (string, error) {
+	sumsURL, ok := rel.asset(checksumsAsset)
+	if !ok {
+		return "", fmt.Errorf("release %s has no %s", rel.Tag, checksumsAsset)
+	}
+	sums, err := download(ctx, sumsURL)
+	if err != nil {
+		return "", fmt.Errorf("can't download %s: %w", checksumsAsset, err)
+	}
+	if !verify {
+		slog.Warn("not checking the release's signature, as -insecure asks; checking the checksum only", "version", rel.Tag)
+	} else {
+		if releaseKey == "" {
+			return "", fmt.Errorf("this build has no release key to verify %s with; install a release built by release.sh, or pass -insecure to check the checksum only", checksumsAsset)
+		}
+		key, err := base64.StdEncoding.DecodeString(releaseKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return "", fmt.Errorf("the release key built in is not a base64 Ed25519 public key")
+		}
+		sigURL, ok := rel.asset(signatureAsset)
+		if !ok {
+			return "", fmt.Errorf("release %s has no %s, so it can't be verified; pass -insecure to install it anyway", rel.Tag, signatureAsset)
+		}
+		sig, err := download(ctx, sigURL)
+		if err != nil {
+			return "", fmt.Errorf("can't download %s: %w", signatureAsset, err)
+		}
+		if len(sig) != ed25519.SignatureSize {
+			// Not a raw signature, so try base64
+			if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err != nil {
+				return "", fmt.Errorf("can't read %s: %w", signatureAsset, err)
+			}
+		}
+		if !ed25519.Verify(key, sums, sig) {
+			return "", fmt.Errorf("the signature of %s is not valid; the release was not signed with the bhedi release key", checksumsAsset)
+		}
+	}
+	// sha256sum lines: "<hex>  <name>", with a "*" before binary-mode names
+	scanner := bufio.NewScanner(strings.NewReader(string(sums)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no checksum for %s", checksumsAsset, name)
+}
+
+// download fetches url into memory; binaries and checksum files are small
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "bhedi-cli/"+version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// replaceExecutable writes binary next to the running executable and renames
+// it into place, so an interrupted update leaves the old one working. Windows
+// won't replace a running executable, so there the old one is moved aside to
+// <name>.old first. It returns the executable's path.
+func replaceExecutable(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return exe, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".new-*")
+	if err != nil {
+		return exe, err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return exe, err
+	}
+	if err := tmp.Close(); err != nil {
+		return exe, err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0o111); err != nil {
+		return exe, err
+	}
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return exe, err
+		}
+		if err := os.Rename(tmp.Name(), exe); err != nil {
+			os.Rename(old, exe)
+			return exe, err
+		}
+		return exe, nil
+	}
+	return exe, os.Rename(tmp.Name(), exe)
+}
+
+// compareVersions compares release tags such as v1.2.3 numerically, returning
+// -1, 0 or 1. Pre-release suffixes (v1.2.3-rc1) sort before the release, and
+// a tag that isn't a version, such as dev, before any that is.
+func compareVersions(a, b string) int {
+	va, oka := parseVersion(a)
+	vb, okb := parseVersion(b)
+	if !oka || !okb {
+		return boolCompare(oka, okb)
+	}
+	for i := range va.parts {
+		if va.parts[i] != vb.parts[i] {
+			if va.parts[i] < vb.parts[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case va.pre == vb.pre:
+		return 0
+	case va.pre == "":
+		return 1
+	case vb.pre == "":
+		return -1
+	case va.pre < vb.pre:
+		return -1
+	default:
+		return 1
+	}
+}
+
+type parsedVersion struct {
+	parts [3]int
+	pre   string
+}
+
+func parseVersion(tag string) (parsedVersion, bool) {
+	var v parsedVersion
+	tag, _, _ = strings.Cut(strings.TrimPrefix(tag, "v"), "+") // build metadata doesn't order
+	tag, v.pre, _ = strings.Cut(tag, "-")
+	fields := strings.Split(tag, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return v, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v.parts[i] = n
+	}
+	return v, true
+}
+
+func boolCompare(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/xopen"
+)
+
+// simBackground is the serotype simulate gives reads of random sequence,
+// standing in for host background
+const simBackground = "background"
+
+// simGenome is a reference sequence reads are drawn from
+type simGenome struct {
+	serotype, id string
+	seq          []byte
+}
+
+// simRead is a simulated read and where it came from
+type simRead struct {
+	id, serotype, ref string
+	pos, errors       int // 1-based start in ref, and bases changed, inserted or deleted
+	seq               []byte
+}
+
+// simulator draws reads from reference genomes, mixed by serotype
+type simulator struct {
+	rng        *rand.Rand
+	genomes    map[string][]simGenome
+	serotypes  []string  // in -mix order
+	cumulative []float64 // running sum of the serotypes' shares, ending at 1
+	background float64
+	length     float64
+	lengthSD   float64
+	errorRate  float64
+}
+
+// readReferences reads every sequence of a FASTA file as a genome of serotype
+func readReferences(serotype, path string) ([]simGenome, error) {
+	reader, err := fastx.NewReader(nil, path, "")
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", path, err)
+	}
+	defer reader.Close()
+	var genomes []simGenome
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", path, err)
+		}
+		if len(record.Seq.Seq) == 0 {
+			continue
+		}
+		genomes = append(genomes, simGenome{serotype: serotype, id: string(record.ID), seq: []byte(strings.ToUpper(string(record.Seq.Seq)))})
+	}
+	if len(genomes) == 0 {
+		return nil, fmt.Errorf("%s holds no sequences", path)
+	}
+	return genomes, nil
+}
+
+// parseMix reads -mix, e.g. 1=0.5,2=0.3,3=0.2, as shares of the given
+// serotypes; without one every serotype gets the same share
+func parseMix(mix string, serotypes []string) ([]string, []float64, error) {
+	var order []string
+	weights := make(map[string]float64)
+	if mix == "" {
+		for _, s := range serotypes {
+			order = append(order, s)
+			weights[s] = 1
+		}
+	} else {
+		for _, part := range strings.Split(mix, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			w, err := strconv.ParseFloat(value, 64)
+			if !ok || err != nil || w < 0 {
+				return nil, nil, fmt.Errorf("invalid share %q (expected <serotype>=<weight>, e.g. 2=0.5)", part)
+			}
+			if !contains(serotypes, name) {
+				return nil, nil, fmt.Errorf("no -ref for serotype %s", name)
+			}
+			if _, dup := weights[name]; dup {
+				return nil, nil, fmt.Errorf("serotype %s is given twice", name)
+			}
+			order = append(order, name)
+			weights[name] = w
+		}
+	}
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		return nil, nil, fmt.Errorf("the shares add up to 0")
+	}
+	cumulative := make([]float64, len(order))
+	sum := 0.0
+	for i, s := range order {
+		sum += weights[s] / total
+		cumulative[i] = sum
+	}
+	cumulative[len(cumulative)-1] = 1
+	return order, cumulative, nil
+}
+
+// readLength draws a read length around -length, at least 1
+func (s *simulator) readLength() int {
+	n := int(math.Round(s.length + s.rng.NormFloat64()*s.lengthSD))
+	return max(n, 1)
+}
+
+// randomBase returns a base other than not
+func (s *simulator) randomBase(not byte) byte {
+	for {
+		b := "ACGT"[s.rng.Intn(4)]
+		if b != not {
+			return b
+		}
+	}
+}
+
+// next draws the next read
+func (s *simulator) next(i int) simRead {
+	read := simRead{id: fmt.Sprintf("sim_%d", i+1), serotype: simBackground, ref: "-"}
+	n := s.readLength()
+	var template []byte
+	if s.rng.Float64() < s.background {
+		template = make([]byte, n)
+		for j := range template {
+			template[j] = "ACGT"[s.rng.Intn(4)]
+		}
+	} else {
+		read.serotype = s.serotypes[sort.SearchFloat64s(s.cumulative, s.rng.Float64())]
+		genomes := s.genomes[read.serotype]
+		g := genomes[s.rng.Intn(len(genomes))]
+		n = min(n, len(g.seq))
+		start := s.rng.Intn(len(g.seq) - n + 1)
+		template, read.ref, read.pos = g.seq[start:start+n], g.id, start+1
+	}
+	// Sequencing errors, a third each substitutions, insertions and deletions
+	read.seq = make([]byte, 0, len(template)+len(template)/10)
+	for _, b := range template {
+		if s.errorRate == 0 || s.rng.Float64() >= s.errorRate {
+			read.seq = append(read.seq, b)
+			continue
+		}
+		read.errors++
+		switch s.rng.Intn(3) {
+		case 0:
+			read.seq = append(read.seq, s.randomBase(b))
+		case 1:
+			read.seq = append(read.seq, s.randomBase(0), b)
+		}
+	}
+	if len(read.seq) == 0 {
+		read.seq = append(read.seq, template[0]) // every base deleted
+	}
+	return read
+}
+
+// simQuality is the Phred+33 quality of every base for an error rate
+func simQuality(errorRate float64) byte {
+	q := 40
+	if errorRate > 0 {
+		q = min(q, int(-10*math.Log10(errorRate)))
+	}
+	return byte(q + 33)
+}
+
+// simulateFlags sets up the simulate command: write a FASTQ file of reads
+// drawn from reference genomes of each serotype, with chosen shares, read
+// lengths and error rate, whose origin is known, to check an installation or
+// a new panel end to end
+func simulateFlags(fs *flag.FlagSet) func(args []string) error {
+	refs := make(map[string][]string)
+	var serotypes []string
+	fs.Func("ref", "Reference genomes of a serotype as <serotype>=<fasta>, e.g. 2=DENV2.fasta; repeat for each serotype", func(v string) error {
+		serotype, path, ok := strings.Cut(v, "=")
+		if !ok || serotype == "" || path == "" {
+			return fmt.Errorf("expected <serotype>=<fasta>, e.g. 2=DENV2.fasta")
+		}
+		if serotype == simBackground {
+			return fmt.Errorf("%s is reserved for the -background reads", simBackground)
+		}
+		if !contains(serotypes, serotype) {
+			serotypes = append(serotypes, serotype)
+		}
+		refs[serotype] = append(refs[serotype], path)
+		return nil
+	})
+	output := fs.String("o", "", "FASTQ file to write, compressed by its extension (.gz, .bz2, .xz or .zst), or - for stdout")
+	truth := fs.String("truth", "", "Also write each read's serotype, reference, position and errors to this TSV file")
+	mix := fs.String("mix", "", "Shares of the serotypes' reads, e.g. 1=0.5,2=0.3,3=0.2 (default equal)")
+	background := fs.Float64("background", 0, "Share of reads of random sequence, standing in for host background")
+	reads := fs.Int("reads", 10000, "Reads to simulate")
+	length := fs.Float64("length", 1000, "Mean read length; reads are no longer than their genome")
+	lengthSD := fs.Float64("length-sd", 0, "Standard deviation of the read length, e.g. 300 for nanopore-like reads")
+	errorRate := fs.Float64("error-rate", 0, "Share of bases with a sequencing error, a third each substituted, inserted before and deleted, e.g. 0.05")
+	seed := fs.Int64("seed", 1, "Random seed; the same seed and flags give the same reads")
+	overwrite := fs.Bool("overwrite", false, "Replace the output files if they exist")
+
+	return func(args []string) error {
+		switch {
+		case len(args) > 0:
+			return usagef("unexpected arguments %q; reference genomes go in -ref", args)
+		case *output == "":
+			return usagef("-o is required")
+		case len(serotypes) == 0:
+			return usagef("no reference genomes; give at least one -ref <serotype>=<fasta>")
+		case *reads < 1:
+			return usagef("-reads must be at least 1")
+		case *length < 1 || *lengthSD < 0:
+			return usagef("-length must be at least 1 and -length-sd can't be negative")
+		case *errorRate < 0 || *errorRate > 0.5:
+			return usagef("-error-rate must be between 0 and 0.5")
+		case *background < 0 || *background > 1:
+			return usagef("-background must be between 0 and 1")
+		}
+		s := &simulator{rng: rand.New(rand.NewSource(*seed)), genomes: make(map[string][]simGenome), background: *background,
+			length: *length, lengthSD: *lengthSD, errorRate: *errorRate}
+		var err error
+		if s.serotypes, s.cumulative, err = parseMix(*mix, serotypes); err != nil {
+			return usagef("invalid -mix: %w", err)
+		}
+		for _, serotype := range serotypes {
+			for _, path := range refs[serotype] {
+				genomes, err := readReferences(serotype, path)
+				if err != nil {
+					return err
+				}
+				s.genomes[serotype] = append(s.genomes[serotype], genomes...)
+			}
+		}
+		for _, path := range []string{*output, *truth} {
+			if path == "" || path == "-" {
+				continue
+			}
+			if _, err := os.Stat(path); err == nil && !*overwrite {
+				return fmt.Errorf("%s exists; pass -overwrite to replace it", path)
+			}
+		}
+
+		counts, err := writeSimulation(s, *reads, *output, *truth, simQuality(*errorRate))
+		if err != nil {
+			return err
+		}
+		var perSerotype []string
+		for _, serotype := range append(s.serotypes, simBackground) {
+			if counts[serotype] > 0 {
+				perSerotype = append(perSerotype, fmt.Sprintf("%s:%d", serotype, counts[serotype]))
+			}
+		}
+		slog.Info("simulated", "reads", *reads, "output", *output, "serotype_reads", strings.Join(perSerotype, " "), "seed", *seed)
+		return nil
+	}
+}
+
+// writeSimulation writes n reads to output, and their origin to truth if
+// given, returning the reads per serotype. Files are written aside and
+// renamed, so a failed simulation leaves none behind.
+func writeSimulation(s *simulator, n int, output, truth string, quality byte) (map[string]int, error) {
+	var renames [][2]string
+	create := func(path string) (*xopen.Writer, error) {
+		if path == "-" {
+			return xopen.Wopen("-")
+		}
+		// The temp name keeps the extension, which picks the compression
+		tmp := filepath.Join(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+		renames = append(renames, [2]string{tmp, path})
+		return xopen.Wopen(tmp)
+	}
+	defer func() {
+		for _, r := range renames {
+			os.Remove(r[0]) // fails harmlessly once renamed
+		}
+	}()
+	out, err := create(output)
+	if err != nil {
+		return nil, err
+	}
+	var truthOut *xopen.Writer
+	if truth != "" {
+		if truthOut, err = create(truth); err != nil {
+			out.Close()
+			return nil, err
+		}
+		fmt.Fprintln(truthOut, "read_id\tserotype\treference\tposition\tlength\terrors")
+	}
+
+	counts := make(map[string]int)
+	var qual []byte
+	for i := 0; i < n; i++ {
+		read := s.next(i)
+		counts[read.serotype]++
+		for len(qual) < len(read.seq) {
+			qual = append(qual, quality)
+		}
+		fmt.Fprintf(out, "@%s serotype=%s ref=%s pos=%d errors=%d\n%s\n+\n%s\n", read.id, read.serotype, read.ref, read.pos, read.errors, read.seq, qual[:len(read.seq)])
+		if truthOut != nil {
+			fmt.Fprintf(truthOut, "%s\t%s\t%s\t%d\t%d\t%d\n", read.id, read.serotype, read.ref, read.pos, len(read.seq), read.errors)
+		}
+	}
+	if truthOut != nil {
+		err = truthOut.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't write the reads: %w", err)
+	}
+	for _, r := range renames {
+		if err := os.Rename(r[0], r[1]); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
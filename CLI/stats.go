@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/shenwei356/bio/seqio/fastx"
+)
+
+// lengthBins is how many bins of equal width the read length histogram
+// splits the shortest to the longest read into
+const lengthBins = 10
+
+// FastqStats describes the reads of a FASTQ file
+type FastqStats struct {
+	File            string         `json:"file"`
+	Reads           int            `json:"reads"`
+	Bases           int64          `json:"bases"`
+	MinLen          int            `json:"min_len"`
+	AvgLen          float64        `json:"avg_len"`
+	MaxLen          int            `json:"max_len"`
+	Q1Len           int            `json:"q1_len"`
+	MedianLen       int            `json:"median_len"`
+	Q3Len           int            `json:"q3_len"`
+	N50             int            `json:"n50"`
+	GCPercentage    float64        `json:"gc_percentage"`
+	AvgQual         float64        `json:"avg_qual"` // mean Phred score of all bases; 0 for FASTA
+	LengthHistogram []HistogramBin `json:"length_histogram"`
+}
+
+// fastqStats reads a FASTQ (or FASTA) file, compressed or not, once, with
+// its reads trimmed as trim and adapters would have run trim them
+func fastqStats(path string, trim qualityTrim, adapters adapterTrim) (FastqStats, error) {
+	stats := FastqStats{File: path, LengthHistogram: []HistogramBin{}}
+	reader, err := fastx.NewReader(nil, path, "")
+	if err != nil {
+		return stats, fmt.Errorf("error initializing FASTX reader: %w", err)
+	}
+	defer reader.Close()
+	lengths := make(map[int]int) // reads per length
+	var gc, qualSum, qualBases int64
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error reading FASTQ record: %w", err)
+		}
+		seq, qual := trimRead(record.Seq.Seq, record.Seq.Qual, trim, adapters)
+		lengths[len(seq)]++
+		stats.Reads++
+		stats.Bases += int64(len(seq))
+		for _, b := range seq {
+			switch b {
+			case 'G', 'C', 'g', 'c':
+				gc++
+			}
+		}
+		for _, q := range qual {
+			qualSum += int64(q) - 33
+		}
+		qualBases += int64(len(qual))
+	}
+	if stats.Reads == 0 {
+		return stats, nil
+	}
+	stats.AvgLen = float64(stats.Bases) / float64(stats.Reads)
+	if stats.Bases > 0 {
+		stats.GCPercentage = float64(gc) / float64(stats.Bases) * 100
+	}
+	if qualBases > 0 {
+		stats.AvgQual = float64(qualSum) / float64(qualBases)
+	}
+
+	distinct := make([]int, 0, len(lengths))
+	for length := range lengths {
+		distinct = append(distinct, length)
+	}
+	sort.Ints(distinct)
+	stats.MinLen, stats.MaxLen = distinct[0], distinct[len(distinct)-1]
+	// Quartiles by nearest rank, as quantile does for BScores
+	ranks := []*int{&stats.Q1Len, &stats.MedianLen, &stats.Q3Len}
+	next, seen := 0, 0
+	for _, length := range distinct {
+		seen += lengths[length]
+		for ; next < len(ranks) && seen >= max(int(math.Ceil(float64(next+1)/4*float64(stats.Reads))), 1); next++ {
+			*ranks[next] = length
+		}
+	}
+	// N50: the length of the read that takes the longest reads past half the bases
+	var bases int64
+	for i := len(distinct) - 1; i >= 0; i-- {
+		bases += int64(distinct[i]) * int64(lengths[distinct[i]])
+		if 2*bases >= stats.Bases {
+			stats.N50 = distinct[i]
+			break
+		}
+	}
+	width := float64(stats.MaxLen-stats.MinLen+1) / lengthBins
+	stats.LengthHistogram = make([]HistogramBin, lengthBins)
+	for i := range stats.LengthHistogram {
+		stats.LengthHistogram[i] = HistogramBin{From: float64(stats.MinLen) + float64(i)*width, To: float64(stats.MinLen) + float64(i+1)*width}
+	}
+	for _, length := range distinct {
+		bin := min(int(float64(length-stats.MinLen)/width), lengthBins-1)
+		stats.LengthHistogram[bin].Reads += lengths[length]
+	}
+	return stats, nil
+}
+
+// normalizationSample is how many reads at the start of a file BScore's
+// normalization is estimated from
+const normalizationSample = 10000
+
+// normalization is what BScore normalizes a file's coverage by, per Lander
+// and Waterman: its reads, and its shortest read standing in for the read
+// length, as seqkit stats' min_len did
+type normalization struct {
+	Reads      int     `json:"reads"`
+	ReadLength float64 `json:"read_length"`
+	Estimated  bool    `json:"estimated"` // from the start of the file rather than counted
+}
+
+// countNormalization counts the reads of a whole file, a pass of its own
+// before classifying it
+func countNormalization(path string, trim qualityTrim, adapters adapterTrim) (normalization, error) {
+	totalRecords, avgReadLength, err := getTotalRecordsAndAvgReadLength(path, trim, adapters)
+	return normalization{Reads: totalRecords, ReadLength: avgReadLength}, err
+}
+
+// estimateNormalization reads the start of a file, as a dry run does, so
+// classifying it can start without counting it first: the reads are scaled
+// from the share of the file the sample took up, and the shortest read is
+// the sample's, trimmed as it is matched. A file that ends within the sample
+// is counted exactly.
+func estimateNormalization(path string, trim qualityTrim, adapters adapterTrim) (normalization, error) {
+	reads, estimate, exact, err := sampleReads(path, normalizationSample)
+	if err != nil {
+		return normalization{}, err
+	}
+	norm := normalization{Reads: estimate, Estimated: !exact}
+	for i, read := range reads {
+		seq, _ := trimRead(read.seq, read.qual, trim, adapters)
+		if n := float64(len(seq)); i == 0 || n < norm.ReadLength {
+			norm.ReadLength = n
+		}
+	}
+	return norm, nil
+}
+
+// statsFlags sets up the stats command: read counts, the length
+// distribution, GC content and mean quality of FASTQ files, as a table on
+// stdout or JSON
+func statsFlags(fs *flag.FlagSet) func(args []string) error {
+	asJSON := fs.Bool("json", false, "Print the stats as JSON, with a histogram of the read lengths")
+	var trim qualityTrim
+	fs.IntVar(&trim.Quality, "trim-quality", 0, "Describe the reads with their low-quality tails cut, as run -trim-quality would match them")
+	fs.IntVar(&trim.Window, "trim-window", 4, "Bases whose mean quality -trim-quality checks")
+	var adapters adapterTrim
+	fs.Var(&adapters, "trim-adapters", "Describe the reads with these adapters removed, as run -trim-adapters would match them")
+
+	return func(args []string) error {
+		if trim.Quality < 0 || (trim.Quality > 0 && trim.Window < 1) {
+			return usagef("-trim-quality can't be negative, and -trim-window must be at least 1 base")
+		}
+		files, err := fastqFiles(args)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return usagef("no FASTQ files given")
+		}
+		all := []FastqStats{}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if !*asJSON {
+			fmt.Fprintln(w, "file\treads\tbases\tmin_len\tavg_len\tmax_len\tq1_len\tmedian_len\tq3_len\tn50\tgc\tavg_qual")
+		}
+		failed := 0
+		for _, path := range files {
+			stats, err := fastqStats(path, trim, adapters)
+			if err != nil {
+				slog.Error("can't count reads", "file", path, "error", err)
+				failed++
+				continue
+			}
+			all = append(all, stats)
+			if !*asJSON {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f\t%d\t%d\t%d\t%d\t%d\t%.2f\t%.2f\n", path, stats.Reads, stats.Bases, stats.MinLen, stats.AvgLen, stats.MaxLen,
+					stats.Q1Len, stats.MedianLen, stats.Q3Len, stats.N50, stats.GCPercentage, stats.AvgQual)
+			}
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(all); err != nil {
+				return err
+			}
+		} else {
+			w.Flush()
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d files couldn't be read", failed, len(files))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import "fmt"
+
+// phredOffset is what FASTQ quality characters add to the Phred score
+const phredOffset = 33
+
+// qualityTrim cuts the low-quality tail off reads before they are matched,
+// as Trimmomatic's SLIDINGWINDOW does: a window of Window bases slides from
+// the start of the read, and the read is cut where their mean quality first
+// drops below Quality, keeping the bases of that window up to the first one
+// below Quality too. Low-quality tails rarely hold a sanket intact, and
+// trimming them spares the matcher scanning them. The zero value trims
+// nothing.
+type qualityTrim struct {
+	Window  int
+	Quality int
+}
+
+// String is the trim as Trimmomatic's window:quality, for metadata
+func (t qualityTrim) String() string {
+	return fmt.Sprintf("%d:%d", t.Window, t.Quality)
+}
+
+// keep returns how many bases of a read with the qualities qual to keep.
+// Reads without qualities, such as FASTA, are kept whole.
+func (t qualityTrim) keep(qual []byte) int {
+	if t.Quality <= 0 || len(qual) == 0 {
+		return len(qual)
+	}
+	window := min(t.Window, len(qual))
+	need := (t.Quality + phredOffset) * window // the window's least sum of quality characters
+	sum := 0
+	for _, q := range qual[:window] {
+		sum += int(q)
+	}
+	for start := 0; ; start++ {
+		if sum < need {
+			keep := start
+			for keep < len(qual) && int(qual[keep])-phredOffset >= t.Quality {
+				keep++
+			}
+			return keep
+		}
+		if start+window == len(qual) {
+			return len(qual)
+		}
+		sum += int(qual[start+window]) - int(qual[start])
+	}
+}
+
+// trimRead cuts a read as run matches it, for measuring it: its low-quality
+// tail first, then any adapters. qual is cut alongside seq when the read has
+// a quality per base.
+func trimRead(seq, qual []byte, trim qualityTrim, adapters adapterTrim) ([]byte, []byte) {
+	if trim.Quality > 0 && len(qual) == len(seq) {
+		keep := trim.keep(qual)
+		seq, qual = seq[:keep], qual[:keep]
+	}
+	if len(adapters.Adapters) > 0 {
+		start, end := adapters.bounds(seq)
+		seq = seq[start:end]
+		if len(qual) >= end {
+			qual = qual[start:end]
+		}
+	}
+	return seq, qual
+}
+
+// trimSetting is the trim as the run state records it, nil when reads
+// aren't trimmed
+func trimSetting(t qualityTrim) *qualityTrim {
+	if t.Quality <= 0 {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+// phred spells Phred scores as FASTQ quality characters
+func phred(scores ...int) []byte {
+	qual := make([]byte, len(scores))
+	for i, q := range scores {
+		qual[i] = byte(q + phredOffset)
+	}
+	return qual
+}
+
+func TestQualityTrimKeep(t *testing.T) {
+	sliding := qualityTrim{Window: 4, Quality: 20} // SLIDINGWINDOW:4:20
+	tests := []struct {
+		name string
+		trim qualityTrim
+		qual []byte
+		want int
+	}{
+		{"all good", sliding, phred(30, 30, 30, 30, 30, 30, 30, 30), 8},
+		// The window 30 10 10 10 is the first below a mean of 20; of it, the
+		// 30 is kept
+		{"low tail", sliding, phred(30, 30, 30, 30, 30, 10, 10, 10, 10, 10), 5},
+		// 30 30 10 10 averages exactly 20, which is enough
+		{"mean at the threshold", sliding, phred(30, 30, 30, 30, 10, 10, 2), 4},
+		{"dip the windows average out", sliding, phred(30, 30, 30, 30, 5, 30, 30, 30, 30, 30), 10},
+		{"low from the start", sliding, phred(10, 10, 10, 10, 40, 40, 40, 40), 0},
+		{"read shorter than the window", sliding, phred(30, 15), 2},
+		{"short read below the threshold", sliding, phred(15, 15), 0},
+		{"window of one", qualityTrim{Window: 1, Quality: 20}, phred(30, 20, 19, 30), 2},
+		{"no trimming", qualityTrim{Window: 4}, phred(2, 2, 2, 2), 4},
+		{"no qualities", sliding, nil, 0},
+	}
+	for _, test := range tests {
+		if got := test.trim.keep(test.qual); got != test.want {
+			t.Errorf("%s: keep(%q) = %d, want %d", test.name, test.qual, got, test.want)
+		}
+	}
+}
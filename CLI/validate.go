@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/shenwei356/bio/seqio/fastx"
+)
+
+// validateFlags sets up the validate command: check the panel run would use,
+// and read through the FASTQ files or directories given, so problems show up
+// before a multi-hour run rather than in the middle of it
+func validateFlags(fs *flag.FlagSet) func(args []string) error {
+	panelFlags(fs)
+
+	return func(args []string) error {
+		failed := 0
+		panelCSV, err := findPanel(panelPath)
+		sankets := 0
+		if err == nil {
+			sankets, err = checkPanelFile(panelCSV)
+		}
+		if err != nil {
+			slog.Error("panel check failed", "error", err)
+			failed++
+		} else {
+			slog.Info("panel ok", "file", panelCSV, "sankets", sankets)
+		}
+
+		files, err := fastqFiles(args)
+		if err != nil {
+			return err
+		}
+		for _, path := range files {
+			reads, err := checkFastq(path)
+			if err != nil {
+				slog.Error("FASTQ check failed", "file", path, "reads", reads, "error", err)
+				failed++
+				continue
+			}
+			slog.Info("FASTQ ok", "file", path, "reads", reads)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(files)+1)
+		}
+		return nil
+	}
+}
+
+// fastqFiles expands the arguments into FASTQ files: files as given, and the
+// FASTQ files directly inside directories, as run picks them
+func fastqFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		inputs, err := discoverInputs(arg, false, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, input := range inputs {
+			files = append(files, input.Path)
+		}
+	}
+	return files, nil
+}
+
+// checkFastq reads every record of a FASTQ file, returning how many were read
+// before the first problem
+func checkFastq(path string) (int, error) {
+	reader, err := fastx.NewReader(nil, path, "")
+	if err != nil {
+		return 0, fmt.Errorf("error initializing FASTX reader: %w", err)
+	}
+	defer reader.Close()
+	reads := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return reads, fmt.Errorf("error reading FASTQ record: %w", err)
+		}
+		if len(record.Seq.Seq) == 0 {
+			return reads, fmt.Errorf("read %s has no sequence", record.ID)
+		}
+		if len(record.Seq.Qual) != len(record.Seq.Seq) {
+			return reads, fmt.Errorf("read %s has %d quality scores for %d bases", record.ID, len(record.Seq.Qual), len(record.Seq.Seq))
+		}
+		reads++
+	}
+	if reads == 0 {
+		return 0, fmt.Errorf("no reads")
+	}
+	return reads, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"bhedi/output"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// requiredMetadata are the footer keys every result file of a run carries
+var requiredMetadata = []string{"bhedi.version", "bhedi.panel.name", "bhedi.panel.version", "bhedi.panel.checksum", "bhedi.scoring", "bhedi.created_at"}
+
+// schemaColumns are the top-level columns of each schema; a file may hold
+// fewer, as chosen with -columns, and merged files add a sample column
+func schemaColumns(schema string) map[string]bool {
+	columns := make(map[string]bool)
+	if schema == output.SchemaNested {
+		for _, name := range []string{"read_id", "gc_percentage", "total_coverage", "matches_found", "matches"} {
+			columns[name] = true
+		}
+		return columns
+	}
+	for _, col := range output.FlatColumns {
+		columns[col.Name] = true
+	}
+	columns[sampleColumn.Name] = true
+	return columns
+}
+
+// outputCheck is what validate-output found in one result file
+type outputCheck struct {
+	rows, reads int
+	problems    []string
+}
+
+func (c *outputCheck) problem(format string, args ...any) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// checkMetadata checks the run metadata of a Parquet or SQLite file: the
+// schema version is one this build reads, and the keys that trace a result
+// to its run are there
+func (c *outputCheck) checkMetadata(path string, metadata map[string]string) {
+	for _, key := range requiredMetadata {
+		if metadata[key] == "" {
+			c.problem("metadata %s is missing", key)
+		}
+	}
+	switch value := metadata["bhedi.schema_version"]; {
+	case value == "":
+		slog.Warn("no schema version; written by a bhedi release before they were recorded", "file", path)
+	default:
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 1 {
+			c.problem("invalid schema version %q", value)
+		} else if v > resultSchemaVersion {
+			c.problem("schema version %d is newer than this build reads (%d); update bhedi-cli", v, resultSchemaVersion)
+		}
+	}
+}
+
+// checkParquet checks a Parquet file's metadata, its columns against its
+// schema and that
+// the row counts of its footer and row groups agree, then reads every row
+// group through, naming the first that can't be decoded. It reports whether
+// the file is worth reading through.
+func (c *outputCheck) checkParquet(path string) bool {
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		c.problem("can't open: %v", err)
+		return false
+	}
+	defer file.Close()
+	pr, err := reader.NewParquetReader(file, nil, 1)
+	if err != nil {
+		c.problem("can't read the footer: %v", err)
+		return false
+	}
+	defer pr.ReadStop()
+	metadata := make(map[string]string)
+	for _, kv := range pr.Footer.KeyValueMetadata {
+		if kv.Value != nil {
+			metadata[kv.Key] = *kv.Value
+		}
+	}
+	c.checkMetadata(path, metadata)
+
+	// The root's direct children; the nested schema's matches group counts as
+	// one. The reader capitalizes names as Go fields, and bhedi's are lowercase.
+	var columns []string
+	elements := pr.Footer.Schema
+	for i := 1; i < len(elements); i = skipSchemaElement(elements, i) {
+		columns = append(columns, strings.ToLower(elements[i].GetName()))
+	}
+	schema := metadata["bhedi.schema"]
+	if schema == "" {
+		schema = output.SchemaFlat
+		if contains(columns, "matches") {
+			schema = output.SchemaNested
+		}
+	}
+	known := schemaColumns(schema)
+	for _, name := range columns {
+		if !known[name] {
+			c.problem("unknown column %s for the %s schema", name, schema)
+		}
+	}
+
+	var total int64
+	for _, rg := range pr.Footer.RowGroups {
+		total += rg.NumRows
+	}
+	if total != pr.Footer.NumRows {
+		c.problem("the footer counts %d rows but its row groups %d", pr.Footer.NumRows, total)
+	}
+	for i, rg := range pr.Footer.RowGroups {
+		if err := readRowGroup(pr, rg.NumRows); err != nil {
+			c.problem("row group %d of %d is corrupt: %v", i+1, len(pr.Footer.RowGroups), err)
+			return false
+		}
+	}
+	return true
+}
+
+// skipSchemaElement returns the index of the element after the one at i and
+// all its descendants in a footer's depth-first schema list
+func skipSchemaElement(elements []*parquet.SchemaElement, i int) int {
+	children := int(elements[i].GetNumChildren())
+	i++
+	for ; children > 0 && i < len(elements); children-- {
+		i = skipSchemaElement(elements, i)
+	}
+	return i
+}
+
+// readRowGroup decodes the next rows of a Parquet file. parquet-go panics
+// on some corrupt pages and comes up short on others, so both count as errors.
+func readRowGroup(pr *reader.ParquetReader, rows int64) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	for rows > 0 {
+		n := min(rows, 1000)
+		batch, err := pr.ReadByNumber(int(n))
+		if err != nil {
+			return err
+		}
+		if int64(len(batch)) < n {
+			return fmt.Errorf("decoded %d of %d rows", len(batch), n)
+		}
+		rows -= n
+	}
+	return nil
+}
+
+// countResults reads a result file through, counting its rows and distinct
+// reads
+func (c *outputCheck) countResults(path string) error {
+	results, err := openResults(path)
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	reads := make(map[uint64]struct{})
+	hasIDs := false
+	for {
+		row, err := results.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("row %d: %w", c.rows+1, err)
+		}
+		c.rows++
+		if row.ReadID != "" {
+			hasIDs = true
+			reads[readHash(row.ReadID)] = struct{}{}
+		}
+	}
+	c.reads = -1 // unknown without a read_id column
+	if hasIDs || c.rows == 0 {
+		c.reads = len(reads)
+	}
+	return nil
+}
+
+// findRunReport looks for the run report of the run that wrote path in its
+// directory and the ones above, returning the report and path's name
+// relative to the report's directory
+func findRunReport(path string) (*runReport, string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(dir, runReportFile))
+		if err == nil {
+			var rep runReport
+			if err := json.Unmarshal(data, &rep); err != nil {
+				return nil, "", fmt.Errorf("can't read %s: %w", filepath.Join(dir, runReportFile), err)
+			}
+			rel, err := filepath.Rel(dir, abs)
+			return &rep, rel, err
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, "", err
+		}
+		if filepath.Dir(dir) == dir {
+			return nil, "", nil
+		}
+	}
+}
+
+// checkAgainstReport compares the reads of a file with what the run report
+// recorded for it. Only files holding all of a FASTQ file's results can be
+// compared; per-serotype files and partitions hold a share, and a run with
+// -matched-only leaves out the reads without a match.
+func (c *outputCheck) checkAgainstReport(path string, rep *runReport, rel string) {
+	for _, file := range rep.Files {
+		if !contains(file.Outputs, rel) {
+			continue
+		}
+		switch {
+		case file.Status != FileClassified:
+			c.problem("the run report lists it as %s", file.Status)
+		case len(file.Outputs) > 1 || c.reads < 0 || rep.Parameters["matched-only"] == "true":
+			slog.Debug("read count not comparable with the run report", "file", path, "outputs", len(file.Outputs))
+		case c.reads != file.Reads:
+			c.problem("%d reads, but the run report counted %d in %s", c.reads, file.Reads, file.File)
+		}
+		return
+	}
+	slog.Warn("not in the run report", "file", path, "report", runReportFile)
+}
+
+// validateOutputFlags sets up the validate-output command: check result files
+// before they go further down a pipeline. A file fails when its schema
+// version is newer than this build, run metadata is missing, a column isn't
+// part of its schema, a row group can't be read, or its reads differ from
+// what the run report beside it counted.
+func validateOutputFlags(fs *flag.FlagSet) func(args []string) error {
+	reportPath := fs.String("run-report", "", "Run report to check read counts against (default the "+runReportFile+" in the file's directory or one above)")
+
+	return func(args []string) error {
+		if len(args) == 0 {
+			return usagef("no result files given")
+		}
+		files, err := resultFiles(args)
+		if err != nil {
+			return err
+		}
+		var given *runReport
+		if *reportPath != "" {
+			data, err := os.ReadFile(*reportPath)
+			if err != nil {
+				return usagef("can't read the run report: %w", err)
+			}
+			given = new(runReport)
+			if err := json.Unmarshal(data, given); err != nil {
+				return usagef("can't read the run report %s: %w", *reportPath, err)
+			}
+		}
+
+		failed := 0
+		for _, path := range files {
+			var c outputCheck
+			readable := true
+			switch filepath.Ext(path) {
+			case ".parquet":
+				readable = c.checkParquet(path)
+			case ".sqlite":
+				metadata, err := resultMetadata(path)
+				if err != nil {
+					c.problem("can't read the metadata: %v", err)
+					readable = false
+					break
+				}
+				c.checkMetadata(path, metadata)
+			}
+			if readable {
+				if err := c.countResults(path); err != nil {
+					c.problem("can't read: %v", err)
+					readable = false
+				}
+			}
+			if readable {
+				rep, rel := given, ""
+				if given != nil {
+					rel, err = filepath.Rel(filepath.Dir(*reportPath), path)
+				} else {
+					rep, rel, err = findRunReport(path)
+				}
+				switch {
+				case err != nil:
+					c.problem("can't check against the run report: %v", err)
+				case rep != nil:
+					c.checkAgainstReport(path, rep, rel)
+				}
+			}
+
+			if len(c.problems) > 0 {
+				for _, problem := range c.problems {
+					slog.Error("output check failed", "file", path, "problem", problem)
+				}
+				failed++
+				continue
+			}
+			slog.Info("output ok", "file", path, "rows", c.rows, "reads", c.reads)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d files failed", failed, len(files))
+		}
+		return nil
+	}
+}
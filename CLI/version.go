@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"text/tabwriter"
+)
+
+// versionInfo is what the version command prints
+type versionInfo struct {
+	Tool      string     `json:"tool"`
+	Version   string     `json:"version"`
+	Commit    string     `json:"commit"`
+	BuildDate string     `json:"build_date"`
+	Go        string     `json:"go"`
+	Platform  string     `json:"platform"`
+	Panel     *PanelInfo `json:"panel"` // nil when no panel was found
+	PanelFile string     `json:"panel_file,omitempty"`
+}
+
+// versionFlags sets up the version command: print the release, commit and
+// build date, and the panel a run would load, for bug reports and for
+// comparing with the bhedi.* metadata of result files
+func versionFlags(fs *flag.FlagSet) func(args []string) error {
+	panelFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the version as JSON")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return usagef("unexpected arguments %q", args)
+		}
+		info := versionInfo{Tool: "bhedi-cli", Go: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+		info.Version, info.Commit, info.BuildDate = buildInfo()
+
+		// Only a panel that was named has to exist; without one, version still
+		// prints the build
+		panelCSV, err := findPanel(panelPath)
+		if err != nil && panelPath != "" {
+			return err
+		}
+		if err == nil {
+			idx, err := loadPanel(panelCSV)
+			if err != nil {
+				return fmt.Errorf("can't load sankets: %w", err)
+			}
+			info.Panel, info.PanelFile = &idx.Panel, panelCSV
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(info)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "%s %s\n", info.Tool, info.Version)
+		fmt.Fprintf(w, "commit:\t%s\n", info.Commit)
+		fmt.Fprintf(w, "built:\t%s\n", info.BuildDate)
+		fmt.Fprintf(w, "go:\t%s %s\n", info.Go, info.Platform)
+		if info.Panel != nil {
+			fmt.Fprintf(w, "panel:\t%s %s, %d sankets (%s)\n", info.Panel.Name, info.Panel.Version, info.Panel.Sankets, info.PanelFile)
+		} else {
+			fmt.Fprintf(w, "panel:\tnone found\n")
+		}
+		return w.Flush()
+	}
+}
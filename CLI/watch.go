@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// fileVersion is a file's size and modification time when last looked at
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // when the file was first seen like this
+}
+
+func versionOf(info os.FileInfo) fileVersion {
+	return fileVersion{size: info.Size(), modTime: info.ModTime()}
+}
+
+func (v fileVersion) same(other fileVersion) bool {
+	return v.size == other.size && v.modTime.Equal(other.modTime)
+}
+
+// watchFlags sets up the watch command: look for new FASTQ files in -i every
+// -interval and classify each once it has stopped changing for -settle.
+// Directories are polled rather than watched through the OS, so a sequencer
+// writing to a network share works too. Finished files are kept in the run
+// state, so a restarted watch carries on where it stopped.
+func watchFlags(fs *flag.FlagSet) func(args []string) error {
+	o := defineRunFlags(fs)
+	interval := fs.Duration("interval", 10*time.Second, "How often to look for new files")
+	settle := fs.Duration("settle", 30*time.Second, "How long a file's size and modification time must stay the same before it is classified, so files still being written are left alone")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return usagef("unexpected arguments %q; the input directory goes in -i", args)
+		}
+		if *interval <= 0 || *settle < 0 {
+			return usagef("-interval must be positive and -settle can't be negative")
+		}
+		r, err := o.start(true)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		// The first SIGINT or SIGTERM lets the files in progress finish; a second
+		// one stops at once, leaving them to be classified again on restart
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+
+		slog.Info("watching for FASTQ files", "input", o.inputDir, "interval", *interval, "settle", *settle)
+		seen := make(map[string]fileVersion)   // unfinished files, as last seen
+		failed := make(map[string]fileVersion) // left alone until they change
+		for {
+			inputs, err := r.discover(o)
+			if err == nil {
+				err = r.nameOutputs(inputs, time.Now())
+			}
+			if err != nil {
+				slog.Warn("can't look for new files", "error", err)
+				inputs = nil
+			}
+			now := time.Now()
+			current := make(map[string]fileVersion, len(inputs))
+			var ready []inputFile
+			for _, input := range inputs {
+				if _, ok := r.state.Finished(input.Path); ok {
+					continue
+				}
+				info, err := os.Stat(input.Path)
+				if err != nil {
+					continue // removed since
+				}
+				version := versionOf(info)
+				if previous, ok := failed[input.Path]; ok && previous.same(version) {
+					continue
+				}
+				delete(failed, input.Path)
+				if previous, ok := seen[input.Path]; ok && previous.same(version) {
+					version.since = previous.since
+				} else {
+					version.since = now
+				}
+				current[input.Path] = version
+				if now.Sub(version.since) >= *settle {
+					ready = append(ready, input)
+				}
+			}
+			seen = current
+
+			if len(ready) > 0 {
+				for _, input := range r.classifyAll(ready, *o.jobs) {
+					if info, err := os.Stat(input.Path); err == nil {
+						failed[input.Path] = versionOf(info)
+					}
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				slog.Info("stopped watching")
+				return nil
+			case <-time.After(*interval):
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// windowedMatcher splits reads longer than twice its window into windows
+// that overlap by one base less than the longest sanket, so every sanket of
+// the read lies whole in one of them, and matches the windows at once. A
+// 100 kb ultra-long read then takes a fraction of the time it would one
+// window after another, rather than stalling its worker while the rest of
+// the batch waits.
+type windowedMatcher struct {
+	next    matcher
+	window  int // bases per window, overlap included
+	overlap int
+}
+
+// newWindowedMatcher puts windows of window bases in front of m, or returns
+// m if window is 0 or too short to hold the longest sanket
+func newWindowedMatcher(idx *sanketIndex, m matcher, window int) matcher {
+	longest := 0
+	for _, info := range idx.Sankets {
+		longest = max(longest, len(info.Sanket))
+	}
+	if window <= 0 || longest >= window {
+		return m
+	}
+	return &windowedMatcher{next: m, window: window, overlap: max(longest-1, 0)}
+}
+
+func (w *windowedMatcher) Match(seq []byte) []*SanketInfo {
+	if len(seq) <= 2*w.window {
+		return w.next.Match(seq)
+	}
+	step := w.window - w.overlap
+	found := make([][]*SanketInfo, (len(seq)-w.overlap+step-1)/step)
+	var wg sync.WaitGroup
+	for i := range found {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			found[i] = w.next.Match(seq[i*step : min(i*step+w.window, len(seq))])
+		}(i)
+	}
+	wg.Wait()
+
+	// Merge the windows' sankets, each once and in SID order as a matcher
+	// returns them
+	var merged []*SanketInfo
+	for _, f := range found {
+		merged = append(merged, f...)
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].SID < merged[j].SID })
+	unique := merged[:1]
+	for _, info := range merged[1:] {
+		if info.SID != unique[len(unique)-1].SID { // a sanket in two windows' overlap, or repeated
+			unique = append(unique, info)
+		}
+	}
+	return unique
+}
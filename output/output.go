@@ -0,0 +1,438 @@
+// Package output writes classified reads as Parquet, CSV, newline-delimited
+// JSON or SQLite files. The CLI and the API both write their results through
+// it, so a format or column added here reaches both.
+package output
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+	_ "modernc.org/sqlite"
+)
+
+// Writer persists processed reads in one output format. Implementations are
+// not safe for concurrent use; callers serialize Write calls and call Close
+// exactly once.
+type Writer interface {
+	Write(result Result) error
+	Close() error
+}
+
+// Output schemas
+const (
+	SchemaFlat   = "flat"   // one row per (read, sanket) match
+	SchemaNested = "nested" // one row per read with a repeated group of matches
+)
+
+// Output formats
+const (
+	FormatParquet = "parquet"
+	FormatCSV     = "csv"
+	FormatJSON    = "json" // newline-delimited JSON
+	FormatSQLite  = "sqlite"
+)
+
+// Extensions maps output formats to file extensions
+var Extensions = map[string]string{
+	FormatParquet: ".parquet",
+	FormatCSV:     ".csv",
+	FormatJSON:    ".jsonl",
+	FormatSQLite:  ".sqlite",
+}
+
+// ParquetCodecs maps Parquet compression names to codecs
+var ParquetCodecs = map[string]parquet.CompressionCodec{
+	"zstd":   parquet.CompressionCodec_ZSTD,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip":   parquet.CompressionCodec_GZIP,
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+}
+
+// DefaultWriterParallelism is how many goroutines encode each Parquet row
+// group when Options doesn't say, fewer if fewer CPUs are available
+const DefaultWriterParallelism = 4
+
+// Options controls the layout of a result file
+type Options struct {
+	Format      string
+	Schema      string
+	Compression string
+	Columns     []string          // flat columns to write, in order; empty means all
+	Metadata    map[string]string // key-value metadata written into each file footer
+
+	RowGroupSize      int64 // bytes of rows buffered per Parquet row group; 0 means the library default
+	PageSize          int64 // bytes per Parquet page, up to RowGroupSize; 0 means the library default
+	WriterParallelism int   // goroutines encoding each Parquet row group; 0 means DefaultWriterParallelism
+	CacheSize         int64 // bytes of SQLite page cache; 0 means the library default
+}
+
+// Validate checks that the options name known values
+func (o Options) Validate() error {
+	if _, ok := Extensions[o.Format]; !ok {
+		return fmt.Errorf("unknown output format %q (expected parquet, csv, json or sqlite)", o.Format)
+	}
+	switch o.Schema {
+	case SchemaFlat, SchemaNested:
+	default:
+		return fmt.Errorf("unknown schema %q (expected %s or %s)", o.Schema, SchemaFlat, SchemaNested)
+	}
+	if o.Schema == SchemaNested && (o.Format == FormatCSV || o.Format == FormatSQLite) {
+		return fmt.Errorf("%s output requires the %s schema", o.Format, SchemaFlat)
+	}
+	if len(o.Columns) > 0 && o.Schema != SchemaFlat {
+		return fmt.Errorf("column selection requires the %s schema", SchemaFlat)
+	}
+	if _, ok := ParquetCodecs[o.Compression]; !ok {
+		return fmt.Errorf("unknown parquet compression %q (expected zstd, snappy, gzip or none)", o.Compression)
+	}
+	if o.RowGroupSize < 0 || o.PageSize < 0 || o.WriterParallelism < 0 || o.CacheSize < 0 {
+		return fmt.Errorf("parquet row group size, page size, writer parallelism and SQLite cache size must be positive")
+	}
+	return nil
+}
+
+// Extension returns the file extension for the output format
+func (o Options) Extension() string {
+	return Extensions[o.Format]
+}
+
+// SelectedColumns returns the flat columns to write, in output order
+func (o Options) SelectedColumns() []Column {
+	if len(o.Columns) == 0 {
+		return FlatColumns
+	}
+	columns := make([]Column, 0, len(o.Columns))
+	for _, name := range o.Columns {
+		for _, col := range FlatColumns {
+			if col.Name == name {
+				columns = append(columns, col)
+			}
+		}
+	}
+	return columns
+}
+
+// Parallelism returns how many goroutines a Parquet writer encodes with
+func (o Options) Parallelism() int64 {
+	if o.WriterParallelism > 0 {
+		return int64(o.WriterParallelism)
+	}
+	return int64(min(DefaultWriterParallelism, runtime.GOMAXPROCS(0)))
+}
+
+// TuneParquet sets the compression, row group and page size of a new
+// Parquet writer. Rows are held in memory until a row group fills, and
+// handed to the encoders a few pages' worth at a time, so larger pages make
+// for fewer, larger batches.
+func (o Options) TuneParquet(pw *writer.ParquetWriter) {
+	pw.CompressionType = ParquetCodecs[o.Compression]
+	if o.RowGroupSize > 0 {
+		pw.RowGroupSize = o.RowGroupSize
+	}
+	if o.PageSize > 0 {
+		pw.PageSize = min(o.PageSize, pw.RowGroupSize)
+	}
+}
+
+// parquetSchema returns the object describing the Parquet schema for the
+// options
+func (o Options) parquetSchema() interface{} {
+	if o.Schema == SchemaNested {
+		return new(NestedRecord)
+	}
+	return new(Record)
+}
+
+// New creates the file at path and returns a writer for the configured
+// format
+func New(path string, opts Options) (Writer, error) {
+	switch opts.Format {
+	case FormatCSV:
+		return newCSVWriter(path, opts)
+	case FormatJSON:
+		return newJSONWriter(path, opts)
+	case FormatSQLite:
+		return newSQLiteWriter(path, opts)
+	default:
+		return newParquetWriter(path, opts)
+	}
+}
+
+// SetFooterMetadata adds metadata to a Parquet footer in a stable key order
+func SetFooterMetadata(footer *parquet.FileMetaData, metadata map[string]string) {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		kv := parquet.NewKeyValue()
+		kv.Key = key
+		value := metadata[key]
+		kv.Value = &value
+		footer.KeyValueMetadata = append(footer.KeyValueMetadata, kv)
+	}
+}
+
+// parquetWriter writes a single Parquet file with the flat or nested schema.
+// With a column selection the flat schema is built from column metadata
+// instead of the Record struct tags.
+type parquetWriter struct {
+	fw      source.ParquetFile
+	pw      *writer.ParquetWriter
+	columns []Column // nil when rows are written as structs
+	opts    Options
+}
+
+func newParquetWriter(path string, opts Options) (*parquetWriter, error) {
+	fw, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't create local file: %w", err)
+	}
+	w := &parquetWriter{fw: fw, opts: opts}
+	if len(opts.Columns) > 0 {
+		w.columns = opts.SelectedColumns()
+		cw, err := writer.NewCSVWriter(ParquetMetadata(w.columns), fw, opts.Parallelism())
+		if err != nil {
+			fw.Close()
+			return nil, fmt.Errorf("can't create parquet writer: %w", err)
+		}
+		w.pw = &cw.ParquetWriter
+	} else {
+		w.pw, err = writer.NewParquetWriter(fw, opts.parquetSchema(), opts.Parallelism())
+		if err != nil {
+			fw.Close()
+			return nil, fmt.Errorf("can't create parquet writer: %w", err)
+		}
+	}
+	opts.TuneParquet(w.pw)
+	return w, nil
+}
+
+func (w *parquetWriter) Write(result Result) error {
+	if w.opts.Schema == SchemaNested {
+		return w.pw.Write(nestedRecord(result))
+	}
+	for _, record := range FlatRecords(result) {
+		var row interface{} = record
+		if w.columns != nil {
+			row = ColumnValues(w.columns, record)
+		}
+		if err := w.pw.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes the footer; WriteStop must run exactly once
+func (w *parquetWriter) Close() error {
+	SetFooterMetadata(w.pw.Footer, w.opts.Metadata)
+	if err := w.pw.WriteStop(); err != nil {
+		w.fw.Close()
+		return fmt.Errorf("error finalizing Parquet file write: %w", err)
+	}
+	return w.fw.Close()
+}
+
+// csvWriter writes flat rows with a header line
+type csvWriter struct {
+	f       *os.File
+	w       *csv.Writer
+	columns []Column
+}
+
+func newCSVWriter(path string, opts Options) (*csvWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't create local file: %w", err)
+	}
+	w := csv.NewWriter(f)
+	columns := opts.SelectedColumns()
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.Name
+	}
+	if err := w.Write(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error writing CSV header: %w", err)
+	}
+	return &csvWriter{f: f, w: w, columns: columns}, nil
+}
+
+func (w *csvWriter) Write(result Result) error {
+	for _, record := range FlatRecords(result) {
+		row := make([]string, len(w.columns))
+		for i, col := range w.columns {
+			row[i] = formatValue(col.Value(record))
+		}
+		if err := w.w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("error flushing CSV file: %w", err)
+	}
+	return w.f.Close()
+}
+
+// jsonWriter writes newline-delimited JSON: one object per flat row, or one
+// object per read with the nested schema
+type jsonWriter struct {
+	f       *os.File
+	bw      *bufio.Writer
+	enc     *json.Encoder
+	columns []Column
+	opts    Options
+}
+
+func newJSONWriter(path string, opts Options) (*jsonWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't create local file: %w", err)
+	}
+	bw := bufio.NewWriter(f)
+	return &jsonWriter{f: f, bw: bw, enc: json.NewEncoder(bw), columns: opts.SelectedColumns(), opts: opts}, nil
+}
+
+func (w *jsonWriter) Write(result Result) error {
+	if w.opts.Schema == SchemaNested {
+		return w.enc.Encode(nestedRecord(result))
+	}
+	for _, record := range FlatRecords(result) {
+		if err := w.writeRow(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRow encodes the selected columns of a flat row as one JSON object,
+// keeping column order
+func (w *jsonWriter) writeRow(record Record) error {
+	w.bw.WriteByte('{')
+	for i, col := range w.columns {
+		if i > 0 {
+			w.bw.WriteByte(',')
+		}
+		key, _ := json.Marshal(col.Name)
+		value, err := json.Marshal(col.Value(record))
+		if err != nil {
+			return err
+		}
+		w.bw.Write(key)
+		w.bw.WriteByte(':')
+		w.bw.Write(value)
+	}
+	w.bw.WriteString("}\n")
+	return nil
+}
+
+func (w *jsonWriter) Close() error {
+	if err := w.bw.Flush(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("error flushing JSON file: %w", err)
+	}
+	return w.f.Close()
+}
+
+// sqliteWriter writes flat rows into a "results" table and the run metadata
+// into a "metadata" table, all inside one transaction
+type sqliteWriter struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	columns []Column
+	opts    Options
+}
+
+func newSQLiteWriter(path string, opts Options) (*sqliteWriter, error) {
+	// Start from an empty database, like the other formats truncate their files
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't replace SQLite file: %w", err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open SQLite file: %w", err)
+	}
+	db.SetMaxOpenConns(1) // so the pragma below applies to the connection the transaction runs on
+	if opts.CacheSize > 0 {
+		// The results go in one transaction, whose pages stay in the cache up to this size
+		if _, err := db.Exec(fmt.Sprintf("PRAGMA cache_size = -%d", max(opts.CacheSize>>10, 1))); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("can't set the SQLite cache size: %w", err)
+		}
+	}
+	columns := opts.SelectedColumns()
+	names := make([]string, len(columns))
+	defs := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+		defs[i] = col.Name + " " + col.SQL
+	}
+	schema := "CREATE TABLE results (" + strings.Join(defs, ", ") + ");" +
+		"CREATE TABLE metadata (key TEXT PRIMARY KEY, value TEXT);"
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't create SQLite tables: %w", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't begin SQLite transaction: %w", err)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	stmt, err := tx.Prepare("INSERT INTO results (" + strings.Join(names, ", ") + ") VALUES (" + placeholders + ")")
+	if err != nil {
+		tx.Rollback()
+		db.Close()
+		return nil, fmt.Errorf("can't prepare SQLite insert: %w", err)
+	}
+	return &sqliteWriter{db: db, tx: tx, stmt: stmt, columns: columns, opts: opts}, nil
+}
+
+func (w *sqliteWriter) Write(result Result) error {
+	for _, record := range FlatRecords(result) {
+		if _, err := w.stmt.Exec(ColumnValues(w.columns, record)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *sqliteWriter) Close() error {
+	defer w.db.Close()
+	w.stmt.Close()
+	keys := make([]string, 0, len(w.opts.Metadata))
+	for key := range w.opts.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := w.tx.Exec("INSERT INTO metadata (key, value) VALUES (?, ?)", key, w.opts.Metadata[key]); err != nil {
+			w.tx.Rollback()
+			return fmt.Errorf("error writing SQLite metadata: %w", err)
+		}
+	}
+	if err := w.tx.Commit(); err != nil {
+		return fmt.Errorf("error committing SQLite results: %w", err)
+	}
+	return nil
+}
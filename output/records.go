@@ -0,0 +1,218 @@
+package output
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Match is one sanket found in a read, with the sanket's panel fields and
+// the BScore of the hit
+type Match struct {
+	SID      string
+	Sanket   string
+	Serotype string
+	SLen     int
+	SSRCount string
+	MLenAvg  string
+	MRCAvg   string
+	PCount   string
+	PLenAvg  string
+	BScore   float64
+}
+
+// Result is a classified read, as the CLI and the API hand it to a Writer
+type Result struct {
+	ReadID        string `parquet:"name=read_id, type=UTF8"`
+	Matches       []Match
+	GCPercentage  float64 `parquet:"name=gc_percentage, type=DOUBLE"`
+	TotalCoverage int     `parquet:"name=total_coverage, type=INT32"`
+	MatchesFound  bool
+	BScore        float64 `parquet:"name=b_score, type=DOUBLE"`
+}
+
+// Record is a row of the flat schema: one per (read, sanket) match
+type Record struct {
+	SID           string  `json:"sid" parquet:"name=sid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ReadID        string  `json:"read_id" parquet:"name=read_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MatchedSanket string  `json:"matched_sanket" parquet:"name=matched_sanket, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Serotype      string  `json:"serotype" parquet:"name=serotype, type=BYTE_ARRAY, convertedtype=UTF8"`
+	GCPercentage  float64 `json:"gc_percentage" parquet:"name=gc_percentage, type=DOUBLE"`
+	TotalCoverage int32   `json:"total_coverage" parquet:"name=total_coverage, type=INT32"`
+	SLen          int32   `json:"s_len" parquet:"name=s_len, type=INT32"`
+	SSRCount      string  `json:"ssr_count" parquet:"name=ssr_count, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MLenAvg       string  `json:"mlen_avg" parquet:"name=mlen_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MRCAvg        string  `json:"mrc_avg" parquet:"name=mrc_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PCount        string  `json:"p_count" parquet:"name=p_count, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PLenAvg       string  `json:"plen_avg" parquet:"name=plen_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
+	BScore        float64 `json:"b_score" parquet:"name=b_score, type=DOUBLE"`
+}
+
+// NestedMatch is one sanket hit inside a NestedRecord
+type NestedMatch struct {
+	SID           string  `json:"sid" parquet:"name=sid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MatchedSanket string  `json:"matched_sanket" parquet:"name=matched_sanket, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Serotype      string  `json:"serotype" parquet:"name=serotype, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SLen          int32   `json:"s_len" parquet:"name=s_len, type=INT32"`
+	SSRCount      string  `json:"ssr_count" parquet:"name=ssr_count, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MLenAvg       string  `json:"mlen_avg" parquet:"name=mlen_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MRCAvg        string  `json:"mrc_avg" parquet:"name=mrc_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PCount        string  `json:"p_count" parquet:"name=p_count, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PLenAvg       string  `json:"plen_avg" parquet:"name=plen_avg, type=BYTE_ARRAY, convertedtype=UTF8"`
+	BScore        float64 `json:"b_score" parquet:"name=b_score, type=DOUBLE"`
+}
+
+// NestedRecord is a row of the nested schema: read-level fields once,
+// matches as a repeated group
+type NestedRecord struct {
+	ReadID        string        `json:"read_id" parquet:"name=read_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	GCPercentage  float64       `json:"gc_percentage" parquet:"name=gc_percentage, type=DOUBLE"`
+	TotalCoverage int32         `json:"total_coverage" parquet:"name=total_coverage, type=INT32"`
+	MatchesFound  bool          `json:"matches_found" parquet:"name=matches_found, type=BOOLEAN"`
+	Matches       []NestedMatch `json:"matches" parquet:"name=matches, repetitiontype=REPEATED"`
+}
+
+// FlatRecords converts a result into one row per match, or a single "No
+// Match Found" row
+func FlatRecords(result Result) []Record {
+	if !result.MatchesFound {
+		return []Record{{
+			ReadID:        result.ReadID,
+			MatchedSanket: "No Match Found",
+			Serotype:      "Unassigned",
+			GCPercentage:  result.GCPercentage,
+			TotalCoverage: 0,
+			BScore:        0, // Use 0 as BScore for no match found
+		}}
+	}
+	records := make([]Record, 0, len(result.Matches))
+	for _, match := range result.Matches {
+		records = append(records, Record{
+			SID:           match.SID,
+			ReadID:        result.ReadID,
+			MatchedSanket: match.Sanket,
+			Serotype:      match.Serotype,
+			GCPercentage:  result.GCPercentage,
+			TotalCoverage: int32(result.TotalCoverage),
+			SLen:          int32(match.SLen),
+			SSRCount:      match.SSRCount,
+			MLenAvg:       match.MLenAvg,
+			MRCAvg:        match.MRCAvg,
+			PCount:        match.PCount,
+			PLenAvg:       match.PLenAvg,
+			BScore:        match.BScore,
+		})
+	}
+	return records
+}
+
+// nestedRecord converts a result into a single read-centric row
+func nestedRecord(result Result) NestedRecord {
+	record := NestedRecord{
+		ReadID:        result.ReadID,
+		GCPercentage:  result.GCPercentage,
+		TotalCoverage: int32(result.TotalCoverage),
+		MatchesFound:  result.MatchesFound,
+		Matches:       make([]NestedMatch, 0, len(result.Matches)),
+	}
+	for _, match := range result.Matches {
+		record.Matches = append(record.Matches, NestedMatch{
+			SID:           match.SID,
+			MatchedSanket: match.Sanket,
+			Serotype:      match.Serotype,
+			SLen:          int32(match.SLen),
+			SSRCount:      match.SSRCount,
+			MLenAvg:       match.MLenAvg,
+			MRCAvg:        match.MRCAvg,
+			PCount:        match.PCount,
+			PLenAvg:       match.PLenAvg,
+			BScore:        match.BScore,
+		})
+	}
+	return record
+}
+
+// Column describes one column of the flat schema for column-driven writers
+type Column struct {
+	Name  string
+	Tag   string // parquet-go metadata without the name
+	SQL   string // SQLite column type
+	Value func(r Record) interface{}
+}
+
+// FlatColumns lists the flat schema in Record field order
+var FlatColumns = []Column{
+	{"sid", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.SID }},
+	{"read_id", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.ReadID }},
+	{"matched_sanket", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.MatchedSanket }},
+	{"serotype", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.Serotype }},
+	{"gc_percentage", "type=DOUBLE", "REAL", func(r Record) interface{} { return r.GCPercentage }},
+	{"total_coverage", "type=INT32", "INTEGER", func(r Record) interface{} { return r.TotalCoverage }},
+	{"s_len", "type=INT32", "INTEGER", func(r Record) interface{} { return r.SLen }},
+	{"ssr_count", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.SSRCount }},
+	{"mlen_avg", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.MLenAvg }},
+	{"mrc_avg", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.MRCAvg }},
+	{"p_count", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.PCount }},
+	{"plen_avg", "type=BYTE_ARRAY, convertedtype=UTF8", "TEXT", func(r Record) interface{} { return r.PLenAvg }},
+	{"b_score", "type=DOUBLE", "REAL", func(r Record) interface{} { return r.BScore }},
+}
+
+// ParseColumns splits and checks a comma-separated column list
+func ParseColumns(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	known := make(map[string]bool, len(FlatColumns))
+	names := make([]string, len(FlatColumns))
+	for i, col := range FlatColumns {
+		known[col.Name] = true
+		names[i] = col.Name
+	}
+	var columns []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			return nil, fmt.Errorf("unknown column %q (expected any of %s)", name, strings.Join(names, ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("column %q given twice", name)
+		}
+		seen[name] = true
+		columns = append(columns, name)
+	}
+	return columns, nil
+}
+
+// ParquetMetadata returns the parquet-go metadata strings for the given
+// columns
+func ParquetMetadata(columns []Column) []string {
+	md := make([]string, len(columns))
+	for i, col := range columns {
+		md[i] = "name=" + col.Name + ", " + col.Tag
+	}
+	return md
+}
+
+// ColumnValues extracts the given columns from a flat row
+func ColumnValues(columns []Column, record Record) []interface{} {
+	values := make([]interface{}, len(columns))
+	for i, col := range columns {
+		values[i] = col.Value(record)
+	}
+	return values
+}
+
+// formatValue renders a column value as CSV text
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}